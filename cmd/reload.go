@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"hafh-server/internal/config"
+	"hafh-server/internal/database"
+	"hafh-server/internal/http"
+	"hafh-server/internal/http/middleware"
+	"hafh-server/internal/logger"
+	"hafh-server/internal/mqtt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// configCheckInterval is how often the configuration file is checked for changes.
+const configCheckInterval = 5 * time.Second
+
+// configReloader reloads the configuration file on SIGHUP or when it changes, and applies the
+// settings that can be changed while the server runs: the log level, the bootstrap API key and the
+// rate limits. The TLS certificates are reloaded from disk as well. Changes to any other setting are
+// reported as requiring a restart.
+type configReloader struct {
+	path       string
+	log        *zap.SugaredLogger
+	httpServer *http.HttpServer
+	mqttBroker *mqtt.MqttServer
+	// initial is the configuration the server was started with, and applied the last configuration
+	// whose settings were applied.
+	initial *config.Config
+	applied *config.Config
+	// modTime and size identify the version of the file that was last loaded.
+	modTime time.Time
+	size    int64
+}
+
+// newConfigReloader creates a reloader of the configuration file at path, which the server was
+// started with.
+func newConfigReloader(path string, initial *config.Config, httpServer *http.HttpServer, mqttBroker *mqtt.MqttServer) *configReloader {
+	r := &configReloader{
+		path:       path,
+		log:        logger.Named("config"),
+		httpServer: httpServer,
+		mqttBroker: mqttBroker,
+		initial:    initial,
+		applied:    initial,
+	}
+
+	r.modTime, r.size = r.stat()
+	return r
+}
+
+// Start reloads the configuration on SIGHUP, or when the file changes, until ctx is done.
+func (r *configReloader) Start(ctx context.Context) error {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	ticker := time.NewTicker(configCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-hangup:
+			r.log.Info("Received SIGHUP, reloading configuration")
+			r.reload()
+		case <-ticker.C:
+			// The file may be halfway through being replaced, in which case it is loaded next time.
+			if modTime, size := r.stat(); size != r.size || !modTime.Equal(r.modTime) {
+				r.log.Info("Configuration file changed, reloading configuration")
+				r.reload()
+			}
+		}
+	}
+}
+
+// stat returns the modification time and size of the file, or zero values if it does not exist.
+func (r *configReloader) stat() (time.Time, int64) {
+	if r.path == "" {
+		return time.Time{}, 0
+	}
+
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return time.Time{}, 0
+	}
+
+	return info.ModTime(), info.Size()
+}
+
+// reload loads and validates the configuration file, applies its reloadable settings, and reports
+// the changes that require a restart. If the file is invalid, the current settings are kept.
+func (r *configReloader) reload() {
+	// A file that fails to load is not reloaded again until it changes (or on SIGHUP).
+	r.modTime, r.size = r.stat()
+
+	if r.path == "" {
+		r.log.Warn("Not reloading configuration, as the server was started without a configuration file")
+		return
+	}
+
+	cfg, err := config.Load(r.path)
+	if err == nil {
+		err = r.apply(cfg)
+	}
+
+	if err != nil {
+		r.log.Error("Failed to reload configuration, keeping the current one: ", err)
+		return
+	}
+
+	reloaded, _ := config.Changes(r.applied, cfg)
+	_, restart := config.Changes(r.initial, cfg)
+	r.applied = cfg
+
+	if len(reloaded) > 0 {
+		r.log.Infof("Applied changes to %s", strings.Join(reloaded, ", "))
+	} else {
+		r.log.Info("No settings to apply changed")
+	}
+
+	// These are reported on every reload until the server is restarted.
+	if len(restart) > 0 {
+		r.log.Warnf("Changes to %s require a restart", strings.Join(restart, ", "))
+	}
+}
+
+// apply applies the reloadable settings. The settings are validated before any is applied.
+func (r *configReloader) apply(cfg *config.Config) error {
+	if cfg.HTTP.APIKey == "" {
+		return errors.New("API key is required")
+	} else if err := r.httpServer.SetRateLimit(rateLimiterConfig(cfg)); err != nil {
+		return err
+	} else if err := r.httpServer.SetAPIKey(cfg.HTTP.APIKey); err != nil {
+		return err
+	}
+
+	logger.SetDebug(cfg.Debug)
+
+	// The certificate files may have been renewed, even if their paths have not changed.
+	if err := r.httpServer.ReloadCertificates(); err != nil {
+		r.log.Error("Failed to reload HTTPS certificate: ", err)
+	}
+
+	if err := r.mqttBroker.ReloadCertificates(); err != nil {
+		r.log.Error("Failed to reload MQTT certificates: ", err)
+	}
+
+	return nil
+}
+
+// rateLimiterConfig returns the rate limits of the HTTP server.
+func rateLimiterConfig(cfg *config.Config) middleware.RateLimiterConfig {
+	rateLimit := middleware.RateLimiterConfig{
+		Default:   middleware.Rate{PerSecond: cfg.HTTP.MaxRequestsPerSecond, Burst: cfg.HTTP.RateLimit.Burst},
+		Scopes:    map[database.Scope]middleware.Rate{},
+		Routes:    map[string]middleware.Rate{},
+		IdleAfter: cfg.HTTP.RateLimit.IdleAfter,
+	}
+	for scope, rate := range cfg.HTTP.RateLimit.Scopes {
+		rateLimit.Scopes[database.Scope(scope)] = middleware.Rate{PerSecond: rate.PerSecond, Burst: rate.Burst}
+	}
+	for route, rate := range cfg.HTTP.RateLimit.Routes {
+		rateLimit.Routes[route] = middleware.Rate{PerSecond: rate.PerSecond, Burst: rate.Burst}
+	}
+
+	return rateLimit
+}
@@ -3,19 +3,39 @@ package main
 import (
 	"context"
 	"fmt"
+	"hafh-server/internal/alerts"
+	"hafh-server/internal/anomaly"
+	"hafh-server/internal/auth"
+	"hafh-server/internal/automation"
+	"hafh-server/internal/commands"
 	"hafh-server/internal/config"
+	"hafh-server/internal/cron"
 	"hafh-server/internal/database"
+	"hafh-server/internal/email"
+	"hafh-server/internal/events"
 	"hafh-server/internal/http"
+	"hafh-server/internal/ingest"
+	"hafh-server/internal/lifecycle"
 	"hafh-server/internal/logger"
 	"hafh-server/internal/mqtt"
 	forward "hafh-server/internal/ngrok"
+	"hafh-server/internal/presence"
+	"hafh-server/internal/scheduler"
+	"hafh-server/internal/stream"
+	"hafh-server/internal/systemd"
+	"hafh-server/internal/virtual"
+	"hafh-server/internal/webhooks"
 	"os"
 	"os/signal"
+	"slices"
 	"syscall"
 	"time"
 )
 
-const dataTopicPrefix string = "/peripherals/readings/"
+const (
+	dataTopicPrefix    string = "/peripherals/readings/"
+	commandTopicPrefix string = "/peripherals/commands/"
+)
 
 func getConfigPath() string {
 	if len(os.Args) < 2 {
@@ -50,103 +70,411 @@ func main() {
 	// Note: this will only print to stdout if debug is enabled.
 	log.Debugf("Using config:\n%s", config.String())
 
+	// Components are added in dependency order as they are initialized, started together once
+	// everything is in place, and stopped in reverse order when the server exits.
+	components, err := lifecycle.NewManager(&lifecycle.ManagerConfig{
+		ShutdownTimeout: config.Lifecycle.ShutdownTimeout,
+		InitialBackoff:  config.Lifecycle.RestartInitialBackoff,
+		MaxBackoff:      config.Lifecycle.RestartMaxBackoff,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// The configuration is checked before the database is opened, so that an invalid one does not
+	// leave it open. Schedules are parsed in the configured time zone.
+	timeZone, err := time.LoadLocation(config.Scheduler.TimeZone)
+	if err != nil {
+		log.Fatalf("Invalid scheduler time zone: %v", err)
+	}
+
+	parser := &cron.Parser{TimeZone: timeZone}
+	if config.Scheduler.Latitude != nil && config.Scheduler.Longitude != nil {
+		parser.Location = &cron.Location{
+			Latitude:  *config.Scheduler.Latitude,
+			Longitude: *config.Scheduler.Longitude,
+		}
+	}
+
+	// Initialize the OpenID Connect provider, if users log in with one.
+	var oidcProvider *auth.Provider
+	switch config.HTTP.AuthMode {
+	case "local":
+	case "oidc":
+		roleMapping := make(map[string]database.Role, len(config.HTTP.OIDC.RoleMapping))
+		for value, role := range config.HTTP.OIDC.RoleMapping {
+			roleMapping[value] = database.Role(role)
+		}
+
+		oidcProvider, err = auth.NewProvider(&auth.OIDCConfig{
+			Issuer:        config.HTTP.OIDC.Issuer,
+			ClientID:      config.HTTP.OIDC.ClientID,
+			ClientSecret:  config.HTTP.OIDC.ClientSecret,
+			RedirectURL:   config.HTTP.OIDC.RedirectURL,
+			Audience:      config.HTTP.OIDC.Audience,
+			Scopes:        config.HTTP.OIDC.Scopes,
+			UsernameClaim: config.HTTP.OIDC.UsernameClaim,
+			RoleClaim:     config.HTTP.OIDC.RoleClaim,
+			RoleMapping:   roleMapping,
+			DefaultRole:   database.Role(config.HTTP.OIDC.DefaultRole),
+		})
+		if err != nil {
+			log.Fatalf("Invalid OIDC configuration: %v", err)
+		}
+	default:
+		log.Fatalf("Invalid HTTP auth mode: %s", config.HTTP.AuthMode)
+	}
+
+	var tlsConfig *http.TLSConfig
+	if config.HTTP.TLS.Enabled {
+		tlsConfig = &http.TLSConfig{
+			Port:         config.HTTP.TLS.Port,
+			CertPath:     config.HTTP.TLS.CertPath,
+			KeyPath:      config.HTTP.TLS.KeyPath,
+			MinVersion:   config.HTTP.TLS.MinVersion,
+			RedirectHTTP: config.HTTP.TLS.RedirectHTTP,
+		}
+		if config.HTTP.TLS.ClientCerts {
+			tlsConfig.ClientCAPath = config.MQTT.CaPath
+		}
+	}
+
 	// Initialize the database.
 	db, err := database.New(config.DB.Path)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer func() {
+
+	// Once the database is open, errors close it before exiting, which log.Fatal would skip.
+	fatal := func(err error) {
+		log.Error(err)
 		if err := db.Close(); err != nil {
-			log.Fatalf("Failed to close database: %v", err)
+			log.Error("Failed to close the database: ", err)
 		}
 
-		log.Info("Database closed successfully!")
-	}()
+		os.Exit(1)
+	}
+
+	components.Add(lifecycle.Component{
+		Name:     "database",
+		Stop:     func(context.Context) error { return db.Close() },
+		Health:   db.Ping,
+		Liveness: true,
+	})
 	log.Info("Database initialized successfully!")
 
-	// Initialize the HTTP server.
-	httpServer, err := http.NewServer(&http.HttpServerConfig{
-		Port:                 config.HTTP.Port,
-		ApiKey:               config.HTTP.APIKey,
-		MaxRequestsPerSecond: config.HTTP.MaxRequestsPerSecond,
-		Db:                   db,
+	// Server events are published on the bus and delivered to registered webhooks.
+	bus := events.NewBus()
+	dispatcher, err := webhooks.NewDispatcher(&webhooks.DispatcherConfig{
+		Db:             db,
+		Bus:            bus,
+		MaxAttempts:    config.Webhooks.MaxAttempts,
+		InitialBackoff: config.Webhooks.InitialBackoff,
+		MaxBackoff:     config.Webhooks.MaxBackoff,
+		Timeout:        config.Webhooks.Timeout,
 	})
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
 
-	go func() {
-		if err := httpServer.Start(); err != nil {
-			log.Fatalf("HTTP server failed: %v", err)
-		}
-	}()
+	components.Add(lifecycle.Component{Name: "webhooks", Start: worker(dispatcher.Start)})
 
-	// Clean up the HTTP server on exit.
-	defer func() {
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
+	// Optionally email server events.
+	var notifier *email.Notifier
+	if config.Email.Enabled {
+		templates := make(map[string]email.Template, len(config.Email.Templates))
+		for eventType, template := range config.Email.Templates {
+			templates[eventType] = email.Template(template)
+		}
 
-		if err := httpServer.Shutdown(ctx); err != nil {
-			log.Fatalf("Server shutdown error: %v", err)
+		notifier, err = email.NewNotifier(&email.NotifierConfig{
+			Bus:            bus,
+			Host:           config.Email.Host,
+			Port:           config.Email.Port,
+			StartTLS:       config.Email.StartTLS,
+			Username:       config.Email.Username,
+			Password:       config.Email.Password,
+			From:           config.Email.From,
+			To:             config.Email.To,
+			EventTypes:     config.Email.EventTypes,
+			DigestInterval: config.Email.DigestInterval,
+			Timeout:        config.Email.Timeout,
+			Templates:      templates,
+		})
+		if err != nil {
+			fatal(err)
 		}
 
-		log.Info("HTTP server shutdown successfully!")
-	}()
+		components.Add(lifecycle.Component{Name: "email", Start: worker(notifier.Start)})
+	}
 
-	// Initialize the ngrok forwarder.
-	if config.Ngrok.Enabled {
-		forwarder, err := forward.NewForwarder(&forward.ForwarderConfig{
-			BackendUrl: fmt.Sprintf("localhost:%d", config.HTTP.Port),
-			DomainUrl:  config.Ngrok.Domain,
-			AuthToken:  config.Ngrok.AuthToken,
-			Region:     config.Ngrok.Region,
+	// Initialize the ingest path for readings reported over MQTT.
+	processor, err := ingest.NewProcessor(db, bus)
+	if err != nil {
+		fatal(err)
+	}
+
+	// Export the latest reading fields of every peripheral as metrics, if enabled.
+	if config.Metrics.Enabled && config.Metrics.ReadingGauges {
+		processor.OnReading(ingest.ReadingGauges())
+	}
+
+	// Evaluate alert rules against every ingested reading.
+	alertEngine, err := alerts.NewEngine(db)
+	if err != nil {
+		fatal(err)
+	}
+
+	processor.OnReading(alertEngine.Evaluate)
+	alertEngine.OnAlert(func(alert *database.Alert) {
+		if alert.State == database.AlertStateFiring {
+			bus.Publish(events.New(events.AlertFired, alert))
+		} else {
+			bus.Publish(events.New(events.AlertResolved, alert))
+		}
+	})
+
+	// Flag stuck and otherwise broken sensors.
+	if config.Anomalies.Enabled {
+		detector, err := anomaly.NewDetector(&anomaly.DetectorConfig{
+			Db:             db,
+			Bus:            bus,
+			FlatlineAfter:  config.Anomalies.FlatlineAfter,
+			SpikeThreshold: config.Anomalies.SpikeThreshold,
+			RateDropFactor: config.Anomalies.RateDropFactor,
+			MinSamples:     config.Anomalies.MinSamples,
 		})
 		if err != nil {
-			log.Fatal(err)
+			fatal(err)
 		}
 
-		go func() {
-			if err := forwarder.Start(context.Background()); err != nil {
-				log.Fatalf("Ngrok forwarder failed: %v", err)
-			}
-		}()
+		processor.OnReading(detector.OnReading)
+		components.Add(lifecycle.Component{Name: "anomalies", Start: worker(detector.Start)})
+	}
+
+	// Stream readings and server events to live clients.
+	streamHub, err := stream.NewHub(db)
+	if err != nil {
+		fatal(err)
 	}
 
-	// Start the MQTT server.
+	processor.OnReading(streamHub.OnReading)
+	bus.Subscribe(streamHub.OnEvent)
+
+	// Compute the readings of virtual peripherals from the readings of their inputs.
+	virtualEngine, err := virtual.NewEngine(db, processor)
+	if err != nil {
+		fatal(err)
+	}
+
+	processor.OnReading(virtualEngine.OnReading)
+	components.Add(lifecycle.Component{Name: "virtual", Start: worker(virtualEngine.Start)})
+
+	// Watch for peripherals going offline or coming back online.
+	presenceMonitor, err := presence.NewMonitor(db, bus, config.Peripherals.OfflineAfter)
+	if err != nil {
+		fatal(err)
+	}
+
+	components.Add(lifecycle.Component{Name: "presence", Start: worker(presenceMonitor.Start)})
+
+	// Listening sockets may be passed by systemd (socket activation), named "http", "https" and
+	// "mqtt" in the socket units.
+	sockets, err := systemd.Listeners()
+	if err != nil {
+		fatal(err)
+	}
+
+	// Sockets that are not used would accept connections that are never served.
+	for name, listener := range sockets {
+		if !slices.Contains([]string{"http", "https", "mqtt"}, name) {
+			log.Warnf("Closing the socket %s passed by systemd, as it is not named http, https or mqtt", name)
+			listener.Close()
+			delete(sockets, name)
+		}
+	}
+
+	if len(sockets) > 0 {
+		log.Infof("Using %d socket(s) passed by systemd", len(sockets))
+	}
+
+	// Initialize the MQTT broker.
 	mqttBroker, err := mqtt.NewBroker(&mqtt.MqttServerConfig{
 		Address:         config.MQTT.Address,
 		Port:            config.MQTT.Port,
 		CertPath:        config.MQTT.CertPath,
 		KeyPath:         config.MQTT.KeyPath,
 		CaPath:          config.MQTT.CaPath,
-		Db:              db,
+		Processor:       processor,
 		DataTopicPrefix: dataTopicPrefix,
+		Listener:        sockets["mqtt"],
 	})
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
 
-	go func() {
-		if err := mqttBroker.Start(); err != nil {
-			log.Fatalf("Starting MQTT broker failed: %v", err)
-		}
-	}()
+	// The broker listens as soon as it is created, so it cannot be restarted.
+	components.Add(lifecycle.Component{
+		Name:     "mqtt",
+		Start:    func(context.Context) error { return mqttBroker.Start() },
+		Stop:     func(context.Context) error { return mqttBroker.Shutdown() },
+		Health:   func(context.Context) error { return mqttBroker.Health() },
+		Liveness: true,
+	})
+
+	// Commands to actuators are published by the MQTT broker.
+	commandSender, err := commands.NewSender(db, mqttBroker, commandTopicPrefix)
+	if err != nil {
+		fatal(err)
+	}
+
+	// Trigger actuator commands from readings and peripheral presence.
+	automationEngine, err := automation.NewEngine(db, commandSender, config.Peripherals.OfflineAfter)
+	if err != nil {
+		fatal(err)
+	}
+
+	processor.OnReading(automationEngine.OnReading)
+	bus.Subscribe(automationEngine.OnEvent)
+	components.Add(lifecycle.Component{Name: "automations", Start: worker(automationEngine.Start)})
+
+	// Run scheduled commands and reports.
+	jobScheduler, err := scheduler.New(&scheduler.Config{
+		Db:     db,
+		Sender: commandSender,
+		Bus:    bus,
+		Parser: parser,
+		Grace:  config.Scheduler.MissedRunGrace,
+	})
+	if err != nil {
+		fatal(err)
+	}
+
+	components.Add(lifecycle.Component{Name: "scheduler", Start: worker(jobScheduler.Start)})
+
+	if sockets["https"] != nil && tlsConfig == nil {
+		log.Warn("Closing the https socket passed by systemd, as TLS is not enabled")
+		sockets["https"].Close()
+		delete(sockets, "https")
+	}
+
+	// The HTTP server is restarted if it fails (e.g. if its port is in use), unless its sockets were
+	// passed by systemd, as they cannot be reopened. systemd restarts the server instead. It is not a
+	// liveness check, so that the watchdog does not restart the server while it is being restarted.
+	var httpServer *http.HttpServer
+	components.Add(lifecycle.Component{
+		Name:    "http",
+		Start:   func(context.Context) error { return httpServer.Start() },
+		Stop:    func(ctx context.Context) error { return httpServer.Shutdown(ctx) },
+		Health:  func(context.Context) error { return httpServer.Health() },
+		Restart: sockets["http"] == nil && sockets["https"] == nil,
+	})
 
-	// Clean up the MQTT broker on exit.
-	defer func() {
-		if err := mqttBroker.Shutdown(); err != nil {
-			log.Fatalf("MQTT broker shutdown error: %v", err)
+	// Initialize the ngrok forwarder.
+	var forwarder *forward.Forwarder
+	if config.Ngrok.Enabled {
+		forwarder, err = forward.NewForwarder(&forward.ForwarderConfig{
+			BackendUrl: fmt.Sprintf("localhost:%d", config.HTTP.Port),
+			DomainUrl:  config.Ngrok.Domain,
+			AuthToken:  config.Ngrok.AuthToken,
+			Region:     config.Ngrok.Region,
+		})
+		if err != nil {
+			fatal(err)
 		}
 
-		log.Info("MQTT broker shutdown successfully!")
-	}()
+		// The forwarder forwards to the HTTP server, and is restarted if the tunnel fails.
+		components.Add(lifecycle.Component{
+			Name:    "ngrok",
+			Start:   forwarder.Start,
+			Health:  func(context.Context) error { return forwarder.Health() },
+			Restart: true,
+		})
+	}
+
+	// The health endpoints and the systemd watchdog check every component.
+	healthChecks := components.Checks()
+
+	// Initialize the HTTP server.
+	httpServer, err = http.NewServer(&http.HttpServerConfig{
+		Port:            config.HTTP.Port,
+		ApiKey:          config.HTTP.APIKey,
+		SessionLifetime: config.HTTP.SessionLifetime,
+		RateLimit:       rateLimiterConfig(config),
+		OfflineAfter:    config.Peripherals.OfflineAfter,
+		Db:              db,
+		Alerts:          alertEngine,
+		Webhooks:        dispatcher,
+		Email:           notifier,
+		Commands:        commandSender,
+		Scheduler:       jobScheduler,
+		Virtual:         virtualEngine,
+		Stream:          streamHub,
+		AllowedOrigins:  config.HTTP.AllowedOrigins,
+		OIDC:            oidcProvider,
+		TLS:             tlsConfig,
+		Metrics:         config.Metrics.Enabled,
+		PublicMetrics:   config.Metrics.Public,
+		Broker:          mqttBroker,
+		HealthChecks:    healthChecks,
+		Listener:        sockets["http"],
+		TLSListener:     sockets["https"],
+	})
+	if err != nil {
+		fatal(err)
+	}
+
+	// Apply changes to the configuration file without a restart, where possible.
+	reloader := newConfigReloader(getConfigPath(), config, httpServer, mqttBroker)
+	components.Add(lifecycle.Component{Name: "config", Start: reloader.Start})
+
+	// Tell systemd once everything is up, and keep its watchdog fed while the server is healthy.
+	components.Add(lifecycle.Component{
+		Name: "systemd",
+		Start: worker(func(ctx context.Context) {
+			notifySystemd(ctx, log, healthChecks)
+		}),
+	})
+
+	// Start every component once everything is in place.
+	components.Start()
 
 	// Wait for interrupt signal to gracefully shut down the server.
 	quit := make(chan os.Signal, 1)
 
 	// Accept SIGINT (Ctrl+C) or SIGTERM (e.g., systemd stop).
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
 
-	log.Info("Exiting...")
+	// A component that fails and cannot be restarted shuts the server down as well, with a non-zero
+	// exit code so that a supervisor (e.g. systemd) can restart it.
+	exitCode := 0
+	select {
+	case <-quit:
+		log.Info("Exiting...")
+	case err := <-components.Failed():
+		log.Errorf("Exiting, as %v", err)
+		exitCode = 1
+	}
+
+	if _, err := systemd.Notify(systemd.Stopping, systemd.Status("Shutting down")); err != nil {
+		log.Error("Failed to notify systemd: ", err)
+	}
+
+	if err := components.Shutdown(); err != nil {
+		log.Error("Failed to shut down cleanly: ", err)
+		exitCode = 1
+	} else {
+		log.Info("Shutdown complete")
+	}
+
+	os.Exit(exitCode)
+}
+
+// worker adapts the Start of a background worker, which blocks until ctx is done, to the Start of
+// a component, so that the server waits for the worker to return before closing the database.
+func worker(start func(ctx context.Context)) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		start(ctx)
+		return nil
+	}
 }
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"hafh-server/internal/health"
+	"hafh-server/internal/systemd"
+	"slices"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// readyPollInterval is how often the health checks are run while waiting for the server to be ready.
+const readyPollInterval = 250 * time.Millisecond
+
+// notifySystemd tells systemd that the server is ready once every health check passes (i.e. the
+// database, HTTP server, MQTT broker and, if enabled, ngrok tunnel are up), and then pings its
+// watchdog (if enabled) for as long as the liveness checks pass, so that a stuck server is
+// restarted. It does nothing if the server is not run by systemd, and returns when ctx is done.
+func notifySystemd(ctx context.Context, log *zap.SugaredLogger, checks []health.Check) {
+	notify := func(states ...string) bool {
+		ok, err := systemd.Notify(states...)
+		if err != nil {
+			log.Error("Failed to notify systemd: ", err)
+		}
+
+		return ok
+	}
+
+	if !notify(systemd.Status("Starting")) {
+		return
+	}
+
+	interval, watchdog := systemd.WatchdogInterval()
+
+	liveness := slices.DeleteFunc(slices.Clone(checks), func(check health.Check) bool { return !check.Liveness })
+
+	ticker := time.NewTicker(readyPollInterval)
+	defer ticker.Stop()
+
+	// Wait until every check passes, reporting what is being waited for. The watchdog may already be
+	// running, so it is pinged as long as the liveness checks pass.
+	var waitingFor string
+	for {
+		results := health.Run(ctx, checks, false)
+		if watchdog && health.FirstFailure(liveness, results) == nil {
+			notify(systemd.Watchdog)
+		}
+
+		err := health.FirstFailure(checks, results)
+		if err == nil {
+			break
+		} else if err.Error() != waitingFor {
+			waitingFor = err.Error()
+			notify(systemd.Status("Waiting for %s", waitingFor))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+
+	log.Info("Notifying systemd that the server is ready")
+	notify(systemd.Ready, systemd.Status("Ready"))
+
+	if !watchdog {
+		return
+	}
+
+	// Ping at twice the rate systemd expects, so that a slow check does not cause a restart.
+	ticker.Reset(interval / 2)
+
+	var failing string
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := health.FirstFailure(checks, health.Run(ctx, checks, true)); err != nil {
+			// Without a ping, systemd restarts the server once the watchdog interval has passed.
+			log.Errorf("Not pinging the systemd watchdog, as a liveness check failed: %v", err)
+			failing = err.Error()
+			notify(systemd.Status("Unhealthy: %s", failing))
+			continue
+		}
+
+		if failing != "" {
+			failing = ""
+			notify(systemd.Watchdog, systemd.Status("Ready"))
+			continue
+		}
+
+		notify(systemd.Watchdog)
+	}
+}
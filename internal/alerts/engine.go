@@ -0,0 +1,189 @@
+package alerts
+
+import (
+	"errors"
+	"hafh-server/internal/database"
+	"hafh-server/internal/logger"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Listener is notified whenever an alert fires or resolves.
+type Listener func(alert *database.Alert)
+
+// Engine evaluates alert rules against ingested readings, recording alert events in the database.
+type Engine struct {
+	db        *database.Database
+	log       *zap.SugaredLogger
+	listeners []Listener
+
+	// mu serializes the evaluation of readings and the resetting of rules, so that an alert cannot
+	// fire twice for the same rule and peripheral, or fire for a rule that was just reset.
+	mu sync.Mutex
+	// pending tracks when each (rule, peripheral) pair first breached its threshold, for rules with
+	// a duration that has not yet elapsed.
+	pending map[pendingKey]time.Time
+}
+
+type pendingKey struct {
+	ruleID int64
+	serial string
+}
+
+// NewEngine creates a new alert [Engine] backed by the given database.
+func NewEngine(db *database.Database) (*Engine, error) {
+	if db == nil {
+		return nil, errors.New("database is required")
+	}
+
+	return &Engine{
+		db:      db,
+		log:     logger.Named("alerts"),
+		pending: map[pendingKey]time.Time{},
+	}, nil
+}
+
+// OnAlert registers a listener that is called whenever an alert fires or resolves. Listeners should
+// be registered before the engine is in use.
+func (e *Engine) OnAlert(listener Listener) {
+	e.listeners = append(e.listeners, listener)
+}
+
+// Evaluate evaluates every enabled alert rule against a newly ingested reading. It has the
+// signature of an ingest.ReadingListener.
+func (e *Engine) Evaluate(reading *database.Reading, peripheral *database.Peripheral) {
+	var changed []*database.Alert
+	defer func() { e.notify(changed...) }()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	rules, err := e.db.GetAlertRules(true)
+	if err != nil {
+		e.log.Errorf("Failed to get alert rules: %v", err)
+		return
+	}
+
+	for i := range rules {
+		rule := &rules[i]
+		if !rule.Matches(peripheral) {
+			continue
+		}
+
+		value, ok := reading.NumericValue(rule.Field)
+		if !ok {
+			continue
+		}
+
+		alert, err := e.evaluateRule(rule, peripheral.SerialNumber, value, reading.Timestamp)
+		if err != nil {
+			e.log.Errorf("Failed to evaluate alert rule %d for %s: %v", rule.ID, peripheral.SerialNumber, err)
+		} else if alert != nil {
+			changed = append(changed, alert)
+		}
+	}
+}
+
+// ResetRule resolves the firing alerts of a rule and forgets its pending breaches, so that it is
+// evaluated from scratch. It must be called whenever a rule is edited, disabled or deleted, as a
+// disabled rule is no longer evaluated and would otherwise never resolve.
+func (e *Engine) ResetRule(ruleID int64) error {
+	e.mu.Lock()
+	for key := range e.pending {
+		if key.ruleID == ruleID {
+			delete(e.pending, key)
+		}
+	}
+
+	resolved, err := e.db.ResolveRuleAlerts(ruleID)
+	e.mu.Unlock()
+
+	for i := range resolved {
+		e.log.Infof("Alert %q resolved for %s (rule changed)", resolved[i].RuleName, resolved[i].SerialNumber)
+		e.notify(&resolved[i])
+	}
+
+	return err
+}
+
+// evaluateRule evaluates a rule against a value of a peripheral, returning the alert that fired or
+// resolved, if any. The engine must be locked.
+func (e *Engine) evaluateRule(rule *database.AlertRule, serial string, value float64, at time.Time) (*database.Alert, error) {
+	if at.IsZero() {
+		at = time.Now()
+	}
+
+	firing, err := e.db.GetFiringAlert(rule.ID, serial)
+	if err != nil {
+		return nil, err
+	}
+
+	key := pendingKey{ruleID: rule.ID, serial: serial}
+	if firing != nil {
+		if !isCleared(rule, value) {
+			return nil, nil
+		}
+
+		alert, err := e.db.ResolveAlert(firing.ID, value)
+		if err != nil {
+			return nil, err
+		}
+
+		e.log.Infof("Alert %q resolved for %s (value %v)", rule.Name, serial, value)
+		return alert, nil
+	}
+
+	if !rule.Comparison.Compare(value, rule.Threshold) {
+		delete(e.pending, key)
+		return nil, nil
+	}
+
+	since, ok := e.pending[key]
+	if !ok {
+		since = at
+		e.pending[key] = since
+	}
+
+	if at.Sub(since) < rule.Duration() {
+		return nil, nil
+	}
+
+	delete(e.pending, key)
+	alert, err := e.db.FireAlert(rule, serial, value)
+	if err != nil {
+		return nil, err
+	}
+
+	e.log.Warnf("Alert %q firing for %s: %s %s %v (value %v)",
+		rule.Name, serial, rule.Field, rule.Comparison, rule.Threshold, value)
+	return alert, nil
+}
+
+// isCleared returns true if a firing rule's value has moved back past its threshold by more than the
+// rule's hysteresis.
+func isCleared(rule *database.AlertRule, value float64) bool {
+	switch rule.Comparison {
+	case database.ComparisonGreater, database.ComparisonGreaterOrEqual:
+		return value < rule.Threshold-rule.Hysteresis
+	case database.ComparisonLess, database.ComparisonLessOrEqual:
+		return value > rule.Threshold+rule.Hysteresis
+	case database.ComparisonEqual:
+		return value < rule.Threshold-rule.Hysteresis || value > rule.Threshold+rule.Hysteresis
+	default:
+		return !rule.Comparison.Compare(value, rule.Threshold)
+	}
+}
+
+func (e *Engine) notify(alerts ...*database.Alert) {
+	for _, alert := range alerts {
+		if alert == nil {
+			continue
+		}
+
+		for _, listener := range e.listeners {
+			listener(alert)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package alerts
+
+import (
+	"hafh-server/internal/database"
+	"hafh-server/internal/logger"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func init() {
+	logger.Init(false)
+}
+
+// newTestEngine returns an engine backed by an in-memory database with one peripheral, "sn-1",
+// and the alerts it notified of.
+func newTestEngine(t *testing.T) (*Engine, *database.Database, *[]database.Alert) {
+	t.Helper()
+
+	db, err := database.New(":memory:")
+	if err != nil {
+		t.Fatalf("database.New() error = %v", err)
+	}
+
+	t.Cleanup(func() { db.Close() })
+
+	if err := db.AddPeripheral(&database.Peripheral{SerialNumber: "sn-1", Type: database.PeripheralTypeSensor}); err != nil {
+		t.Fatalf("AddPeripheral() error = %v", err)
+	}
+
+	engine, err := NewEngine(db)
+	if err != nil {
+		t.Fatalf("NewEngine() error = %v", err)
+	}
+
+	var mu sync.Mutex
+	var notified []database.Alert
+	engine.OnAlert(func(alert *database.Alert) {
+		mu.Lock()
+		defer mu.Unlock()
+		notified = append(notified, *alert)
+	})
+
+	return engine, db, &notified
+}
+
+func addRule(t *testing.T, db *database.Database, rule database.AlertRule) *database.AlertRule {
+	t.Helper()
+
+	rule.Name, rule.Field, rule.Enabled = "too hot", "t", true
+	if err := db.AddAlertRule(&rule); err != nil {
+		t.Fatalf("AddAlertRule() error = %v", err)
+	}
+
+	return &rule
+}
+
+func evaluate(engine *Engine, value float64, at time.Time) {
+	engine.Evaluate(
+		&database.Reading{SerialNumber: "sn-1", Data: map[string]any{"t": value}, Timestamp: at},
+		&database.Peripheral{SerialNumber: "sn-1"},
+	)
+}
+
+func states(alerts []database.Alert) []database.AlertState {
+	var states []database.AlertState
+	for _, alert := range alerts {
+		states = append(states, alert.State)
+	}
+
+	return states
+}
+
+func TestEvaluate(t *testing.T) {
+	start := time.Now()
+
+	tests := []struct {
+		name   string
+		rule   database.AlertRule
+		values []float64
+		want   []database.AlertState
+	}{
+		{
+			name:   "fires and resolves",
+			rule:   database.AlertRule{Comparison: database.ComparisonGreater, Threshold: 30},
+			values: []float64{25, 31, 32, 29},
+			want:   []database.AlertState{database.AlertStateFiring, database.AlertStateResolved},
+		},
+		{
+			name:   "hysteresis",
+			rule:   database.AlertRule{Comparison: database.ComparisonGreater, Threshold: 30, Hysteresis: 2},
+			values: []float64{31, 29, 31, 27},
+			want:   []database.AlertState{database.AlertStateFiring, database.AlertStateResolved},
+		},
+		{
+			// The values are a minute apart, so the condition must hold for three of them.
+			name:   "duration",
+			rule:   database.AlertRule{Comparison: database.ComparisonGreater, Threshold: 30, DurationSeconds: 120},
+			values: []float64{31, 32, 29, 31, 31, 31},
+			want:   []database.AlertState{database.AlertStateFiring},
+		},
+		{
+			name:   "never fires",
+			rule:   database.AlertRule{Comparison: database.ComparisonLess, Threshold: 0},
+			values: []float64{1, 2, 0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			engine, db, notified := newTestEngine(t)
+			addRule(t, db, tt.rule)
+
+			for i, value := range tt.values {
+				evaluate(engine, value, start.Add(time.Duration(i)*time.Minute))
+			}
+
+			if got := states(*notified); !slices.Equal(got, tt.want) {
+				t.Errorf("notified %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEvaluateConcurrently(t *testing.T) {
+	engine, db, _ := newTestEngine(t)
+	rule := addRule(t, db, database.AlertRule{Comparison: database.ComparisonGreater, Threshold: 30})
+
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			evaluate(engine, 35, time.Now())
+		}()
+	}
+
+	wg.Wait()
+
+	alerts, err := db.FindAlerts(database.AlertFilter{RuleID: rule.ID})
+	if err != nil {
+		t.Fatalf("FindAlerts() error = %v", err)
+	} else if len(alerts) != 1 {
+		t.Errorf("%d alerts fired, want 1", len(alerts))
+	}
+}
+
+func TestResetRule(t *testing.T) {
+	engine, db, notified := newTestEngine(t)
+	rule := addRule(t, db, database.AlertRule{Comparison: database.ComparisonGreater, Threshold: 30})
+	pendingRule := addRule(t, db, database.AlertRule{Comparison: database.ComparisonGreater, Threshold: 30, DurationSeconds: 60})
+
+	start := time.Now()
+	evaluate(engine, 35, start)
+
+	// Disabling the firing rule resolves its alert, which would otherwise fire forever.
+	rule.Enabled = false
+	if err := db.UpdateAlertRule(rule); err != nil {
+		t.Fatalf("UpdateAlertRule() error = %v", err)
+	} else if err := engine.ResetRule(rule.ID); err != nil {
+		t.Fatalf("ResetRule() error = %v", err)
+	}
+
+	if firing, _ := db.GetFiringAlert(rule.ID, "sn-1"); firing != nil {
+		t.Error("alert of the disabled rule is still firing")
+	}
+
+	if got := states(*notified); len(got) != 2 || got[1] != database.AlertStateResolved {
+		t.Errorf("notified %v, want firing then resolved", got)
+	}
+
+	// Resetting the pending rule restarts its duration.
+	if err := engine.ResetRule(pendingRule.ID); err != nil {
+		t.Fatalf("ResetRule() error = %v", err)
+	}
+
+	evaluate(engine, 35, start.Add(time.Minute))
+	if firing, _ := db.GetFiringAlert(pendingRule.ID, "sn-1"); firing != nil {
+		t.Error("pending rule fired before its duration since the reset")
+	}
+
+	evaluate(engine, 35, start.Add(2*time.Minute))
+	if firing, _ := db.GetFiringAlert(pendingRule.ID, "sn-1"); firing == nil {
+		t.Error("pending rule did not fire after its duration")
+	}
+}
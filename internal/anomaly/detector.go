@@ -0,0 +1,385 @@
+// Package anomaly detects broken sensors from the readings they report, such as stuck values,
+// implausible jumps, values outside their defined range, and peripherals that report far less often
+// than usual.
+package anomaly
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hafh-server/internal/database"
+	"hafh-server/internal/events"
+	"hafh-server/internal/ingest"
+	"hafh-server/internal/logger"
+	"math"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// alpha is the weight of a new sample in the exponentially weighted rolling statistics.
+const alpha = 0.1
+
+// checkInterval is how often the reporting rate of every peripheral is checked.
+const checkInterval = time.Minute
+
+// DetectorConfig holds the configuration for the [Detector].
+type DetectorConfig struct {
+	Db  *database.Database
+	Bus *events.Bus
+	// FlatlineAfter is how long a field must report the exact same value to be flagged.
+	FlatlineAfter time.Duration
+	// SpikeThreshold is how many (rolling) standard deviations a value must jump to be flagged.
+	SpikeThreshold float64
+	// RateDropFactor is how many times its usual interval a peripheral must go without reporting to
+	// be flagged.
+	RateDropFactor float64
+	// MinSamples is how many readings are needed before spikes and rate drops are flagged.
+	MinSamples int
+}
+
+// fieldKey identifies a field of a peripheral.
+type fieldKey struct {
+	serial string
+	field  string
+}
+
+// anomalyKey identifies an open anomaly. The field is empty for rate drops.
+type anomalyKey struct {
+	fieldKey
+	kind database.AnomalyKind
+}
+
+// fieldStats are the rolling statistics of a field of a peripheral.
+type fieldStats struct {
+	samples   int
+	mean      float64
+	variance  float64
+	last      float64
+	sameSince time.Time
+}
+
+// rateStats are the rolling statistics of how often a peripheral reports.
+type rateStats struct {
+	samples  int
+	lastAt   time.Time
+	interval float64 // seconds
+}
+
+// Detector maintains rolling statistics of every numeric field of every peripheral, and records an
+// anomaly (publishing a [events.AnomalyDetected] event) when a field flatlines, spikes or leaves
+// its defined range, or a peripheral's reporting rate drops. Anomalies are resolved (publishing a
+// [events.AnomalyResolved] event) once the condition clears.
+type Detector struct {
+	db             *database.Database
+	bus            *events.Bus
+	log            *zap.SugaredLogger
+	flatlineAfter  time.Duration
+	spikeThreshold float64
+	rateDropFactor float64
+	minSamples     int
+
+	mu     sync.Mutex
+	fields map[fieldKey]*fieldStats
+	rates  map[string]*rateStats
+	open   map[anomalyKey]*database.Anomaly
+}
+
+// NewDetector creates a new [Detector], restoring the anomalies that are still open.
+func NewDetector(config *DetectorConfig) (*Detector, error) {
+	if config == nil {
+		return nil, errors.New("config cannot be nil")
+	} else if config.Db == nil {
+		return nil, errors.New("database is required")
+	}
+
+	d := &Detector{
+		db:             config.Db,
+		bus:            config.Bus,
+		log:            logger.Named("anomaly"),
+		flatlineAfter:  config.FlatlineAfter,
+		spikeThreshold: config.SpikeThreshold,
+		rateDropFactor: config.RateDropFactor,
+		minSamples:     config.MinSamples,
+		fields:         map[fieldKey]*fieldStats{},
+		rates:          map[string]*rateStats{},
+		open:           map[anomalyKey]*database.Anomaly{},
+	}
+
+	if d.flatlineAfter <= 0 {
+		d.flatlineAfter = 6 * time.Hour
+	}
+
+	if d.spikeThreshold <= 0 {
+		d.spikeThreshold = 6
+	}
+
+	if d.rateDropFactor <= 1 {
+		d.rateDropFactor = 5
+	}
+
+	if d.minSamples <= 0 {
+		d.minSamples = 20
+	}
+
+	open := true
+	anomalies, err := d.db.FindAnomalies(database.AnomalyFilter{Open: &open})
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range anomalies {
+		a := &anomalies[i]
+		d.open[anomalyKey{fieldKey{a.SerialNumber, a.Field}, a.Kind}] = a
+	}
+
+	return d, nil
+}
+
+// Start periodically checks the reporting rate of every peripheral until the context is cancelled.
+// **This should be called in a separate goroutine.**
+func (d *Detector) Start(ctx context.Context) {
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			d.checkRates(now)
+		}
+	}
+}
+
+// OnReading updates the rolling statistics with a newly ingested reading, detecting and resolving
+// anomalies. It has the signature of an [ingest.ReadingListener].
+func (d *Detector) OnReading(reading *database.Reading, peripheral *database.Peripheral) {
+	now := reading.Timestamp
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	// Field definitions are looked up before taking the lock, as they require queries.
+	ranges := map[string]database.FieldDefinition{}
+	definitions, err := d.db.GetFieldDefinitions(reading.SerialNumber)
+	if err != nil {
+		d.log.Errorf("Failed to get field definitions of %s: %v", reading.SerialNumber, err)
+	}
+
+	for _, f := range definitions {
+		if f.Min != nil || f.Max != nil {
+			ranges[f.Name] = f
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.updateRate(reading.SerialNumber, now)
+	for field, value := range ingest.NumericFields(reading.Data) {
+		key := fieldKey{reading.SerialNumber, field}
+		stats, ok := d.fields[key]
+		if !ok {
+			d.fields[key] = &fieldStats{samples: 1, mean: value, last: value, sameSince: now}
+		} else {
+			d.updateField(key, stats, value, now)
+		}
+
+		if definition, ok := ranges[field]; ok {
+			d.checkRange(key, &definition, value, now)
+		}
+	}
+}
+
+// updateRate updates the reporting interval of a peripheral, resolving any rate drop.
+func (d *Detector) updateRate(serial string, now time.Time) {
+	d.resolve(anomalyKey{fieldKey{serial, ""}, database.AnomalyRateDrop}, now, "The peripheral is reporting again.")
+
+	stats, ok := d.rates[serial]
+	if !ok {
+		d.rates[serial] = &rateStats{lastAt: now}
+		return
+	}
+
+	interval := now.Sub(stats.lastAt).Seconds()
+	stats.lastAt = now
+	if interval <= 0 {
+		return
+	}
+
+	if stats.samples == 0 {
+		stats.interval = interval
+	} else {
+		stats.interval += alpha * (interval - stats.interval)
+	}
+	stats.samples++
+}
+
+// updateField updates the rolling statistics of a field, detecting and resolving flatlines and
+// spikes.
+func (d *Detector) updateField(key fieldKey, stats *fieldStats, value float64, now time.Time) {
+	// Flatlines: the exact same value for too long.
+	flatlineKey := anomalyKey{key, database.AnomalyFlatline}
+	if value != stats.last {
+		stats.sameSince = now
+		d.resolve(flatlineKey, now, fmt.Sprintf("%s changed to %g.", key.field, value))
+	} else if now.Sub(stats.sameSince) >= d.flatlineAfter {
+		d.detect(flatlineKey, value, now, fmt.Sprintf("%s of %s has reported %g for %s.",
+			key.field, key.serial, value, now.Sub(stats.sameSince).Round(time.Minute)))
+	}
+
+	// Spikes: a jump from the previous value, and away from the mean, by many standard deviations.
+	// The standard deviation is floored so that tiny changes of an otherwise steady field are not
+	// flagged.
+	spikeKey := anomalyKey{key, database.AnomalySpike}
+	deviation := math.Max(math.Sqrt(stats.variance), 0.01*math.Abs(stats.mean))
+	limit := d.spikeThreshold * deviation
+	spike := stats.samples >= d.minSamples && deviation > 0 &&
+		math.Abs(value-stats.mean) > limit && math.Abs(value-stats.last) > limit
+
+	stats.last = value
+	if spike {
+		d.detect(spikeKey, value, now, fmt.Sprintf("%s of %s jumped to %g (usually %.3g ± %.3g).",
+			key.field, key.serial, value, stats.mean, deviation))
+
+		// Spikes are left out of the statistics, so that they do not mask the next one.
+		return
+	}
+
+	d.resolve(spikeKey, now, fmt.Sprintf("%s returned to %g.", key.field, value))
+
+	delta := value - stats.mean
+	stats.mean += alpha * delta
+	stats.variance = (1 - alpha) * (stats.variance + alpha*delta*delta)
+	stats.samples++
+}
+
+// checkRange detects and resolves values outside the range of their field definition.
+func (d *Detector) checkRange(key fieldKey, definition *database.FieldDefinition, value float64, now time.Time) {
+	rangeKey := anomalyKey{key, database.AnomalyOutOfRange}
+	if (definition.Min != nil && value < *definition.Min) || (definition.Max != nil && value > *definition.Max) {
+		d.detect(rangeKey, value, now, fmt.Sprintf("%s of %s reported %g, outside its range of %s.",
+			key.field, key.serial, value, formatRange(definition)))
+	} else {
+		d.resolve(rangeKey, now, fmt.Sprintf("%s is back in range at %g.", key.field, value))
+	}
+}
+
+func formatRange(definition *database.FieldDefinition) string {
+	lower, upper := "-∞", "∞"
+	if definition.Min != nil {
+		lower = fmt.Sprintf("%g", *definition.Min)
+	}
+
+	if definition.Max != nil {
+		upper = fmt.Sprintf("%g", *definition.Max)
+	}
+
+	return "[" + lower + ", " + upper + "]"
+}
+
+// checkRates detects peripherals that have gone much longer than usual without reporting.
+func (d *Detector) checkRates(now time.Time) {
+	peripherals, err := d.db.GetAllPeripherals()
+	if err != nil {
+		d.log.Errorf("Failed to get peripherals: %v", err)
+		return
+	}
+
+	exists := make(map[string]bool, len(peripherals))
+	for _, p := range peripherals {
+		exists[p.SerialNumber] = true
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for serial, stats := range d.rates {
+		// Forget peripherals that have been deleted (or merged into another).
+		if !exists[serial] {
+			d.forget(serial)
+			continue
+		}
+
+		if stats.samples < d.minSamples || stats.interval <= 0 {
+			continue
+		}
+
+		usual := time.Duration(stats.interval * float64(time.Second))
+		silence := now.Sub(stats.lastAt)
+		if silence.Seconds() > d.rateDropFactor*stats.interval {
+			d.detect(anomalyKey{fieldKey{serial, ""}, database.AnomalyRateDrop}, math.NaN(), now,
+				fmt.Sprintf("%s has not reported for %s, but usually reports every %s.",
+					serial, silence.Round(time.Second), usual.Round(time.Second)))
+		}
+	}
+}
+
+// forget drops the statistics and open anomalies of a peripheral.
+func (d *Detector) forget(serial string) {
+	delete(d.rates, serial)
+	for key := range d.fields {
+		if key.serial == serial {
+			delete(d.fields, key)
+		}
+	}
+
+	for key := range d.open {
+		if key.serial == serial {
+			delete(d.open, key)
+		}
+	}
+}
+
+// detect records and publishes an anomaly, unless one of the same kind is already open. A NaN value
+// is not stored.
+func (d *Detector) detect(key anomalyKey, value float64, now time.Time, message string) {
+	if _, ok := d.open[key]; ok {
+		return
+	}
+
+	anomaly := &database.Anomaly{
+		SerialNumber: key.serial,
+		Field:        key.field,
+		Kind:         key.kind,
+		Message:      message,
+		DetectedAt:   now.UTC(),
+	}
+
+	if !math.IsNaN(value) {
+		anomaly.Value = &value
+	}
+
+	if err := d.db.AddAnomaly(anomaly); err != nil {
+		d.log.Errorf("Failed to record anomaly: %v", err)
+		return
+	}
+
+	d.open[key] = anomaly
+	d.log.Warn(message)
+	d.bus.Publish(events.New(events.AnomalyDetected, anomaly))
+}
+
+// resolve resolves and publishes the open anomaly with the given key, if any.
+func (d *Detector) resolve(key anomalyKey, now time.Time, message string) {
+	anomaly, ok := d.open[key]
+	if !ok {
+		return
+	}
+
+	if err := d.db.ResolveAnomaly(anomaly.ID, now); err != nil {
+		d.log.Errorf("Failed to resolve anomaly %d: %v", anomaly.ID, err)
+		return
+	}
+
+	delete(d.open, key)
+
+	resolvedAt := now.UTC()
+	resolved := *anomaly
+	resolved.ResolvedAt = &resolvedAt
+	resolved.Message = message
+	d.log.Infof("Resolved %s anomaly of %s: %s", key.kind, key.serial, message)
+	d.bus.Publish(events.New(events.AnomalyResolved, &resolved))
+}
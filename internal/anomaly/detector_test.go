@@ -0,0 +1,261 @@
+package anomaly
+
+import (
+	"fmt"
+	"hafh-server/internal/database"
+	"hafh-server/internal/events"
+	"hafh-server/internal/logger"
+	"sync"
+	"testing"
+	"time"
+)
+
+func init() {
+	logger.Init(false)
+}
+
+type testDetector struct {
+	*Detector
+	t  *testing.T
+	db *database.Database
+
+	eventsMu sync.Mutex
+	events   []events.Type
+}
+
+// newTestDetector returns a detector for a peripheral "sensor", flagging spikes and rate drops after
+// 10 samples.
+func newTestDetector(t *testing.T) *testDetector {
+	t.Helper()
+
+	db, err := database.New(":memory:")
+	if err != nil {
+		t.Fatalf("database.New() error = %v", err)
+	}
+
+	t.Cleanup(func() { db.Close() })
+
+	if err := db.AddPeripheral(&database.Peripheral{SerialNumber: "sensor", Type: database.PeripheralTypeSensor}); err != nil {
+		t.Fatalf("AddPeripheral() error = %v", err)
+	}
+
+	return newTestDetectorWithDatabase(t, db)
+}
+
+func newTestDetectorWithDatabase(t *testing.T, db *database.Database) *testDetector {
+	t.Helper()
+
+	d := &testDetector{t: t, db: db}
+	bus := events.NewBus()
+	bus.Subscribe(func(event events.Event) {
+		d.eventsMu.Lock()
+		defer d.eventsMu.Unlock()
+		d.events = append(d.events, event.Type)
+	})
+
+	detector, err := NewDetector(&DetectorConfig{Db: db, Bus: bus, MinSamples: 10})
+	if err != nil {
+		t.Fatalf("NewDetector() error = %v", err)
+	}
+
+	d.Detector = detector
+	return d
+}
+
+func (d *testDetector) report(at time.Time, data map[string]any) {
+	d.OnReading(&database.Reading{SerialNumber: "sensor", Timestamp: at, Data: data}, nil)
+}
+
+// anomalies returns the anomalies of a kind, and how many of them are open.
+func (d *testDetector) anomalies(kind database.AnomalyKind) ([]database.Anomaly, int) {
+	d.t.Helper()
+
+	anomalies, err := d.db.FindAnomalies(database.AnomalyFilter{Kind: kind})
+	if err != nil {
+		d.t.Fatalf("FindAnomalies() error = %v", err)
+	}
+
+	open := 0
+	for _, a := range anomalies {
+		if a.ResolvedAt == nil {
+			open++
+		}
+	}
+
+	return anomalies, open
+}
+
+// expect fails the test unless there are the given number of anomalies of a kind, of which the
+// given number are open.
+func (d *testDetector) expect(step string, kind database.AnomalyKind, total, open int) {
+	d.t.Helper()
+
+	anomalies, gotOpen := d.anomalies(kind)
+	if len(anomalies) != total || gotOpen != open {
+		d.t.Fatalf("%s: %d %s anomalies (%d open), want %d (%d open)", step, len(anomalies), kind, gotOpen, total, open)
+	}
+}
+
+func (d *testDetector) published() []events.Type {
+	d.eventsMu.Lock()
+	defer d.eventsMu.Unlock()
+	return append([]events.Type(nil), d.events...)
+}
+
+func TestFlatline(t *testing.T) {
+	d := newTestDetector(t)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for i := range 6 * 60 {
+		d.report(start.Add(time.Duration(i)*time.Minute), map[string]any{"t": 21.5})
+	}
+	d.expect("after 5h59m", database.AnomalyFlatline, 0, 0)
+
+	d.report(start.Add(6*time.Hour), map[string]any{"t": 21.5})
+	d.expect("after 6h", database.AnomalyFlatline, 1, 1)
+
+	anomalies, _ := d.anomalies(database.AnomalyFlatline)
+	if a := anomalies[0]; a.SerialNumber != "sensor" || a.Field != "t" || a.Value == nil || *a.Value != 21.5 {
+		t.Errorf("anomaly = %+v", a)
+	}
+
+	// The anomaly is recorded once while the value stays the same.
+	d.report(start.Add(7*time.Hour), map[string]any{"t": 21.5})
+	d.expect("after 7h", database.AnomalyFlatline, 1, 1)
+
+	d.report(start.Add(8*time.Hour), map[string]any{"t": 21.6})
+	d.expect("after a change", database.AnomalyFlatline, 1, 0)
+
+	got := d.published()
+	if len(got) != 2 || got[0] != events.AnomalyDetected || got[1] != events.AnomalyResolved {
+		t.Errorf("published %v, want [%s %s]", got, events.AnomalyDetected, events.AnomalyResolved)
+	}
+}
+
+func TestSpike(t *testing.T) {
+	d := newTestDetector(t)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(i int) time.Time { return start.Add(time.Duration(i) * time.Minute) }
+
+	// A noisy but steady field.
+	for i := range 30 {
+		d.report(at(i), map[string]any{"t": 20 + 0.1*float64(i%3-1)})
+	}
+
+	tests := []struct {
+		value      float64
+		total      int
+		open       int
+		annotation string
+	}{
+		{20.5, 0, 0, "small changes are not spikes"},
+		{50, 1, 1, "a jump is a spike"},
+		{20, 1, 0, "spikes are not averaged in, so returning to the usual value is not one"},
+		{-10, 2, 1, "jumps in either direction are spikes"},
+		{-10, 2, 0, "a value close to the previous one is not a spike"},
+	}
+
+	for i, tt := range tests {
+		d.report(at(30+i), map[string]any{"t": tt.value})
+		d.expect(tt.annotation, database.AnomalySpike, tt.total, tt.open)
+	}
+}
+
+func TestSpikeMinSamples(t *testing.T) {
+	d := newTestDetector(t)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for i := range 5 {
+		d.report(start.Add(time.Duration(i)*time.Minute), map[string]any{"t": 20.0})
+	}
+
+	d.report(start.Add(5*time.Minute), map[string]any{"t": 50.0})
+	d.expect("after 6 samples", database.AnomalySpike, 0, 0)
+}
+
+func TestOutOfRange(t *testing.T) {
+	d := newTestDetector(t)
+	low, high := -40.0, 85.0
+	fields := []database.FieldDefinition{{Name: "t", Min: &low, Max: &high}}
+	if err := d.db.PatchPeripheral(&database.Peripheral{SerialNumber: "sensor", Type: database.PeripheralTypeSensor},
+		database.PeripheralMetadataUpdate{Fields: &fields}); err != nil {
+		t.Fatalf("PatchPeripheral() error = %v", err)
+	}
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value       float64
+		total, open int
+	}{
+		{20, 0, 0},
+		{85, 0, 0},
+		{85.5, 1, 1},
+		{-100, 1, 1},
+		{-40, 1, 0},
+		{-41, 2, 1},
+	}
+
+	for i, tt := range tests {
+		d.report(start.Add(time.Duration(i)*time.Minute), map[string]any{"t": tt.value})
+		d.expect(fmt.Sprintf("after %g", tt.value), database.AnomalyOutOfRange, tt.total, tt.open)
+	}
+
+	// Open anomalies are restored, so a new detector does not record the same anomaly again.
+	restarted := newTestDetectorWithDatabase(t, d.db)
+	restarted.report(start.Add(time.Hour), map[string]any{"t": -50.0})
+	restarted.expect("after restarting", database.AnomalyOutOfRange, 2, 1)
+
+	restarted.report(start.Add(2*time.Hour), map[string]any{"t": 0.0})
+	restarted.expect("after returning to range", database.AnomalyOutOfRange, 2, 0)
+}
+
+func TestRateDrop(t *testing.T) {
+	d := newTestDetector(t)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var last time.Time
+	for i := range 12 {
+		last = start.Add(time.Duration(i) * 10 * time.Second)
+		d.report(last, map[string]any{"t": float64(i)})
+	}
+
+	// The peripheral usually reports every 10s, so it must be silent for 50s to be flagged.
+	d.checkRates(last.Add(40 * time.Second))
+	d.expect("after 40s", database.AnomalyRateDrop, 0, 0)
+
+	d.checkRates(last.Add(60 * time.Second))
+	d.expect("after 60s", database.AnomalyRateDrop, 1, 1)
+
+	anomalies, _ := d.anomalies(database.AnomalyRateDrop)
+	if a := anomalies[0]; a.Field != "" || a.Value != nil {
+		t.Errorf("anomaly = %+v, want no field or value", a)
+	}
+
+	d.checkRates(last.Add(120 * time.Second))
+	d.expect("after 120s", database.AnomalyRateDrop, 1, 1)
+
+	d.report(last.Add(130*time.Second), map[string]any{"t": 12.0})
+	d.expect("after reporting again", database.AnomalyRateDrop, 1, 0)
+}
+
+func TestForgetDeletedPeripherals(t *testing.T) {
+	d := newTestDetector(t)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for i := range 12 {
+		d.report(start.Add(time.Duration(i)*10*time.Second), map[string]any{"t": float64(i)})
+	}
+
+	if err := d.db.DeletePeripheral("sensor", database.ReadingsDeleteModeCascade); err != nil {
+		t.Fatalf("DeletePeripheral() error = %v", err)
+	}
+
+	d.checkRates(start.Add(time.Hour))
+	d.expect("after deleting the peripheral", database.AnomalyRateDrop, 0, 0)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.rates) != 0 || len(d.fields) != 0 {
+		t.Errorf("%d rates and %d fields remain, want none", len(d.rates), len(d.fields))
+	}
+}
@@ -0,0 +1,57 @@
+// Package auth identifies the clients of the HTTP API and what they are allowed to do.
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"hafh-server/internal/database"
+	"slices"
+)
+
+const (
+	// apiKeyPrefix is prepended to every generated API key, so that keys are recognizable (e.g. by
+	// secret scanners).
+	apiKeyPrefix = "hafh_"
+	// displayPrefixLength is how many characters of a key are stored in plain text to identify it.
+	displayPrefixLength = len(apiKeyPrefix) + 8
+)
+
+// Principal is the authenticated client of a request.
+type Principal struct {
+	// Name describes the client, e.g. the name of its API key.
+	Name string `json:"name"`
+	// APIKeyID is the ID of the API key used, or zero for the bootstrap key from the configuration
+	// and for users.
+	APIKeyID int64 `json:"api_key_id,omitempty"`
+	// UserID and Role are set for logged in users.
+	UserID int64            `json:"user_id,omitempty"`
+	Role   database.Role    `json:"role,omitempty"`
+	Scopes []database.Scope `json:"scopes"`
+}
+
+// Bootstrap is the principal of the API key from the configuration, which is always an admin.
+var Bootstrap = Principal{Name: "bootstrap", Scopes: []database.Scope{database.ScopeAdmin}}
+
+// Has returns true if the principal has been granted the given scope, which admins always have.
+func (p *Principal) Has(scope database.Scope) bool {
+	return slices.Contains(p.Scopes, scope) || slices.Contains(p.Scopes, database.ScopeAdmin)
+}
+
+// GenerateAPIKey returns a new random API key, along with the prefix and hash to store.
+func GenerateAPIKey() (key, prefix, hash string, err error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", "", err
+	}
+
+	key = apiKeyPrefix + hex.EncodeToString(secret)
+	return key, key[:displayPrefixLength], HashToken(key), nil
+}
+
+// HashToken returns the hash of an API key or session token that is stored and looked up. Tokens
+// are random and long enough that a fast, unsalted hash is sufficient.
+func HashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,643 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hafh-server/internal/database"
+	"hafh-server/internal/logger"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// jwksLifetime is how long the signing keys of the provider are cached.
+	jwksLifetime = time.Hour
+	// jwksMinRefresh is how often the signing keys may be refetched when a token is signed by an
+	// unknown key, e.g. after the provider rotated its keys.
+	jwksMinRefresh = time.Minute
+	// loginTimeout is how long a user has to complete a login at the provider.
+	loginTimeout = 10 * time.Minute
+	// clockSkew is how much the clocks of the server and the provider may disagree.
+	clockSkew = time.Minute
+)
+
+// ErrNoRole is returned when the claims of a token do not map to any role.
+var ErrNoRole = errors.New("no role is mapped to the claims of the token")
+
+// OIDCConfig holds the configuration for the [Provider].
+type OIDCConfig struct {
+	// Issuer is the URL of the provider, from which its configuration is discovered.
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is the URL of the callback endpoint of the server, as registered at the provider.
+	RedirectURL string
+	// Audience is the audience that bearer tokens must be issued for, defaulting to the client ID.
+	Audience string
+	// Scopes are requested when logging in, defaulting to "openid profile email".
+	Scopes []string
+	// UsernameClaim is the claim holding the username, defaulting to "preferred_username". The
+	// "email" and "sub" claims are used if it is missing.
+	UsernameClaim string
+	// RoleClaim is the claim (a string or a list of strings, e.g. groups) mapped to a role.
+	RoleClaim string
+	// RoleMapping maps values of the role claim to roles. The highest mapped role is used.
+	RoleMapping map[string]database.Role
+	// DefaultRole is the role of users none of whose claim values are mapped. If it is empty, such
+	// users are rejected.
+	DefaultRole database.Role
+	// Client is used to talk to the provider, defaulting to a client with a timeout.
+	Client *http.Client
+}
+
+// Identity is a user authenticated by the provider. The issuer and subject identify the user; the
+// username is only a display name that may change or be reused.
+type Identity struct {
+	Issuer   string
+	Subject  string
+	Username string
+	Role     database.Role
+}
+
+// discovery is the subset of the provider's configuration that is used.
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// pendingLogin is a login that has been redirected to the provider and not yet completed.
+type pendingLogin struct {
+	nonce     string
+	verifier  string
+	redirect  string
+	expiresAt time.Time
+}
+
+// Provider logs users in with the OpenID Connect authorization code flow, and validates bearer
+// tokens issued by an OpenID Connect provider. Its configuration is discovered from the issuer on
+// first use, and its signing keys are cached.
+type Provider struct {
+	config *OIDCConfig
+	client *http.Client
+	log    *zap.SugaredLogger
+
+	mu            sync.Mutex
+	discovery     *discovery
+	keys          map[string]crypto.PublicKey
+	keysFetchedAt time.Time
+	pending       map[string]*pendingLogin
+}
+
+// NewProvider creates a new [Provider].
+func NewProvider(config *OIDCConfig) (*Provider, error) {
+	if config == nil {
+		return nil, errors.New("config cannot be nil")
+	} else if config.Issuer == "" {
+		return nil, errors.New("issuer is required")
+	} else if config.ClientID == "" {
+		return nil, errors.New("client ID is required")
+	} else if config.RoleClaim == "" && config.DefaultRole == "" {
+		return nil, errors.New("a role claim or default role is required")
+	} else if config.DefaultRole != "" && !config.DefaultRole.IsValid() {
+		return nil, fmt.Errorf("invalid default role: %s", config.DefaultRole)
+	}
+
+	for value, role := range config.RoleMapping {
+		if !role.IsValid() {
+			return nil, fmt.Errorf("invalid role for %q: %s", value, role)
+		}
+	}
+
+	p := &Provider{
+		config:  config,
+		client:  config.Client,
+		log:     logger.Named("oidc"),
+		keys:    map[string]crypto.PublicKey{},
+		pending: map[string]*pendingLogin{},
+	}
+
+	if p.client == nil {
+		p.client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	return p, nil
+}
+
+// BeginLogin starts a login, returning the URL of the provider to redirect the user to. Once logged
+// in, the user is redirected back to the redirect URL with the state and code to pass to
+// [Provider.CompleteLogin]. The given redirect is returned by [Provider.CompleteLogin], e.g. the
+// page to return to.
+func (p *Provider) BeginLogin(ctx context.Context, redirect string) (string, error) {
+	if p.config.RedirectURL == "" {
+		return "", errors.New("redirect URL is not configured")
+	}
+
+	d, err := p.getDiscovery(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	state, _, err := GenerateSessionToken()
+	if err != nil {
+		return "", err
+	}
+
+	nonce, _, err := GenerateSessionToken()
+	if err != nil {
+		return "", err
+	}
+
+	// The code is bound to the login with PKCE.
+	verifier, _, err := GenerateSessionToken()
+	if err != nil {
+		return "", err
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+
+	scopes := p.config.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "profile", "email"}
+	}
+
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.config.ClientID},
+		"redirect_uri":          {p.config.RedirectURL},
+		"scope":                 {strings.Join(scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+
+	now := time.Now()
+
+	p.mu.Lock()
+	for key, login := range p.pending {
+		if now.After(login.expiresAt) {
+			delete(p.pending, key)
+		}
+	}
+	p.pending[state] = &pendingLogin{nonce: nonce, verifier: verifier, redirect: redirect,
+		expiresAt: now.Add(loginTimeout)}
+	p.mu.Unlock()
+
+	separator := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+
+	return d.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+// CompleteLogin completes the login with the given state, exchanging the code for an ID token and
+// validating it. It returns the identity of the user and the redirect passed to
+// [Provider.BeginLogin].
+func (p *Provider) CompleteLogin(ctx context.Context, state, code string) (*Identity, string, error) {
+	p.mu.Lock()
+	login, ok := p.pending[state]
+	delete(p.pending, state)
+	p.mu.Unlock()
+
+	if !ok || time.Now().After(login.expiresAt) {
+		return nil, "", errors.New("unknown or expired login")
+	}
+
+	d, err := p.getDiscovery(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.config.RedirectURL},
+		"client_id":     {p.config.ClientID},
+		"code_verifier": {login.verifier},
+	}
+
+	if p.config.ClientSecret != "" {
+		form.Set("client_secret", p.config.ClientSecret)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint,
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, "", err
+	}
+
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+
+	if err := p.do(request, &tokens); err != nil {
+		return nil, "", fmt.Errorf("failed to exchange code: %w", err)
+	} else if tokens.IDToken == "" {
+		return nil, "", errors.New("the provider did not return an ID token")
+	}
+
+	claims, err := p.verify(ctx, tokens.IDToken, p.config.ClientID)
+	if err != nil {
+		return nil, "", err
+	} else if nonce, _ := claims["nonce"].(string); nonce != login.nonce {
+		return nil, "", errors.New("ID token nonce does not match")
+	}
+
+	identity, err := p.identity(claims)
+	return identity, login.redirect, err
+}
+
+// VerifyBearer validates a bearer (access) token issued by the provider for the configured
+// audience, returning the identity of its user.
+func (p *Provider) VerifyBearer(ctx context.Context, token string) (*Identity, error) {
+	audience := p.config.Audience
+	if audience == "" {
+		audience = p.config.ClientID
+	}
+
+	claims, err := p.verify(ctx, token, audience)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.identity(claims)
+}
+
+// IsJWT returns true if the token looks like a JWT rather than a session token.
+func IsJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// identity maps the claims of a validated token to an identity.
+func (p *Provider) identity(claims map[string]any) (*Identity, error) {
+	identity := &Identity{}
+	identity.Issuer, _ = claims["iss"].(string)
+	identity.Subject, _ = claims["sub"].(string)
+	if identity.Subject == "" {
+		return nil, errors.New("the token has no subject")
+	}
+
+	usernameClaim := p.config.UsernameClaim
+	if usernameClaim == "" {
+		usernameClaim = "preferred_username"
+	}
+
+	for _, claim := range []string{usernameClaim, "email", "sub"} {
+		if username, ok := claims[claim].(string); ok && username != "" {
+			identity.Username = username
+			break
+		}
+	}
+
+	if identity.Username == "" {
+		return nil, errors.New("the token has no username")
+	}
+
+	var values []string
+	switch value := claims[p.config.RoleClaim].(type) {
+	case string:
+		values = []string{value}
+	case []any:
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+
+	for _, value := range values {
+		if role, ok := p.config.RoleMapping[value]; ok && roleRank(role) > roleRank(identity.Role) {
+			identity.Role = role
+		}
+	}
+
+	if identity.Role == "" {
+		identity.Role = p.config.DefaultRole
+	}
+
+	if identity.Role == "" {
+		return nil, ErrNoRole
+	}
+
+	return identity, nil
+}
+
+// roleRank orders roles by the access they grant.
+func roleRank(role database.Role) int {
+	return slices.Index([]database.Role{database.RoleViewer, database.RoleOperator, database.RoleAdmin}, role)
+}
+
+// verify validates the signature, issuer, audience and lifetime of a JWT, returning its claims.
+func (p *Provider) verify(ctx context.Context, token, audience string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}
+
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed token header: %w", err)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature: %w", err)
+	}
+
+	key, err := p.getKey(ctx, header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := verifySignature(header.Algorithm, key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed token claims: %w", err)
+	}
+
+	d, err := p.getDiscovery(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if issuer, _ := claims["iss"].(string); issuer != d.Issuer {
+		return nil, fmt.Errorf("unexpected issuer: %s", issuer)
+	} else if !hasAudience(claims["aud"], audience) {
+		return nil, fmt.Errorf("the token was not issued for %s", audience)
+	} else if exp, ok := claims["exp"].(float64); !ok || now.After(time.Unix(int64(exp), 0).Add(clockSkew)) {
+		return nil, errors.New("the token has expired")
+	} else if nbf, ok := claims["nbf"].(float64); ok && now.Add(clockSkew).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.New("the token is not valid yet")
+	}
+
+	return claims, nil
+}
+
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+func hasAudience(aud any, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []any:
+		return slices.Contains(aud, any(audience))
+	default:
+		return false
+	}
+}
+
+// verifySignature verifies a JWT signature with one of the asymmetric algorithms. Symmetric and
+// "none" algorithms are never accepted.
+func verifySignature(algorithm string, key crypto.PublicKey, signed, signature []byte) error {
+	var hash crypto.Hash
+	switch algorithm {
+	case "RS256", "ES256", "PS256":
+		hash = crypto.SHA256
+	case "RS384", "ES384", "PS384":
+		hash = crypto.SHA384
+	case "RS512", "ES512", "PS512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported token algorithm: %s", algorithm)
+	}
+
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if strings.HasPrefix(algorithm, "RS") {
+			if rsa.VerifyPKCS1v15(key, hash, digest, signature) == nil {
+				return nil
+			}
+		} else if strings.HasPrefix(algorithm, "PS") {
+			if rsa.VerifyPSS(key, hash, digest, signature, nil) == nil {
+				return nil
+			}
+		}
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if strings.HasPrefix(algorithm, "ES") && len(signature) == 2*size {
+			r := new(big.Int).SetBytes(signature[:size])
+			s := new(big.Int).SetBytes(signature[size:])
+			if ecdsa.Verify(key, digest, r, s) {
+				return nil
+			}
+		}
+	}
+
+	return errors.New("invalid token signature")
+}
+
+// getDiscovery returns the configuration of the provider, discovering it on first use.
+func (p *Provider) getDiscovery(ctx context.Context) (*discovery, error) {
+	p.mu.Lock()
+	d := p.discovery
+	p.mu.Unlock()
+
+	if d != nil {
+		return d, nil
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		strings.TrimSuffix(p.config.Issuer, "/")+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	d = &discovery{}
+	if err := p.do(request, d); err != nil {
+		return nil, fmt.Errorf("failed to discover the provider: %w", err)
+	} else if d.Issuer != p.config.Issuer {
+		return nil, fmt.Errorf("the provider's issuer %s does not match %s", d.Issuer, p.config.Issuer)
+	} else if d.JWKSURI == "" || d.TokenEndpoint == "" || d.AuthorizationEndpoint == "" {
+		return nil, errors.New("the provider's configuration is incomplete")
+	}
+
+	p.mu.Lock()
+	p.discovery = d
+	p.mu.Unlock()
+
+	p.log.Infof("Discovered OIDC provider %s", d.Issuer)
+	return d, nil
+}
+
+// getKey returns the signing key with the given ID, refetching the keys if they are stale or the ID
+// is unknown.
+func (p *Provider) getKey(ctx context.Context, id string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	key, ok := lookupKey(p.keys, id)
+	age := time.Since(p.keysFetchedAt)
+	p.mu.Unlock()
+
+	if ok && age < jwksLifetime {
+		return key, nil
+	} else if !ok && age < jwksMinRefresh {
+		return nil, fmt.Errorf("unknown signing key: %s", id)
+	}
+
+	keys, err := p.fetchKeys(ctx)
+	if err != nil {
+		// Stale keys are better than none while the provider is unreachable.
+		if ok {
+			p.log.Warnf("Failed to refresh signing keys: %v", err)
+			return key, nil
+		}
+
+		return nil, err
+	}
+
+	p.mu.Lock()
+	p.keys = keys
+	p.keysFetchedAt = time.Now()
+	p.mu.Unlock()
+
+	if key, ok := lookupKey(keys, id); ok {
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("unknown signing key: %s", id)
+}
+
+// lookupKey returns the signing key with the given ID. Tokens without a key ID are only accepted if
+// the provider has a single key.
+func lookupKey(keys map[string]crypto.PublicKey, id string) (crypto.PublicKey, bool) {
+	if key, ok := keys[id]; ok {
+		return key, true
+	} else if id == "" && len(keys) == 1 {
+		for _, key := range keys {
+			return key, true
+		}
+	}
+
+	return nil, false
+}
+
+// fetchKeys fetches the signing keys of the provider.
+func (p *Provider) fetchKeys(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	d, err := p.getDiscovery(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, d.JWKSURI, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var jwks struct {
+		Keys []struct {
+			KeyType string `json:"kty"`
+			KeyID   string `json:"kid"`
+			Use     string `json:"use"`
+			N       string `json:"n"`
+			E       string `json:"e"`
+			Curve   string `json:"crv"`
+			X       string `json:"x"`
+			Y       string `json:"y"`
+		} `json:"keys"`
+	}
+
+	if err := p.do(request, &jwks); err != nil {
+		return nil, fmt.Errorf("failed to fetch signing keys: %w", err)
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		switch k.KeyType {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+			if errN != nil || errE != nil || len(e) > 4 {
+				p.log.Warnf("Skipping malformed RSA key %s", k.KeyID)
+				continue
+			}
+
+			keys[k.KeyID] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			var curve elliptic.Curve
+			switch k.Curve {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				continue
+			}
+
+			x, errX := base64.RawURLEncoding.DecodeString(k.X)
+			y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+			if errX != nil || errY != nil {
+				p.log.Warnf("Skipping malformed EC key %s", k.KeyID)
+				continue
+			}
+
+			keys[k.KeyID] = &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+
+	return keys, nil
+}
+
+// do sends a request to the provider and decodes its JSON response.
+func (p *Provider) do(request *http.Request, v any) error {
+	response, err := p.client.Do(request)
+	if err != nil {
+		return err
+	}
+
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(response.Body, 1<<20))
+	if err != nil {
+		return err
+	} else if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s: %s", request.URL.Redacted(), response.Status, strings.TrimSpace(string(body)))
+	}
+
+	return json.Unmarshal(body, v)
+}
@@ -0,0 +1,345 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"hafh-server/internal/database"
+	"hafh-server/internal/logger"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func init() {
+	logger.Init(false)
+}
+
+// mockProvider is a local OpenID Connect provider that signs tokens with a single RSA key.
+type mockProvider struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu sync.Mutex
+	// claims are the claims of the ID token issued for a code, along with its PKCE challenge.
+	codes map[string]mockCode
+}
+
+type mockCode struct {
+	challenge string
+	claims    map[string]any
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+
+	m := &mockProvider{key: key, codes: map[string]mockCode{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 m.server.URL,
+			"authorization_endpoint": m.server.URL + "/authorize",
+			"token_endpoint":         m.server.URL + "/token",
+			"jwks_uri":               m.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "key-1",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		m.mu.Lock()
+		code, ok := m.codes[r.PostFormValue("code")]
+		delete(m.codes, r.PostFormValue("code"))
+		m.mu.Unlock()
+
+		verifier := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if !ok || base64.RawURLEncoding.EncodeToString(verifier[:]) != code.challenge {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{"id_token": m.sign(t, "key-1", code.claims)})
+	})
+
+	m.server = httptest.NewServer(mux)
+	t.Cleanup(m.server.Close)
+	return m
+}
+
+// authorize logs a user with the given claims in at the authorization URL, returning the state and
+// code that the provider redirects back with.
+func (m *mockProvider) authorize(t *testing.T, location string, claims map[string]any) (string, string) {
+	t.Helper()
+
+	u, err := url.Parse(location)
+	if err != nil {
+		t.Fatalf("url.Parse(%q) error = %v", location, err)
+	}
+
+	query := u.Query()
+	claims = m.claims(claims)
+	claims["aud"] = query.Get("client_id")
+	claims["nonce"] = query.Get("nonce")
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	code := "code-" + query.Get("state")
+	m.codes[code] = mockCode{challenge: query.Get("code_challenge"), claims: claims}
+	return query.Get("state"), code
+}
+
+// claims returns valid claims for the client, overridden by the given claims. A nil value removes
+// the claim.
+func (m *mockProvider) claims(overrides map[string]any) map[string]any {
+	claims := map[string]any{
+		"iss":                m.server.URL,
+		"sub":                "1234",
+		"aud":                "hafh",
+		"exp":                time.Now().Add(time.Hour).Unix(),
+		"preferred_username": "alice",
+		"groups":             []string{"home"},
+	}
+
+	for claim, value := range overrides {
+		if value == nil {
+			delete(claims, claim)
+		} else {
+			claims[claim] = value
+		}
+	}
+
+	return claims
+}
+
+// sign returns a JWT with the given claims, signed with RS256 by the provider's key.
+func (m *mockProvider) sign(t *testing.T, keyID string, claims map[string]any) string {
+	t.Helper()
+
+	header := map[string]string{"alg": "RS256", "typ": "JWT"}
+	if keyID != "" {
+		header["kid"] = keyID
+	}
+
+	signed := encodeSegment(t, header) + "." + encodeSegment(t, claims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, m.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatalf("SignPKCS1v15() error = %v", err)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func encodeSegment(t *testing.T, v any) string {
+	t.Helper()
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("json.Marshal() error = %v", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func newTestProvider(t *testing.T, m *mockProvider) *Provider {
+	t.Helper()
+
+	p, err := NewProvider(&OIDCConfig{
+		Issuer:      m.server.URL,
+		ClientID:    "hafh",
+		RedirectURL: "https://hafh.example.com/api/v1/auth/oidc/callback",
+		RoleClaim:   "groups",
+		RoleMapping: map[string]database.Role{
+			"home":    database.RoleViewer,
+			"family":  database.RoleOperator,
+			"parents": database.RoleAdmin,
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewProvider() error = %v", err)
+	}
+
+	return p
+}
+
+func TestProviderLogin(t *testing.T) {
+	m := newMockProvider(t)
+	p := newTestProvider(t, m)
+	ctx := context.Background()
+
+	location, err := p.BeginLogin(ctx, "/dashboard")
+	if err != nil {
+		t.Fatalf("BeginLogin() error = %v", err)
+	}
+
+	if !strings.HasPrefix(location, m.server.URL+"/authorize?") {
+		t.Fatalf("BeginLogin() = %q, want the authorization endpoint", location)
+	}
+
+	state, code := m.authorize(t, location, map[string]any{"groups": []string{"home", "parents"}})
+	identity, redirect, err := p.CompleteLogin(ctx, state, code)
+	if err != nil {
+		t.Fatalf("CompleteLogin() error = %v", err)
+	}
+
+	want := Identity{Issuer: m.server.URL, Subject: "1234", Username: "alice", Role: database.RoleAdmin}
+	if *identity != want || redirect != "/dashboard" {
+		t.Errorf("CompleteLogin() = %+v, %q, want %+v, /dashboard", *identity, redirect, want)
+	}
+
+	// A login can only be completed once.
+	if _, _, err := p.CompleteLogin(ctx, state, code); err == nil {
+		t.Error("CompleteLogin() a second time error = nil, want an error")
+	}
+}
+
+func TestProviderLoginRejectsMismatchedNonce(t *testing.T) {
+	m := newMockProvider(t)
+	p := newTestProvider(t, m)
+	ctx := context.Background()
+
+	location, err := p.BeginLogin(ctx, "")
+	if err != nil {
+		t.Fatalf("BeginLogin() error = %v", err)
+	}
+
+	state, code := m.authorize(t, location, nil)
+	m.codes[code].claims["nonce"] = "replayed"
+
+	if _, _, err := p.CompleteLogin(ctx, state, code); err == nil {
+		t.Error("CompleteLogin() with another login's nonce error = nil, want an error")
+	}
+
+	if _, _, err := p.CompleteLogin(ctx, "unknown", code); err == nil {
+		t.Error("CompleteLogin() with an unknown state error = nil, want an error")
+	}
+}
+
+func TestProviderVerifyBearer(t *testing.T) {
+	m := newMockProvider(t)
+	p := newTestProvider(t, m)
+
+	tests := []struct {
+		name  string
+		token string
+		// want is the role of the identity, or empty if the token is rejected.
+		want database.Role
+	}{
+		{"valid", m.sign(t, "key-1", m.claims(nil)), database.RoleViewer},
+		{"audience list", m.sign(t, "key-1", m.claims(map[string]any{"aud": []string{"other", "hafh"}})),
+			database.RoleViewer},
+		{"highest role", m.sign(t, "key-1", m.claims(map[string]any{"groups": []string{"parents", "family"}})),
+			database.RoleAdmin},
+		{"single role", m.sign(t, "key-1", m.claims(map[string]any{"groups": "family"})), database.RoleOperator},
+		{"no key ID", m.sign(t, "", m.claims(nil)), database.RoleViewer},
+		{"no key ID again", m.sign(t, "", m.claims(nil)), database.RoleViewer},
+		{"other audience", m.sign(t, "key-1", m.claims(map[string]any{"aud": "other"})), ""},
+		{"other issuer", m.sign(t, "key-1", m.claims(map[string]any{"iss": "https://evil.example.com"})), ""},
+		{"expired", m.sign(t, "key-1", m.claims(map[string]any{"exp": time.Now().Add(-time.Hour).Unix()})), ""},
+		{"no expiry", m.sign(t, "key-1", m.claims(map[string]any{"exp": nil})), ""},
+		{"not valid yet", m.sign(t, "key-1", m.claims(map[string]any{"nbf": time.Now().Add(time.Hour).Unix()})), ""},
+		{"no subject", m.sign(t, "key-1", m.claims(map[string]any{"sub": nil})), ""},
+		{"unknown key", m.sign(t, "key-2", m.claims(nil)), ""},
+		{"unmapped role", m.sign(t, "key-1", m.claims(map[string]any{"groups": []string{"guests"}})), ""},
+		{"unsigned", encodeSegment(t, map[string]string{"alg": "none"}) + "." + encodeSegment(t, m.claims(nil)) + ".",
+			""},
+		{"tampered", tamper(t, m.sign(t, "key-1", m.claims(nil))), ""},
+		{"malformed", "not.a.jwt", ""},
+	}
+
+	for _, tt := range tests {
+		identity, err := p.VerifyBearer(context.Background(), tt.token)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%s: VerifyBearer() = %+v, want an error", tt.name, identity)
+			}
+		} else if err != nil {
+			t.Errorf("%s: VerifyBearer() error = %v", tt.name, err)
+		} else if identity.Role != tt.want || identity.Subject != "1234" {
+			t.Errorf("%s: VerifyBearer() = %+v, want a %s", tt.name, identity, tt.want)
+		}
+	}
+}
+
+// tamper replaces the claims of a signed token, keeping its signature.
+func tamper(t *testing.T, token string) string {
+	t.Helper()
+
+	parts := strings.Split(token, ".")
+	parts[1] = encodeSegment(t, map[string]any{"sub": "1234", "groups": []string{"parents"}})
+	return strings.Join(parts, ".")
+}
+
+func TestProviderIdentity(t *testing.T) {
+	m := newMockProvider(t)
+
+	tests := []struct {
+		name        string
+		defaultRole database.Role
+		claims      map[string]any
+		username    string
+		role        database.Role
+		err         error
+	}{
+		{"username", "", nil, "alice", database.RoleViewer, nil},
+		{"email fallback", "", map[string]any{"preferred_username": nil, "email": "alice@example.com"},
+			"alice@example.com", database.RoleViewer, nil},
+		{"subject fallback", "", map[string]any{"preferred_username": nil}, "1234", database.RoleViewer, nil},
+		{"no role", "", map[string]any{"groups": nil}, "", "", ErrNoRole},
+		{"default role", database.RoleViewer, map[string]any{"groups": []string{"guests"}}, "alice",
+			database.RoleViewer, nil},
+	}
+
+	for _, tt := range tests {
+		p := newTestProvider(t, m)
+		p.config.DefaultRole = tt.defaultRole
+
+		identity, err := p.VerifyBearer(context.Background(), m.sign(t, "key-1", m.claims(tt.claims)))
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: VerifyBearer() error = %v, want %v", tt.name, err, tt.err)
+		} else if err == nil && (identity.Username != tt.username || identity.Role != tt.role) {
+			t.Errorf("%s: VerifyBearer() = %+v, want %s as a %s", tt.name, identity, tt.username, tt.role)
+		}
+	}
+}
+
+func TestNewProviderValidatesConfig(t *testing.T) {
+	tests := []*OIDCConfig{
+		nil,
+		{ClientID: "hafh", RoleClaim: "groups"},
+		{Issuer: "https://idp", RoleClaim: "groups"},
+		{Issuer: "https://idp", ClientID: "hafh"},
+		{Issuer: "https://idp", ClientID: "hafh", DefaultRole: "owner"},
+		{Issuer: "https://idp", ClientID: "hafh", RoleClaim: "groups",
+			RoleMapping: map[string]database.Role{"home": "owner"}},
+	}
+
+	for _, config := range tests {
+		if _, err := NewProvider(config); err == nil {
+			t.Errorf("NewProvider(%+v) error = nil, want an error", config)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"hafh-server/internal/database"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// MinPasswordLength is the minimum length of a user's password.
+const MinPasswordLength = 8
+
+// dummyHash is compared against when logging in as a user that does not exist, so that the
+// response time does not reveal which usernames exist.
+var dummyHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("not a real password"), bcrypt.DefaultCost)
+	return hash
+})
+
+// UserPrincipal returns the principal of a logged in user, with the scopes of their role.
+func UserPrincipal(user *database.User) *Principal {
+	return &Principal{Name: user.Username, UserID: user.ID, Role: user.Role, Scopes: user.Role.Scopes()}
+}
+
+// IdentityPrincipal returns the principal of a user authenticated by an OpenID Connect bearer token,
+// with the scopes of their role.
+func IdentityPrincipal(identity *Identity) *Principal {
+	return &Principal{Name: identity.Username, Role: identity.Role, Scopes: identity.Role.Scopes()}
+}
+
+// HashPassword returns the bcrypt hash of a password.
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// CheckPassword returns true if the password matches the user's password hash. The user may be
+// nil, in which case the check takes as long as it would otherwise but always fails.
+func CheckPassword(user *database.User, password string) bool {
+	if user == nil {
+		bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
+		return false
+	}
+
+	return bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) == nil
+}
+
+// GenerateSessionToken returns a new random session token, along with the hash to store.
+func GenerateSessionToken() (token, hash string, err error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", err
+	}
+
+	token = hex.EncodeToString(secret)
+	return token, HashToken(token), nil
+}
@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"hafh-server/internal/database"
+	"testing"
+)
+
+func TestCheckPassword(t *testing.T) {
+	hash, err := HashPassword("correct horse")
+	if err != nil {
+		t.Fatalf("HashPassword() error = %v", err)
+	}
+
+	if hash == "correct horse" {
+		t.Fatal("HashPassword() returned the password")
+	}
+
+	user := &database.User{Username: "alice", PasswordHash: hash}
+	tests := []struct {
+		user     *database.User
+		password string
+		want     bool
+	}{
+		{user, "correct horse", true},
+		{user, "correct horse ", false},
+		{user, "Correct horse", false},
+		{user, "", false},
+		{&database.User{Username: "oidc"}, "", false},
+		{nil, "correct horse", false},
+	}
+
+	for _, tt := range tests {
+		if got := CheckPassword(tt.user, tt.password); got != tt.want {
+			t.Errorf("CheckPassword(%+v, %q) = %v, want %v", tt.user, tt.password, got, tt.want)
+		}
+	}
+}
+
+func TestGenerateSessionToken(t *testing.T) {
+	seen := map[string]bool{}
+	for range 10 {
+		token, hash, err := GenerateSessionToken()
+		if err != nil {
+			t.Fatalf("GenerateSessionToken() error = %v", err)
+		}
+
+		if len(token) != 64 || hash != HashToken(token) || hash == token {
+			t.Errorf("GenerateSessionToken() = %q, %q", token, hash)
+		}
+
+		if seen[token] {
+			t.Errorf("GenerateSessionToken() returned %q twice", token)
+		}
+		seen[token] = true
+	}
+}
+
+func TestUserPrincipal(t *testing.T) {
+	tests := []struct {
+		role database.Role
+		// allowed are the scopes the principal has, out of readings:read, peripherals:write,
+		// commands:send and admin.
+		allowed [4]bool
+	}{
+		{database.RoleViewer, [4]bool{true, false, false, false}},
+		{database.RoleOperator, [4]bool{true, false, true, false}},
+		{database.RoleAdmin, [4]bool{true, true, true, true}},
+		{database.Role("unknown"), [4]bool{}},
+	}
+
+	scopes := []database.Scope{
+		database.ScopeReadReadings, database.ScopeWritePeripherals, database.ScopeSendCommands, database.ScopeAdmin,
+	}
+
+	for _, tt := range tests {
+		principal := UserPrincipal(&database.User{ID: 1, Username: "alice", Role: tt.role})
+		for i, scope := range scopes {
+			if got := principal.Has(scope); got != tt.allowed[i] {
+				t.Errorf("%s principal.Has(%s) = %v, want %v", tt.role, scope, got, tt.allowed[i])
+			}
+		}
+	}
+}
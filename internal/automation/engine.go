@@ -0,0 +1,265 @@
+// Package automation evaluates automations, which trigger actuator commands when conditions over
+// readings and peripheral presence hold.
+package automation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hafh-server/internal/commands"
+	"hafh-server/internal/database"
+	"hafh-server/internal/events"
+	"hafh-server/internal/logger"
+	"hafh-server/internal/presence"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// checkInterval is how often every automation is re-evaluated, so that durations elapse and
+// presence changes are noticed even when no new readings arrive.
+const checkInterval = 10 * time.Second
+
+// Engine evaluates enabled automations whenever a reading is ingested, a peripheral's presence
+// changes, and periodically, executing the actions of automations whose conditions hold.
+type Engine struct {
+	db           *database.Database
+	sender       *commands.Sender
+	log          *zap.SugaredLogger
+	offlineAfter time.Duration
+
+	mu sync.Mutex
+	// states tracks, per automation, since when its conditions have held and whether it has
+	// triggered since they became true.
+	states map[int64]*state
+	// latest caches the latest reading of each peripheral referenced by a condition.
+	latest map[string]*database.Reading
+}
+
+type state struct {
+	since     time.Time
+	triggered bool
+}
+
+// NewEngine creates a new automation [Engine] that sends commands with the given sender. A
+// peripheral is considered offline once it has not reported a reading for offlineAfter.
+func NewEngine(db *database.Database, sender *commands.Sender, offlineAfter time.Duration) (*Engine, error) {
+	if db == nil {
+		return nil, errors.New("database is required")
+	} else if sender == nil {
+		return nil, errors.New("command sender is required")
+	}
+
+	return &Engine{
+		db:           db,
+		sender:       sender,
+		log:          logger.Named("automation"),
+		offlineAfter: offlineAfter,
+		states:       map[int64]*state{},
+		latest:       map[string]*database.Reading{},
+	}, nil
+}
+
+// Start periodically evaluates every automation until the context is cancelled. **This should be
+// called in a separate goroutine.**
+func (e *Engine) Start(ctx context.Context) {
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			e.evaluate("")
+		}
+	}
+}
+
+// OnReading evaluates the automations that depend on the peripheral that reported a reading. It has
+// the signature of an ingest.ReadingListener.
+func (e *Engine) OnReading(reading *database.Reading, peripheral *database.Peripheral) {
+	e.mu.Lock()
+	e.latest[peripheral.SerialNumber] = reading
+	e.mu.Unlock()
+
+	e.evaluate(peripheral.SerialNumber)
+}
+
+// OnEvent evaluates the automations that depend on a peripheral whose presence changed. It has the
+// signature of an events.Handler.
+func (e *Engine) OnEvent(event events.Event) {
+	if event.Type != events.PeripheralOnline && event.Type != events.PeripheralOffline {
+		return
+	}
+
+	if change, ok := event.Data.(presence.Change); ok {
+		e.evaluate(change.SerialNumber)
+	}
+}
+
+// evaluate evaluates the enabled automations with a condition on the given peripheral, or every
+// enabled automation if serial is empty.
+func (e *Engine) evaluate(serial string) {
+	automations, err := e.db.GetAutomations(true)
+	if err != nil {
+		e.log.Errorf("Failed to get automations: %v", err)
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := time.Now()
+	enabled := make(map[int64]bool, len(automations))
+	for i := range automations {
+		a := &automations[i]
+		enabled[a.ID] = true
+		if serial != "" && !dependsOn(a, serial) {
+			continue
+		}
+
+		holds, err := e.holds(a)
+		if err != nil {
+			e.log.Errorf("Failed to evaluate automation %d: %v", a.ID, err)
+			continue
+		}
+
+		s := e.states[a.ID]
+		if !holds {
+			// The automation re-arms once its conditions stop holding.
+			delete(e.states, a.ID)
+			continue
+		} else if s == nil {
+			s = &state{since: now}
+			e.states[a.ID] = s
+		}
+
+		if s.triggered || now.Sub(s.since) < a.Duration() {
+			continue
+		} else if a.LastTriggeredAt != nil && now.Sub(*a.LastTriggeredAt) < a.Cooldown() {
+			continue
+		}
+
+		s.triggered = true
+		e.execute(a, now)
+	}
+
+	// Forget about automations that were disabled or deleted.
+	if serial == "" {
+		for id := range e.states {
+			if !enabled[id] {
+				delete(e.states, id)
+			}
+		}
+	}
+}
+
+func dependsOn(a *database.Automation, serial string) bool {
+	for _, c := range a.Conditions {
+		if c.SerialNumber == serial {
+			return true
+		}
+	}
+
+	return false
+}
+
+// holds returns true if every condition of the automation holds.
+func (e *Engine) holds(a *database.Automation) (bool, error) {
+	for i := range a.Conditions {
+		c := &a.Conditions[i]
+
+		var holds bool
+		var err error
+		switch c.Kind {
+		case database.ConditionKindReading:
+			holds, err = e.readingHolds(c)
+		case database.ConditionKindPresence:
+			holds, err = e.presenceHolds(c)
+		}
+
+		if err != nil || !holds {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+func (e *Engine) readingHolds(c *database.AutomationCondition) (bool, error) {
+	reading, ok := e.latest[c.SerialNumber]
+	if !ok {
+		readings, err := e.db.GetLastReadings(c.SerialNumber, 1)
+		if err != nil {
+			return false, err
+		}
+
+		// Peripherals without readings are cached too, until their first reading arrives.
+		if len(readings) > 0 {
+			reading = &readings[0]
+		}
+		e.latest[c.SerialNumber] = reading
+	}
+
+	if reading == nil {
+		return false, nil
+	}
+
+	value, ok := reading.NumericValue(c.Field)
+	return ok && c.Comparison.Compare(value, c.Threshold), nil
+}
+
+func (e *Engine) presenceHolds(c *database.AutomationCondition) (bool, error) {
+	peripheral, err := e.db.GetPeripheralBySerial(c.SerialNumber)
+	if err != nil || peripheral == nil {
+		return false, err
+	}
+
+	return peripheral.IsOnline(e.offlineAfter) == *c.Online, nil
+}
+
+// execute sends the automation's commands (unless it is a dry run) and records the execution.
+func (e *Engine) execute(a *database.Automation, now time.Time) {
+	execution := &database.AutomationExecution{
+		AutomationID: a.ID,
+		TriggeredAt:  now,
+		DryRun:       a.DryRun,
+		Success:      true,
+	}
+
+	for _, action := range a.Actions {
+		result := database.ActionResult{SerialNumber: action.SerialNumber, Command: action.Command}
+
+		var err error
+		if a.DryRun {
+			// Still validate, so that a dry run shows whether the command would be accepted.
+			err = e.sender.Validate(action.SerialNumber, action.Command)
+		} else {
+			err = e.sender.Send(&commands.Command{
+				SerialNumber: action.SerialNumber,
+				Command:      action.Command,
+				Args:         action.Args,
+				Source:       fmt.Sprintf("automation:%d", a.ID),
+			})
+		}
+
+		if err != nil {
+			result.Error = err.Error()
+			execution.Success = false
+		}
+
+		execution.Results = append(execution.Results, result)
+	}
+
+	if a.DryRun {
+		e.log.Infof("Automation %q triggered (dry run)", a.Name)
+	} else {
+		e.log.Infof("Automation %q triggered", a.Name)
+	}
+
+	if err := e.db.RecordAutomationExecution(execution); err != nil {
+		e.log.Errorf("Failed to record execution of automation %d: %v", a.ID, err)
+	}
+}
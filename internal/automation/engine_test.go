@@ -0,0 +1,167 @@
+package automation
+
+import (
+	"encoding/json"
+	"hafh-server/internal/commands"
+	"hafh-server/internal/database"
+	"hafh-server/internal/logger"
+	"sync"
+	"testing"
+	"time"
+)
+
+func init() {
+	logger.Init(false)
+}
+
+// publisher records the commands published by the engine.
+type publisher struct {
+	mu       sync.Mutex
+	commands []commands.Command
+}
+
+func (p *publisher) Publish(topic string, payload []byte) error {
+	var command commands.Command
+	if err := json.Unmarshal(payload, &command); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.commands = append(p.commands, command)
+	return nil
+}
+
+func (p *publisher) count() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.commands)
+}
+
+// newTestEngine returns an engine with a sensor "sensor" and an actuator "fan", and an automation
+// that turns on the fan when the temperature of the sensor exceeds 25.
+func newTestEngine(t *testing.T, automation database.Automation) (*Engine, *database.Database, *publisher, *database.Peripheral) {
+	t.Helper()
+
+	db, err := database.New(":memory:")
+	if err != nil {
+		t.Fatalf("database.New() error = %v", err)
+	}
+
+	t.Cleanup(func() { db.Close() })
+
+	sensor := &database.Peripheral{SerialNumber: "sensor", Type: database.PeripheralTypeSensor}
+	for _, p := range []*database.Peripheral{sensor, {SerialNumber: "fan", Type: database.PeripheralTypeActuator}} {
+		if err := db.AddPeripheral(p); err != nil {
+			t.Fatalf("AddPeripheral() error = %v", err)
+		}
+	}
+
+	automation.Name, automation.Enabled = "cool down", true
+	automation.Conditions = []database.AutomationCondition{{
+		Kind:         database.ConditionKindReading,
+		SerialNumber: "sensor",
+		Field:        "t",
+		Comparison:   database.ComparisonGreater,
+		Threshold:    25,
+	}}
+	automation.Actions = []database.AutomationAction{{SerialNumber: "fan", Command: "on"}}
+	if err := db.AddAutomation(&automation); err != nil {
+		t.Fatalf("AddAutomation() error = %v", err)
+	}
+
+	p := &publisher{}
+	sender, err := commands.NewSender(db, p, "commands/")
+	if err != nil {
+		t.Fatalf("NewSender() error = %v", err)
+	}
+
+	engine, err := NewEngine(db, sender, time.Minute)
+	if err != nil {
+		t.Fatalf("NewEngine() error = %v", err)
+	}
+
+	return engine, db, p, sensor
+}
+
+func report(engine *Engine, sensor *database.Peripheral, t float64) {
+	engine.OnReading(&database.Reading{SerialNumber: sensor.SerialNumber, Data: map[string]any{"t": t}}, sensor)
+}
+
+func TestTriggersOncePerCondition(t *testing.T) {
+	engine, _, p, sensor := newTestEngine(t, database.Automation{})
+
+	tests := []struct {
+		t    float64
+		want int
+	}{
+		{20, 0},
+		{26, 1},
+		// The automation does not trigger again while its condition keeps holding...
+		{27, 1},
+		// ...but re-arms once it stops holding.
+		{25, 1},
+		{30, 2},
+	}
+
+	for _, tt := range tests {
+		report(engine, sensor, tt.t)
+		if got := p.count(); got != tt.want {
+			t.Fatalf("after t = %v, %d commands sent, want %d", tt.t, got, tt.want)
+		}
+	}
+
+	if command := p.commands[0]; command.SerialNumber != "fan" || command.Command != "on" || command.Source == "" {
+		t.Errorf("command = %+v", command)
+	}
+}
+
+func TestCooldown(t *testing.T) {
+	engine, _, p, sensor := newTestEngine(t, database.Automation{CooldownSeconds: 3600})
+
+	for _, value := range []float64{26, 20, 26} {
+		report(engine, sensor, value)
+	}
+
+	if got := p.count(); got != 1 {
+		t.Errorf("%d commands sent within the cooldown, want 1", got)
+	}
+}
+
+func TestDuration(t *testing.T) {
+	engine, _, p, sensor := newTestEngine(t, database.Automation{DurationSeconds: 3600})
+
+	report(engine, sensor, 26)
+	engine.evaluate("")
+	if got := p.count(); got != 0 {
+		t.Errorf("%d commands sent before the duration elapsed, want 0", got)
+	}
+
+	// Pretend the condition started holding long enough ago.
+	engine.mu.Lock()
+	for _, s := range engine.states {
+		s.since = s.since.Add(-2 * time.Hour)
+	}
+	engine.mu.Unlock()
+
+	engine.evaluate("")
+	if got := p.count(); got != 1 {
+		t.Errorf("%d commands sent after the duration elapsed, want 1", got)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	engine, db, p, sensor := newTestEngine(t, database.Automation{DryRun: true})
+
+	report(engine, sensor, 26)
+	if got := p.count(); got != 0 {
+		t.Errorf("%d commands sent in a dry run, want 0", got)
+	}
+
+	executions, err := db.GetAutomationExecutions(1, 10)
+	if err != nil {
+		t.Fatalf("GetAutomationExecutions() error = %v", err)
+	} else if len(executions) != 1 || !executions[0].DryRun || !executions[0].Success {
+		t.Errorf("executions = %+v, want one successful dry run", executions)
+	}
+}
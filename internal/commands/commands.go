@@ -0,0 +1,127 @@
+// Package commands publishes commands to actuator peripherals over MQTT.
+package commands
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hafh-server/internal/database"
+	"hafh-server/internal/logger"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrUnknownPeripheral is returned when a command targets a peripheral that does not exist.
+	ErrUnknownPeripheral = errors.New("unknown peripheral")
+	// ErrNotActuator is returned when a command targets a peripheral that does not accept commands.
+	ErrNotActuator = errors.New("peripheral does not accept commands")
+	// ErrUnsupportedCommand is returned when a command is not one of the commands declared by the
+	// peripheral's type.
+	ErrUnsupportedCommand = errors.New("unsupported command")
+)
+
+// Publisher publishes a message to an MQTT topic.
+type Publisher interface {
+	Publish(topic string, payload []byte) error
+}
+
+// Command is a command sent to an actuator peripheral.
+type Command struct {
+	SerialNumber string         `json:"serial_number"`
+	Command      string         `json:"command"`
+	Args         map[string]any `json:"args,omitempty"`
+	// Source describes what issued the command, e.g. "automation:3".
+	Source   string    `json:"source"`
+	IssuedAt time.Time `json:"issued_at"`
+}
+
+// Sender validates commands against the peripheral type registry and publishes them to the
+// command topic of the target peripheral, i.e. `<topicPrefix><serial number>`.
+type Sender struct {
+	db          *database.Database
+	publisher   Publisher
+	topicPrefix string
+	log         *zap.SugaredLogger
+}
+
+// NewSender creates a new command [Sender].
+func NewSender(db *database.Database, publisher Publisher, topicPrefix string) (*Sender, error) {
+	if db == nil {
+		return nil, errors.New("database is required")
+	} else if publisher == nil {
+		return nil, errors.New("publisher is required")
+	} else if topicPrefix == "" {
+		return nil, errors.New("topic prefix is required")
+	}
+
+	return &Sender{
+		db:          db,
+		publisher:   publisher,
+		topicPrefix: topicPrefix,
+		log:         logger.Named("commands"),
+	}, nil
+}
+
+// Validate checks that the peripheral exists and accepts the command. A peripheral accepts commands
+// if it is an actuator or its type declares commands; if the type declares commands, the command
+// must be one of them.
+func (s *Sender) Validate(serial, command string) error {
+	if command == "" {
+		return errors.New("command is required")
+	}
+
+	peripheral, err := s.db.GetPeripheralBySerial(serial)
+	if err != nil {
+		return err
+	} else if peripheral == nil {
+		return fmt.Errorf("%w: %s", ErrUnknownPeripheral, serial)
+	}
+
+	definition, err := s.db.GetPeripheralType(peripheral.Type)
+	if err != nil {
+		return err
+	}
+
+	var declared []string
+	if definition != nil {
+		declared = definition.Commands
+	}
+
+	if len(declared) == 0 {
+		if peripheral.Type != database.PeripheralTypeActuator {
+			return fmt.Errorf("%w: %s", ErrNotActuator, serial)
+		}
+		return nil
+	}
+
+	for _, c := range declared {
+		if c == command {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: %s", ErrUnsupportedCommand, command)
+}
+
+// Send validates and publishes a command, setting its issue time.
+func (s *Sender) Send(command *Command) error {
+	if err := s.Validate(command.SerialNumber, command.Command); err != nil {
+		return err
+	}
+
+	command.IssuedAt = time.Now().UTC()
+	payload, err := json.Marshal(command)
+	if err != nil {
+		return err
+	}
+
+	topic := s.topicPrefix + command.SerialNumber
+	if err := s.publisher.Publish(topic, payload); err != nil {
+		return fmt.Errorf("failed to publish command: %w", err)
+	}
+
+	s.log.Infof("Sent %q to %s (%s)", command.Command, command.SerialNumber, command.Source)
+	return nil
+}
@@ -0,0 +1,49 @@
+package config
+
+import "reflect"
+
+// Changes returns the settings (as YAML paths, e.g. "http.rate_limit.burst") that differ between
+// two configurations, split into those that are applied when the configuration is reloaded and those
+// that require a restart.
+func Changes(old, new *Config) (reloadable, restart []string) {
+	diff(reflect.ValueOf(*old), reflect.ValueOf(*new), "", false, func(path string, reload bool) {
+		if reload {
+			reloadable = append(reloadable, path)
+		} else {
+			restart = append(restart, path)
+		}
+	})
+
+	return reloadable, restart
+}
+
+// diff calls changed for every field of two structs that differs, recursing into nested structs.
+// Maps, slices and pointers are compared as a whole, with nil and empty maps and slices being equal
+// (e.g. a list that is left out and one that is written as `[]`).
+func diff(old, new reflect.Value, prefix string, reload bool, changed func(path string, reload bool)) {
+	for i := range old.NumField() {
+		field := old.Type().Field(i)
+		name := yamlName(field)
+		if name == "" {
+			continue
+		}
+
+		path := prefix + name
+		fieldReload := reload || field.Tag.Get("reload") == "true"
+
+		if field.Type.Kind() == reflect.Struct {
+			diff(old.Field(i), new.Field(i), path+".", fieldReload, changed)
+		} else if !equal(old.Field(i), new.Field(i)) {
+			changed(path, fieldReload)
+		}
+	}
+}
+
+// equal reports whether two values of a field are equal.
+func equal(old, new reflect.Value) bool {
+	if kind := old.Kind(); (kind == reflect.Map || kind == reflect.Slice) && old.Len() == 0 && new.Len() == 0 {
+		return true
+	}
+
+	return reflect.DeepEqual(old.Interface(), new.Interface())
+}
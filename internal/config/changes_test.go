@@ -0,0 +1,86 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// load writes a configuration file with the given contents and loads it.
+func load(t *testing.T, contents string) *Config {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	config, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	return config
+}
+
+func TestChanges(t *testing.T) {
+	old := load(t, `
+debug: false
+http:
+  port: 8080
+  api_key: "first"
+  rate_limit:
+    burst: 10
+mqtt:
+  port: 8883
+`)
+
+	tests := []struct {
+		name          string
+		new           string
+		wantReloaded  []string
+		wantRestarted []string
+	}{
+		{"unchanged", `
+http:
+  port: 8080
+  api_key: "first"
+  allowed_origins: []
+  rate_limit:
+    scopes: {}
+`, nil, nil},
+		{"reloadable", `
+debug: true
+http:
+  api_key: "second"
+  max_requests_per_second: 2
+  rate_limit:
+    burst: 20
+    routes:
+      "POST /api/v1/schedules/:id/run": { per_second: 0.1, burst: 2 }
+`, []string{
+			"debug", "http.api_key", "http.max_requests_per_second", "http.rate_limit.burst",
+			"http.rate_limit.routes",
+		}, nil},
+		{"restart", `
+http:
+  api_key: "first"
+  allowed_origins: ["https://dashboard.example.com"]
+  tls:
+    enabled: true
+mqtt:
+  port: 1883
+scheduler:
+  latitude: 51.5
+`, nil, []string{"http.tls.enabled", "http.allowed_origins", "mqtt.port", "scheduler.latitude"}},
+	}
+
+	for _, tt := range tests {
+		reloaded, restart := Changes(old, load(t, tt.new))
+		if !slices.Equal(reloaded, tt.wantReloaded) || !slices.Equal(restart, tt.wantRestarted) {
+			t.Errorf("%s: Changes() = %v, %v, want %v, %v", tt.name, reloaded, restart, tt.wantReloaded,
+				tt.wantRestarted)
+		}
+	}
+}
@@ -1,29 +1,117 @@
 package config
 
 import (
+	"io"
 	"os"
+	"reflect"
+	"time"
 
 	"github.com/mcuadros/go-defaults"
 	"gopkg.in/yaml.v3"
 )
 
+// Config is the configuration of the server. Fields tagged `reload:"true"` (and every field within
+// them) are applied when the configuration is reloaded; changes to any other field require a restart.
+// Fields tagged `secret:"true"` are redacted from [Config.String].
 type Config struct {
-	Debug bool        `yaml:"debug" default:"false"`
-	HTTP  HTTPConfig  `yaml:"http"`
-	Ngrok NgrokConfig `yaml:"ngrok"`
-	MQTT  MQTTConfig  `yaml:"mqtt"`
-	DB    DBConfig    `yaml:"database"`
+	Debug       bool              `yaml:"debug" default:"false" reload:"true"`
+	HTTP        HTTPConfig        `yaml:"http"`
+	Ngrok       NgrokConfig       `yaml:"ngrok"`
+	MQTT        MQTTConfig        `yaml:"mqtt"`
+	DB          DBConfig          `yaml:"database"`
+	Peripherals PeripheralsConfig `yaml:"peripherals"`
+	Webhooks    WebhooksConfig    `yaml:"webhooks"`
+	Email       EmailConfig       `yaml:"email"`
+	Scheduler   SchedulerConfig   `yaml:"scheduler"`
+	Anomalies   AnomaliesConfig   `yaml:"anomalies"`
+	Metrics     MetricsConfig     `yaml:"metrics"`
+	Lifecycle   LifecycleConfig   `yaml:"lifecycle"`
 }
 
 type HTTPConfig struct {
-	Port                 int    `yaml:"port" default:"8080"`
-	APIKey               string `yaml:"api_key" default:""`
-	MaxRequestsPerSecond int    `yaml:"max_requests_per_second" default:"5"`
+	Port   int    `yaml:"port" default:"8080"`
+	APIKey string `yaml:"api_key" default:"" reload:"true" secret:"true"`
+	// MaxRequestsPerSecond is the sustained rate of requests of every client (API key, user or IP
+	// address), unless overridden for one of its scopes.
+	MaxRequestsPerSecond float64         `yaml:"max_requests_per_second" default:"5" reload:"true"`
+	RateLimit            RateLimitConfig `yaml:"rate_limit" reload:"true"`
+	// SessionLifetime is how long users stay logged in.
+	SessionLifetime time.Duration `yaml:"session_lifetime" default:"168h"`
+	// AuthMode is how users log in: "local" (a username and password) or "oidc" (an OpenID Connect
+	// provider). API keys are accepted in either mode.
+	AuthMode string     `yaml:"auth_mode" default:"local"`
+	OIDC     OIDCConfig `yaml:"oidc"`
+	TLS      TLSConfig  `yaml:"tls"`
+	// AllowedOrigins are the origins (e.g. "https://dashboard.example.com") of other sites whose
+	// pages may open WebSockets with the session cookie of a logged in user, in addition to the
+	// server's own.
+	AllowedOrigins []string `yaml:"allowed_origins"`
+}
+
+type TLSConfig struct {
+	// Enabled serves HTTPS on Port, in addition to plain HTTP on the HTTP port.
+	Enabled  bool   `yaml:"enabled" default:"false"`
+	Port     int    `yaml:"port" default:"8443"`
+	CertPath string `yaml:"cert_path" default:"certs/server.crt"`
+	KeyPath  string `yaml:"key_path" default:"certs/server.key"`
+	// ClientCerts requires clients to present a certificate signed by the MQTT CA.
+	ClientCerts bool `yaml:"client_certs" default:"false"`
+	// MinVersion is the minimum TLS version: "1.0", "1.1", "1.2" or "1.3".
+	MinVersion string `yaml:"min_version" default:"1.2"`
+	// RedirectHTTP redirects plain HTTP requests from other hosts to HTTPS. Otherwise, plain HTTP is
+	// only served to this host (e.g. to the ngrok forwarder).
+	RedirectHTTP bool `yaml:"redirect_http" default:"true"`
+}
+
+type RateLimitConfig struct {
+	// Burst is the number of requests a client may make at once after being idle.
+	Burst int `yaml:"burst" default:"10"`
+	// Scopes override the rate limit of clients with the given scopes (e.g. "admin").
+	Scopes map[string]RateConfig `yaml:"scopes"`
+	// Routes add a rate limit to expensive routes, keyed by method and route pattern (e.g.
+	// "POST /api/v1/schedules/:id/run").
+	Routes map[string]RateConfig `yaml:"routes"`
+	// IdleAfter is how long a client must be idle before its rate limit state is dropped.
+	IdleAfter time.Duration `yaml:"idle_after" default:"10m"`
+}
+
+type RateConfig struct {
+	PerSecond float64 `yaml:"per_second"`
+	Burst     int     `yaml:"burst"`
+}
+
+type OIDCConfig struct {
+	// Issuer is the URL of the provider, e.g. "https://accounts.example.com".
+	Issuer       string `yaml:"issuer"`
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret" secret:"true"`
+	// RedirectURL is the public URL of `/api/v1/auth/oidc/callback`, as registered at the provider.
+	RedirectURL string `yaml:"redirect_url"`
+	// Audience is the audience that bearer tokens must be issued for, defaulting to the client ID.
+	Audience string `yaml:"audience"`
+	// Scopes are requested when logging in, defaulting to openid, profile and email.
+	Scopes        []string `yaml:"scopes"`
+	UsernameClaim string   `yaml:"username_claim" default:"preferred_username"`
+	// RoleClaim is the claim (e.g. a list of groups) whose values are mapped to roles.
+	RoleClaim string `yaml:"role_claim" default:"groups"`
+	// RoleMapping maps values of the role claim to roles (viewer, operator or admin).
+	RoleMapping map[string]string `yaml:"role_mapping"`
+	// DefaultRole is the role of users without a mapped claim value. If empty, they are rejected.
+	DefaultRole string `yaml:"default_role"`
+}
+
+type MetricsConfig struct {
+	// Enabled serves Prometheus metrics at /metrics.
+	Enabled bool `yaml:"enabled" default:"true"`
+	// Public serves the metrics without authentication; otherwise the readings:read scope is needed.
+	Public bool `yaml:"public" default:"false"`
+	// ReadingGauges exports the latest value of every numeric reading field of every peripheral.
+	ReadingGauges bool `yaml:"reading_gauges" default:"false"`
 }
 
 type NgrokConfig struct {
 	Enabled   bool   `yaml:"enabled" default:"false"`
-	AuthToken string `yaml:"auth_token" default:""`
+	AuthToken string `yaml:"auth_token" default:"" secret:"true"`
 	Domain    string `yaml:"domain" default:""`
 	Region    string `yaml:"region" default:"us"`
 }
@@ -40,9 +128,90 @@ type DBConfig struct {
 	Path string `yaml:"path" default:":memory:"`
 }
 
-// String returns the string representation of the Config struct.
+type PeripheralsConfig struct {
+	// OfflineAfter is how long a peripheral can go without reporting a reading before it is
+	// considered offline.
+	OfflineAfter time.Duration `yaml:"offline_after" default:"10m"`
+}
+
+type WebhooksConfig struct {
+	// MaxAttempts is how many times a delivery is attempted before it is marked as failed.
+	MaxAttempts int `yaml:"max_attempts" default:"8"`
+	// InitialBackoff is the delay before the first retry, which doubles with every failed attempt.
+	InitialBackoff time.Duration `yaml:"initial_backoff" default:"10s"`
+	// MaxBackoff caps the delay between retries.
+	MaxBackoff time.Duration `yaml:"max_backoff" default:"1h"`
+	// Timeout is how long to wait for a webhook to respond.
+	Timeout time.Duration `yaml:"timeout" default:"10s"`
+}
+
+type EmailConfig struct {
+	Enabled  bool   `yaml:"enabled" default:"false"`
+	Host     string `yaml:"host" default:"localhost"`
+	Port     int    `yaml:"port" default:"587"`
+	StartTLS bool   `yaml:"starttls" default:"true"`
+	Username string `yaml:"username" default:""`
+	Password string `yaml:"password" default:"" secret:"true"`
+	From     string `yaml:"from" default:""`
+	// To are the recipients of every notification.
+	To []string `yaml:"to"`
+	// EventTypes are the event types that are emailed. An empty list means all events.
+	EventTypes []string `yaml:"event_types"`
+	// DigestInterval is the minimum time between two emails. Events in between are sent together
+	// as a digest.
+	DigestInterval time.Duration `yaml:"digest_interval" default:"15m"`
+	Timeout        time.Duration `yaml:"timeout" default:"30s"`
+	// Templates override the default subject and/or body of the email for an event type.
+	Templates map[string]EmailTemplate `yaml:"templates"`
+}
+
+type EmailTemplate struct {
+	Subject string `yaml:"subject"`
+	Body    string `yaml:"body"`
+}
+
+type SchedulerConfig struct {
+	// TimeZone is the IANA time zone that schedule expressions are evaluated in, e.g.
+	// "Europe/London". "Local" is the system time zone.
+	TimeZone string `yaml:"timezone" default:"Local"`
+	// Latitude and Longitude are the location used to compute sunrise and sunset. Sun expressions
+	// are rejected if they are not set.
+	Latitude  *float64 `yaml:"latitude"`
+	Longitude *float64 `yaml:"longitude"`
+	// MissedRunGrace is how late a run may start before it is considered missed.
+	MissedRunGrace time.Duration `yaml:"missed_run_grace" default:"2m"`
+}
+
+type AnomaliesConfig struct {
+	Enabled bool `yaml:"enabled" default:"true"`
+	// FlatlineAfter is how long a field must report the exact same value to be flagged as stuck.
+	FlatlineAfter time.Duration `yaml:"flatline_after" default:"6h"`
+	// SpikeThreshold is how many standard deviations a value must jump to be flagged as a spike.
+	SpikeThreshold float64 `yaml:"spike_threshold" default:"6"`
+	// RateDropFactor is how many times its usual interval a peripheral must go without reporting
+	// to be flagged.
+	RateDropFactor float64 `yaml:"rate_drop_factor" default:"5"`
+	// MinSamples is how many readings are needed before spikes and rate drops are flagged.
+	MinSamples int `yaml:"min_samples" default:"20"`
+}
+
+type LifecycleConfig struct {
+	// ShutdownTimeout is how long the server has to shut down every component, after which it exits
+	// anyway.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" default:"15s"`
+	// RestartInitialBackoff is the delay before a failed component (the HTTP server or the ngrok
+	// forwarder) is restarted, which doubles with every failure in a row.
+	RestartInitialBackoff time.Duration `yaml:"restart_initial_backoff" default:"1s"`
+	// RestartMaxBackoff caps the delay between restarts.
+	RestartMaxBackoff time.Duration `yaml:"restart_max_backoff" default:"1m"`
+}
+
+// String returns the string representation of the Config struct, with secrets redacted.
 func (c *Config) String() string {
-	data, err := yaml.Marshal(c)
+	redacted := *c
+	redact(reflect.ValueOf(&redacted).Elem())
+
+	data, err := yaml.Marshal(&redacted)
 	if err != nil {
 		return ""
 	}
@@ -50,20 +219,70 @@ func (c *Config) String() string {
 	return string(data)
 }
 
+// redact replaces the value of every secret that is set, recursing into nested structs.
+func redact(v reflect.Value) {
+	for i := range v.NumField() {
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct {
+			redact(field)
+		} else if v.Type().Field(i).Tag.Get("secret") == "true" && field.String() != "" {
+			field.SetString("REDACTED")
+		}
+	}
+}
+
 // Load reads the configuration from the specified YAML file and populates the Config struct.
+//
+// Every setting is, in order of precedence:
+//
+//  1. The HAFH_* environment variable of the setting (e.g. HAFH_HTTP_API_KEY for http.api_key), or the
+//     contents of the file named by its _FILE variant (e.g. HAFH_HTTP_API_KEY_FILE).
+//  2. The contents of the file named by the _file variant of the setting (e.g. api_key_file).
+//  3. The value of the setting in the file, in which `${NAME}` references to environment variables
+//     are replaced (`${NAME:-default}` if NAME may be unset).
+//  4. The default value of the setting.
+//
+// If the file cannot be opened, the defaults and environment variables are used, and the error is
+// returned with them.
 func Load(path string) (*Config, error) {
 	config := &Config{}
 	defaults.SetDefaults(config)
 
 	file, err := os.Open(path)
 	if err != nil {
+		if err := applyEnv(reflect.ValueOf(config).Elem(), nil); err != nil {
+			return nil, err
+		}
+
 		return config, err
 	}
 
 	defer file.Close()
 
+	var document yaml.Node
 	decoder := yaml.NewDecoder(file)
-	if err := decoder.Decode(config); err != nil {
+	if err := decoder.Decode(&document); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if err := interpolate(&document); err != nil {
+		return nil, err
+	}
+
+	files, err := extractFiles(&document, reflect.TypeOf(*config), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if document.Kind != 0 {
+		if err := document.Decode(config); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := applyFiles(config, files); err != nil {
+		return nil, err
+	} else if err := applyEnv(reflect.ValueOf(config).Elem(), nil); err != nil {
 		return nil, err
 	}
 
@@ -0,0 +1,38 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestString(t *testing.T) {
+	config := load(t, `
+http:
+  api_key: "api-key-secret"
+  oidc:
+    client_id: "hafh"
+    client_secret: "client-secret"
+ngrok:
+  auth_token: "ngrok-secret"
+email:
+  username: "hafh@example.com"
+`)
+
+	s := config.String()
+	for _, secret := range []string{"api-key-secret", "client-secret", "ngrok-secret"} {
+		if strings.Contains(s, secret) {
+			t.Errorf("String() contains the secret %s:\n%s", secret, s)
+		}
+	}
+
+	for _, setting := range []string{"api_key: REDACTED", "client_id: hafh", "username: hafh@example.com", "password: \"\""} {
+		if !strings.Contains(s, setting) {
+			t.Errorf("String() does not contain %s:\n%s", setting, s)
+		}
+	}
+
+	// The configuration itself is not changed.
+	if config.HTTP.APIKey != "api-key-secret" {
+		t.Errorf("http.api_key = %q after String(), want api-key-secret", config.HTTP.APIKey)
+	}
+}
@@ -0,0 +1,281 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// envPrefix is the prefix of the environment variables that override settings, e.g.
+	// HAFH_HTTP_API_KEY for http.api_key.
+	envPrefix = "HAFH_"
+	// fileSuffix is the suffix of the settings (e.g. api_key_file) and environment variables (e.g.
+	// HAFH_HTTP_API_KEY_FILE) that read the value of a setting from a file, e.g. a secret.
+	fileSuffix = "_file"
+)
+
+// interpolate replaces the environment variables referenced as `${NAME}` (or `${NAME:-default}`,
+// to use default if NAME is unset or empty) in every string of the document. `$$` is a literal `$`;
+// any other `$` is left as is.
+func interpolate(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode && node.Tag == "!!str" {
+		value, err := expand(node.Value)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", node.Line, err)
+		}
+
+		// A plain (i.e. unquoted) value is resolved again, e.g. "${PORT}" as a number.
+		if node.Style&(yaml.DoubleQuotedStyle|yaml.SingleQuotedStyle|yaml.LiteralStyle|yaml.FoldedStyle) == 0 {
+			node.Tag = ""
+		}
+
+		node.Value = value
+	}
+
+	for _, child := range node.Content {
+		if err := interpolate(child); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// expand replaces the environment variables referenced in s, see [interpolate].
+func expand(s string) (string, error) {
+	var b strings.Builder
+	for {
+		i := strings.IndexByte(s, '$')
+		if i < 0 || i == len(s)-1 {
+			b.WriteString(s)
+			return b.String(), nil
+		}
+
+		b.WriteString(s[:i])
+		switch s[i+1] {
+		case '$':
+			b.WriteByte('$')
+			s = s[i+2:]
+		case '{':
+			end := strings.IndexByte(s[i:], '}')
+			if end < 0 {
+				return "", fmt.Errorf("unterminated variable reference in %q", s[i:])
+			}
+
+			name, fallback, hasFallback := strings.Cut(s[i+2:i+end], ":-")
+			if name == "" {
+				return "", errors.New("empty variable reference")
+			}
+
+			value, ok := os.LookupEnv(name)
+			if hasFallback && value == "" {
+				value = fallback
+			} else if !ok {
+				return "", fmt.Errorf("environment variable %s is not set", name)
+			}
+
+			b.WriteString(value)
+			s = s[i+end+1:]
+		default:
+			b.WriteByte('$')
+			s = s[i+1:]
+		}
+	}
+}
+
+// fileSetting is a setting whose value is read from a file.
+type fileSetting struct {
+	path []string
+	file string
+}
+
+// extractFiles removes the settings of the document that read another setting from a file (e.g.
+// api_key_file), and returns them. A setting and its file variant cannot both be set.
+func extractFiles(node *yaml.Node, t reflect.Type, path []string) ([]fileSetting, error) {
+	if node.Kind == yaml.DocumentNode {
+		if len(node.Content) == 0 {
+			return nil, nil
+		}
+
+		return extractFiles(node.Content[0], t, path)
+	} else if node.Kind != yaml.MappingNode {
+		return nil, nil
+	}
+
+	var files []fileSetting
+	content := make([]*yaml.Node, 0, len(node.Content))
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+
+		if field, ok := fieldByName(t, key.Value); ok {
+			if field.Type.Kind() == reflect.Struct {
+				nested, err := extractFiles(value, field.Type, append(slices.Clone(path), key.Value))
+				if err != nil {
+					return nil, err
+				}
+
+				files = append(files, nested...)
+			}
+		} else if name, ok := strings.CutSuffix(key.Value, fileSuffix); ok {
+			if field, ok := fieldByName(t, name); ok && field.Type.Kind() != reflect.Struct {
+				settingPath := append(slices.Clone(path), name)
+				if hasKey(node, name) {
+					setting := strings.Join(settingPath, ".")
+					return nil, fmt.Errorf("%s and %s%s cannot both be set", setting, setting, fileSuffix)
+				}
+
+				files = append(files, fileSetting{path: settingPath, file: value.Value})
+				continue
+			}
+		}
+
+		content = append(content, key, value)
+	}
+
+	node.Content = content
+	return files, nil
+}
+
+// applyFiles sets the settings read from files.
+func applyFiles(config *Config, files []fileSetting) error {
+	for _, setting := range files {
+		value, err := readSecret(setting.file)
+		if err != nil {
+			return fmt.Errorf("%s%s: %w", strings.Join(setting.path, "."), fileSuffix, err)
+		}
+
+		if err := set(fieldByPath(config, setting.path), value); err != nil {
+			return fmt.Errorf("%s%s: %w", strings.Join(setting.path, "."), fileSuffix, err)
+		}
+	}
+
+	return nil
+}
+
+// applyEnv overrides every setting for which an environment variable is set: HAFH_ followed by the
+// path of the setting in upper case, with dots replaced by underscores (e.g. HAFH_HTTP_API_KEY), or
+// the same with a _FILE suffix to read the value from a file.
+func applyEnv(v reflect.Value, path []string) error {
+	for i := range v.NumField() {
+		name := yamlName(v.Type().Field(i))
+		if name == "" {
+			continue
+		}
+
+		fieldPath := append(slices.Clone(path), name)
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct {
+			if err := applyEnv(field, fieldPath); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		env := envPrefix + strings.ToUpper(strings.Join(fieldPath, "_"))
+		envFile := env + strings.ToUpper(fileSuffix)
+
+		value, ok := os.LookupEnv(env)
+		file, fromFile := os.LookupEnv(envFile)
+		if ok && fromFile {
+			return fmt.Errorf("%s and %s cannot both be set", env, envFile)
+		} else if fromFile {
+			var err error
+			if value, err = readSecret(file); err != nil {
+				return fmt.Errorf("%s: %w", envFile, err)
+			}
+
+			env, ok = envFile, true
+		}
+
+		if !ok {
+			continue
+		}
+
+		if err := set(field, value); err != nil {
+			return fmt.Errorf("%s: %w", env, err)
+		}
+	}
+
+	return nil
+}
+
+// readSecret reads the value of a setting from a file, without trailing newlines.
+func readSecret(path string) (string, error) {
+	if path == "" {
+		return "", errors.New("file path is empty")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// set sets a field from a string: strings as is, and any other type (e.g. numbers, durations, lists
+// and maps) parsed as YAML, e.g. "[a, b]" for a list.
+func set(field reflect.Value, value string) error {
+	if field.Kind() == reflect.String {
+		field.SetString(value)
+		return nil
+	}
+
+	parsed := reflect.New(field.Type())
+	if err := yaml.Unmarshal([]byte(value), parsed.Interface()); err != nil {
+		return err
+	}
+
+	field.Set(parsed.Elem())
+	return nil
+}
+
+// fieldByName returns the field of a struct type with the given YAML name.
+func fieldByName(t reflect.Type, name string) (reflect.StructField, bool) {
+	for i := range t.NumField() {
+		if yamlName(t.Field(i)) == name {
+			return t.Field(i), true
+		}
+	}
+
+	return reflect.StructField{}, false
+}
+
+// fieldByPath returns the field of the configuration with the given YAML path.
+func fieldByPath(config *Config, path []string) reflect.Value {
+	v := reflect.ValueOf(config).Elem()
+	for _, name := range path {
+		field, _ := fieldByName(v.Type(), name)
+		v = v.FieldByIndex(field.Index)
+	}
+
+	return v
+}
+
+// hasKey returns whether a mapping node has the given key.
+func hasKey(node *yaml.Node, key string) bool {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+// yamlName returns the YAML name of a field, or an empty string if it has none.
+func yamlName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+	if name == "-" {
+		return ""
+	}
+
+	return name
+}
@@ -0,0 +1,160 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeFile writes a file with the given contents to a temporary directory and returns its path.
+func writeFile(t *testing.T, name, contents string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	return path
+}
+
+func TestExpand(t *testing.T) {
+	t.Setenv("HAFH_TEST_DOMAIN", "example.com")
+	t.Setenv("HAFH_TEST_EMPTY", "")
+
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{"no variables", "no variables", false},
+		{"https://${HAFH_TEST_DOMAIN}/callback", "https://example.com/callback", false},
+		{"${HAFH_TEST_UNSET:-fallback}", "fallback", false},
+		{"${HAFH_TEST_EMPTY:-fallback}", "fallback", false},
+		{"${HAFH_TEST_DOMAIN:-fallback}", "example.com", false},
+		{"${HAFH_TEST_EMPTY}", "", false},
+		{"pa$$word $5 $", "pa$word $5 $", false},
+		{"${HAFH_TEST_UNSET}", "", true},
+		{"${HAFH_TEST_DOMAIN", "", true},
+		{"${}", "", true},
+	}
+
+	for _, tt := range tests {
+		got, err := expand(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("expand(%q) = %q, %v, want %q (error: %v)", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestLoadOverrides(t *testing.T) {
+	apiKeyFile := writeFile(t, "api_key", "from-file\n")
+	passwordFile := writeFile(t, "password", "from-env-file\r\n")
+
+	t.Setenv("HAFH_TEST_PORT", "9090")
+	t.Setenv("HAFH_TEST_TOKEN", "token")
+	t.Setenv("HAFH_MQTT_PORT", "1883")
+	t.Setenv("HAFH_EMAIL_TO", "[a@example.com, b@example.com]")
+	t.Setenv("HAFH_EMAIL_PASSWORD_FILE", passwordFile)
+	t.Setenv("HAFH_WEBHOOKS_TIMEOUT", "30s")
+
+	config := load(t, `
+http:
+  port: ${HAFH_TEST_PORT}
+  api_key_file: "`+apiKeyFile+`"
+ngrok:
+  auth_token: "${HAFH_TEST_TOKEN}"
+  domain: "${HAFH_TEST_DOMAIN:-hafh.example.com}"
+mqtt:
+  port: 8883
+email:
+  password: "in-file"
+`)
+
+	if config.HTTP.Port != 9090 {
+		t.Errorf("http.port = %d, want 9090", config.HTTP.Port)
+	}
+	if config.HTTP.APIKey != "from-file" {
+		t.Errorf("http.api_key = %q, want from-file", config.HTTP.APIKey)
+	}
+	if config.Ngrok.AuthToken != "token" || config.Ngrok.Domain != "hafh.example.com" {
+		t.Errorf("ngrok = %+v, want token and hafh.example.com", config.Ngrok)
+	}
+	if config.MQTT.Port != 1883 {
+		t.Errorf("mqtt.port = %d, want 1883", config.MQTT.Port)
+	}
+	if config.Email.Password != "from-env-file" {
+		t.Errorf("email.password = %q, want from-env-file", config.Email.Password)
+	}
+	if !slices.Equal(config.Email.To, []string{"a@example.com", "b@example.com"}) {
+		t.Errorf("email.to = %v, want a@example.com and b@example.com", config.Email.To)
+	}
+	if config.Webhooks.Timeout != 30*time.Second {
+		t.Errorf("webhooks.timeout = %s, want 30s", config.Webhooks.Timeout)
+	}
+}
+
+func TestLoadOverridesErrors(t *testing.T) {
+	apiKeyFile := writeFile(t, "api_key", "secret")
+
+	tests := []struct {
+		name    string
+		config  string
+		env     map[string]string
+		wantErr string
+	}{
+		{"unset variable", "ngrok:\n  domain: ${HAFH_TEST_UNSET}\n", nil, "HAFH_TEST_UNSET is not set"},
+		{"setting and file", "http:\n  api_key: key\n  api_key_file: " + apiKeyFile + "\n", nil,
+			"http.api_key and http.api_key_file cannot both be set"},
+		{"missing file", "http:\n  api_key_file: /nonexistent/api_key\n", nil, "http.api_key_file"},
+		{"variable and file", "", map[string]string{"HAFH_HTTP_API_KEY": "key", "HAFH_HTTP_API_KEY_FILE": apiKeyFile},
+			"HAFH_HTTP_API_KEY and HAFH_HTTP_API_KEY_FILE cannot both be set"},
+		{"invalid variable", "", map[string]string{"HAFH_MQTT_PORT": "not a port"}, "HAFH_MQTT_PORT"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+
+			_, err := Load(writeFile(t, "config.yaml", tt.config))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Load() error = %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadTargetConfig(t *testing.T) {
+	contents, err := os.ReadFile("../../configs/target.yaml")
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+
+	credentials := t.TempDir()
+	for name, secret := range map[string]string{"api_key": "key", "ngrok_auth_token": "token"} {
+		if err := os.WriteFile(filepath.Join(credentials, name), []byte(secret+"\n"), 0o600); err != nil {
+			t.Fatalf("WriteFile() error = %v", err)
+		}
+	}
+
+	t.Setenv("CREDENTIALS_DIRECTORY", credentials)
+	t.Setenv("HAFH_SERVER_NGROK_SUBDOMAIN", "")
+
+	// Build recipes may still substitute the ngrok domain placeholder, rather than set the variable.
+	legacy := strings.ReplaceAll(string(contents), "@@HAFH_SERVER_NGROK_SUBDOMAIN@@", "legacy.ngrok.app")
+	config := load(t, legacy)
+	if config.HTTP.APIKey != "key" || config.Ngrok.AuthToken != "token" || config.Ngrok.Domain != "legacy.ngrok.app" {
+		t.Errorf("substituted target config: api key %q, ngrok %+v, want key, token and legacy.ngrok.app",
+			config.HTTP.APIKey, config.Ngrok)
+	}
+
+	t.Setenv("HAFH_SERVER_NGROK_SUBDOMAIN", "hafh.ngrok.app")
+	if config := load(t, string(contents)); config.Ngrok.Domain != "hafh.ngrok.app" {
+		t.Errorf("target config ngrok.domain = %q, want hafh.ngrok.app", config.Ngrok.Domain)
+	}
+}
@@ -0,0 +1,323 @@
+// Package cron parses schedule expressions and computes when they next occur.
+//
+// Two kinds of expressions are supported:
+//
+//   - Standard five-field cron expressions ("minute hour day-of-month month day-of-week"), with
+//     `*`, lists (`1,15`), ranges (`1-5`), steps (`*/15`, `0-30/10`) and the three-letter names of
+//     months and weekdays, as well as the macros @yearly, @monthly, @weekly, @daily, @midnight and
+//     @hourly. As in most cron implementations, if both the day of month and the day of week are
+//     restricted, a time matches if either matches. Across daylight saving transitions, occurrences
+//     in a skipped hour run when the gap ends, and occurrences in a repeated hour run once (unless
+//     the expression runs every hour).
+//   - Sun-relative expressions, @sunrise and @sunset, optionally followed by an offset such as
+//     "@sunset-30m" or "@sunrise+1h15m". These require a [Location].
+package cron
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule computes the occurrences of a parsed expression.
+type Schedule interface {
+	// Next returns the first occurrence strictly after the given time, or the zero time if there is
+	// none within a reasonable horizon.
+	Next(after time.Time) time.Time
+}
+
+// Location is the geographic position used to compute sunrise and sunset.
+type Location struct {
+	// Latitude in degrees, positive north of the equator.
+	Latitude float64
+	// Longitude in degrees, positive east of Greenwich.
+	Longitude float64
+}
+
+// Parser parses expressions, evaluating them in a time zone and, for sun-relative expressions, at a
+// location.
+type Parser struct {
+	// TimeZone is the time zone expressions are evaluated in, defaulting to [time.Local].
+	TimeZone *time.Location
+	// Location is required for sun-relative expressions.
+	Location *Location
+}
+
+var macros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// Parse parses an expression.
+func (p *Parser) Parse(expression string) (Schedule, error) {
+	tz := p.TimeZone
+	if tz == nil {
+		tz = time.Local
+	}
+
+	expression = strings.TrimSpace(expression)
+	if expanded, ok := macros[strings.ToLower(expression)]; ok {
+		expression = expanded
+	}
+
+	if strings.HasPrefix(expression, "@") {
+		return p.parseSun(expression, tz)
+	}
+
+	fields := strings.Fields(expression)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected 5 fields, got %d", len(fields))
+	}
+
+	s := &cronSchedule{tz: tz}
+	var err error
+	if s.minute, err = parseField(fields[0], bounds{0, 59, nil}); err != nil {
+		return nil, fmt.Errorf("minute: %w", err)
+	}
+	if s.hour, err = parseField(fields[1], bounds{0, 23, nil}); err != nil {
+		return nil, fmt.Errorf("hour: %w", err)
+	}
+	if s.dom, err = parseField(fields[2], bounds{1, 31, nil}); err != nil {
+		return nil, fmt.Errorf("day of month: %w", err)
+	}
+	if s.month, err = parseField(fields[3], bounds{1, 12, monthNames}); err != nil {
+		return nil, fmt.Errorf("month: %w", err)
+	}
+	if s.dow, err = parseField(fields[4], bounds{0, 7, dayNames}); err != nil {
+		return nil, fmt.Errorf("day of week: %w", err)
+	}
+
+	// Both 0 and 7 are Sunday.
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+
+	s.domRestricted = fields[2] != "*"
+	s.dowRestricted = fields[4] != "*"
+	return s, nil
+}
+
+type bounds struct {
+	min, max int
+	names    map[string]int
+}
+
+var monthNames = map[string]int{
+	"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+	"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+}
+
+var dayNames = map[string]int{
+	"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+}
+
+// parseField parses a comma-separated cron field into a bit set of the values it matches.
+func parseField(field string, b bounds) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if rangePart, stepPart, ok := strings.Cut(part, "/"); ok {
+			value, err := strconv.Atoi(stepPart)
+			if err != nil || value <= 0 {
+				return 0, fmt.Errorf("invalid step %q", stepPart)
+			}
+			part, step = rangePart, value
+		}
+
+		var low, high int
+		switch {
+		case part == "*":
+			low, high = b.min, b.max
+		case strings.Contains(part, "-"):
+			from, to, _ := strings.Cut(part, "-")
+			var err error
+			if low, err = parseValue(from, b); err != nil {
+				return 0, err
+			}
+			if high, err = parseValue(to, b); err != nil {
+				return 0, err
+			}
+			if low > high {
+				return 0, fmt.Errorf("invalid range %q", part)
+			}
+		default:
+			value, err := parseValue(part, b)
+			if err != nil {
+				return 0, err
+			}
+			low, high = value, value
+			// "5/15" means every 15 starting at 5.
+			if step > 1 {
+				high = b.max
+			}
+		}
+
+		for v := low; v <= high; v += step {
+			set |= 1 << v
+		}
+	}
+
+	return set, nil
+}
+
+func parseValue(s string, b bounds) (int, error) {
+	if value, ok := b.names[strings.ToLower(s)]; ok {
+		return value, nil
+	}
+
+	value, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", s)
+	} else if value < b.min || value > b.max {
+		return 0, fmt.Errorf("value %d out of range [%d, %d]", value, b.min, b.max)
+	}
+
+	return value, nil
+}
+
+type cronSchedule struct {
+	tz                           *time.Location
+	minute, hour, dom, month     uint64
+	dow                          uint64
+	domRestricted, dowRestricted bool
+}
+
+// allHours is the hour set of a schedule that runs every hour.
+const allHours = 1<<24 - 1
+
+// horizon bounds the search for the next occurrence, e.g. for "0 0 30 2 *" which never occurs.
+const horizon = 5 * 366 * 24 * time.Hour
+
+func (s *cronSchedule) Next(after time.Time) time.Time {
+	t := after.In(s.tz).Truncate(time.Minute).Add(time.Minute)
+	limit := t.Add(horizon)
+
+	for t.Before(limit) {
+		year, month, day := t.Date()
+		var next time.Time
+		switch {
+		case s.month&(1<<uint(month)) == 0:
+			next = time.Date(year, month+1, 1, 0, 0, 0, 0, s.tz)
+		case !s.dayMatches(t):
+			next = time.Date(year, month, day+1, 0, 0, 0, 0, s.tz)
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			next = t.Add(time.Duration(60-t.Minute()) * time.Minute)
+			if s.skipped(t, next) {
+				return next
+			}
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			next = t.Add(time.Minute)
+			if s.skipped(t, next) {
+				return next
+			}
+		case s.hour != allHours && t.Add(-time.Hour).Hour() == t.Hour():
+			// The hour is repeated because daylight saving time ended, and the schedule already
+			// ran during its first pass.
+			next = t.Add(time.Duration(60-t.Minute()) * time.Minute)
+		default:
+			return t
+		}
+
+		// A local time that falls into a daylight saving gap may be normalized to an earlier
+		// instant, so always make progress.
+		if !next.After(t) {
+			next = t.Add(time.Hour)
+		}
+		t = next
+	}
+
+	return time.Time{}
+}
+
+// skipped reports whether the clock jumped from t to next, on the same day, over an hour the schedule
+// matches, i.e. whether daylight saving time started during a matching hour. Such occurrences run
+// at the end of the gap rather than not at all.
+func (s *cronSchedule) skipped(t, next time.Time) bool {
+	if next.YearDay() != t.YearDay() || next.Hour() <= t.Hour()+1 {
+		return false
+	}
+
+	gap := uint64(1)<<uint(next.Hour()) - uint64(1)<<uint(t.Hour()+1)
+	return s.hour&gap != 0
+}
+
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	domMatch := s.dom&(1<<uint(t.Day())) != 0
+	dowMatch := s.dow&(1<<uint(t.Weekday())) != 0
+
+	if s.domRestricted && s.dowRestricted {
+		return domMatch || dowMatch
+	}
+
+	return domMatch && dowMatch
+}
+
+func (p *Parser) parseSun(expression string, tz *time.Location) (Schedule, error) {
+	name, offset := expression, ""
+	if i := strings.IndexAny(expression, "+-"); i > 0 {
+		name, offset = strings.TrimSpace(expression[:i]), strings.ReplaceAll(expression[i:], " ", "")
+	}
+
+	s := &sunSchedule{tz: tz}
+	switch strings.ToLower(name) {
+	case "@sunrise":
+		s.sunset = false
+	case "@sunset":
+		s.sunset = true
+	default:
+		return nil, fmt.Errorf("unknown expression %q", expression)
+	}
+
+	if offset != "" {
+		d, err := time.ParseDuration(offset)
+		if err != nil {
+			return nil, fmt.Errorf("invalid offset %q", offset)
+		}
+		s.offset = d
+	}
+
+	if p.Location == nil {
+		return nil, errors.New(name + " requires a location")
+	}
+
+	s.location = *p.Location
+	return s, nil
+}
+
+type sunSchedule struct {
+	tz       *time.Location
+	location Location
+	sunset   bool
+	offset   time.Duration
+}
+
+func (s *sunSchedule) Next(after time.Time) time.Time {
+	local := after.In(s.tz)
+
+	// Start a day early in case a negative offset moves tomorrow's event before midnight.
+	for i := -1; i <= 366; i++ {
+		date := time.Date(local.Year(), local.Month(), local.Day()+i, 12, 0, 0, 0, s.tz)
+		sunrise, sunset, ok := SunTimes(date, s.location)
+		if !ok {
+			continue
+		}
+
+		event := sunrise
+		if s.sunset {
+			event = sunset
+		}
+
+		if t := event.Add(s.offset).Truncate(time.Minute); t.After(after) {
+			return t.In(s.tz)
+		}
+	}
+
+	return time.Time{}
+}
@@ -0,0 +1,255 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func mustLoadLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+
+	tz, err := time.LoadLocation(name)
+	if err != nil {
+		t.Skipf("time zone %s is not available: %v", name, err)
+	}
+
+	return tz
+}
+
+func TestParseErrors(t *testing.T) {
+	parser := &Parser{TimeZone: time.UTC}
+
+	tests := []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"*/-1 * * * *",
+		"a * * * *",
+		"1,,2 * * * *",
+		"* * * foo *",
+		"@sometimes",
+		"@sunrise",
+		"@sunset+soon",
+	}
+
+	for _, expression := range tests {
+		if _, err := parser.Parse(expression); err == nil {
+			t.Errorf("Parse(%q) error = nil, want an error", expression)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	// 2024-01-01 is a Monday.
+	after := time.Date(2024, 1, 1, 10, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		expression string
+		after      time.Time
+		want       time.Time
+	}{
+		{"* * * * *", after, time.Date(2024, 1, 1, 10, 31, 0, 0, time.UTC)},
+		// Seconds are ignored, and the next occurrence is strictly after the given time.
+		{"* * * * *", after.Add(59 * time.Second), time.Date(2024, 1, 1, 10, 31, 0, 0, time.UTC)},
+		{"30 10 * * *", after, time.Date(2024, 1, 2, 10, 30, 0, 0, time.UTC)},
+		{"*/15 * * * *", after, time.Date(2024, 1, 1, 10, 45, 0, 0, time.UTC)},
+		{"5/20 * * * *", after, time.Date(2024, 1, 1, 10, 45, 0, 0, time.UTC)},
+		{"0-30/10 * * * *", after, time.Date(2024, 1, 1, 11, 0, 0, 0, time.UTC)},
+		{"0 9-17/4 * * *", after, time.Date(2024, 1, 1, 13, 0, 0, 0, time.UTC)},
+		{"0 8,20 * * *", after, time.Date(2024, 1, 1, 20, 0, 0, 0, time.UTC)},
+		{"0 0 * * fri", after, time.Date(2024, 1, 5, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * SUN", after, time.Date(2024, 1, 7, 0, 0, 0, 0, time.UTC)},
+		// Both 0 and 7 are Sunday.
+		{"0 0 * * 7", after, time.Date(2024, 1, 7, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * mon-fri", after, time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 jun *", after, time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 * *", time.Date(2024, 1, 31, 12, 0, 0, 0, time.UTC), time.Date(2024, 3, 31, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", after, time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// If both the day of month and the day of week are restricted, either may match.
+		{"0 0 15 * fri", after, time.Date(2024, 1, 5, 0, 0, 0, 0, time.UTC)},
+		{"0 0 3 * fri", after, time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC)},
+		{"59 23 31 12 *", after, time.Date(2024, 12, 31, 23, 59, 0, 0, time.UTC)},
+		{"0 0 1 1 *", time.Date(2024, 12, 31, 23, 59, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", after, time.Date(2024, 1, 1, 11, 0, 0, 0, time.UTC)},
+		{"@daily", after, time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{"@weekly", after, time.Date(2024, 1, 7, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", after, time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"@YEARLY", after, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"  0 12 * * *  ", after, time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)},
+		// February 30 never occurs.
+		{"0 0 30 2 *", after, time.Time{}},
+	}
+
+	parser := &Parser{TimeZone: time.UTC}
+	for _, tt := range tests {
+		schedule, err := parser.Parse(tt.expression)
+		if err != nil {
+			t.Errorf("Parse(%q) error = %v", tt.expression, err)
+			continue
+		}
+
+		if got := schedule.Next(tt.after); !got.Equal(tt.want) {
+			t.Errorf("Parse(%q).Next(%v) = %v, want %v", tt.expression, tt.after, got, tt.want)
+		}
+	}
+}
+
+func TestNextTimeZone(t *testing.T) {
+	tz := mustLoadLocation(t, "America/New_York")
+	schedule, err := (&Parser{TimeZone: tz}).Parse("0 9 * * *")
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+
+	got := schedule.Next(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	if want := time.Date(2024, 1, 1, 14, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("Next() = %v, want %v", got, want)
+	}
+}
+
+func TestNextDaylightSaving(t *testing.T) {
+	// In 2024, daylight saving time in Berlin started on March 31 at 02:00, when clocks jumped to
+	// 03:00, and ended on October 27 at 03:00, when clocks went back to 02:00.
+	tz := mustLoadLocation(t, "Europe/Berlin")
+	parser := &Parser{TimeZone: tz}
+
+	occurrences := func(expression string, from time.Time, n int) []time.Time {
+		t.Helper()
+
+		schedule, err := parser.Parse(expression)
+		if err != nil {
+			t.Fatalf("Parse(%q) error = %v", expression, err)
+		}
+
+		var times []time.Time
+		for t := from; len(times) < n; {
+			t = schedule.Next(t)
+			times = append(times, t)
+		}
+
+		return times
+	}
+
+	cet := time.FixedZone("CET", 3600)
+	cest := time.FixedZone("CEST", 2*3600)
+
+	tests := []struct {
+		expression string
+		from       time.Time
+		want       []time.Time
+	}{{
+		// An occurrence in the skipped hour runs when the gap ends.
+		expression: "30 2 * * *",
+		from:       time.Date(2024, 3, 30, 12, 0, 0, 0, cet),
+		want: []time.Time{
+			time.Date(2024, 3, 31, 3, 0, 0, 0, cest),
+			time.Date(2024, 4, 1, 2, 30, 0, 0, cest),
+		},
+	}, {
+		expression: "*/20 2 * * *",
+		from:       time.Date(2024, 3, 31, 0, 0, 0, 0, cet),
+		want: []time.Time{
+			time.Date(2024, 3, 31, 3, 0, 0, 0, cest),
+			time.Date(2024, 4, 1, 2, 0, 0, 0, cest),
+		},
+	}, {
+		// An occurrence in the repeated hour runs once.
+		expression: "30 2 * * *",
+		from:       time.Date(2024, 10, 26, 12, 0, 0, 0, cest),
+		want: []time.Time{
+			time.Date(2024, 10, 27, 2, 30, 0, 0, cest),
+			time.Date(2024, 10, 28, 2, 30, 0, 0, cet),
+		},
+	}, {
+		// Schedules that run every hour run in both passes of the repeated hour.
+		expression: "30 * * * *",
+		from:       time.Date(2024, 10, 27, 1, 0, 0, 0, cest),
+		want: []time.Time{
+			time.Date(2024, 10, 27, 1, 30, 0, 0, cest),
+			time.Date(2024, 10, 27, 2, 30, 0, 0, cest),
+			time.Date(2024, 10, 27, 2, 30, 0, 0, cet),
+			time.Date(2024, 10, 27, 3, 30, 0, 0, cet),
+		},
+	}, {
+		expression: "0 * * * *",
+		from:       time.Date(2024, 3, 31, 0, 30, 0, 0, cet),
+		want: []time.Time{
+			time.Date(2024, 3, 31, 1, 0, 0, 0, cet),
+			time.Date(2024, 3, 31, 3, 0, 0, 0, cest),
+			time.Date(2024, 3, 31, 4, 0, 0, 0, cest),
+		},
+	}}
+
+	for _, tt := range tests {
+		got := occurrences(tt.expression, tt.from, len(tt.want))
+		for i := range tt.want {
+			if !got[i].Equal(tt.want[i]) {
+				t.Errorf("%q: occurrence %d after %v = %v, want %v", tt.expression, i, tt.from, got[i], tt.want[i])
+			}
+		}
+	}
+}
+
+func TestSun(t *testing.T) {
+	tz := mustLoadLocation(t, "Europe/London")
+	greenwich := &Location{Latitude: 51.4769, Longitude: 0}
+	parser := &Parser{TimeZone: tz, Location: greenwich}
+	after := time.Date(2024, 6, 21, 0, 0, 0, 0, tz)
+
+	tests := []struct {
+		expression string
+		want       time.Time
+	}{
+		// On the summer solstice, the sun rises at 04:43 and sets at 21:21 in Greenwich.
+		{"@sunrise", time.Date(2024, 6, 21, 4, 43, 0, 0, tz)},
+		{"@sunset", time.Date(2024, 6, 21, 21, 21, 0, 0, tz)},
+		{"@sunset-30m", time.Date(2024, 6, 21, 20, 51, 0, 0, tz)},
+		{"@sunrise + 1h15m", time.Date(2024, 6, 21, 5, 58, 0, 0, tz)},
+		// A negative offset may move the next day's event before midnight.
+		{"@sunrise-5h", time.Date(2024, 6, 21, 23, 44, 0, 0, tz)},
+	}
+
+	for _, tt := range tests {
+		schedule, err := parser.Parse(tt.expression)
+		if err != nil {
+			t.Errorf("Parse(%q) error = %v", tt.expression, err)
+			continue
+		}
+
+		got := schedule.Next(after)
+		if diff := got.Sub(tt.want).Abs(); diff > 3*time.Minute {
+			t.Errorf("Parse(%q).Next(%v) = %v, want %v", tt.expression, after, got, tt.want)
+		}
+
+		if again := schedule.Next(got); !again.After(got.Add(23 * time.Hour)) {
+			t.Errorf("Parse(%q).Next(%v) = %v, want the next day's event", tt.expression, got, again)
+		}
+	}
+}
+
+func TestSunPolar(t *testing.T) {
+	tromso := Location{Latitude: 69.65, Longitude: 18.96}
+	if _, _, ok := SunTimes(time.Date(2024, 6, 21, 12, 0, 0, 0, time.UTC), tromso); ok {
+		t.Error("SunTimes() on the summer solstice in Tromsø ok = true, want false")
+	}
+
+	schedule, err := (&Parser{TimeZone: time.UTC, Location: &tromso}).Parse("@sunset")
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+
+	// The midnight sun lasts until late July.
+	got := schedule.Next(time.Date(2024, 6, 21, 0, 0, 0, 0, time.UTC))
+	if got.Before(time.Date(2024, 7, 20, 0, 0, 0, 0, time.UTC)) || got.After(time.Date(2024, 8, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Next() = %v, want the end of the midnight sun", got)
+	}
+}
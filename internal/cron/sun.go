@@ -0,0 +1,50 @@
+package cron
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	julianUnixEpoch = 2440587.5
+	julian2000      = 2451545.0
+	degrees         = math.Pi / 180
+)
+
+// SunTimes returns the sunrise and sunset on the (local) date of the given time at a location, using
+// the sunrise equation. It returns false if the sun does not rise or set on that day (polar day or
+// night). The results are accurate to within a minute or two.
+func SunTimes(date time.Time, location Location) (time.Time, time.Time, bool) {
+	// Use the local noon of the date so that the result belongs to the right day.
+	noon := time.Date(date.Year(), date.Month(), date.Day(), 12, 0, 0, 0, date.Location())
+	julianDay := float64(noon.Unix())/86400 + julianUnixEpoch
+
+	n := math.Round(julianDay - julian2000 - 0.0008 + location.Longitude/360)
+	meanSolarTime := n - location.Longitude/360
+
+	anomaly := math.Mod(357.5291+0.98560028*meanSolarTime, 360)
+	center := 1.9148*math.Sin(anomaly*degrees) + 0.02*math.Sin(2*anomaly*degrees) +
+		0.0003*math.Sin(3*anomaly*degrees)
+	longitude := math.Mod(anomaly+center+180+102.9372, 360)
+
+	transit := julian2000 + meanSolarTime + 0.0053*math.Sin(anomaly*degrees) -
+		0.0069*math.Sin(2*longitude*degrees)
+	declination := math.Asin(math.Sin(longitude*degrees) * math.Sin(23.4397*degrees))
+
+	latitude := location.Latitude * degrees
+	cosHourAngle := (math.Sin(-0.833*degrees) - math.Sin(latitude)*math.Sin(declination)) /
+		(math.Cos(latitude) * math.Cos(declination))
+	if cosHourAngle < -1 || cosHourAngle > 1 {
+		return time.Time{}, time.Time{}, false
+	}
+
+	hourAngle := math.Acos(cosHourAngle) / degrees
+	sunrise := julianToTime(transit-hourAngle/360, date.Location())
+	sunset := julianToTime(transit+hourAngle/360, date.Location())
+	return sunrise, sunset, true
+}
+
+func julianToTime(julianDay float64, location *time.Location) time.Time {
+	seconds := (julianDay - julianUnixEpoch) * 86400
+	return time.Unix(int64(seconds), 0).In(location)
+}
@@ -0,0 +1,456 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// ErrAlertRuleNotFound is returned when an operation targets an alert rule that does not exist.
+var ErrAlertRuleNotFound = errors.New("alert rule not found")
+
+// Comparison is the operator an alert rule uses to compare a reading value against its threshold.
+type Comparison string
+
+const (
+	ComparisonGreater        Comparison = ">"
+	ComparisonGreaterOrEqual Comparison = ">="
+	ComparisonLess           Comparison = "<"
+	ComparisonLessOrEqual    Comparison = "<="
+	ComparisonEqual          Comparison = "=="
+	ComparisonNotEqual       Comparison = "!="
+)
+
+// Compare returns true if `value <comparison> threshold` holds.
+func (c Comparison) Compare(value, threshold float64) bool {
+	switch c {
+	case ComparisonGreater:
+		return value > threshold
+	case ComparisonGreaterOrEqual:
+		return value >= threshold
+	case ComparisonLess:
+		return value < threshold
+	case ComparisonLessOrEqual:
+		return value <= threshold
+	case ComparisonEqual:
+		return value == threshold
+	case ComparisonNotEqual:
+		return value != threshold
+	default:
+		return false
+	}
+}
+
+// IsValid returns true if the comparison is one of the supported operators.
+func (c Comparison) IsValid() bool {
+	switch c {
+	case ComparisonGreater, ComparisonGreaterOrEqual, ComparisonLess, ComparisonLessOrEqual,
+		ComparisonEqual, ComparisonNotEqual:
+		return true
+	default:
+		return false
+	}
+}
+
+// AlertRule is a threshold rule evaluated against every ingested reading.
+//
+// A rule applies to the peripheral with SerialNumber, to every peripheral with Tag, or to every
+// peripheral if neither is set. It fires once `Data[Field] <Comparison> Threshold` has held for at
+// least DurationSeconds, and resolves once the value has moved back past the threshold by more than
+// Hysteresis.
+type AlertRule struct {
+	ID              int64      `json:"id"`
+	Name            string     `json:"name"`
+	SerialNumber    string     `json:"serial_number"`
+	Tag             string     `json:"tag"`
+	Field           string     `json:"field"`
+	Comparison      Comparison `json:"comparison"`
+	Threshold       float64    `json:"threshold"`
+	DurationSeconds int64      `json:"duration_seconds"`
+	Hysteresis      float64    `json:"hysteresis"`
+	Enabled         bool       `json:"enabled"`
+	CreatedAt       time.Time  `json:"created_at"`
+}
+
+// Duration returns how long the rule's condition must hold before it fires.
+func (r *AlertRule) Duration() time.Duration {
+	return time.Duration(r.DurationSeconds) * time.Second
+}
+
+// Validate checks that the alert rule is well-formed.
+func (r *AlertRule) Validate() error {
+	if r.Name == "" {
+		return errors.New("name is required")
+	} else if r.Field == "" {
+		return errors.New("field is required")
+	} else if !r.Comparison.IsValid() {
+		return errors.New("invalid comparison: " + string(r.Comparison))
+	} else if r.DurationSeconds < 0 {
+		return errors.New("duration must not be negative")
+	} else if r.Hysteresis < 0 {
+		return errors.New("hysteresis must not be negative")
+	}
+
+	return nil
+}
+
+// Matches returns true if the rule applies to the given peripheral.
+func (r *AlertRule) Matches(p *Peripheral) bool {
+	if r.SerialNumber != "" && r.SerialNumber != p.SerialNumber {
+		return false
+	}
+
+	if r.Tag != "" {
+		for _, tag := range p.Tags {
+			if tag == r.Tag {
+				return true
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
+// AlertState is the state of an alert event.
+type AlertState string
+
+const (
+	AlertStateFiring   AlertState = "firing"
+	AlertStateResolved AlertState = "resolved"
+)
+
+// Alert is an alert event produced when an alert rule fires for a peripheral.
+type Alert struct {
+	ID            int64      `json:"id"`
+	RuleID        int64      `json:"rule_id"`
+	RuleName      string     `json:"rule_name"`
+	SerialNumber  string     `json:"serial_number"`
+	State         AlertState `json:"state"`
+	Value         float64    `json:"value"`
+	FiredAt       time.Time  `json:"fired_at"`
+	ResolvedAt    *time.Time `json:"resolved_at"`
+	ResolvedValue *float64   `json:"resolved_value"`
+}
+
+// AlertFilter narrows down the alerts returned by [Database.FindAlerts]. Zero-valued fields are
+// ignored.
+type AlertFilter struct {
+	State        AlertState
+	RuleID       int64
+	SerialNumber string
+	Limit        uint32
+}
+
+func (d *Database) initAlertsSchema() error {
+	rulesTable := `
+	CREATE TABLE IF NOT EXISTS alert_rules (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		serial_number TEXT NOT NULL DEFAULT '',
+		tag TEXT NOT NULL DEFAULT '',
+		field TEXT NOT NULL,
+		comparison TEXT NOT NULL,
+		threshold REAL NOT NULL,
+		duration_seconds INTEGER NOT NULL DEFAULT 0,
+		hysteresis REAL NOT NULL DEFAULT 0,
+		enabled INTEGER NOT NULL DEFAULT 1,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);`
+
+	alertsTable := `
+	CREATE TABLE IF NOT EXISTS alerts (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		rule_id INTEGER NOT NULL,
+		serial_number TEXT NOT NULL,
+		state TEXT NOT NULL,
+		value REAL NOT NULL,
+		fired_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		resolved_at TIMESTAMP,
+		resolved_value REAL,
+		FOREIGN KEY(rule_id) REFERENCES alert_rules(id) ON DELETE CASCADE,
+		FOREIGN KEY(serial_number) REFERENCES peripherals(serial_number) ON DELETE CASCADE
+	);`
+
+	for _, table := range []string{rulesTable, alertsTable} {
+		if _, err := d.db.Exec(table); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+const alertRuleColumns = `id, name, serial_number, tag, field, comparison, threshold, duration_seconds,
+	hysteresis, enabled, created_at`
+
+func scanAlertRule(row rowScanner) (*AlertRule, error) {
+	var r AlertRule
+	if err := row.Scan(&r.ID, &r.Name, &r.SerialNumber, &r.Tag, &r.Field, &r.Comparison,
+		&r.Threshold, &r.DurationSeconds, &r.Hysteresis, &r.Enabled, &r.CreatedAt); err != nil {
+		return nil, err
+	}
+
+	return &r, nil
+}
+
+// AddAlertRule adds a new alert rule, populating its ID on success.
+func (d *Database) AddAlertRule(r *AlertRule) error {
+	if err := r.Validate(); err != nil {
+		return err
+	}
+
+	result, err := d.db.Exec(
+		`INSERT INTO alert_rules
+		 (name, serial_number, tag, field, comparison, threshold, duration_seconds, hysteresis, enabled)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		r.Name, r.SerialNumber, r.Tag, r.Field, r.Comparison, r.Threshold, r.DurationSeconds,
+		r.Hysteresis, r.Enabled,
+	)
+	if err != nil {
+		return err
+	}
+
+	r.ID, err = result.LastInsertId()
+	return err
+}
+
+// UpdateAlertRule updates an existing alert rule.
+func (d *Database) UpdateAlertRule(r *AlertRule) error {
+	if err := r.Validate(); err != nil {
+		return err
+	}
+
+	result, err := d.db.Exec(
+		`UPDATE alert_rules SET name = ?, serial_number = ?, tag = ?, field = ?, comparison = ?,
+		 threshold = ?, duration_seconds = ?, hysteresis = ?, enabled = ? WHERE id = ?`,
+		r.Name, r.SerialNumber, r.Tag, r.Field, r.Comparison, r.Threshold, r.DurationSeconds,
+		r.Hysteresis, r.Enabled, r.ID,
+	)
+	if err != nil {
+		return err
+	}
+
+	return requireRowsAffected(result, ErrAlertRuleNotFound)
+}
+
+// DeleteAlertRule deletes an alert rule along with its alerts.
+func (d *Database) DeleteAlertRule(id int64) error {
+	result, err := d.db.Exec(`DELETE FROM alert_rules WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+
+	return requireRowsAffected(result, ErrAlertRuleNotFound)
+}
+
+// GetAlertRule retrieves an alert rule by its ID, returning nil if it does not exist.
+func (d *Database) GetAlertRule(id int64) (*AlertRule, error) {
+	row := d.db.QueryRow(`SELECT `+alertRuleColumns+` FROM alert_rules WHERE id = ?`, id)
+
+	r, err := scanAlertRule(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return r, err
+}
+
+// GetAlertRules retrieves all alert rules. If enabledOnly is true, disabled rules are excluded.
+func (d *Database) GetAlertRules(enabledOnly bool) ([]AlertRule, error) {
+	query := `SELECT ` + alertRuleColumns + ` FROM alert_rules`
+	if enabledOnly {
+		query += ` WHERE enabled = 1`
+	}
+
+	rows, err := d.db.Query(query + ` ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	rules := []AlertRule{}
+	for rows.Next() {
+		r, err := scanAlertRule(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		rules = append(rules, *r)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+const alertColumns = `a.id, a.rule_id, r.name, a.serial_number, a.state, a.value, a.fired_at,
+	a.resolved_at, a.resolved_value`
+
+func scanAlert(row rowScanner) (*Alert, error) {
+	var a Alert
+	var resolvedAt sql.NullTime
+	var resolvedValue sql.NullFloat64
+	if err := row.Scan(&a.ID, &a.RuleID, &a.RuleName, &a.SerialNumber, &a.State, &a.Value,
+		&a.FiredAt, &resolvedAt, &resolvedValue); err != nil {
+		return nil, err
+	}
+
+	if resolvedAt.Valid {
+		a.ResolvedAt = &resolvedAt.Time
+	}
+
+	if resolvedValue.Valid {
+		a.ResolvedValue = &resolvedValue.Float64
+	}
+
+	return &a, nil
+}
+
+// FireAlert records a new firing alert for the given rule and peripheral.
+func (d *Database) FireAlert(rule *AlertRule, serial string, value float64) (*Alert, error) {
+	result, err := d.db.Exec(
+		`INSERT INTO alerts (rule_id, serial_number, state, value) VALUES (?, ?, ?, ?)`,
+		rule.ID, serial, AlertStateFiring, value,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	return d.getAlert(id)
+}
+
+// ResolveAlert marks a firing alert as resolved.
+func (d *Database) ResolveAlert(id int64, value float64) (*Alert, error) {
+	if _, err := d.db.Exec(
+		`UPDATE alerts SET state = ?, resolved_at = CURRENT_TIMESTAMP, resolved_value = ?
+		 WHERE id = ? AND state = ?`,
+		AlertStateResolved, value, id, AlertStateFiring,
+	); err != nil {
+		return nil, err
+	}
+
+	return d.getAlert(id)
+}
+
+// ResolveRuleAlerts marks every firing alert of a rule as resolved, without a resolved value, and
+// returns them. This is used when the rule is edited or disabled while firing.
+func (d *Database) ResolveRuleAlerts(ruleID int64) ([]Alert, error) {
+	firing, err := d.FindAlerts(AlertFilter{State: AlertStateFiring, RuleID: ruleID})
+	if err != nil || len(firing) == 0 {
+		return nil, err
+	}
+
+	if _, err := d.db.Exec(
+		`UPDATE alerts SET state = ?, resolved_at = CURRENT_TIMESTAMP WHERE rule_id = ? AND state = ?`,
+		AlertStateResolved, ruleID, AlertStateFiring,
+	); err != nil {
+		return nil, err
+	}
+
+	resolved := make([]Alert, 0, len(firing))
+	for _, a := range firing {
+		alert, err := d.getAlert(a.ID)
+		if err != nil {
+			return nil, err
+		} else if alert != nil {
+			resolved = append(resolved, *alert)
+		}
+	}
+
+	return resolved, nil
+}
+
+func (d *Database) getAlert(id int64) (*Alert, error) {
+	row := d.db.QueryRow(
+		`SELECT `+alertColumns+` FROM alerts a JOIN alert_rules r ON r.id = a.rule_id WHERE a.id = ?`,
+		id,
+	)
+
+	a, err := scanAlert(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return a, err
+}
+
+// GetFiringAlert retrieves the firing alert for the given rule and peripheral, returning nil if
+// there is none.
+func (d *Database) GetFiringAlert(ruleID int64, serial string) (*Alert, error) {
+	alerts, err := d.FindAlerts(AlertFilter{
+		State:        AlertStateFiring,
+		RuleID:       ruleID,
+		SerialNumber: serial,
+		Limit:        1,
+	})
+	if err != nil || len(alerts) == 0 {
+		return nil, err
+	}
+
+	return &alerts[0], nil
+}
+
+// FindAlerts retrieves the alerts matching the given filter, most recent first.
+func (d *Database) FindAlerts(filter AlertFilter) ([]Alert, error) {
+	var conditions []string
+	var args []any
+
+	if filter.State != "" {
+		conditions = append(conditions, `a.state = ?`)
+		args = append(args, filter.State)
+	}
+
+	if filter.RuleID != 0 {
+		conditions = append(conditions, `a.rule_id = ?`)
+		args = append(args, filter.RuleID)
+	}
+
+	if filter.SerialNumber != "" {
+		conditions = append(conditions, `a.serial_number = ?`)
+		args = append(args, filter.SerialNumber)
+	}
+
+	query := `SELECT ` + alertColumns + ` FROM alerts a JOIN alert_rules r ON r.id = a.rule_id`
+	if len(conditions) > 0 {
+		query += ` WHERE ` + strings.Join(conditions, ` AND `)
+	}
+
+	query += ` ORDER BY a.fired_at DESC, a.id DESC`
+	if filter.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, filter.Limit)
+	}
+
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	alerts := []Alert{}
+	for rows.Next() {
+		a, err := scanAlert(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		alerts = append(alerts, *a)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return alerts, nil
+}
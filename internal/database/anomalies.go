@@ -0,0 +1,182 @@
+package database
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// AnomalyKind is the kind of problem an anomaly detector found with a peripheral's readings.
+type AnomalyKind string
+
+const (
+	// AnomalyFlatline is a field reporting the exact same value for too long, e.g. a stuck sensor.
+	AnomalyFlatline AnomalyKind = "flatline"
+	// AnomalySpike is a sudden jump of a field far outside its usual variation.
+	AnomalySpike AnomalyKind = "spike"
+	// AnomalyOutOfRange is a field outside the min/max of its field definition.
+	AnomalyOutOfRange AnomalyKind = "out_of_range"
+	// AnomalyRateDrop is a peripheral reporting far less often than usual. It has no field.
+	AnomalyRateDrop AnomalyKind = "rate_drop"
+)
+
+// IsValid returns true if the kind is one of the known anomaly kinds.
+func (k AnomalyKind) IsValid() bool {
+	switch k {
+	case AnomalyFlatline, AnomalySpike, AnomalyOutOfRange, AnomalyRateDrop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Anomaly is a finding of the anomaly detector. It is open until the condition clears, at which
+// point ResolvedAt is set.
+type Anomaly struct {
+	ID           int64       `json:"id"`
+	SerialNumber string      `json:"serial_number"`
+	Field        string      `json:"field"`
+	Kind         AnomalyKind `json:"kind"`
+	Value        *float64    `json:"value"`
+	Message      string      `json:"message"`
+	DetectedAt   time.Time   `json:"detected_at"`
+	ResolvedAt   *time.Time  `json:"resolved_at"`
+}
+
+// AnomalyFilter narrows down the anomalies returned by [Database.FindAnomalies]. Zero-valued fields
+// are ignored.
+type AnomalyFilter struct {
+	SerialNumber string
+	Kind         AnomalyKind
+	// Open filters anomalies by whether they have been resolved.
+	Open  *bool
+	Limit uint32
+}
+
+func (d *Database) initAnomaliesSchema() error {
+	anomaliesTable := `
+	CREATE TABLE IF NOT EXISTS anomalies (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		serial_number TEXT NOT NULL,
+		field TEXT NOT NULL DEFAULT '',
+		kind TEXT NOT NULL,
+		value REAL,
+		message TEXT NOT NULL DEFAULT '',
+		detected_at TIMESTAMP NOT NULL,
+		resolved_at TIMESTAMP,
+		FOREIGN KEY(serial_number) REFERENCES peripherals(serial_number) ON DELETE CASCADE
+	);`
+
+	_, err := d.db.Exec(anomaliesTable)
+	return err
+}
+
+const anomalyColumns = `id, serial_number, field, kind, value, message, detected_at, resolved_at`
+
+func scanAnomaly(row rowScanner) (*Anomaly, error) {
+	var a Anomaly
+	var value sql.NullFloat64
+	var resolvedAt sql.NullTime
+	if err := row.Scan(&a.ID, &a.SerialNumber, &a.Field, &a.Kind, &value, &a.Message,
+		&a.DetectedAt, &resolvedAt); err != nil {
+		return nil, err
+	}
+
+	if value.Valid {
+		a.Value = &value.Float64
+	}
+
+	if resolvedAt.Valid {
+		a.ResolvedAt = &resolvedAt.Time
+	}
+
+	return &a, nil
+}
+
+// AddAnomaly records a new, open anomaly, populating its ID on success.
+func (d *Database) AddAnomaly(a *Anomaly) error {
+	if a.DetectedAt.IsZero() {
+		a.DetectedAt = time.Now()
+	}
+
+	result, err := d.db.Exec(
+		`INSERT INTO anomalies (serial_number, field, kind, value, message, detected_at)
+		 VALUES (?, ?, ?, ?, ?, ?)`,
+		a.SerialNumber, a.Field, a.Kind, a.Value, a.Message,
+		a.DetectedAt.UTC().Format(sqliteTimestampLayout),
+	)
+	if err != nil {
+		return err
+	}
+
+	a.ID, err = result.LastInsertId()
+	return err
+}
+
+// ResolveAnomaly marks an open anomaly as resolved at the given time.
+func (d *Database) ResolveAnomaly(id int64, at time.Time) error {
+	_, err := d.db.Exec(
+		`UPDATE anomalies SET resolved_at = ? WHERE id = ? AND resolved_at IS NULL`,
+		at.UTC().Format(sqliteTimestampLayout), id,
+	)
+
+	return err
+}
+
+// FindAnomalies retrieves the anomalies matching the given filter, most recent first.
+func (d *Database) FindAnomalies(filter AnomalyFilter) ([]Anomaly, error) {
+	var conditions []string
+	var args []any
+
+	if filter.SerialNumber != "" {
+		conditions = append(conditions, `serial_number = ?`)
+		args = append(args, filter.SerialNumber)
+	}
+
+	if filter.Kind != "" {
+		conditions = append(conditions, `kind = ?`)
+		args = append(args, filter.Kind)
+	}
+
+	if filter.Open != nil {
+		if *filter.Open {
+			conditions = append(conditions, `resolved_at IS NULL`)
+		} else {
+			conditions = append(conditions, `resolved_at IS NOT NULL`)
+		}
+	}
+
+	query := `SELECT ` + anomalyColumns + ` FROM anomalies`
+	if len(conditions) > 0 {
+		query += ` WHERE ` + strings.Join(conditions, ` AND `)
+	}
+
+	query += ` ORDER BY detected_at DESC, id DESC`
+	if filter.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, filter.Limit)
+	}
+
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	anomalies := []Anomaly{}
+	for rows.Next() {
+		a, err := scanAnomaly(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		anomalies = append(anomalies, *a)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return anomalies, nil
+}
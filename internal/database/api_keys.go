@@ -0,0 +1,218 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// ErrAPIKeyNotFound is returned when an operation targets an API key that does not exist.
+var ErrAPIKeyNotFound = errors.New("API key not found")
+
+// Scope is a permission granted to an API key.
+type Scope string
+
+const (
+	// ScopeReadReadings allows querying readings, reading peripherals and the rest of the API's
+	// state, and streaming live data.
+	ScopeReadReadings Scope = "readings:read"
+	// ScopeWritePeripherals allows managing peripherals, rooms, types, calibrations and virtual
+	// peripherals. Readings are reported over MQTT, not through the API.
+	ScopeWritePeripherals Scope = "peripherals:write"
+	// ScopeSendCommands allows sending commands to actuators.
+	ScopeSendCommands Scope = "commands:send"
+	// ScopeAdmin allows everything, including managing API keys and server configuration such as
+	// alert rules, webhooks, automations and schedules.
+	ScopeAdmin Scope = "admin"
+)
+
+// IsValid returns true if the scope is one of the known scopes.
+func (s Scope) IsValid() bool {
+	switch s {
+	case ScopeReadReadings, ScopeWritePeripherals, ScopeSendCommands, ScopeAdmin:
+		return true
+	default:
+		return false
+	}
+}
+
+// APIKey is an API key that grants access to the HTTP API. Only a hash of the key is stored; the
+// prefix is kept so that keys can be told apart.
+type APIKey struct {
+	ID     int64  `json:"id"`
+	Name   string `json:"name"`
+	Prefix string `json:"prefix"`
+	// Hash is the hash of the key and is never serialized.
+	Hash       string     `json:"-"`
+	Scopes     []Scope    `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// IsExpired returns true if the key has an expiry that has passed at the given time.
+func (k *APIKey) IsExpired(now time.Time) bool {
+	return k.ExpiresAt != nil && !now.Before(*k.ExpiresAt)
+}
+
+func (d *Database) initAPIKeysSchema() error {
+	apiKeysTable := `
+	CREATE TABLE IF NOT EXISTS api_keys (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		prefix TEXT NOT NULL,
+		hash TEXT NOT NULL UNIQUE,
+		scopes JSON NOT NULL DEFAULT '[]',
+		expires_at TIMESTAMP,
+		last_used_at TIMESTAMP,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);`
+
+	_, err := d.db.Exec(apiKeysTable)
+	return err
+}
+
+const apiKeyColumns = `id, name, prefix, hash, scopes, expires_at, last_used_at, created_at`
+
+func scanAPIKey(row rowScanner) (*APIKey, error) {
+	var k APIKey
+	var scopes string
+	var expiresAt, lastUsedAt sql.NullTime
+	if err := row.Scan(&k.ID, &k.Name, &k.Prefix, &k.Hash, &scopes, &expiresAt, &lastUsedAt,
+		&k.CreatedAt); err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal([]byte(scopes), &k.Scopes); err != nil {
+		return nil, err
+	}
+
+	if expiresAt.Valid {
+		k.ExpiresAt = &expiresAt.Time
+	}
+
+	if lastUsedAt.Valid {
+		k.LastUsedAt = &lastUsedAt.Time
+	}
+
+	return &k, nil
+}
+
+func marshalScopes(scopes []Scope) (string, error) {
+	if scopes == nil {
+		scopes = []Scope{}
+	}
+
+	data, err := json.Marshal(scopes)
+	return string(data), err
+}
+
+// AddAPIKey adds a new API key, populating its ID and creation time on success.
+func (d *Database) AddAPIKey(k *APIKey) error {
+	scopes, err := marshalScopes(k.Scopes)
+	if err != nil {
+		return err
+	}
+
+	k.CreatedAt = time.Now().UTC().Truncate(time.Second)
+	result, err := d.db.Exec(
+		`INSERT INTO api_keys (name, prefix, hash, scopes, expires_at, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		k.Name, k.Prefix, k.Hash, scopes, nullableTimestamp(k.ExpiresAt),
+		k.CreatedAt.Format(sqliteTimestampLayout),
+	)
+	if err != nil {
+		return err
+	}
+
+	k.ID, err = result.LastInsertId()
+	return err
+}
+
+// UpdateAPIKey updates the name, scopes and expiry of an existing API key.
+func (d *Database) UpdateAPIKey(k *APIKey) error {
+	scopes, err := marshalScopes(k.Scopes)
+	if err != nil {
+		return err
+	}
+
+	result, err := d.db.Exec(
+		`UPDATE api_keys SET name = ?, scopes = ?, expires_at = ? WHERE id = ?`,
+		k.Name, scopes, nullableTimestamp(k.ExpiresAt), k.ID,
+	)
+	if err != nil {
+		return err
+	}
+
+	return requireRowsAffected(result, ErrAPIKeyNotFound)
+}
+
+// TouchAPIKey records that an API key was used at the given time.
+func (d *Database) TouchAPIKey(id int64, at time.Time) error {
+	_, err := d.db.Exec(
+		`UPDATE api_keys SET last_used_at = ? WHERE id = ?`,
+		at.UTC().Format(sqliteTimestampLayout), id,
+	)
+
+	return err
+}
+
+// DeleteAPIKey deletes (i.e. revokes) an API key.
+func (d *Database) DeleteAPIKey(id int64) error {
+	result, err := d.db.Exec(`DELETE FROM api_keys WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+
+	return requireRowsAffected(result, ErrAPIKeyNotFound)
+}
+
+// GetAPIKey retrieves an API key by its ID, returning nil if it does not exist.
+func (d *Database) GetAPIKey(id int64) (*APIKey, error) {
+	row := d.db.QueryRow(`SELECT `+apiKeyColumns+` FROM api_keys WHERE id = ?`, id)
+
+	k, err := scanAPIKey(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return k, err
+}
+
+// GetAPIKeyByHash retrieves an API key by the hash of the key, returning nil if it does not exist.
+func (d *Database) GetAPIKeyByHash(hash string) (*APIKey, error) {
+	row := d.db.QueryRow(`SELECT `+apiKeyColumns+` FROM api_keys WHERE hash = ?`, hash)
+
+	k, err := scanAPIKey(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return k, err
+}
+
+// GetAllAPIKeys retrieves all API keys.
+func (d *Database) GetAllAPIKeys() ([]APIKey, error) {
+	rows, err := d.db.Query(`SELECT ` + apiKeyColumns + ` FROM api_keys ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, *k)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
@@ -0,0 +1,390 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrAutomationNotFound is returned when an operation targets an automation that does not exist.
+var ErrAutomationNotFound = errors.New("automation not found")
+
+// ConditionKind is the kind of an [AutomationCondition].
+type ConditionKind string
+
+const (
+	// ConditionKindReading compares a field of the latest reading of a peripheral to a threshold.
+	ConditionKindReading ConditionKind = "reading"
+	// ConditionKindPresence checks whether a peripheral is online or offline.
+	ConditionKindPresence ConditionKind = "presence"
+)
+
+// AutomationCondition is a single condition of an automation. Reading conditions hold when
+// `Data[Field] <Comparison> Threshold` for the latest reading of the peripheral; presence conditions
+// hold when the peripheral's online state equals Online.
+type AutomationCondition struct {
+	Kind         ConditionKind `json:"kind"`
+	SerialNumber string        `json:"serial_number"`
+	Field        string        `json:"field,omitempty"`
+	Comparison   Comparison    `json:"comparison,omitempty"`
+	Threshold    float64       `json:"threshold,omitempty"`
+	Online       *bool         `json:"online,omitempty"`
+}
+
+// Validate checks that the condition is well-formed.
+func (c *AutomationCondition) Validate() error {
+	if c.SerialNumber == "" {
+		return errors.New("serial_number is required")
+	}
+
+	switch c.Kind {
+	case ConditionKindReading:
+		if c.Field == "" {
+			return errors.New("field is required")
+		} else if !c.Comparison.IsValid() {
+			return errors.New("invalid comparison: " + string(c.Comparison))
+		}
+	case ConditionKindPresence:
+		if c.Online == nil {
+			return errors.New("online is required")
+		}
+	default:
+		return errors.New("invalid condition kind: " + string(c.Kind))
+	}
+
+	return nil
+}
+
+// AutomationAction is a command sent to an actuator when an automation triggers.
+type AutomationAction struct {
+	SerialNumber string         `json:"serial_number"`
+	Command      string         `json:"command"`
+	Args         map[string]any `json:"args,omitempty"`
+}
+
+// Automation triggers actuator commands once all of its conditions have held for at least
+// DurationSeconds. It triggers once each time its conditions become true, and at most once per
+// CooldownSeconds. In dry-run mode, executions are recorded but no commands are sent.
+type Automation struct {
+	ID              int64                 `json:"id"`
+	Name            string                `json:"name"`
+	Conditions      []AutomationCondition `json:"conditions"`
+	Actions         []AutomationAction    `json:"actions"`
+	DurationSeconds int64                 `json:"duration_seconds"`
+	CooldownSeconds int64                 `json:"cooldown_seconds"`
+	Enabled         bool                  `json:"enabled"`
+	DryRun          bool                  `json:"dry_run"`
+	LastTriggeredAt *time.Time            `json:"last_triggered_at"`
+	CreatedAt       time.Time             `json:"created_at"`
+}
+
+// Duration returns how long the automation's conditions must hold before it triggers.
+func (a *Automation) Duration() time.Duration {
+	return time.Duration(a.DurationSeconds) * time.Second
+}
+
+// Cooldown returns the minimum time between two executions of the automation.
+func (a *Automation) Cooldown() time.Duration {
+	return time.Duration(a.CooldownSeconds) * time.Second
+}
+
+// Validate checks that the automation is well-formed. Whether the actions target peripherals that
+// accept the commands is checked by the caller.
+func (a *Automation) Validate() error {
+	if a.Name == "" {
+		return errors.New("name is required")
+	} else if len(a.Conditions) == 0 {
+		return errors.New("at least one condition is required")
+	} else if len(a.Actions) == 0 {
+		return errors.New("at least one action is required")
+	} else if a.DurationSeconds < 0 {
+		return errors.New("duration must not be negative")
+	} else if a.CooldownSeconds < 0 {
+		return errors.New("cooldown must not be negative")
+	}
+
+	for i := range a.Conditions {
+		if err := a.Conditions[i].Validate(); err != nil {
+			return fmt.Errorf("condition %d: %w", i, err)
+		}
+	}
+
+	for i, action := range a.Actions {
+		if action.SerialNumber == "" {
+			return fmt.Errorf("action %d: serial_number is required", i)
+		} else if action.Command == "" {
+			return fmt.Errorf("action %d: command is required", i)
+		}
+	}
+
+	return nil
+}
+
+// ActionResult is the outcome of a single action of an automation execution.
+type ActionResult struct {
+	SerialNumber string `json:"serial_number"`
+	Command      string `json:"command"`
+	Error        string `json:"error,omitempty"`
+}
+
+// AutomationExecution is a record of an automation being triggered.
+type AutomationExecution struct {
+	ID           int64          `json:"id"`
+	AutomationID int64          `json:"automation_id"`
+	TriggeredAt  time.Time      `json:"triggered_at"`
+	DryRun       bool           `json:"dry_run"`
+	Success      bool           `json:"success"`
+	Results      []ActionResult `json:"results"`
+}
+
+func (d *Database) initAutomationsSchema() error {
+	automationsTable := `
+	CREATE TABLE IF NOT EXISTS automations (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		conditions JSON NOT NULL,
+		actions JSON NOT NULL,
+		duration_seconds INTEGER NOT NULL DEFAULT 0,
+		cooldown_seconds INTEGER NOT NULL DEFAULT 0,
+		enabled INTEGER NOT NULL DEFAULT 1,
+		dry_run INTEGER NOT NULL DEFAULT 0,
+		last_triggered_at TIMESTAMP,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);`
+
+	executionsTable := `
+	CREATE TABLE IF NOT EXISTS automation_executions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		automation_id INTEGER NOT NULL,
+		triggered_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		dry_run INTEGER NOT NULL,
+		success INTEGER NOT NULL,
+		results JSON NOT NULL,
+		FOREIGN KEY(automation_id) REFERENCES automations(id) ON DELETE CASCADE
+	);`
+
+	for _, statement := range []string{automationsTable, executionsTable} {
+		if _, err := d.db.Exec(statement); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+const automationColumns = `id, name, conditions, actions, duration_seconds, cooldown_seconds, enabled,
+	dry_run, last_triggered_at, created_at`
+
+func scanAutomation(row rowScanner) (*Automation, error) {
+	var a Automation
+	var conditions, actions string
+	var lastTriggeredAt sql.NullTime
+	if err := row.Scan(&a.ID, &a.Name, &conditions, &actions, &a.DurationSeconds, &a.CooldownSeconds,
+		&a.Enabled, &a.DryRun, &lastTriggeredAt, &a.CreatedAt); err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal([]byte(conditions), &a.Conditions); err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal([]byte(actions), &a.Actions); err != nil {
+		return nil, err
+	}
+
+	if lastTriggeredAt.Valid {
+		a.LastTriggeredAt = &lastTriggeredAt.Time
+	}
+
+	return &a, nil
+}
+
+// marshalAutomation validates the automation and serializes its conditions and actions.
+func marshalAutomation(a *Automation) (string, string, error) {
+	if err := a.Validate(); err != nil {
+		return "", "", err
+	}
+
+	conditions, err := json.Marshal(a.Conditions)
+	if err != nil {
+		return "", "", err
+	}
+
+	actions, err := json.Marshal(a.Actions)
+	if err != nil {
+		return "", "", err
+	}
+
+	return string(conditions), string(actions), nil
+}
+
+// AddAutomation adds a new automation, populating its ID on success.
+func (d *Database) AddAutomation(a *Automation) error {
+	conditions, actions, err := marshalAutomation(a)
+	if err != nil {
+		return err
+	}
+
+	result, err := d.db.Exec(
+		`INSERT INTO automations
+		 (name, conditions, actions, duration_seconds, cooldown_seconds, enabled, dry_run)
+		 VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		a.Name, conditions, actions, a.DurationSeconds, a.CooldownSeconds, a.Enabled, a.DryRun,
+	)
+	if err != nil {
+		return err
+	}
+
+	a.ID, err = result.LastInsertId()
+	return err
+}
+
+// UpdateAutomation updates an existing automation.
+func (d *Database) UpdateAutomation(a *Automation) error {
+	conditions, actions, err := marshalAutomation(a)
+	if err != nil {
+		return err
+	}
+
+	result, err := d.db.Exec(
+		`UPDATE automations SET name = ?, conditions = ?, actions = ?, duration_seconds = ?,
+		 cooldown_seconds = ?, enabled = ?, dry_run = ? WHERE id = ?`,
+		a.Name, conditions, actions, a.DurationSeconds, a.CooldownSeconds, a.Enabled, a.DryRun, a.ID,
+	)
+	if err != nil {
+		return err
+	}
+
+	return requireRowsAffected(result, ErrAutomationNotFound)
+}
+
+// DeleteAutomation deletes an automation along with its execution history.
+func (d *Database) DeleteAutomation(id int64) error {
+	result, err := d.db.Exec(`DELETE FROM automations WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+
+	return requireRowsAffected(result, ErrAutomationNotFound)
+}
+
+// GetAutomation retrieves an automation by its ID, returning nil if it does not exist.
+func (d *Database) GetAutomation(id int64) (*Automation, error) {
+	row := d.db.QueryRow(`SELECT `+automationColumns+` FROM automations WHERE id = ?`, id)
+
+	a, err := scanAutomation(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return a, err
+}
+
+// GetAutomations retrieves all automations, or only the enabled ones if enabledOnly is true.
+func (d *Database) GetAutomations(enabledOnly bool) ([]Automation, error) {
+	query := `SELECT ` + automationColumns + ` FROM automations`
+	if enabledOnly {
+		query += ` WHERE enabled = 1`
+	}
+
+	rows, err := d.db.Query(query + ` ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	automations := []Automation{}
+	for rows.Next() {
+		a, err := scanAutomation(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		automations = append(automations, *a)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return automations, nil
+}
+
+// RecordAutomationExecution stores an execution of an automation and updates its last trigger time.
+func (d *Database) RecordAutomationExecution(e *AutomationExecution) error {
+	results, err := json.Marshal(e.Results)
+	if err != nil {
+		return err
+	}
+
+	triggeredAt := e.TriggeredAt.UTC().Format(sqliteTimestampLayout)
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		`INSERT INTO automation_executions (automation_id, triggered_at, dry_run, success, results)
+		 VALUES (?, ?, ?, ?, ?)`,
+		e.AutomationID, triggeredAt, e.DryRun, e.Success, string(results),
+	)
+	if err != nil {
+		return err
+	}
+
+	if e.ID, err = result.LastInsertId(); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(
+		`UPDATE automations SET last_triggered_at = ? WHERE id = ?`, triggeredAt, e.AutomationID,
+	); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetAutomationExecutions retrieves the most recent `limit` executions of an automation.
+func (d *Database) GetAutomationExecutions(automationID int64, limit uint32) ([]AutomationExecution, error) {
+	rows, err := d.db.Query(
+		`SELECT id, automation_id, triggered_at, dry_run, success, results
+		 FROM automation_executions
+		 WHERE automation_id = ?
+		 ORDER BY triggered_at DESC, id DESC
+		 LIMIT ?`,
+		automationID, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	executions := []AutomationExecution{}
+	for rows.Next() {
+		var e AutomationExecution
+		var results string
+		if err := rows.Scan(&e.ID, &e.AutomationID, &e.TriggeredAt, &e.DryRun, &e.Success, &results); err != nil {
+			return nil, err
+		}
+
+		if err := json.Unmarshal([]byte(results), &e.Results); err != nil {
+			return nil, err
+		}
+
+		executions = append(executions, e)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return executions, nil
+}
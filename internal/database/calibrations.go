@@ -0,0 +1,241 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"hafh-server/internal/expr"
+)
+
+// Calibration is a per-peripheral correction applied to a numeric field of incoming readings before
+// they are stored. If Polynomial is set, the calibrated value is
+// Polynomial[0] + Polynomial[1]*x + Polynomial[2]*x^2 + ...; otherwise it is x*Scale + Offset.
+type Calibration struct {
+	Field      string    `json:"field"`
+	Offset     float64   `json:"offset"`
+	Scale      *float64  `json:"scale,omitempty"`
+	Polynomial []float64 `json:"polynomial,omitempty"`
+}
+
+// Apply returns the calibrated value of x.
+func (c *Calibration) Apply(x float64) float64 {
+	if len(c.Polynomial) > 0 {
+		// Horner's method.
+		result := 0.0
+		for i := len(c.Polynomial) - 1; i >= 0; i-- {
+			result = result*x + c.Polynomial[i]
+		}
+		return result
+	}
+
+	scale := 1.0
+	if c.Scale != nil {
+		scale = *c.Scale
+	}
+
+	return x*scale + c.Offset
+}
+
+// DerivedField is a per-peripheral field computed from the other fields of incoming readings, such
+// as a dew point computed from temperature and humidity (e.g. "dewpoint(t, h)").
+type DerivedField struct {
+	Name       string `json:"name"`
+	Expression string `json:"expression"`
+}
+
+func (d *Database) initCalibrationsSchema() error {
+	calibrationsTable := `
+	CREATE TABLE IF NOT EXISTS calibrations (
+		serial_number TEXT NOT NULL,
+		field TEXT NOT NULL,
+		definition JSON NOT NULL,
+		PRIMARY KEY(serial_number, field),
+		FOREIGN KEY(serial_number) REFERENCES peripherals(serial_number) ON DELETE CASCADE
+	);`
+
+	derivedFieldsTable := `
+	CREATE TABLE IF NOT EXISTS derived_fields (
+		serial_number TEXT NOT NULL,
+		name TEXT NOT NULL,
+		expression TEXT NOT NULL,
+		position INTEGER NOT NULL,
+		PRIMARY KEY(serial_number, name),
+		FOREIGN KEY(serial_number) REFERENCES peripherals(serial_number) ON DELETE CASCADE
+	);`
+
+	for _, table := range []string{calibrationsTable, derivedFieldsTable} {
+		if _, err := d.db.Exec(table); err != nil {
+			return err
+		}
+	}
+
+	// Raw (uncalibrated) values of calibrated fields are preserved alongside the reading, and kept
+	// when it is archived.
+	for _, table := range []string{"readings", "archived_readings"} {
+		if err := d.addColumnIfMissing(table, "raw", "JSON"); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ValidateCalibrations checks that every calibration has a field, and that no field is calibrated
+// twice.
+func ValidateCalibrations(calibrations []Calibration) error {
+	seen := map[string]bool{}
+	for _, c := range calibrations {
+		if c.Field == "" {
+			return errors.New("calibration field is required")
+		} else if seen[c.Field] {
+			return errors.New("duplicate calibration for field: " + c.Field)
+		}
+		seen[c.Field] = true
+	}
+
+	return nil
+}
+
+// ValidateDerivedFields checks that every derived field has a name and a valid expression, and
+// that no name is used twice.
+func ValidateDerivedFields(fields []DerivedField) error {
+	seen := map[string]bool{}
+	for _, f := range fields {
+		if f.Name == "" {
+			return errors.New("derived field name is required")
+		} else if seen[f.Name] {
+			return errors.New("duplicate derived field: " + f.Name)
+		} else if _, err := expr.Parse(f.Expression); err != nil {
+			return errors.New("invalid expression for derived field " + f.Name + ": " + err.Error())
+		}
+		seen[f.Name] = true
+	}
+
+	return nil
+}
+
+// SetCalibrations replaces all calibrations of a peripheral.
+func (d *Database) SetCalibrations(serial string, calibrations []Calibration) error {
+	if err := ValidateCalibrations(calibrations); err != nil {
+		return err
+	}
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM calibrations WHERE serial_number = ?`, serial); err != nil {
+		return err
+	}
+
+	for _, c := range calibrations {
+		definition, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(
+			`INSERT INTO calibrations (serial_number, field, definition) VALUES (?, ?, ?)`,
+			serial, c.Field, string(definition),
+		); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetCalibrations retrieves all calibrations of a peripheral.
+func (d *Database) GetCalibrations(serial string) ([]Calibration, error) {
+	rows, err := d.db.Query(
+		`SELECT definition FROM calibrations WHERE serial_number = ? ORDER BY field`,
+		serial,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	calibrations := []Calibration{}
+	for rows.Next() {
+		var definition string
+		if err := rows.Scan(&definition); err != nil {
+			return nil, err
+		}
+
+		var c Calibration
+		if err := json.Unmarshal([]byte(definition), &c); err != nil {
+			return nil, err
+		}
+
+		calibrations = append(calibrations, c)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return calibrations, nil
+}
+
+// SetDerivedFields replaces all derived fields of a peripheral. Derived fields are evaluated in the
+// given order, so later fields may reference earlier ones.
+func (d *Database) SetDerivedFields(serial string, fields []DerivedField) error {
+	if err := ValidateDerivedFields(fields); err != nil {
+		return err
+	}
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM derived_fields WHERE serial_number = ?`, serial); err != nil {
+		return err
+	}
+
+	for i, f := range fields {
+		if _, err := tx.Exec(
+			`INSERT INTO derived_fields (serial_number, name, expression, position) VALUES (?, ?, ?, ?)`,
+			serial, f.Name, f.Expression, i,
+		); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetDerivedFields retrieves all derived fields of a peripheral, in evaluation order.
+func (d *Database) GetDerivedFields(serial string) ([]DerivedField, error) {
+	rows, err := d.db.Query(
+		`SELECT name, expression FROM derived_fields WHERE serial_number = ? ORDER BY position`,
+		serial,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	fields := []DerivedField{}
+	for rows.Next() {
+		var f DerivedField
+		if err := rows.Scan(&f.Name, &f.Expression); err != nil {
+			return nil, err
+		}
+
+		fields = append(fields, f)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return fields, nil
+}
@@ -0,0 +1,90 @@
+package database
+
+import "testing"
+
+func TestValidateCalibrations(t *testing.T) {
+	tests := []struct {
+		name         string
+		calibrations []Calibration
+		wantErr      bool
+	}{
+		{name: "empty"},
+		{name: "valid", calibrations: []Calibration{{Field: "t", Offset: -0.5}, {Field: "h", Polynomial: []float64{1, 2}}}},
+		{name: "missing field", calibrations: []Calibration{{Offset: 1}}, wantErr: true},
+		{name: "duplicate field", calibrations: []Calibration{{Field: "t"}, {Field: "t"}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateCalibrations(tt.calibrations); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateCalibrations() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateDerivedFields(t *testing.T) {
+	tests := []struct {
+		name    string
+		fields  []DerivedField
+		wantErr bool
+	}{
+		{name: "empty"},
+		{name: "valid", fields: []DerivedField{{Name: "dp", Expression: "dewpoint(t, h)"}, {Name: "f", Expression: "t * 1.8 + 32"}}},
+		{name: "missing name", fields: []DerivedField{{Expression: "t"}}, wantErr: true},
+		{name: "duplicate name", fields: []DerivedField{{Name: "f", Expression: "t"}, {Name: "f", Expression: "h"}}, wantErr: true},
+		{name: "invalid expression", fields: []DerivedField{{Name: "f", Expression: "t *"}}, wantErr: true},
+		{name: "unknown function", fields: []DerivedField{{Name: "f", Expression: "foo(t)"}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateDerivedFields(tt.fields); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateDerivedFields() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCalibrationApply(t *testing.T) {
+	scale := 2.0
+
+	tests := []struct {
+		name        string
+		calibration Calibration
+		want        float64
+	}{
+		{"offset", Calibration{Offset: -1.5}, 8.5},
+		{"scale and offset", Calibration{Offset: 1, Scale: &scale}, 21},
+		{"polynomial", Calibration{Offset: 100, Polynomial: []float64{1, 0, 0.5}}, 51},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.calibration.Apply(10); got != tt.want {
+				t.Errorf("Apply(10) = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestArchiveKeepsRawValues(t *testing.T) {
+	db := newTestDatabase(t)
+	addTestPeripheral(t, db, "sn-1", 0)
+
+	reading := &Reading{SerialNumber: "sn-1", Data: map[string]any{"t": 20.5}, Raw: map[string]any{"t": 21.0}}
+	if err := db.InsertReading(reading); err != nil {
+		t.Fatalf("InsertReading() error = %v", err)
+	}
+
+	if err := db.DeletePeripheral("sn-1", ReadingsDeleteModeArchive); err != nil {
+		t.Fatalf("DeletePeripheral() error = %v", err)
+	}
+
+	var raw string
+	if err := db.db.QueryRow(`SELECT raw FROM archived_readings WHERE id = ?`, reading.ID).Scan(&raw); err != nil {
+		t.Fatalf("archived reading: %v", err)
+	} else if raw != `{"t":21}` {
+		t.Errorf("archived raw = %s, want {\"t\":21}", raw)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"errors"
+	"strings"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -11,10 +12,12 @@ import (
 
 // Database represents a SQLite database connection.
 type Database struct {
-	db *sql.DB
+	db *timedDB
 }
 
-// PeripheralType represents the type of a peripheral device.
+// PeripheralType represents the type of a peripheral device. The constants below are the built-in
+// types; additional types can be defined at runtime in the peripheral type registry
+// (see [PeripheralTypeDefinition]).
 type PeripheralType int
 
 const (
@@ -54,10 +57,25 @@ func PeripheralTypeFromString(s string) PeripheralType {
 
 // Peripheral represents a device in the system.
 type Peripheral struct {
-	SerialNumber string         `json:"serial_number"`
-	Type         PeripheralType `json:"type"`
-	Name         string         `json:"name"`
-	CreatedAt    time.Time      `json:"created_at"`
+	SerialNumber string            `json:"serial_number"`
+	Type         PeripheralType    `json:"type"`
+	Name         string            `json:"name"`
+	RoomID       *int64            `json:"room_id"`
+	Tags         []string          `json:"tags"`
+	Attributes   map[string]string `json:"attributes"`
+	Fields       []FieldDefinition `json:"fields"`
+	LastSeenAt   *time.Time        `json:"last_seen_at"`
+	CreatedAt    time.Time         `json:"created_at"`
+	// Virtual is the definition of a virtual peripheral, whose readings are computed from the
+	// readings of other peripherals. It is nil for physical peripherals.
+	Virtual *VirtualDefinition `json:"virtual,omitempty"`
+	// Online is not stored in the database; it is derived from LastSeenAt by the caller.
+	Online bool `json:"online"`
+}
+
+// IsOnline returns true if the peripheral has reported a reading within the given duration.
+func (p *Peripheral) IsOnline(offlineAfter time.Duration) bool {
+	return p.LastSeenAt != nil && time.Since(*p.LastSeenAt) <= offlineAfter
 }
 
 // ToJson serializes the Peripheral to JSON.
@@ -97,6 +115,8 @@ type Reading struct {
 	SerialNumber string         `json:"serial_number"`
 	Timestamp    time.Time      `json:"timestamp"`
 	Data         map[string]any `json:"data"`
+	// Raw holds the original values of any fields that were calibrated at ingest.
+	Raw map[string]any `json:"raw,omitempty"`
 }
 
 // ToJson serializes the Reading to JSON.
@@ -120,6 +140,34 @@ func ReadingFromJson(data []byte) (*Reading, error) {
 	return &r, nil
 }
 
+// NumericValue returns the numeric value at the given path in the reading data, where nested objects
+// are separated by dots (e.g. "climate.temperature"). Booleans are returned as 0 or 1.
+func (r *Reading) NumericValue(path string) (float64, bool) {
+	var current any = r.Data
+	for _, key := range strings.Split(path, ".") {
+		object, ok := current.(map[string]any)
+		if !ok {
+			return 0, false
+		}
+
+		if current, ok = object[key]; !ok {
+			return 0, false
+		}
+	}
+
+	switch value := current.(type) {
+	case float64:
+		return value, true
+	case bool:
+		if value {
+			return 1, true
+		}
+		return 0, true
+	default:
+		return 0, false
+	}
+}
+
 // String returns the string representation of the Reading.
 func (r *Reading) String() string {
 	json, err := r.ToJson()
@@ -151,11 +199,13 @@ func New(path string) (*Database, error) {
 	}
 
 	// Initialize the database schema
-	d := &Database{db: db}
+	d := &Database{db: &timedDB{db}}
 	if err := d.initSchema(); err != nil {
 		return nil, err
 	}
 
+	registerMetrics(d)
+
 	return d, nil
 }
 
@@ -177,15 +227,102 @@ func (d *Database) initSchema() error {
 		FOREIGN KEY(serial_number) REFERENCES peripherals(serial_number)
 	);`
 
-	if _, err := d.db.Exec(peripheralsTable); err != nil {
+	// Readings removed alongside a deleted peripheral may be moved here instead of being dropped.
+	// There is intentionally no foreign key so that the peripheral row can be removed.
+	archivedReadingsTable := `
+	CREATE TABLE IF NOT EXISTS archived_readings (
+		id INTEGER PRIMARY KEY,
+		serial_number TEXT NOT NULL,
+		timestamp TIMESTAMP NOT NULL,
+		data JSON NOT NULL,
+		archived_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);`
+
+	for _, table := range []string{peripheralsTable, readingsTable, archivedReadingsTable} {
+		if _, err := d.db.Exec(table); err != nil {
+			return err
+		}
+	}
+
+	if err := d.initRoomsSchema(); err != nil {
 		return err
 	}
 
-	if _, err := d.db.Exec(readingsTable); err != nil {
+	if err := d.initPeripheralTypesSchema(); err != nil {
 		return err
 	}
 
-	return nil
+	if err := d.initFieldsSchema(); err != nil {
+		return err
+	}
+
+	if err := d.initCalibrationsSchema(); err != nil {
+		return err
+	}
+
+	if err := d.initAlertsSchema(); err != nil {
+		return err
+	}
+
+	if err := d.initWebhooksSchema(); err != nil {
+		return err
+	}
+
+	if err := d.initAutomationsSchema(); err != nil {
+		return err
+	}
+
+	if err := d.initSchedulesSchema(); err != nil {
+		return err
+	}
+
+	if err := d.initVirtualPeripheralsSchema(); err != nil {
+		return err
+	}
+
+	if err := d.initAnomaliesSchema(); err != nil {
+		return err
+	}
+
+	if err := d.initAPIKeysSchema(); err != nil {
+		return err
+	}
+
+	if err := d.initUsersSchema(); err != nil {
+		return err
+	}
+
+	return d.initPeripheralMetadataSchema()
+}
+
+// addColumnIfMissing adds a column to an existing table, allowing databases created by older
+// versions of the server to be upgraded in place.
+func (d *Database) addColumnIfMissing(table, column, definition string) error {
+	rows, err := d.db.Query(`SELECT name FROM pragma_table_info(?)`, table)
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+
+		if name == column {
+			return nil
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rows.Close()
+	_, err = d.db.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + column + ` ` + definition)
+	return err
 }
 
 // AddPeripheral adds a new peripheral to the database.
@@ -198,38 +335,81 @@ func (d *Database) AddPeripheral(p *Peripheral) error {
 	return err
 }
 
-// UpdatePeripheral updates the name of an existing peripheral.
+// UpdatePeripheral updates the name, type and room of an existing peripheral.
 func (d *Database) UpdatePeripheral(p *Peripheral) error {
 	_, err := d.db.Exec(
-		`UPDATE peripherals SET name = ? WHERE serial_number = ?`,
-		p.Name, p.SerialNumber,
+		`UPDATE peripherals SET name = ?, type = ?, room_id = ? WHERE serial_number = ?`,
+		p.Name, p.Type, p.RoomID, p.SerialNumber,
 	)
 
 	return err
 }
 
-// InsertReading inserts a new reading for a given peripheral.
+// InsertReading inserts a new reading for a given peripheral, populating its ID and timestamp.
 func (d *Database) InsertReading(r *Reading) error {
 	jsonData, err := json.Marshal(r.Data)
 	if err != nil {
 		return err
 	}
 
-	_, err = d.db.Exec(
-		`INSERT INTO readings (serial_number, data) VALUES (?, ?)`,
-		r.SerialNumber, string(jsonData),
+	// Only calibrated readings have raw values to preserve.
+	var rawData any
+	if len(r.Raw) > 0 {
+		jsonRaw, err := json.Marshal(r.Raw)
+		if err != nil {
+			return err
+		}
+		rawData = string(jsonRaw)
+	}
+
+	// The reading is timestamped when it is stored, with the precision SQLite uses for
+	// CURRENT_TIMESTAMP.
+	now := time.Now().UTC().Truncate(time.Second)
+
+	// The peripheral is last seen when the reading is stored, so both are written together.
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		`INSERT INTO readings (serial_number, timestamp, data, raw) VALUES (?, ?, ?, ?)`,
+		r.SerialNumber, now.Format(sqliteTimestampLayout), string(jsonData), rawData,
 	)
+	if err != nil {
+		return err
+	}
 
-	return err
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(
+		`UPDATE peripherals SET last_seen_at = ? WHERE serial_number = ?`,
+		now.Format(sqliteTimestampLayout), r.SerialNumber,
+	); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	r.ID = int(id)
+	r.Timestamp = now
+	return nil
 }
 
 // GetLastReadings retrieves the last `limit` readings for a given peripheral.
 func (d *Database) GetLastReadings(serial string, limit uint32) ([]Reading, error) {
 	rows, err := d.db.Query(
-		`SELECT id, serial_number, timestamp, data 
+		`SELECT id, serial_number, timestamp, data, raw
 		 FROM readings 
 		 WHERE serial_number = ? 
-		 ORDER BY timestamp DESC 
+		 ORDER BY timestamp DESC, id DESC 
 		 LIMIT ?`,
 		serial, limit,
 	)
@@ -243,7 +423,8 @@ func (d *Database) GetLastReadings(serial string, limit uint32) ([]Reading, erro
 	for rows.Next() {
 		var r Reading
 		var rawData string
-		if err := rows.Scan(&r.ID, &r.SerialNumber, &r.Timestamp, &rawData); err != nil {
+		var rawValues sql.NullString
+		if err := rows.Scan(&r.ID, &r.SerialNumber, &r.Timestamp, &rawData, &rawValues); err != nil {
 			return nil, err
 		}
 
@@ -251,80 +432,272 @@ func (d *Database) GetLastReadings(serial string, limit uint32) ([]Reading, erro
 			return nil, err
 		}
 
+		if rawValues.Valid {
+			if err := json.Unmarshal([]byte(rawValues.String), &r.Raw); err != nil {
+				return nil, err
+			}
+		}
+
 		results = append(results, r)
 	}
 
 	return results, nil
 }
 
-// GetAllPeripherals retrieves all peripherals from the database.
-func (d *Database) GetAllPeripherals() ([]Peripheral, error) {
-	rows, err := d.db.Query(`SELECT serial_number, type, name, created_at FROM peripherals`)
+// GetReadingsAfter retrieves up to `limit` readings with an ID greater than afterID, oldest first,
+// e.g. to resume a stream of readings. If serials is not empty, only readings of those peripherals
+// are included; if tag is not empty, only readings of peripherals with the tag are.
+func (d *Database) GetReadingsAfter(afterID int, serials []string, tag string, limit uint32) ([]Reading, error) {
+	query := `SELECT id, serial_number, timestamp, data, raw FROM readings WHERE id > ?`
+	args := []any{afterID}
+
+	if len(serials) > 0 {
+		query += ` AND serial_number IN (?` + strings.Repeat(`, ?`, len(serials)-1) + `)`
+		for _, serial := range serials {
+			args = append(args, serial)
+		}
+	}
+
+	if tag != "" {
+		query += ` AND serial_number IN (SELECT serial_number FROM peripheral_tags WHERE tag = ?)`
+		args = append(args, tag)
+	}
+
+	rows, err := d.db.Query(query+` ORDER BY id LIMIT ?`, append(args, limit)...)
 	if err != nil {
 		return nil, err
 	}
 
 	defer rows.Close()
 
-	var peripherals []Peripheral
+	results := []Reading{}
 	for rows.Next() {
-		var p Peripheral
-		var name sql.NullString
-		if err := rows.Scan(&p.SerialNumber, &p.Type, &name, &p.CreatedAt); err != nil {
+		var r Reading
+		var rawData string
+		var rawValues sql.NullString
+		if err := rows.Scan(&r.ID, &r.SerialNumber, &r.Timestamp, &rawData, &rawValues); err != nil {
 			return nil, err
 		}
 
-		// The 'name' is optional, and may be null.
-		if name.Valid {
-			p.Name = name.String
-		} else {
-			p.Name = ""
+		if err := json.Unmarshal([]byte(rawData), &r.Data); err != nil {
+			return nil, err
 		}
 
-		peripherals = append(peripherals, p)
-	}
+		if rawValues.Valid {
+			if err := json.Unmarshal([]byte(rawValues.String), &r.Raw); err != nil {
+				return nil, err
+			}
+		}
 
-	if err := rows.Err(); err != nil {
-		return nil, err
+		results = append(results, r)
 	}
 
-	return peripherals, nil
+	return results, rows.Err()
+}
+
+// GetAllPeripherals retrieves all peripherals from the database.
+func (d *Database) GetAllPeripherals() ([]Peripheral, error) {
+	return d.FindPeripherals(PeripheralFilter{})
 }
 
 // GetPeripheralBySerial retrieves a peripheral by its serial number.
 func (d *Database) GetPeripheralBySerial(serial string) (*Peripheral, error) {
-	row := d.db.QueryRow(
-		`SELECT serial_number, type, created_at FROM peripherals WHERE serial_number = ?`,
-		serial,
-	)
+	return d.getPeripheralWhere(`serial_number = ?`, serial)
+}
 
-	var p Peripheral
-	if err := row.Scan(&p.SerialNumber, &p.Type, &p.CreatedAt); err != nil {
+// GetPeripheralByName retrieves a peripheral by its name.
+func (d *Database) GetPeripheralByName(name string) (*Peripheral, error) {
+	return d.getPeripheralWhere(`name = ?`, name)
+}
+
+func (d *Database) getPeripheralWhere(where string, arg any) (*Peripheral, error) {
+	row := d.db.QueryRow(`SELECT `+peripheralColumns+` FROM peripherals WHERE `+where, arg)
+
+	p, err := scanPeripheral(row)
+	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
 		}
 		return nil, err
 	}
 
-	return &p, nil
+	peripherals := []Peripheral{*p}
+	if err := d.loadPeripheralMetadata(peripherals); err != nil {
+		return nil, err
+	}
+
+	return &peripherals[0], nil
 }
 
-// GetPeripheralByName retrieves a peripheral by its name.
-func (d *Database) GetPeripheralByName(name string) (*Peripheral, error) {
-	row := d.db.QueryRow(
-		`SELECT serial_number, type, created_at FROM peripherals WHERE name = ?`,
-		name,
-	)
+// ReadingsDeleteMode determines what happens to a peripheral's readings when the peripheral is deleted.
+type ReadingsDeleteMode int
 
-	var p Peripheral
-	if err := row.Scan(&p.SerialNumber, &p.Type, &p.CreatedAt); err != nil {
-		if err == sql.ErrNoRows {
-			return nil, nil
+const (
+	// ReadingsDeleteModeRestrict refuses to delete a peripheral that still has readings.
+	ReadingsDeleteModeRestrict ReadingsDeleteMode = iota
+	// ReadingsDeleteModeCascade deletes the peripheral's readings along with it.
+	ReadingsDeleteModeCascade
+	// ReadingsDeleteModeArchive moves the peripheral's readings to the archived_readings table.
+	ReadingsDeleteModeArchive
+)
+
+var (
+	// ErrPeripheralNotFound is returned when an operation targets a peripheral that does not exist.
+	ErrPeripheralNotFound = errors.New("peripheral not found")
+	// ErrPeripheralHasReadings is returned when deleting a peripheral that still has readings
+	// using [ReadingsDeleteModeRestrict].
+	ErrPeripheralHasReadings = errors.New("peripheral has readings")
+)
+
+// ReadingsDeleteModeFromString converts a string to a ReadingsDeleteMode. An empty string maps to
+// [ReadingsDeleteModeRestrict].
+func ReadingsDeleteModeFromString(s string) (ReadingsDeleteMode, error) {
+	switch s {
+	case "", "restrict":
+		return ReadingsDeleteModeRestrict, nil
+	case "cascade":
+		return ReadingsDeleteModeCascade, nil
+	case "archive":
+		return ReadingsDeleteModeArchive, nil
+	default:
+		return ReadingsDeleteModeRestrict, errors.New("invalid readings delete mode: " + s)
+	}
+}
+
+// DeletePeripheral deletes a peripheral, handling its readings according to the given mode.
+func (d *Database) DeletePeripheral(serial string, mode ReadingsDeleteMode) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	var exists bool
+	if err := tx.QueryRow(
+		`SELECT EXISTS(SELECT 1 FROM peripherals WHERE serial_number = ?)`,
+		serial,
+	).Scan(&exists); err != nil {
+		return err
+	} else if !exists {
+		return ErrPeripheralNotFound
+	}
+
+	switch mode {
+	case ReadingsDeleteModeArchive:
+		if _, err := tx.Exec(
+			`INSERT INTO archived_readings (id, serial_number, timestamp, data, raw)
+			 SELECT id, serial_number, timestamp, data, raw FROM readings WHERE serial_number = ?`,
+			serial,
+		); err != nil {
+			return err
+		}
+		fallthrough
+	case ReadingsDeleteModeCascade:
+		if _, err := tx.Exec(`DELETE FROM readings WHERE serial_number = ?`, serial); err != nil {
+			return err
+		}
+	default:
+		var count int
+		if err := tx.QueryRow(
+			`SELECT COUNT(*) FROM readings WHERE serial_number = ?`,
+			serial,
+		).Scan(&count); err != nil {
+			return err
+		} else if count > 0 {
+			return ErrPeripheralHasReadings
 		}
-		return nil, err
 	}
 
-	return &p, nil
+	if _, err := tx.Exec(`DELETE FROM peripherals WHERE serial_number = ?`, serial); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// MergePeripherals reassigns all readings from the peripheral `from` to the peripheral `to` and then
+// deletes `from`. This is intended for when a device's hardware is swapped. Archived readings,
+// alerts and anomalies are reassigned as well, and the tags, attributes, field definitions,
+// calibrations and derived fields of `from` are added to those of `to`, which keeps its own where
+// both have one. The target keeps its room, or takes that of `from` if it has none, and its last
+// seen time becomes the later of the two. The number of readings that were reassigned is returned.
+func (d *Database) MergePeripherals(from, to string) (int64, error) {
+	if from == to {
+		return 0, errors.New("cannot merge a peripheral into itself")
+	}
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	defer tx.Rollback()
+
+	var count int
+	if err := tx.QueryRow(
+		`SELECT COUNT(*) FROM peripherals WHERE serial_number IN (?, ?)`,
+		from, to,
+	).Scan(&count); err != nil {
+		return 0, err
+	} else if count != 2 {
+		return 0, ErrPeripheralNotFound
+	}
+
+	result, err := tx.Exec(`UPDATE readings SET serial_number = ? WHERE serial_number = ?`, to, from)
+	if err != nil {
+		return 0, err
+	}
+
+	moved, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, table := range []string{"archived_readings", "alerts", "anomalies"} {
+		if _, err := tx.Exec(`UPDATE `+table+` SET serial_number = ? WHERE serial_number = ?`, to, from); err != nil {
+			return 0, err
+		}
+	}
+
+	// The derived fields of `from` are computed after those of `to`, in their own order.
+	var position int
+	if err := tx.QueryRow(
+		`SELECT COALESCE(MAX(position) + 1, 0) FROM derived_fields WHERE serial_number = ?`, to,
+	).Scan(&position); err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.Exec(
+		`UPDATE OR IGNORE derived_fields SET serial_number = ?, position = position + ? WHERE serial_number = ?`,
+		to, position, from,
+	); err != nil {
+		return 0, err
+	}
+
+	// Rows that `to` already has are left behind, and deleted along with `from`.
+	for _, table := range []string{"peripheral_tags", "peripheral_attributes", "peripheral_fields", "calibrations"} {
+		if _, err := tx.Exec(`UPDATE OR IGNORE `+table+` SET serial_number = ? WHERE serial_number = ?`, to, from); err != nil {
+			return 0, err
+		}
+	}
+
+	// The target was last seen when either peripheral last reported (MAX ignores NULL).
+	if _, err := tx.Exec(
+		`UPDATE peripherals SET
+			room_id = COALESCE(room_id, (SELECT room_id FROM peripherals WHERE serial_number = ?)),
+			last_seen_at = (SELECT MAX(last_seen_at) FROM peripherals WHERE serial_number IN (?, ?))
+		WHERE serial_number = ?`,
+		from, from, to, to,
+	); err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM peripherals WHERE serial_number = ?`, from); err != nil {
+		return 0, err
+	}
+
+	return moved, tx.Commit()
 }
 
 // Close closes the database connection.
@@ -0,0 +1,337 @@
+package database
+
+import (
+	"errors"
+	"maps"
+	"slices"
+	"testing"
+	"time"
+)
+
+// newTestDatabase returns a new in-memory database, closed when the test ends.
+func newTestDatabase(t *testing.T) *Database {
+	t.Helper()
+
+	db, err := New(":memory:")
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// addTestPeripheral adds a sensor with the given serial number and number of readings.
+func addTestPeripheral(t *testing.T, db *Database, serial string, readings int) {
+	t.Helper()
+
+	if err := db.AddPeripheral(&Peripheral{SerialNumber: serial, Type: PeripheralTypeSensor}); err != nil {
+		t.Fatalf("AddPeripheral() error = %v", err)
+	}
+
+	for i := range readings {
+		if err := db.InsertReading(&Reading{SerialNumber: serial, Data: map[string]any{"value": float64(i)}}); err != nil {
+			t.Fatalf("InsertReading() error = %v", err)
+		}
+	}
+}
+
+func countRows(t *testing.T, db *Database, query string, args ...any) int {
+	t.Helper()
+
+	var count int
+	if err := db.db.QueryRow(query, args...).Scan(&count); err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+
+	return count
+}
+
+func TestDeletePeripheral(t *testing.T) {
+	tests := []struct {
+		name         string
+		readings     int
+		mode         ReadingsDeleteMode
+		wantErr      error
+		wantReadings int
+		wantArchived int
+	}{
+		{name: "restrict without readings", mode: ReadingsDeleteModeRestrict},
+		{name: "restrict with readings", readings: 2, mode: ReadingsDeleteModeRestrict, wantErr: ErrPeripheralHasReadings, wantReadings: 2},
+		{name: "cascade", readings: 2, mode: ReadingsDeleteModeCascade},
+		{name: "archive", readings: 2, mode: ReadingsDeleteModeArchive, wantArchived: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDatabase(t)
+			addTestPeripheral(t, db, "sn-1", tt.readings)
+
+			err := db.DeletePeripheral("sn-1", tt.mode)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("DeletePeripheral() error = %v, want %v", err, tt.wantErr)
+			}
+
+			p, err := db.GetPeripheralBySerial("sn-1")
+			if err != nil {
+				t.Fatalf("GetPeripheralBySerial() error = %v", err)
+			} else if (p != nil) != (tt.wantErr != nil) {
+				t.Errorf("peripheral exists = %v, want %v", p != nil, tt.wantErr != nil)
+			}
+
+			if got := countRows(t, db, `SELECT COUNT(*) FROM readings`); got != tt.wantReadings {
+				t.Errorf("readings = %d, want %d", got, tt.wantReadings)
+			}
+
+			if got := countRows(t, db, `SELECT COUNT(*) FROM archived_readings`); got != tt.wantArchived {
+				t.Errorf("archived readings = %d, want %d", got, tt.wantArchived)
+			}
+		})
+	}
+}
+
+func TestDeletePeripheralNotFound(t *testing.T) {
+	db := newTestDatabase(t)
+
+	if err := db.DeletePeripheral("missing", ReadingsDeleteModeCascade); !errors.Is(err, ErrPeripheralNotFound) {
+		t.Fatalf("DeletePeripheral() error = %v, want %v", err, ErrPeripheralNotFound)
+	}
+}
+
+func TestMergePeripherals(t *testing.T) {
+	db := newTestDatabase(t)
+	addTestPeripheral(t, db, "old", 3)
+	addTestPeripheral(t, db, "new", 1)
+
+	// The replaced peripheral reported last, e.g. just before its hardware was swapped.
+	if _, err := db.db.Exec(`UPDATE peripherals SET last_seen_at = ? WHERE serial_number = ?`, "2030-01-02 03:04:05", "old"); err != nil {
+		t.Fatalf("UPDATE error = %v", err)
+	}
+
+	moved, err := db.MergePeripherals("old", "new")
+	if err != nil {
+		t.Fatalf("MergePeripherals() error = %v", err)
+	} else if moved != 3 {
+		t.Errorf("moved = %d, want 3", moved)
+	}
+
+	if p, _ := db.GetPeripheralBySerial("old"); p != nil {
+		t.Error("merged peripheral still exists")
+	}
+
+	if got := countRows(t, db, `SELECT COUNT(*) FROM readings WHERE serial_number = ?`, "new"); got != 4 {
+		t.Errorf("readings of new = %d, want 4", got)
+	}
+
+	want := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	p, err := db.GetPeripheralBySerial("new")
+	if err != nil {
+		t.Fatalf("GetPeripheralBySerial() error = %v", err)
+	} else if p.LastSeenAt == nil || !p.LastSeenAt.Equal(want) {
+		t.Errorf("LastSeenAt = %v, want %v", p.LastSeenAt, want)
+	}
+
+	// The target keeps its own last seen time if it is the later one.
+	addTestPeripheral(t, db, "unseen", 0)
+	if _, err := db.MergePeripherals("unseen", "new"); err != nil {
+		t.Fatalf("MergePeripherals() error = %v", err)
+	} else if p, _ := db.GetPeripheralBySerial("new"); p.LastSeenAt == nil || !p.LastSeenAt.Equal(want) {
+		t.Errorf("LastSeenAt after merging a peripheral never seen = %v, want %v", p.LastSeenAt, want)
+	}
+
+	if _, err := db.MergePeripherals("new", "new"); err == nil {
+		t.Error("merging a peripheral into itself succeeded")
+	}
+
+	if _, err := db.MergePeripherals("new", "missing"); !errors.Is(err, ErrPeripheralNotFound) {
+		t.Errorf("MergePeripherals() error = %v, want %v", err, ErrPeripheralNotFound)
+	}
+}
+
+func TestMergePeripheralsMetadata(t *testing.T) {
+	db := newTestDatabase(t)
+	addTestPeripheral(t, db, "old", 0)
+	addTestPeripheral(t, db, "new", 0)
+
+	room := &Room{Name: "Kitchen"}
+	if err := db.AddRoom(room); err != nil {
+		t.Fatalf("AddRoom() error = %v", err)
+	}
+
+	old, _ := db.GetPeripheralBySerial("old")
+	old.RoomID = &room.ID
+	if err := db.PatchPeripheral(old, PeripheralMetadataUpdate{
+		Tags:       &[]string{"a", "b"},
+		Attributes: &map[string]string{"floor": "1", "site": "x"},
+		Fields:     &[]FieldDefinition{{Name: "h", DataType: FieldDataTypeNumber}},
+	}); err != nil {
+		t.Fatalf("PatchPeripheral() error = %v", err)
+	}
+
+	replacement, _ := db.GetPeripheralBySerial("new")
+	if err := db.PatchPeripheral(replacement, PeripheralMetadataUpdate{
+		Tags:       &[]string{"b", "c"},
+		Attributes: &map[string]string{"floor": "2"},
+	}); err != nil {
+		t.Fatalf("PatchPeripheral() error = %v", err)
+	}
+
+	if err := db.SetCalibrations("old", []Calibration{{Field: "t", Offset: 1}, {Field: "h", Offset: 2}}); err != nil {
+		t.Fatalf("SetCalibrations() error = %v", err)
+	} else if err := db.SetCalibrations("new", []Calibration{{Field: "t", Offset: 5}}); err != nil {
+		t.Fatalf("SetCalibrations() error = %v", err)
+	}
+
+	if err := db.SetDerivedFields("old", []DerivedField{{Name: "d2", Expression: "t * 2"}}); err != nil {
+		t.Fatalf("SetDerivedFields() error = %v", err)
+	} else if err := db.SetDerivedFields("new", []DerivedField{{Name: "d1", Expression: "t + 1"}}); err != nil {
+		t.Fatalf("SetDerivedFields() error = %v", err)
+	}
+
+	for _, query := range []string{
+		`INSERT INTO archived_readings (id, serial_number, timestamp, data) VALUES (100, 'old', CURRENT_TIMESTAMP, '{}')`,
+		`INSERT INTO alert_rules (name, field, comparison, threshold) VALUES ('hot', 't', '>', 30)`,
+		`INSERT INTO alerts (rule_id, serial_number, state, value) VALUES (1, 'old', 'firing', 35)`,
+		`INSERT INTO anomalies (serial_number, kind, detected_at) VALUES ('old', 'spike', CURRENT_TIMESTAMP)`,
+	} {
+		if _, err := db.db.Exec(query); err != nil {
+			t.Fatalf("%s error = %v", query, err)
+		}
+	}
+
+	if _, err := db.MergePeripherals("old", "new"); err != nil {
+		t.Fatalf("MergePeripherals() error = %v", err)
+	}
+
+	p, err := db.GetPeripheralBySerial("new")
+	if err != nil {
+		t.Fatalf("GetPeripheralBySerial() error = %v", err)
+	}
+
+	if !slices.Equal(p.Tags, []string{"a", "b", "c"}) {
+		t.Errorf("tags = %v, want [a b c]", p.Tags)
+	}
+	if !maps.Equal(p.Attributes, map[string]string{"floor": "2", "site": "x"}) {
+		t.Errorf("attributes = %v, want the target's floor and the merged site", p.Attributes)
+	}
+	if p.RoomID == nil || *p.RoomID != room.ID {
+		t.Errorf("room = %v, want %d", p.RoomID, room.ID)
+	}
+	if got := countRows(t, db, `SELECT COUNT(*) FROM peripheral_fields WHERE serial_number = 'new'`); got != 1 {
+		t.Errorf("field definitions of new = %d, want 1", got)
+	}
+
+	calibrations, err := db.GetCalibrations("new")
+	if err != nil {
+		t.Fatalf("GetCalibrations() error = %v", err)
+	}
+	offsets := map[string]float64{}
+	for _, c := range calibrations {
+		offsets[c.Field] = c.Offset
+	}
+	if !maps.Equal(offsets, map[string]float64{"t": 5, "h": 2}) {
+		t.Errorf("calibration offsets = %v, want the target's t and the merged h", offsets)
+	}
+
+	derived, err := db.GetDerivedFields("new")
+	if err != nil {
+		t.Fatalf("GetDerivedFields() error = %v", err)
+	} else if len(derived) != 2 || derived[0].Name != "d1" || derived[1].Name != "d2" {
+		t.Errorf("derived fields = %+v, want d1 then d2", derived)
+	}
+
+	for _, table := range []string{"archived_readings", "alerts", "anomalies"} {
+		if got := countRows(t, db, `SELECT COUNT(*) FROM `+table+` WHERE serial_number = 'new'`); got != 1 {
+			t.Errorf("%s of new = %d, want 1", table, got)
+		}
+	}
+}
+
+func TestPatchPeripheral(t *testing.T) {
+	db := newTestDatabase(t)
+	addTestPeripheral(t, db, "sn-1", 0)
+	addTestPeripheral(t, db, "sn-2", 0)
+
+	p, _ := db.GetPeripheralBySerial("sn-1")
+	p.Name = "Kitchen"
+	err := db.PatchPeripheral(p, PeripheralMetadataUpdate{
+		Tags:       &[]string{" b ", "a", ""},
+		Attributes: &map[string]string{"floor": "1"},
+		Fields:     &[]FieldDefinition{{Name: "temperature", DataType: FieldDataTypeNumber}},
+	})
+	if err != nil {
+		t.Fatalf("PatchPeripheral() error = %v", err)
+	}
+
+	p, err = db.GetPeripheralBySerial("sn-1")
+	if err != nil {
+		t.Fatalf("GetPeripheralBySerial() error = %v", err)
+	} else if p.Name != "Kitchen" {
+		t.Errorf("name = %q, want %q", p.Name, "Kitchen")
+	} else if len(p.Tags) != 2 || p.Tags[0] != "a" || p.Tags[1] != "b" {
+		t.Errorf("tags = %v, want [a b]", p.Tags)
+	} else if p.Attributes["floor"] != "1" {
+		t.Errorf("attributes = %v, want floor=1", p.Attributes)
+	} else if len(p.Fields) != 1 {
+		t.Errorf("fields = %v, want 1 field", p.Fields)
+	}
+
+	// The metadata of one peripheral must not leak into another.
+	other, _ := db.GetPeripheralBySerial("sn-2")
+	if len(other.Tags) != 0 || len(other.Attributes) != 0 || len(other.Fields) != 0 {
+		t.Errorf("sn-2 has metadata of sn-1: %+v", other)
+	}
+
+	peripherals, err := db.FindPeripherals(PeripheralFilter{})
+	if err != nil {
+		t.Fatalf("FindPeripherals() error = %v", err)
+	}
+
+	for _, p := range peripherals {
+		if want := map[string]int{"sn-1": 2, "sn-2": 0}[p.SerialNumber]; len(p.Tags) != want {
+			t.Errorf("%s has %d tags, want %d", p.SerialNumber, len(p.Tags), want)
+		}
+	}
+}
+
+func TestPatchPeripheralInvalid(t *testing.T) {
+	db := newTestDatabase(t)
+	addTestPeripheral(t, db, "sn-1", 0)
+
+	p, _ := db.GetPeripheralBySerial("sn-1")
+	p.Name = "Kitchen"
+	if err := db.PatchPeripheral(p, PeripheralMetadataUpdate{Attributes: &map[string]string{" ": "x"}}); err == nil {
+		t.Error("PatchPeripheral() with an empty attribute key succeeded")
+	}
+
+	if p, _ := db.GetPeripheralBySerial("sn-1"); p.Name != "" {
+		t.Errorf("name = %q, want the update to be rejected", p.Name)
+	}
+}
+
+func TestPatchPeripheralRollback(t *testing.T) {
+	db := newTestDatabase(t)
+	addTestPeripheral(t, db, "sn-1", 0)
+
+	// Make the last step of the update fail.
+	if _, err := db.db.Exec(`DROP TABLE peripheral_fields`); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Peripheral{SerialNumber: "sn-1", Name: "Kitchen", Type: PeripheralTypeSensor}
+	err := db.PatchPeripheral(p, PeripheralMetadataUpdate{
+		Tags:   &[]string{"a"},
+		Fields: &[]FieldDefinition{{Name: "temperature", DataType: FieldDataTypeNumber}},
+	})
+	if err == nil {
+		t.Fatal("PatchPeripheral() succeeded without a fields table")
+	}
+
+	if got := countRows(t, db, `SELECT COUNT(*) FROM peripheral_tags`); got != 0 {
+		t.Errorf("tags = %d, want the update to be rolled back", got)
+	}
+
+	if got := countRows(t, db, `SELECT COUNT(*) FROM peripherals WHERE name = 'Kitchen'`); got != 0 {
+		t.Error("name was updated, want the update to be rolled back")
+	}
+}
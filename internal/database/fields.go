@@ -0,0 +1,148 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+)
+
+// FieldDataType is the data type of a field in Reading.Data.
+type FieldDataType string
+
+const (
+	FieldDataTypeNumber  FieldDataType = "number"
+	FieldDataTypeInteger FieldDataType = "integer"
+	FieldDataTypeBoolean FieldDataType = "boolean"
+	FieldDataTypeString  FieldDataType = "string"
+)
+
+// FieldDefinition describes a field that a peripheral is expected to report in Reading.Data. Field
+// definitions can be attached to a peripheral type, and overridden (by name) per peripheral.
+type FieldDefinition struct {
+	// Name is the key of the field in Reading.Data (e.g. "t").
+	Name string `json:"name"`
+	// DisplayName is the human-readable name of the field (e.g. "Temperature").
+	DisplayName string        `json:"display_name,omitempty"`
+	Unit        string        `json:"unit,omitempty"`
+	DataType    FieldDataType `json:"data_type,omitempty"`
+	// Precision is the number of decimal places the field should be displayed with.
+	Precision   *int     `json:"precision,omitempty"`
+	Min         *float64 `json:"min,omitempty"`
+	Max         *float64 `json:"max,omitempty"`
+	Description string   `json:"description,omitempty"`
+}
+
+// Validate checks that the field definition is well-formed.
+func (f *FieldDefinition) Validate() error {
+	if f.Name == "" {
+		return errors.New("field name is required")
+	}
+
+	switch f.DataType {
+	case "", FieldDataTypeNumber, FieldDataTypeInteger, FieldDataTypeBoolean, FieldDataTypeString:
+	default:
+		return errors.New("invalid data type for field " + f.Name + ": " + string(f.DataType))
+	}
+
+	if f.Precision != nil && *f.Precision < 0 {
+		return errors.New("precision must not be negative for field " + f.Name)
+	}
+
+	if f.Min != nil && f.Max != nil && *f.Min > *f.Max {
+		return errors.New("min must not be greater than max for field " + f.Name)
+	}
+
+	return nil
+}
+
+// ValidateFieldDefinitions checks that every field definition is well-formed and that no name is
+// used twice.
+func ValidateFieldDefinitions(fields []FieldDefinition) error {
+	seen := make(map[string]bool, len(fields))
+	for i := range fields {
+		if err := fields[i].Validate(); err != nil {
+			return err
+		} else if seen[fields[i].Name] {
+			return errors.New("duplicate field: " + fields[i].Name)
+		}
+
+		seen[fields[i].Name] = true
+	}
+
+	return nil
+}
+
+func (d *Database) initFieldsSchema() error {
+	fieldsTable := `
+	CREATE TABLE IF NOT EXISTS peripheral_fields (
+		serial_number TEXT NOT NULL,
+		name TEXT NOT NULL,
+		definition JSON NOT NULL,
+		PRIMARY KEY(serial_number, name),
+		FOREIGN KEY(serial_number) REFERENCES peripherals(serial_number) ON DELETE CASCADE
+	);`
+
+	_, err := d.db.Exec(fieldsTable)
+	return err
+}
+
+// setPeripheralFields replaces the per-peripheral field definitions of a peripheral. These override
+// the field definitions of the peripheral's type with the same name.
+func setPeripheralFields(tx *sql.Tx, serial string, fields []FieldDefinition) error {
+	if _, err := tx.Exec(`DELETE FROM peripheral_fields WHERE serial_number = ?`, serial); err != nil {
+		return err
+	}
+
+	for _, field := range fields {
+		definition, err := json.Marshal(field)
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(
+			`INSERT INTO peripheral_fields (serial_number, name, definition) VALUES (?, ?, ?)`,
+			serial, field.Name, string(definition),
+		); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetFieldDefinitions returns the effective field definitions of a peripheral: the fields of its
+// type, overridden by (and extended with) the peripheral's own fields. Nil is returned if the
+// peripheral does not exist.
+func (d *Database) GetFieldDefinitions(serial string) ([]FieldDefinition, error) {
+	peripheral, err := d.GetPeripheralBySerial(serial)
+	if err != nil || peripheral == nil {
+		return nil, err
+	}
+
+	t, err := d.GetPeripheralType(peripheral.Type)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields []FieldDefinition
+	if t != nil {
+		fields = append(fields, t.Fields...)
+	}
+
+	for _, override := range peripheral.Fields {
+		replaced := false
+		for i := range fields {
+			if fields[i].Name == override.Name {
+				fields[i] = override
+				replaced = true
+				break
+			}
+		}
+
+		if !replaced {
+			fields = append(fields, override)
+		}
+	}
+
+	return fields, nil
+}
@@ -0,0 +1,72 @@
+package database
+
+import "testing"
+
+func TestValidateFieldDefinitions(t *testing.T) {
+	negative, zero, one := -1, 0.0, 1.0
+
+	tests := []struct {
+		name    string
+		fields  []FieldDefinition
+		wantErr bool
+	}{
+		{name: "empty"},
+		{name: "valid", fields: []FieldDefinition{{Name: "t", DataType: FieldDataTypeNumber, Min: &zero, Max: &one}}},
+		{name: "missing name", fields: []FieldDefinition{{DataType: FieldDataTypeNumber}}, wantErr: true},
+		{name: "invalid data type", fields: []FieldDefinition{{Name: "t", DataType: "float"}}, wantErr: true},
+		{name: "negative precision", fields: []FieldDefinition{{Name: "t", Precision: &negative}}, wantErr: true},
+		{name: "min above max", fields: []FieldDefinition{{Name: "t", Min: &one, Max: &zero}}, wantErr: true},
+		{name: "duplicate name", fields: []FieldDefinition{{Name: "t"}, {Name: "t"}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateFieldDefinitions(tt.fields); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateFieldDefinitions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGetFieldDefinitions(t *testing.T) {
+	db := newTestDatabase(t)
+
+	thermostat := &PeripheralTypeDefinition{
+		Name:   "Thermostat",
+		Fields: []FieldDefinition{{Name: "t", Unit: "°C"}, {Name: "h", Unit: "%"}},
+	}
+	if err := db.AddPeripheralType(thermostat); err != nil {
+		t.Fatalf("AddPeripheralType() error = %v", err)
+	}
+
+	p := &Peripheral{SerialNumber: "sn-1", Type: thermostat.ID}
+	if err := db.AddPeripheral(p); err != nil {
+		t.Fatalf("AddPeripheral() error = %v", err)
+	}
+
+	// The peripheral's own fields override those of its type with the same name.
+	err := db.PatchPeripheral(p, PeripheralMetadataUpdate{
+		Fields: &[]FieldDefinition{{Name: "t", Unit: "°F"}, {Name: "battery", Unit: "V"}},
+	})
+	if err != nil {
+		t.Fatalf("PatchPeripheral() error = %v", err)
+	}
+
+	fields, err := db.GetFieldDefinitions("sn-1")
+	if err != nil {
+		t.Fatalf("GetFieldDefinitions() error = %v", err)
+	}
+
+	units := map[string]string{}
+	for _, field := range fields {
+		units[field.Name] = field.Unit
+	}
+
+	if len(fields) != 3 || units["t"] != "°F" || units["h"] != "%" || units["battery"] != "V" {
+		t.Errorf("GetFieldDefinitions() = %+v", fields)
+	}
+
+	if fields, err := db.GetFieldDefinitions("missing"); err != nil || fields != nil {
+		t.Errorf("GetFieldDefinitions(missing) = %v, %v, want nil, nil", fields, err)
+	}
+}
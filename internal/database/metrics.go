@@ -0,0 +1,53 @@
+package database
+
+import (
+	"database/sql"
+	"hafh-server/internal/metrics"
+	"strings"
+	"time"
+	"unicode"
+)
+
+var queryDuration = metrics.NewHistogram("hafh_db_query_duration_seconds",
+	"Time taken to run database queries outside of transactions, by operation (e.g. select).", nil, "operation")
+
+// timedDB is a [sql.DB] that measures the latency of its queries.
+type timedDB struct {
+	*sql.DB
+}
+
+func (db *timedDB) Exec(query string, args ...any) (sql.Result, error) {
+	defer observeQuery(query, time.Now())
+	return db.DB.Exec(query, args...)
+}
+
+func (db *timedDB) Query(query string, args ...any) (*sql.Rows, error) {
+	defer observeQuery(query, time.Now())
+	return db.DB.Query(query, args...)
+}
+
+func (db *timedDB) QueryRow(query string, args ...any) *sql.Row {
+	defer observeQuery(query, time.Now())
+	return db.DB.QueryRow(query, args...)
+}
+
+// observeQuery records the latency of a query, labelled with its first keyword.
+func observeQuery(query string, start time.Time) {
+	query = strings.TrimSpace(query)
+	operation := "unknown"
+	if i := strings.IndexFunc(query, unicode.IsSpace); i > 0 {
+		operation = strings.ToLower(query[:i])
+	}
+
+	queryDuration.Observe(time.Since(start).Seconds(), operation)
+}
+
+// registerMetrics exports the size of the database as a metric.
+func registerMetrics(d *Database) {
+	metrics.NewGaugeFunc("hafh_db_size_bytes", "Size of the database file.", nil,
+		func(emit func(float64, ...string)) {
+			if size, err := d.Size(); err == nil {
+				emit(float64(size))
+			}
+		})
+}
@@ -0,0 +1,383 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// sqliteTimestampLayout is the layout SQLite uses for CURRENT_TIMESTAMP, allowing Go times to be
+// compared against stored timestamps.
+const sqliteTimestampLayout = "2006-01-02 15:04:05"
+
+const peripheralColumns = `serial_number, type, name, room_id, last_seen_at, created_at`
+
+// PeripheralFilter narrows down the peripherals returned by [Database.FindPeripherals]. Zero-valued
+// fields are ignored.
+type PeripheralFilter struct {
+	RoomID *int64
+	Tag    string
+	Type   *PeripheralType
+	// Online filters peripherals by whether they have reported a reading within OfflineAfter.
+	Online       *bool
+	OfflineAfter time.Duration
+}
+
+func (d *Database) initPeripheralMetadataSchema() error {
+	tagsTable := `
+	CREATE TABLE IF NOT EXISTS peripheral_tags (
+		serial_number TEXT NOT NULL,
+		tag TEXT NOT NULL,
+		PRIMARY KEY(serial_number, tag),
+		FOREIGN KEY(serial_number) REFERENCES peripherals(serial_number) ON DELETE CASCADE
+	);`
+
+	attributesTable := `
+	CREATE TABLE IF NOT EXISTS peripheral_attributes (
+		serial_number TEXT NOT NULL,
+		key TEXT NOT NULL,
+		value TEXT NOT NULL,
+		PRIMARY KEY(serial_number, key),
+		FOREIGN KEY(serial_number) REFERENCES peripherals(serial_number) ON DELETE CASCADE
+	);`
+
+	for _, table := range []string{tagsTable, attributesTable} {
+		if _, err := d.db.Exec(table); err != nil {
+			return err
+		}
+	}
+
+	if err := d.addColumnIfMissing(
+		"peripherals", "room_id", "INTEGER REFERENCES rooms(id) ON DELETE SET NULL",
+	); err != nil {
+		return err
+	}
+
+	return d.addColumnIfMissing("peripherals", "last_seen_at", "TIMESTAMP")
+}
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanPeripheral(row rowScanner) (*Peripheral, error) {
+	var p Peripheral
+	var name sql.NullString
+	var roomID sql.NullInt64
+	var lastSeenAt sql.NullTime
+	if err := row.Scan(&p.SerialNumber, &p.Type, &name, &roomID, &lastSeenAt, &p.CreatedAt); err != nil {
+		return nil, err
+	}
+
+	// The 'name', 'room_id' and 'last_seen_at' are optional, and may be null.
+	if name.Valid {
+		p.Name = name.String
+	}
+
+	if roomID.Valid {
+		p.RoomID = &roomID.Int64
+	}
+
+	if lastSeenAt.Valid {
+		p.LastSeenAt = &lastSeenAt.Time
+	}
+
+	return &p, nil
+}
+
+// FindPeripherals retrieves all peripherals matching the given filter, including their tags,
+// attributes and fields.
+func (d *Database) FindPeripherals(filter PeripheralFilter) ([]Peripheral, error) {
+	var conditions []string
+	var args []any
+
+	if filter.RoomID != nil {
+		conditions = append(conditions, `room_id = ?`)
+		args = append(args, *filter.RoomID)
+	}
+
+	if filter.Tag != "" {
+		conditions = append(conditions,
+			`serial_number IN (SELECT serial_number FROM peripheral_tags WHERE tag = ?)`)
+		args = append(args, filter.Tag)
+	}
+
+	if filter.Type != nil {
+		conditions = append(conditions, `type = ?`)
+		args = append(args, *filter.Type)
+	}
+
+	if filter.Online != nil {
+		cutoff := time.Now().UTC().Add(-filter.OfflineAfter).Format(sqliteTimestampLayout)
+		if *filter.Online {
+			conditions = append(conditions, `last_seen_at >= ?`)
+		} else {
+			conditions = append(conditions, `(last_seen_at IS NULL OR last_seen_at < ?)`)
+		}
+		args = append(args, cutoff)
+	}
+
+	query := `SELECT ` + peripheralColumns + ` FROM peripherals`
+	if len(conditions) > 0 {
+		query += ` WHERE ` + strings.Join(conditions, ` AND `)
+	}
+
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var peripherals []Peripheral
+	for rows.Next() {
+		p, err := scanPeripheral(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		peripherals = append(peripherals, *p)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// The connection must be released before the metadata can be queried.
+	rows.Close()
+	if err := d.loadPeripheralMetadata(peripherals); err != nil {
+		return nil, err
+	}
+
+	return peripherals, nil
+}
+
+// loadPeripheralMetadata populates the tags, attributes, fields and virtual definitions of the given
+// peripherals in place.
+func (d *Database) loadPeripheralMetadata(peripherals []Peripheral) error {
+	if len(peripherals) == 0 {
+		return nil
+	}
+
+	index := make(map[string]*Peripheral, len(peripherals))
+	for i := range peripherals {
+		peripherals[i].Tags = []string{}
+		peripherals[i].Attributes = map[string]string{}
+		peripherals[i].Fields = []FieldDefinition{}
+		index[peripherals[i].SerialNumber] = &peripherals[i]
+	}
+
+	where, args := serialFilter(index)
+	tagRows, err := d.db.Query(`SELECT serial_number, tag FROM peripheral_tags`+where+` ORDER BY tag`, args...)
+	if err != nil {
+		return err
+	}
+
+	defer tagRows.Close()
+
+	for tagRows.Next() {
+		var serial, tag string
+		if err := tagRows.Scan(&serial, &tag); err != nil {
+			return err
+		}
+
+		if p, ok := index[serial]; ok {
+			p.Tags = append(p.Tags, tag)
+		}
+	}
+
+	if err := tagRows.Err(); err != nil {
+		return err
+	}
+
+	tagRows.Close()
+	attributeRows, err := d.db.Query(`SELECT serial_number, key, value FROM peripheral_attributes`+where, args...)
+	if err != nil {
+		return err
+	}
+
+	defer attributeRows.Close()
+
+	for attributeRows.Next() {
+		var serial, key, value string
+		if err := attributeRows.Scan(&serial, &key, &value); err != nil {
+			return err
+		}
+
+		if p, ok := index[serial]; ok {
+			p.Attributes[key] = value
+		}
+	}
+
+	if err := attributeRows.Err(); err != nil {
+		return err
+	}
+
+	attributeRows.Close()
+	fieldRows, err := d.db.Query(`SELECT serial_number, definition FROM peripheral_fields`+where+` ORDER BY name`, args...)
+	if err != nil {
+		return err
+	}
+
+	defer fieldRows.Close()
+
+	for fieldRows.Next() {
+		var serial, definition string
+		if err := fieldRows.Scan(&serial, &definition); err != nil {
+			return err
+		}
+
+		var field FieldDefinition
+		if err := json.Unmarshal([]byte(definition), &field); err != nil {
+			return err
+		}
+
+		if p, ok := index[serial]; ok {
+			p.Fields = append(p.Fields, field)
+		}
+	}
+
+	if err := fieldRows.Err(); err != nil {
+		return err
+	}
+
+	fieldRows.Close()
+	return d.loadVirtualDefinitions(index, where, args)
+}
+
+// maxFilteredSerials is the largest number of peripherals whose metadata is queried by serial
+// number. Beyond it, the tables are read in full, which is cheaper than a long IN list and stays
+// below SQLite's limit on the number of parameters.
+const maxFilteredSerials = 500
+
+// serialFilter returns the WHERE clause (and its arguments) that restricts a metadata query to the
+// given (indexed) peripherals, or an empty clause if there are too many of them.
+func serialFilter(index map[string]*Peripheral) (string, []any) {
+	if len(index) > maxFilteredSerials {
+		return "", nil
+	}
+
+	args := make([]any, 0, len(index))
+	for serial := range index {
+		args = append(args, serial)
+	}
+
+	if len(args) == 1 {
+		return ` WHERE serial_number = ?`, args
+	}
+
+	return ` WHERE serial_number IN (?` + strings.Repeat(`, ?`, len(args)-1) + `)`, args
+}
+
+// PeripheralMetadataUpdate is the metadata replaced by [Database.PatchPeripheral]. Nil fields are
+// left unchanged.
+type PeripheralMetadataUpdate struct {
+	Tags       *[]string
+	Attributes *map[string]string
+	Fields     *[]FieldDefinition
+}
+
+// PatchPeripheral updates the name, type and room of a peripheral, and replaces the metadata set in
+// update, in a single transaction: either every change is applied or none is.
+func (d *Database) PatchPeripheral(p *Peripheral, update PeripheralMetadataUpdate) error {
+	if update.Attributes != nil {
+		if err := ValidatePeripheralAttributes(*update.Attributes); err != nil {
+			return err
+		}
+	}
+
+	if update.Fields != nil {
+		if err := ValidateFieldDefinitions(*update.Fields); err != nil {
+			return err
+		}
+	}
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(
+		`UPDATE peripherals SET name = ?, type = ?, room_id = ? WHERE serial_number = ?`,
+		p.Name, p.Type, p.RoomID, p.SerialNumber,
+	); err != nil {
+		return err
+	}
+
+	if update.Tags != nil {
+		if err := setPeripheralTags(tx, p.SerialNumber, *update.Tags); err != nil {
+			return err
+		}
+	}
+
+	if update.Attributes != nil {
+		if err := setPeripheralAttributes(tx, p.SerialNumber, *update.Attributes); err != nil {
+			return err
+		}
+	}
+
+	if update.Fields != nil {
+		if err := setPeripheralFields(tx, p.SerialNumber, *update.Fields); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// ValidatePeripheralAttributes checks that no attribute key is empty.
+func ValidatePeripheralAttributes(attributes map[string]string) error {
+	for key := range attributes {
+		if strings.TrimSpace(key) == "" {
+			return errors.New("attribute keys cannot be empty")
+		}
+	}
+
+	return nil
+}
+
+// setPeripheralTags replaces all tags of a peripheral. Tags are trimmed and empty tags are ignored.
+func setPeripheralTags(tx *sql.Tx, serial string, tags []string) error {
+	if _, err := tx.Exec(`DELETE FROM peripheral_tags WHERE serial_number = ?`, serial); err != nil {
+		return err
+	}
+
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+
+		if _, err := tx.Exec(
+			`INSERT OR IGNORE INTO peripheral_tags (serial_number, tag) VALUES (?, ?)`,
+			serial, tag,
+		); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setPeripheralAttributes replaces all key/value attributes of a peripheral.
+func setPeripheralAttributes(tx *sql.Tx, serial string, attributes map[string]string) error {
+	if _, err := tx.Exec(`DELETE FROM peripheral_attributes WHERE serial_number = ?`, serial); err != nil {
+		return err
+	}
+
+	for key, value := range attributes {
+		if _, err := tx.Exec(
+			`INSERT INTO peripheral_attributes (serial_number, key, value) VALUES (?, ?, ?)`,
+			serial, key, value,
+		); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,263 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+var (
+	// ErrPeripheralTypeNotFound is returned when an operation targets a peripheral type that does
+	// not exist.
+	ErrPeripheralTypeNotFound = errors.New("peripheral type not found")
+	// ErrPeripheralTypeInUse is returned when deleting a peripheral type that is still assigned to
+	// at least one peripheral.
+	ErrPeripheralTypeInUse = errors.New("peripheral type is in use")
+	// ErrPeripheralTypeBuiltIn is returned when deleting or renaming one of the built-in types.
+	ErrPeripheralTypeBuiltIn = errors.New("built-in peripheral types cannot be deleted or renamed")
+	// ErrPeripheralTypeNameTaken is returned when adding or renaming a peripheral type to a name
+	// that another type already has.
+	ErrPeripheralTypeNameTaken = errors.New("peripheral type name is already taken")
+)
+
+// builtInPeripheralTypes are always present in the registry, keeping the integer values of the
+// original PeripheralType enum stable.
+var builtInPeripheralTypes = []PeripheralType{
+	PeripheralTypeUnknown,
+	PeripheralTypeSensor,
+	PeripheralTypeActuator,
+	PeripheralTypeController,
+}
+
+// PeripheralTypeDefinition describes a type of peripheral in the type registry.
+type PeripheralTypeDefinition struct {
+	ID          PeripheralType    `json:"id"`
+	Name        string            `json:"name"`
+	Description string            `json:"description"`
+	Fields      []FieldDefinition `json:"fields"`
+	Commands    []string          `json:"commands"`
+	BuiltIn     bool              `json:"built_in"`
+	CreatedAt   time.Time         `json:"created_at"`
+}
+
+// IsBuiltIn returns true if the peripheral type is one of the original, built-in types.
+func (pt PeripheralType) IsBuiltIn() bool {
+	for _, builtIn := range builtInPeripheralTypes {
+		if pt == builtIn {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (d *Database) initPeripheralTypesSchema() error {
+	typesTable := `
+	CREATE TABLE IF NOT EXISTS peripheral_types (
+		id INTEGER PRIMARY KEY,
+		name TEXT NOT NULL UNIQUE,
+		description TEXT NOT NULL DEFAULT '',
+		fields JSON NOT NULL DEFAULT '[]',
+		commands JSON NOT NULL DEFAULT '[]',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);`
+
+	if _, err := d.db.Exec(typesTable); err != nil {
+		return err
+	}
+
+	for _, pt := range builtInPeripheralTypes {
+		if _, err := d.db.Exec(
+			`INSERT OR IGNORE INTO peripheral_types (id, name) VALUES (?, ?)`,
+			pt, pt.String(),
+		); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func scanPeripheralType(row rowScanner) (*PeripheralTypeDefinition, error) {
+	var t PeripheralTypeDefinition
+	var fields, commands string
+	if err := row.Scan(&t.ID, &t.Name, &t.Description, &fields, &commands, &t.CreatedAt); err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal([]byte(fields), &t.Fields); err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal([]byte(commands), &t.Commands); err != nil {
+		return nil, err
+	}
+
+	t.BuiltIn = t.ID.IsBuiltIn()
+	return &t, nil
+}
+
+// marshalPeripheralType serializes the fields and commands of a type, normalizing nil slices so
+// they are stored as empty JSON arrays.
+func marshalPeripheralType(t *PeripheralTypeDefinition) (string, string, error) {
+	if err := ValidateFieldDefinitions(t.Fields); err != nil {
+		return "", "", err
+	}
+
+	if t.Fields == nil {
+		t.Fields = []FieldDefinition{}
+	}
+
+	if t.Commands == nil {
+		t.Commands = []string{}
+	}
+
+	fields, err := json.Marshal(t.Fields)
+	if err != nil {
+		return "", "", err
+	}
+
+	commands, err := json.Marshal(t.Commands)
+	if err != nil {
+		return "", "", err
+	}
+
+	return string(fields), string(commands), nil
+}
+
+// AddPeripheralType adds a new peripheral type to the registry, populating its ID on success.
+func (d *Database) AddPeripheralType(t *PeripheralTypeDefinition) error {
+	fields, commands, err := marshalPeripheralType(t)
+	if err != nil {
+		return err
+	}
+
+	result, err := d.db.Exec(
+		`INSERT INTO peripheral_types (name, description, fields, commands) VALUES (?, ?, ?, ?)`,
+		t.Name, t.Description, fields, commands,
+	)
+	if isUniqueViolation(err) {
+		return ErrPeripheralTypeNameTaken
+	} else if err != nil {
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	t.ID = PeripheralType(id)
+	return nil
+}
+
+// UpdatePeripheralType updates an existing peripheral type. Built-in types cannot be renamed.
+func (d *Database) UpdatePeripheralType(t *PeripheralTypeDefinition) error {
+	if t.ID.IsBuiltIn() && t.Name != t.ID.String() {
+		return ErrPeripheralTypeBuiltIn
+	}
+
+	fields, commands, err := marshalPeripheralType(t)
+	if err != nil {
+		return err
+	}
+
+	result, err := d.db.Exec(
+		`UPDATE peripheral_types SET name = ?, description = ?, fields = ?, commands = ? WHERE id = ?`,
+		t.Name, t.Description, fields, commands, t.ID,
+	)
+	if isUniqueViolation(err) {
+		return ErrPeripheralTypeNameTaken
+	} else if err != nil {
+		return err
+	}
+
+	return requireRowsAffected(result, ErrPeripheralTypeNotFound)
+}
+
+// DeletePeripheralType deletes a peripheral type from the registry. Built-in types and types that
+// are assigned to a peripheral cannot be deleted.
+func (d *Database) DeletePeripheralType(id PeripheralType) error {
+	if id.IsBuiltIn() {
+		return ErrPeripheralTypeBuiltIn
+	}
+
+	// The check that the type is unused is part of the deletion, so that a peripheral cannot be
+	// assigned the type in between.
+	result, err := d.db.Exec(
+		`DELETE FROM peripheral_types WHERE id = ? AND NOT EXISTS (SELECT 1 FROM peripherals WHERE type = ?)`,
+		id, id,
+	)
+	if err != nil {
+		return err
+	} else if err := requireRowsAffected(result, ErrPeripheralTypeNotFound); !errors.Is(err, ErrPeripheralTypeNotFound) {
+		return err
+	}
+
+	// Nothing was deleted: either the type does not exist or it is in use.
+	var inUse bool
+	if err := d.db.QueryRow(
+		`SELECT EXISTS (SELECT 1 FROM peripherals WHERE type = ?)`,
+		id,
+	).Scan(&inUse); err != nil {
+		return err
+	} else if inUse {
+		return ErrPeripheralTypeInUse
+	}
+
+	return ErrPeripheralTypeNotFound
+}
+
+// GetPeripheralType retrieves a peripheral type by its ID, returning nil if it does not exist.
+func (d *Database) GetPeripheralType(id PeripheralType) (*PeripheralTypeDefinition, error) {
+	row := d.db.QueryRow(
+		`SELECT id, name, description, fields, commands, created_at FROM peripheral_types WHERE id = ?`,
+		id,
+	)
+
+	t, err := scanPeripheralType(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return t, err
+}
+
+// GetAllPeripheralTypes retrieves all peripheral types from the registry, ordered by ID.
+func (d *Database) GetAllPeripheralTypes() ([]PeripheralTypeDefinition, error) {
+	rows, err := d.db.Query(
+		`SELECT id, name, description, fields, commands, created_at FROM peripheral_types ORDER BY id`,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var types []PeripheralTypeDefinition
+	for rows.Next() {
+		t, err := scanPeripheralType(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		types = append(types, *t)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return types, nil
+}
+
+// isUniqueViolation returns true if err is caused by a UNIQUE (or PRIMARY KEY) constraint.
+func isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) &&
+		(sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique ||
+			sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey)
+}
@@ -0,0 +1,98 @@
+package database
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestAddPeripheralTypeNameTaken(t *testing.T) {
+	db := newTestDatabase(t)
+
+	thermostat := &PeripheralTypeDefinition{Name: "Thermostat"}
+	if err := db.AddPeripheralType(thermostat); err != nil {
+		t.Fatalf("AddPeripheralType() error = %v", err)
+	}
+
+	tests := []struct {
+		name string
+		add  func() error
+	}{
+		{"add existing name", func() error { return db.AddPeripheralType(&PeripheralTypeDefinition{Name: "Thermostat"}) }},
+		{"add built-in name", func() error { return db.AddPeripheralType(&PeripheralTypeDefinition{Name: "Sensor"}) }},
+		{"rename to existing name", func() error {
+			other := &PeripheralTypeDefinition{Name: "Valve"}
+			if err := db.AddPeripheralType(other); err != nil {
+				return err
+			}
+
+			other.Name = "Thermostat"
+			return db.UpdatePeripheralType(other)
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.add(); !errors.Is(err, ErrPeripheralTypeNameTaken) {
+				t.Errorf("error = %v, want %v", err, ErrPeripheralTypeNameTaken)
+			}
+		})
+	}
+}
+
+func TestAddPeripheralTypeInvalid(t *testing.T) {
+	db := newTestDatabase(t)
+
+	// Errors other than a name conflict must not be reported as one.
+	err := db.AddPeripheralType(&PeripheralTypeDefinition{
+		Name:   "Thermostat",
+		Fields: []FieldDefinition{{Name: "t"}, {Name: "t"}},
+	})
+	if err == nil || errors.Is(err, ErrPeripheralTypeNameTaken) {
+		t.Errorf("error = %v, want a validation error", err)
+	}
+}
+
+func TestDeletePeripheralType(t *testing.T) {
+	db := newTestDatabase(t)
+
+	thermostat := &PeripheralTypeDefinition{Name: "Thermostat"}
+	if err := db.AddPeripheralType(thermostat); err != nil {
+		t.Fatalf("AddPeripheralType() error = %v", err)
+	}
+
+	if err := db.AddPeripheral(&Peripheral{SerialNumber: "sn-1", Type: thermostat.ID}); err != nil {
+		t.Fatalf("AddPeripheral() error = %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		id      PeripheralType
+		wantErr error
+	}{
+		{"built-in", PeripheralTypeSensor, ErrPeripheralTypeBuiltIn},
+		{"in use", thermostat.ID, ErrPeripheralTypeInUse},
+		{"missing", thermostat.ID + 1, ErrPeripheralTypeNotFound},
+	}
+
+	for _, tt := range tests {
+		if err := db.DeletePeripheralType(tt.id); !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: DeletePeripheralType() error = %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+
+	if got, err := db.GetPeripheralType(thermostat.ID); err != nil || got == nil {
+		t.Fatalf("GetPeripheralType() = %v, %v, want the type in use", got, err)
+	}
+
+	if err := db.DeletePeripheral("sn-1", ReadingsDeleteModeRestrict); err != nil {
+		t.Fatalf("DeletePeripheral() error = %v", err)
+	}
+
+	if err := db.DeletePeripheralType(thermostat.ID); err != nil {
+		t.Errorf("DeletePeripheralType() of an unused type error = %v", err)
+	}
+
+	if got, err := db.GetPeripheralType(thermostat.ID); err != nil || got != nil {
+		t.Errorf("GetPeripheralType() after deleting = %v, %v, want nil", got, err)
+	}
+}
@@ -0,0 +1,127 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ErrRoomNotFound is returned when an operation targets a room that does not exist.
+var ErrRoomNotFound = errors.New("room not found")
+
+// Room represents a room (or zone) that peripherals can be grouped into.
+type Room struct {
+	ID          int64     `json:"id"`
+	Name        string    `json:"name"`
+	Floor       string    `json:"floor"`
+	Description string    `json:"description"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+func (d *Database) initRoomsSchema() error {
+	roomsTable := `
+	CREATE TABLE IF NOT EXISTS rooms (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL UNIQUE,
+		floor TEXT NOT NULL DEFAULT '',
+		description TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);`
+
+	_, err := d.db.Exec(roomsTable)
+	return err
+}
+
+// AddRoom adds a new room to the database, populating its ID on success.
+func (d *Database) AddRoom(r *Room) error {
+	result, err := d.db.Exec(
+		`INSERT INTO rooms (name, floor, description) VALUES (?, ?, ?)`,
+		r.Name, r.Floor, r.Description,
+	)
+	if err != nil {
+		return err
+	}
+
+	r.ID, err = result.LastInsertId()
+	return err
+}
+
+// UpdateRoom updates the name, floor and description of an existing room.
+func (d *Database) UpdateRoom(r *Room) error {
+	result, err := d.db.Exec(
+		`UPDATE rooms SET name = ?, floor = ?, description = ? WHERE id = ?`,
+		r.Name, r.Floor, r.Description, r.ID,
+	)
+	if err != nil {
+		return err
+	}
+
+	return requireRowsAffected(result, ErrRoomNotFound)
+}
+
+// DeleteRoom deletes a room. Peripherals in the room are left without a room.
+func (d *Database) DeleteRoom(id int64) error {
+	result, err := d.db.Exec(`DELETE FROM rooms WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+
+	return requireRowsAffected(result, ErrRoomNotFound)
+}
+
+// GetRoom retrieves a room by its ID, returning nil if it does not exist.
+func (d *Database) GetRoom(id int64) (*Room, error) {
+	row := d.db.QueryRow(
+		`SELECT id, name, floor, description, created_at FROM rooms WHERE id = ?`,
+		id,
+	)
+
+	var r Room
+	if err := row.Scan(&r.ID, &r.Name, &r.Floor, &r.Description, &r.CreatedAt); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &r, nil
+}
+
+// GetAllRooms retrieves all rooms from the database, ordered by floor and name.
+func (d *Database) GetAllRooms() ([]Room, error) {
+	rows, err := d.db.Query(
+		`SELECT id, name, floor, description, created_at FROM rooms ORDER BY floor, name`,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var rooms []Room
+	for rows.Next() {
+		var r Room
+		if err := rows.Scan(&r.ID, &r.Name, &r.Floor, &r.Description, &r.CreatedAt); err != nil {
+			return nil, err
+		}
+
+		rooms = append(rooms, r)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return rooms, nil
+}
+
+func requireRowsAffected(result sql.Result, notFound error) error {
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	} else if affected == 0 {
+		return notFound
+	}
+
+	return nil
+}
@@ -0,0 +1,412 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrScheduleNotFound is returned when an operation targets a schedule that does not exist.
+var ErrScheduleNotFound = errors.New("schedule not found")
+
+// ScheduleKind is what a schedule does when it runs.
+type ScheduleKind string
+
+const (
+	// ScheduleKindCommand sends commands to actuators.
+	ScheduleKindCommand ScheduleKind = "command"
+	// ScheduleKindReport summarizes the readings reported since the previous run.
+	ScheduleKindReport ScheduleKind = "report"
+)
+
+// MissedRunPolicy determines what happens to runs that were missed, e.g. while the server was not
+// running.
+type MissedRunPolicy string
+
+const (
+	// MissedRunSkip records missed runs as skipped and waits for the next occurrence.
+	MissedRunSkip MissedRunPolicy = "skip"
+	// MissedRunCatchUp runs the schedule once as soon as possible, however many runs were missed.
+	MissedRunCatchUp MissedRunPolicy = "catch_up"
+)
+
+// ReportOptions configures a report schedule. If neither SerialNumbers nor Tag is set, the report
+// covers every peripheral.
+type ReportOptions struct {
+	SerialNumbers []string `json:"serial_numbers,omitempty"`
+	Tag           string   `json:"tag,omitempty"`
+	// PeriodSeconds is the period the report covers. If zero, it covers the time since the previous
+	// run, or the last 24 hours for the first run.
+	PeriodSeconds int64 `json:"period_seconds,omitempty"`
+}
+
+// Schedule runs commands or reports at the times described by its cron expression (see the cron
+// package).
+type Schedule struct {
+	ID              int64              `json:"id"`
+	Name            string             `json:"name"`
+	Expression      string             `json:"expression"`
+	Kind            ScheduleKind       `json:"kind"`
+	Actions         []AutomationAction `json:"actions,omitempty"`
+	Report          *ReportOptions     `json:"report,omitempty"`
+	MissedRunPolicy MissedRunPolicy    `json:"missed_run_policy"`
+	Enabled         bool               `json:"enabled"`
+	LastRunAt       *time.Time         `json:"last_run_at"`
+	NextRunAt       *time.Time         `json:"next_run_at"`
+	CreatedAt       time.Time          `json:"created_at"`
+}
+
+// Validate checks that the schedule is well-formed. The expression itself is parsed by the caller.
+func (s *Schedule) Validate() error {
+	if s.Name == "" {
+		return errors.New("name is required")
+	} else if s.Expression == "" {
+		return errors.New("expression is required")
+	} else if s.MissedRunPolicy != MissedRunSkip && s.MissedRunPolicy != MissedRunCatchUp {
+		return errors.New("invalid missed run policy: " + string(s.MissedRunPolicy))
+	}
+
+	switch s.Kind {
+	case ScheduleKindCommand:
+		if len(s.Actions) == 0 {
+			return errors.New("at least one action is required")
+		}
+
+		for i, action := range s.Actions {
+			if action.SerialNumber == "" {
+				return fmt.Errorf("action %d: serial_number is required", i)
+			} else if action.Command == "" {
+				return fmt.Errorf("action %d: command is required", i)
+			}
+		}
+	case ScheduleKindReport:
+		if s.Report != nil && s.Report.PeriodSeconds < 0 {
+			return errors.New("report period must not be negative")
+		}
+	default:
+		return errors.New("invalid kind: " + string(s.Kind))
+	}
+
+	return nil
+}
+
+// ScheduleRunStatus is the outcome of a schedule run.
+type ScheduleRunStatus string
+
+const (
+	ScheduleRunSucceeded ScheduleRunStatus = "succeeded"
+	ScheduleRunFailed    ScheduleRunStatus = "failed"
+	ScheduleRunSkipped   ScheduleRunStatus = "skipped"
+)
+
+// ScheduleRun is a record of a schedule running (or being skipped).
+type ScheduleRun struct {
+	ID           int64             `json:"id"`
+	ScheduleID   int64             `json:"schedule_id"`
+	ScheduledFor time.Time         `json:"scheduled_for"`
+	StartedAt    time.Time         `json:"started_at"`
+	Status       ScheduleRunStatus `json:"status"`
+	// Output is the outcome of the run: the action results of a command schedule, or the report.
+	Output json.RawMessage `json:"output,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+func (d *Database) initSchedulesSchema() error {
+	schedulesTable := `
+	CREATE TABLE IF NOT EXISTS schedules (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		expression TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		actions JSON NOT NULL DEFAULT '[]',
+		report JSON,
+		missed_run_policy TEXT NOT NULL,
+		enabled INTEGER NOT NULL DEFAULT 1,
+		last_run_at TIMESTAMP,
+		next_run_at TIMESTAMP,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);`
+
+	runsTable := `
+	CREATE TABLE IF NOT EXISTS schedule_runs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		schedule_id INTEGER NOT NULL,
+		scheduled_for TIMESTAMP NOT NULL,
+		started_at TIMESTAMP NOT NULL,
+		status TEXT NOT NULL,
+		output JSON,
+		error TEXT NOT NULL DEFAULT '',
+		FOREIGN KEY(schedule_id) REFERENCES schedules(id) ON DELETE CASCADE
+	);`
+
+	for _, statement := range []string{schedulesTable, runsTable} {
+		if _, err := d.db.Exec(statement); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+const scheduleColumns = `id, name, expression, kind, actions, report, missed_run_policy, enabled,
+	last_run_at, next_run_at, created_at`
+
+func scanSchedule(row rowScanner) (*Schedule, error) {
+	var s Schedule
+	var actions string
+	var report sql.NullString
+	var lastRunAt, nextRunAt sql.NullTime
+	if err := row.Scan(&s.ID, &s.Name, &s.Expression, &s.Kind, &actions, &report, &s.MissedRunPolicy,
+		&s.Enabled, &lastRunAt, &nextRunAt, &s.CreatedAt); err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal([]byte(actions), &s.Actions); err != nil {
+		return nil, err
+	}
+
+	if report.Valid {
+		if err := json.Unmarshal([]byte(report.String), &s.Report); err != nil {
+			return nil, err
+		}
+	}
+
+	if lastRunAt.Valid {
+		s.LastRunAt = &lastRunAt.Time
+	}
+
+	if nextRunAt.Valid {
+		s.NextRunAt = &nextRunAt.Time
+	}
+
+	return &s, nil
+}
+
+// marshalSchedule validates the schedule and serializes its actions and report options.
+func marshalSchedule(s *Schedule) (string, any, error) {
+	if err := s.Validate(); err != nil {
+		return "", nil, err
+	}
+
+	if s.Actions == nil {
+		s.Actions = []AutomationAction{}
+	}
+
+	actions, err := json.Marshal(s.Actions)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var report any
+	if s.Report != nil {
+		data, err := json.Marshal(s.Report)
+		if err != nil {
+			return "", nil, err
+		}
+		report = string(data)
+	}
+
+	return string(actions), report, nil
+}
+
+// nullableTimestamp formats an optional time for storage, so that it compares correctly with
+// CURRENT_TIMESTAMP.
+func nullableTimestamp(t *time.Time) any {
+	if t == nil {
+		return nil
+	}
+
+	return t.UTC().Format(sqliteTimestampLayout)
+}
+
+// AddSchedule adds a new schedule, populating its ID on success.
+func (d *Database) AddSchedule(s *Schedule) error {
+	actions, report, err := marshalSchedule(s)
+	if err != nil {
+		return err
+	}
+
+	result, err := d.db.Exec(
+		`INSERT INTO schedules
+		 (name, expression, kind, actions, report, missed_run_policy, enabled, next_run_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		s.Name, s.Expression, s.Kind, actions, report, s.MissedRunPolicy, s.Enabled,
+		nullableTimestamp(s.NextRunAt),
+	)
+	if err != nil {
+		return err
+	}
+
+	s.ID, err = result.LastInsertId()
+	return err
+}
+
+// UpdateSchedule updates an existing schedule, including its next run time.
+func (d *Database) UpdateSchedule(s *Schedule) error {
+	actions, report, err := marshalSchedule(s)
+	if err != nil {
+		return err
+	}
+
+	result, err := d.db.Exec(
+		`UPDATE schedules SET name = ?, expression = ?, kind = ?, actions = ?, report = ?,
+		 missed_run_policy = ?, enabled = ?, next_run_at = ? WHERE id = ?`,
+		s.Name, s.Expression, s.Kind, actions, report, s.MissedRunPolicy, s.Enabled,
+		nullableTimestamp(s.NextRunAt), s.ID,
+	)
+	if err != nil {
+		return err
+	}
+
+	return requireRowsAffected(result, ErrScheduleNotFound)
+}
+
+// DeleteSchedule deletes a schedule along with its run history.
+func (d *Database) DeleteSchedule(id int64) error {
+	result, err := d.db.Exec(`DELETE FROM schedules WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+
+	return requireRowsAffected(result, ErrScheduleNotFound)
+}
+
+// GetSchedule retrieves a schedule by its ID, returning nil if it does not exist.
+func (d *Database) GetSchedule(id int64) (*Schedule, error) {
+	row := d.db.QueryRow(`SELECT `+scheduleColumns+` FROM schedules WHERE id = ?`, id)
+
+	s, err := scanSchedule(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return s, err
+}
+
+// GetSchedules retrieves all schedules, or only the enabled ones if enabledOnly is true.
+func (d *Database) GetSchedules(enabledOnly bool) ([]Schedule, error) {
+	query := `SELECT ` + scheduleColumns + ` FROM schedules`
+	if enabledOnly {
+		query += ` WHERE enabled = 1`
+	}
+
+	rows, err := d.db.Query(query + ` ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	schedules := []Schedule{}
+	for rows.Next() {
+		s, err := scanSchedule(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		schedules = append(schedules, *s)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return schedules, nil
+}
+
+// SetScheduleNextRun sets when a schedule runs next, without recording a run.
+func (d *Database) SetScheduleNextRun(id int64, nextRunAt *time.Time) error {
+	_, err := d.db.Exec(
+		`UPDATE schedules SET next_run_at = ? WHERE id = ?`, nullableTimestamp(nextRunAt), id,
+	)
+
+	return err
+}
+
+// RecordScheduleRun stores a run of a schedule and sets when it runs next. Skipped runs do not
+// update the schedule's last run time.
+func (d *Database) RecordScheduleRun(run *ScheduleRun, nextRunAt *time.Time) error {
+	var output any
+	if len(run.Output) > 0 {
+		output = string(run.Output)
+	}
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		`INSERT INTO schedule_runs (schedule_id, scheduled_for, started_at, status, output, error)
+		 VALUES (?, ?, ?, ?, ?, ?)`,
+		run.ScheduleID, nullableTimestamp(&run.ScheduledFor), nullableTimestamp(&run.StartedAt),
+		run.Status, output, run.Error,
+	)
+	if err != nil {
+		return err
+	}
+
+	if run.ID, err = result.LastInsertId(); err != nil {
+		return err
+	}
+
+	if run.Status == ScheduleRunSkipped {
+		_, err = tx.Exec(
+			`UPDATE schedules SET next_run_at = ? WHERE id = ?`,
+			nullableTimestamp(nextRunAt), run.ScheduleID,
+		)
+	} else {
+		_, err = tx.Exec(
+			`UPDATE schedules SET last_run_at = ?, next_run_at = ? WHERE id = ?`,
+			nullableTimestamp(&run.StartedAt), nullableTimestamp(nextRunAt), run.ScheduleID,
+		)
+	}
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetScheduleRuns retrieves the most recent `limit` runs of a schedule.
+func (d *Database) GetScheduleRuns(scheduleID int64, limit uint32) ([]ScheduleRun, error) {
+	rows, err := d.db.Query(
+		`SELECT id, schedule_id, scheduled_for, started_at, status, output, error
+		 FROM schedule_runs
+		 WHERE schedule_id = ?
+		 ORDER BY started_at DESC, id DESC
+		 LIMIT ?`,
+		scheduleID, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	runs := []ScheduleRun{}
+	for rows.Next() {
+		var r ScheduleRun
+		var output sql.NullString
+		if err := rows.Scan(&r.ID, &r.ScheduleID, &r.ScheduledFor, &r.StartedAt, &r.Status, &output,
+			&r.Error); err != nil {
+			return nil, err
+		}
+
+		if output.Valid {
+			r.Output = json.RawMessage(output.String)
+		}
+
+		runs = append(runs, r)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return runs, nil
+}
@@ -0,0 +1,56 @@
+package database
+
+import (
+	"context"
+	"strings"
+)
+
+// Ping checks that the database can be reached.
+func (d *Database) Ping(ctx context.Context) error {
+	return d.db.PingContext(ctx)
+}
+
+// Size returns the size of the database in bytes.
+func (d *Database) Size() (int64, error) {
+	var size int64
+	err := d.db.QueryRow(`SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size()`).Scan(&size)
+	return size, err
+}
+
+// RowCounts returns the number of rows of every table, keyed by table name.
+func (d *Database) RowCounts() (map[string]int64, error) {
+	rows, err := d.db.Query(`SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%'`)
+	if err != nil {
+		return nil, err
+	}
+
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		tables = append(tables, table)
+	}
+
+	// The rows must be closed before the next query, as there is a single connection.
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int64, len(tables))
+	for _, table := range tables {
+		var count int64
+		quoted := `"` + strings.ReplaceAll(table, `"`, `""`) + `"`
+		if err := d.db.QueryRow(`SELECT COUNT(*) FROM ` + quoted).Scan(&count); err != nil {
+			return nil, err
+		}
+
+		counts[table] = count
+	}
+
+	return counts, nil
+}
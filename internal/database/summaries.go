@@ -0,0 +1,108 @@
+package database
+
+import (
+	"encoding/json"
+	"math"
+	"strings"
+	"time"
+)
+
+// FieldSummary summarizes the values of a numeric field over a period.
+type FieldSummary struct {
+	Count int     `json:"count"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Mean  float64 `json:"mean"`
+	Last  float64 `json:"last"`
+}
+
+// ReadingSummary summarizes the readings of a peripheral over a period.
+type ReadingSummary struct {
+	SerialNumber string                   `json:"serial_number"`
+	Readings     int                      `json:"readings"`
+	Fields       map[string]*FieldSummary `json:"fields"`
+}
+
+// SummarizeReadings summarizes the numeric (and boolean, as 0 or 1) top-level fields of the readings
+// stored in [from, to), per peripheral. If serials is not empty, only those peripherals are
+// included.
+func (d *Database) SummarizeReadings(from, to time.Time, serials []string) ([]ReadingSummary, error) {
+	query := `SELECT serial_number, data FROM readings WHERE timestamp >= ? AND timestamp < ?`
+	args := []any{from.UTC().Format(sqliteTimestampLayout), to.UTC().Format(sqliteTimestampLayout)}
+
+	if len(serials) > 0 {
+		query += ` AND serial_number IN (?` + strings.Repeat(`, ?`, len(serials)-1) + `)`
+		for _, serial := range serials {
+			args = append(args, serial)
+		}
+	}
+
+	rows, err := d.db.Query(query+` ORDER BY serial_number, timestamp, id`, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	summaries := []ReadingSummary{}
+	var current *ReadingSummary
+	for rows.Next() {
+		var serial, rawData string
+		if err := rows.Scan(&serial, &rawData); err != nil {
+			return nil, err
+		}
+
+		var data map[string]any
+		if err := json.Unmarshal([]byte(rawData), &data); err != nil {
+			return nil, err
+		}
+
+		if current == nil || current.SerialNumber != serial {
+			summaries = append(summaries, ReadingSummary{
+				SerialNumber: serial,
+				Fields:       map[string]*FieldSummary{},
+			})
+			current = &summaries[len(summaries)-1]
+		}
+
+		current.Readings++
+		for name, value := range data {
+			var v float64
+			switch typed := value.(type) {
+			case float64:
+				v = typed
+			case bool:
+				if typed {
+					v = 1
+				}
+			default:
+				continue
+			}
+
+			field, ok := current.Fields[name]
+			if !ok {
+				field = &FieldSummary{Min: math.Inf(1), Max: math.Inf(-1)}
+				current.Fields[name] = field
+			}
+
+			// The mean is accumulated as a sum and divided below.
+			field.Count++
+			field.Min = math.Min(field.Min, v)
+			field.Max = math.Max(field.Max, v)
+			field.Mean += v
+			field.Last = v
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range summaries {
+		for _, field := range summaries[i].Fields {
+			field.Mean /= float64(field.Count)
+		}
+	}
+
+	return summaries, nil
+}
@@ -0,0 +1,315 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ErrUserNotFound is returned when an operation targets a user that does not exist.
+var ErrUserNotFound = errors.New("user not found")
+
+// Role is the role of a user, which determines the scopes they are granted.
+type Role string
+
+const (
+	// RoleViewer can read readings, peripherals and the rest of the API's state.
+	RoleViewer Role = "viewer"
+	// RoleOperator can also send commands to actuators.
+	RoleOperator Role = "operator"
+	// RoleAdmin can do everything.
+	RoleAdmin Role = "admin"
+)
+
+// IsValid returns true if the role is one of the known roles.
+func (r Role) IsValid() bool {
+	switch r {
+	case RoleViewer, RoleOperator, RoleAdmin:
+		return true
+	default:
+		return false
+	}
+}
+
+// Scopes returns the scopes granted to the role.
+func (r Role) Scopes() []Scope {
+	switch r {
+	case RoleViewer:
+		return []Scope{ScopeReadReadings}
+	case RoleOperator:
+		return []Scope{ScopeReadReadings, ScopeSendCommands}
+	case RoleAdmin:
+		return []Scope{ScopeAdmin}
+	default:
+		return nil
+	}
+}
+
+// User is a person who logs in to the HTTP API with a username and password, or through an OpenID
+// Connect provider.
+type User struct {
+	ID       int64  `json:"id"`
+	Username string `json:"username"`
+	// PasswordHash is the bcrypt hash of the password and is never serialized.
+	PasswordHash string `json:"-"`
+	Role         Role   `json:"role"`
+	// OIDCIssuer and OIDCSubject identify the account of the user at an OpenID Connect provider.
+	// Both are empty for local users.
+	OIDCIssuer  string     `json:"oidc_issuer,omitempty"`
+	OIDCSubject string     `json:"oidc_subject,omitempty"`
+	LastLoginAt *time.Time `json:"last_login_at"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// Session is a logged in session of a user. Only a hash of the session token is stored.
+type Session struct {
+	ID        int64
+	UserID    int64
+	Hash      string
+	ExpiresAt time.Time
+	CreatedAt time.Time
+}
+
+func (d *Database) initUsersSchema() error {
+	usersTable := `
+	CREATE TABLE IF NOT EXISTS users (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		username TEXT NOT NULL UNIQUE COLLATE NOCASE,
+		password_hash TEXT NOT NULL,
+		role TEXT NOT NULL,
+		last_login_at TIMESTAMP,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);`
+
+	sessionsTable := `
+	CREATE TABLE IF NOT EXISTS sessions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		hash TEXT NOT NULL UNIQUE,
+		expires_at TIMESTAMP NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+	);`
+
+	for _, table := range []string{usersTable, sessionsTable} {
+		if _, err := d.db.Exec(table); err != nil {
+			return err
+		}
+	}
+
+	for _, column := range []string{"oidc_issuer", "oidc_subject"} {
+		if err := d.addColumnIfMissing("users", column, "TEXT"); err != nil {
+			return err
+		}
+	}
+
+	// Local users have neither column set, and NULLs are distinct in a unique index.
+	_, err := d.db.Exec(
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_users_oidc ON users(oidc_issuer, oidc_subject)`,
+	)
+
+	return err
+}
+
+const userColumns = `id, username, password_hash, role, oidc_issuer, oidc_subject, last_login_at, created_at`
+
+func scanUser(row rowScanner) (*User, error) {
+	var u User
+	var issuer, subject sql.NullString
+	var lastLoginAt sql.NullTime
+	if err := row.Scan(
+		&u.ID, &u.Username, &u.PasswordHash, &u.Role, &issuer, &subject, &lastLoginAt, &u.CreatedAt,
+	); err != nil {
+		return nil, err
+	}
+
+	u.OIDCIssuer = issuer.String
+	u.OIDCSubject = subject.String
+
+	if lastLoginAt.Valid {
+		u.LastLoginAt = &lastLoginAt.Time
+	}
+
+	return &u, nil
+}
+
+// nullIfEmpty stores an empty string as NULL, e.g. so that it is ignored by a unique index.
+func nullIfEmpty(s string) any {
+	if s == "" {
+		return nil
+	}
+
+	return s
+}
+
+// AddUser adds a new user, populating its ID and creation time on success.
+func (d *Database) AddUser(u *User) error {
+	u.CreatedAt = time.Now().UTC().Truncate(time.Second)
+	result, err := d.db.Exec(
+		`INSERT INTO users (username, password_hash, role, oidc_issuer, oidc_subject, created_at)
+		 VALUES (?, ?, ?, ?, ?, ?)`,
+		u.Username, u.PasswordHash, u.Role, nullIfEmpty(u.OIDCIssuer), nullIfEmpty(u.OIDCSubject),
+		u.CreatedAt.Format(sqliteTimestampLayout),
+	)
+	if err != nil {
+		return err
+	}
+
+	u.ID, err = result.LastInsertId()
+	return err
+}
+
+// UpdateUser updates the username, password hash, role and OpenID Connect account of an existing
+// user.
+func (d *Database) UpdateUser(u *User) error {
+	result, err := d.db.Exec(
+		`UPDATE users SET username = ?, password_hash = ?, role = ?, oidc_issuer = ?, oidc_subject = ?
+		 WHERE id = ?`,
+		u.Username, u.PasswordHash, u.Role, nullIfEmpty(u.OIDCIssuer), nullIfEmpty(u.OIDCSubject), u.ID,
+	)
+	if err != nil {
+		return err
+	}
+
+	return requireRowsAffected(result, ErrUserNotFound)
+}
+
+// RecordUserLogin records that a user logged in at the given time.
+func (d *Database) RecordUserLogin(id int64, at time.Time) error {
+	_, err := d.db.Exec(
+		`UPDATE users SET last_login_at = ? WHERE id = ?`,
+		at.UTC().Format(sqliteTimestampLayout), id,
+	)
+
+	return err
+}
+
+// DeleteUser deletes a user along with their sessions.
+func (d *Database) DeleteUser(id int64) error {
+	result, err := d.db.Exec(`DELETE FROM users WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+
+	return requireRowsAffected(result, ErrUserNotFound)
+}
+
+// GetUser retrieves a user by their ID, returning nil if they do not exist.
+func (d *Database) GetUser(id int64) (*User, error) {
+	row := d.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, id)
+
+	u, err := scanUser(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return u, err
+}
+
+// GetUserByUsername retrieves a user by their (case-insensitive) username, returning nil if they do
+// not exist.
+func (d *Database) GetUserByUsername(username string) (*User, error) {
+	row := d.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE username = ?`, username)
+
+	u, err := scanUser(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return u, err
+}
+
+// GetUserByOIDCSubject retrieves the user of an account at an OpenID Connect provider, returning nil
+// if there is no such user.
+func (d *Database) GetUserByOIDCSubject(issuer, subject string) (*User, error) {
+	row := d.db.QueryRow(
+		`SELECT `+userColumns+` FROM users WHERE oidc_issuer = ? AND oidc_subject = ?`, issuer, subject,
+	)
+
+	u, err := scanUser(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return u, err
+}
+
+// GetAllUsers retrieves all users.
+func (d *Database) GetAllUsers() ([]User, error) {
+	rows, err := d.db.Query(`SELECT ` + userColumns + ` FROM users ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		users = append(users, *u)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// AddSession adds a new session, populating its ID and creation time on success.
+func (d *Database) AddSession(s *Session) error {
+	s.CreatedAt = time.Now().UTC().Truncate(time.Second)
+	result, err := d.db.Exec(
+		`INSERT INTO sessions (user_id, hash, expires_at, created_at) VALUES (?, ?, ?, ?)`,
+		s.UserID, s.Hash, s.ExpiresAt.UTC().Format(sqliteTimestampLayout),
+		s.CreatedAt.Format(sqliteTimestampLayout),
+	)
+	if err != nil {
+		return err
+	}
+
+	s.ID, err = result.LastInsertId()
+	return err
+}
+
+// GetSessionUser retrieves the user of the unexpired session with the given token hash, returning
+// nil if there is no such session.
+func (d *Database) GetSessionUser(hash string, now time.Time) (*User, error) {
+	row := d.db.QueryRow(
+		`SELECT u.id, u.username, u.password_hash, u.role, u.oidc_issuer, u.oidc_subject, u.last_login_at,
+		 u.created_at
+		 FROM sessions s JOIN users u ON u.id = s.user_id
+		 WHERE s.hash = ? AND s.expires_at > ?`,
+		hash, now.UTC().Format(sqliteTimestampLayout),
+	)
+
+	u, err := scanUser(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return u, err
+}
+
+// DeleteSession deletes (i.e. logs out) the session with the given token hash.
+func (d *Database) DeleteSession(hash string) error {
+	_, err := d.db.Exec(`DELETE FROM sessions WHERE hash = ?`, hash)
+	return err
+}
+
+// DeleteUserSessions deletes every session of a user, logging them out everywhere.
+func (d *Database) DeleteUserSessions(userID int64) error {
+	_, err := d.db.Exec(`DELETE FROM sessions WHERE user_id = ?`, userID)
+	return err
+}
+
+// DeleteExpiredSessions deletes the sessions that expired before the given time.
+func (d *Database) DeleteExpiredSessions(now time.Time) error {
+	_, err := d.db.Exec(`DELETE FROM sessions WHERE expires_at <= ?`,
+		now.UTC().Format(sqliteTimestampLayout))
+	return err
+}
@@ -0,0 +1,181 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+func addTestUser(t *testing.T, db *Database, username string, role Role) *User {
+	t.Helper()
+
+	user := &User{Username: username, PasswordHash: "hash", Role: role}
+	if err := db.AddUser(user); err != nil {
+		t.Fatalf("AddUser() error = %v", err)
+	}
+
+	return user
+}
+
+func TestRoleScopes(t *testing.T) {
+	tests := []struct {
+		role Role
+		want []Scope
+	}{
+		{RoleViewer, []Scope{ScopeReadReadings}},
+		{RoleOperator, []Scope{ScopeReadReadings, ScopeSendCommands}},
+		{RoleAdmin, []Scope{ScopeAdmin}},
+		{Role("owner"), nil},
+	}
+
+	for _, tt := range tests {
+		got := tt.role.Scopes()
+		if len(got) != len(tt.want) {
+			t.Errorf("%s.Scopes() = %v, want %v", tt.role, got, tt.want)
+			continue
+		}
+
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s.Scopes() = %v, want %v", tt.role, got, tt.want)
+			}
+		}
+
+		if valid := tt.want != nil; tt.role.IsValid() != valid {
+			t.Errorf("%s.IsValid() = %v, want %v", tt.role, !valid, valid)
+		}
+	}
+}
+
+func TestUsernamesAreUnique(t *testing.T) {
+	db := newTestDatabase(t)
+	addTestUser(t, db, "alice", RoleViewer)
+
+	if err := db.AddUser(&User{Username: "Alice", PasswordHash: "hash", Role: RoleAdmin}); err == nil {
+		t.Error("AddUser() with a username differing only in case error = nil, want an error")
+	}
+
+	user, err := db.GetUserByUsername("ALICE")
+	if err != nil || user == nil || user.Username != "alice" {
+		t.Errorf("GetUserByUsername() = %+v, %v, want alice", user, err)
+	}
+}
+
+func TestGetUserByOIDCSubject(t *testing.T) {
+	db := newTestDatabase(t)
+	addTestUser(t, db, "local", RoleAdmin)
+
+	user := &User{Username: "alice", Role: RoleViewer, OIDCIssuer: "https://idp", OIDCSubject: "1234"}
+	if err := db.AddUser(user); err != nil {
+		t.Fatalf("AddUser() error = %v", err)
+	}
+
+	got, err := db.GetUserByOIDCSubject("https://idp", "1234")
+	if err != nil || got == nil || got.ID != user.ID || got.OIDCSubject != "1234" {
+		t.Errorf("GetUserByOIDCSubject() = %+v, %v, want alice", got, err)
+	}
+
+	// Local users have no subject, and subjects are scoped to their issuer.
+	for _, tt := range [][2]string{{"", ""}, {"https://other", "1234"}, {"https://idp", "5678"}} {
+		if got, err := db.GetUserByOIDCSubject(tt[0], tt[1]); err != nil || got != nil {
+			t.Errorf("GetUserByOIDCSubject(%q, %q) = %+v, %v, want nil", tt[0], tt[1], got, err)
+		}
+	}
+
+	// An account is linked to a single user, but any number of users are local.
+	if err := db.AddUser(&User{Username: "bob", Role: RoleViewer, OIDCIssuer: "https://idp",
+		OIDCSubject: "1234"}); err == nil {
+		t.Error("AddUser() with a linked account error = nil, want an error")
+	}
+
+	addTestUser(t, db, "other", RoleViewer)
+}
+
+func TestSessions(t *testing.T) {
+	db := newTestDatabase(t)
+	alice := addTestUser(t, db, "alice", RoleViewer)
+	bob := addTestUser(t, db, "bob", RoleAdmin)
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, s := range []*Session{
+		{UserID: alice.ID, Hash: "alice-1", ExpiresAt: now.Add(time.Hour)},
+		{UserID: alice.ID, Hash: "alice-2", ExpiresAt: now.Add(time.Hour)},
+		{UserID: alice.ID, Hash: "alice-expired", ExpiresAt: now.Add(-time.Second)},
+		{UserID: bob.ID, Hash: "bob", ExpiresAt: now.Add(time.Hour)},
+	} {
+		if err := db.AddSession(s); err != nil {
+			t.Fatalf("AddSession() error = %v", err)
+		}
+	}
+
+	sessionUser := func(hash string, at time.Time) *User {
+		t.Helper()
+
+		user, err := db.GetSessionUser(hash, at)
+		if err != nil {
+			t.Fatalf("GetSessionUser(%q) error = %v", hash, err)
+		}
+
+		return user
+	}
+
+	if user := sessionUser("alice-1", now); user == nil || user.ID != alice.ID || user.Role != RoleViewer {
+		t.Errorf("GetSessionUser() = %+v, want alice", user)
+	}
+
+	// Sessions expire, and unknown tokens have no user.
+	for _, tt := range []struct {
+		hash string
+		at   time.Time
+	}{
+		{"alice-expired", now},
+		{"alice-1", now.Add(time.Hour)},
+		{"unknown", now},
+	} {
+		if user := sessionUser(tt.hash, tt.at); user != nil {
+			t.Errorf("GetSessionUser(%q, %v) = %+v, want nil", tt.hash, tt.at, user)
+		}
+	}
+
+	// The role is read on every request, so changing it applies to existing sessions.
+	alice.Role = RoleOperator
+	if err := db.UpdateUser(alice); err != nil {
+		t.Fatalf("UpdateUser() error = %v", err)
+	}
+
+	if user := sessionUser("alice-1", now); user == nil || user.Role != RoleOperator {
+		t.Errorf("GetSessionUser() = %+v, want an operator", user)
+	}
+
+	if err := db.DeleteSession("alice-1"); err != nil {
+		t.Fatalf("DeleteSession() error = %v", err)
+	}
+
+	if user := sessionUser("alice-1", now); user != nil {
+		t.Error("session is valid after being deleted")
+	}
+
+	if err := db.DeleteExpiredSessions(now); err != nil {
+		t.Fatalf("DeleteExpiredSessions() error = %v", err)
+	}
+
+	if got := countRows(t, db, `SELECT COUNT(*) FROM sessions`); got != 2 {
+		t.Errorf("%d sessions after deleting expired ones, want 2", got)
+	}
+
+	if err := db.DeleteUserSessions(alice.ID); err != nil {
+		t.Fatalf("DeleteUserSessions() error = %v", err)
+	}
+
+	if user := sessionUser("alice-2", now); user != nil {
+		t.Error("session is valid after deleting the user's sessions")
+	}
+
+	// Deleting a user deletes their sessions.
+	if err := db.DeleteUser(bob.ID); err != nil {
+		t.Fatalf("DeleteUser() error = %v", err)
+	}
+
+	if got := countRows(t, db, `SELECT COUNT(*) FROM sessions`); got != 0 {
+		t.Errorf("%d sessions after deleting every user, want 0", got)
+	}
+}
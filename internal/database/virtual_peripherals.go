@@ -0,0 +1,300 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hafh-server/internal/expr"
+	"strings"
+	"time"
+)
+
+// ErrVirtualPeripheralNotFound is returned when an operation targets a virtual peripheral that does
+// not exist.
+var ErrVirtualPeripheralNotFound = errors.New("virtual peripheral not found")
+
+// VirtualAggregate determines how the values of a [VirtualInput] are combined into one.
+type VirtualAggregate string
+
+const (
+	// AggregateLast is the most recent value.
+	AggregateLast VirtualAggregate = "last"
+	AggregateMean VirtualAggregate = "mean"
+	AggregateMin  VirtualAggregate = "min"
+	AggregateMax  VirtualAggregate = "max"
+	AggregateSum  VirtualAggregate = "sum"
+	// AggregateCount is the number of values, e.g. the number of peripherals with a tag that
+	// reported the field.
+	AggregateCount VirtualAggregate = "count"
+)
+
+// VirtualInput is a variable of a virtual peripheral's expressions, computed from the readings of
+// a single peripheral (SerialNumber) or of every peripheral with a tag (Tag).
+//
+// Without a window, the values are the field of the latest reading of each peripheral. With a
+// window, they are the field of every reading reported within it. The values are then combined
+// with the aggregate (the last value by default).
+type VirtualInput struct {
+	Name          string           `json:"name"`
+	SerialNumber  string           `json:"serial_number,omitempty"`
+	Tag           string           `json:"tag,omitempty"`
+	Field         string           `json:"field"`
+	Aggregate     VirtualAggregate `json:"aggregate,omitempty"`
+	WindowSeconds int64            `json:"window_seconds,omitempty"`
+}
+
+// Window returns the window of the input, which is zero for the latest values.
+func (i *VirtualInput) Window() time.Duration {
+	return time.Duration(i.WindowSeconds) * time.Second
+}
+
+// VirtualDefinition describes how the readings of a virtual peripheral are computed. Each field is
+// an expression (see the expr package) over the inputs and the fields before it.
+type VirtualDefinition struct {
+	Inputs []VirtualInput `json:"inputs"`
+	Fields []DerivedField `json:"fields"`
+	// IntervalSeconds is how often the readings are recomputed in addition to whenever an input
+	// peripheral reports a reading. Zero disables the timer.
+	IntervalSeconds int64 `json:"interval_seconds"`
+}
+
+// Interval returns the recompute interval of the virtual peripheral.
+func (v *VirtualDefinition) Interval() time.Duration {
+	return time.Duration(v.IntervalSeconds) * time.Second
+}
+
+// Validate checks that the definition is well-formed for the virtual peripheral with the given
+// serial number, which may not be one of its own inputs.
+func (v *VirtualDefinition) Validate(serial string) error {
+	if len(v.Inputs) == 0 {
+		return errors.New("at least one input is required")
+	} else if len(v.Fields) == 0 {
+		return errors.New("at least one field is required")
+	} else if v.IntervalSeconds < 0 {
+		return errors.New("interval must not be negative")
+	}
+
+	names := map[string]bool{}
+	for i := range v.Inputs {
+		input := &v.Inputs[i]
+		if input.Aggregate == "" {
+			input.Aggregate = AggregateLast
+		}
+
+		switch {
+		case input.Name == "":
+			return fmt.Errorf("input %d: name is required", i)
+		case names[input.Name]:
+			return fmt.Errorf("input %d: duplicate name %q", i, input.Name)
+		case (input.SerialNumber == "") == (input.Tag == ""):
+			return fmt.Errorf("input %d: exactly one of serial_number and tag is required", i)
+		case input.SerialNumber == serial:
+			return fmt.Errorf("input %d: a virtual peripheral cannot be its own input", i)
+		case input.Field == "":
+			return fmt.Errorf("input %d: field is required", i)
+		case input.WindowSeconds < 0:
+			return fmt.Errorf("input %d: window must not be negative", i)
+		}
+
+		switch input.Aggregate {
+		case AggregateLast, AggregateMean, AggregateMin, AggregateMax, AggregateSum, AggregateCount:
+		default:
+			return fmt.Errorf("input %d: invalid aggregate %q", i, input.Aggregate)
+		}
+
+		names[input.Name] = true
+	}
+
+	for _, f := range v.Fields {
+		if f.Name == "" {
+			return errors.New("field name is required")
+		} else if names[f.Name] {
+			return errors.New("duplicate field or input: " + f.Name)
+		} else if _, err := expr.Parse(f.Expression); err != nil {
+			return errors.New("invalid expression for field " + f.Name + ": " + err.Error())
+		}
+		names[f.Name] = true
+	}
+
+	return nil
+}
+
+// VirtualPeripheral is the definition of a virtual peripheral along with its serial number.
+type VirtualPeripheral struct {
+	SerialNumber string `json:"serial_number"`
+	VirtualDefinition
+}
+
+func (d *Database) initVirtualPeripheralsSchema() error {
+	virtualTable := `
+	CREATE TABLE IF NOT EXISTS virtual_peripherals (
+		serial_number TEXT PRIMARY KEY,
+		definition JSON NOT NULL,
+		FOREIGN KEY(serial_number) REFERENCES peripherals(serial_number) ON DELETE CASCADE
+	);`
+
+	_, err := d.db.Exec(virtualTable)
+	return err
+}
+
+// AddVirtualPeripheral creates a new peripheral along with its virtual definition.
+func (d *Database) AddVirtualPeripheral(p *Peripheral, definition *VirtualDefinition) error {
+	data, err := json.Marshal(definition)
+	if err != nil {
+		return err
+	}
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(
+		`INSERT INTO peripherals (serial_number, type, name) VALUES (?, ?, ?)`,
+		p.SerialNumber, p.Type, p.Name,
+	); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(
+		`INSERT INTO virtual_peripherals (serial_number, definition) VALUES (?, ?)`,
+		p.SerialNumber, string(data),
+	); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// SetVirtualDefinition replaces the definition of an existing virtual peripheral.
+func (d *Database) SetVirtualDefinition(serial string, definition *VirtualDefinition) error {
+	data, err := json.Marshal(definition)
+	if err != nil {
+		return err
+	}
+
+	result, err := d.db.Exec(
+		`UPDATE virtual_peripherals SET definition = ? WHERE serial_number = ?`,
+		string(data), serial,
+	)
+	if err != nil {
+		return err
+	}
+
+	return requireRowsAffected(result, ErrVirtualPeripheralNotFound)
+}
+
+// GetVirtualPeripherals retrieves the definitions of all virtual peripherals.
+func (d *Database) GetVirtualPeripherals() ([]VirtualPeripheral, error) {
+	rows, err := d.db.Query(`SELECT serial_number, definition FROM virtual_peripherals ORDER BY serial_number`)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	virtuals := []VirtualPeripheral{}
+	for rows.Next() {
+		var v VirtualPeripheral
+		var definition string
+		if err := rows.Scan(&v.SerialNumber, &definition); err != nil {
+			return nil, err
+		}
+
+		if err := json.Unmarshal([]byte(definition), &v.VirtualDefinition); err != nil {
+			return nil, err
+		}
+
+		virtuals = append(virtuals, v)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return virtuals, nil
+}
+
+// GetVirtualInputValues retrieves the numeric values of a field (see [Reading.NumericValue]) of the
+// readings of the given peripherals, oldest first. If since is nil, only the latest reading of each
+// peripheral is considered; otherwise, every reading reported since then is.
+func (d *Database) GetVirtualInputValues(serials []string, field string, since *time.Time) ([]float64, error) {
+	if len(serials) == 0 {
+		return nil, nil
+	}
+
+	placeholders := `?` + strings.Repeat(`, ?`, len(serials)-1)
+	args := make([]any, 0, len(serials)+1)
+	for _, serial := range serials {
+		args = append(args, serial)
+	}
+
+	var query string
+	if since == nil {
+		query = `SELECT data FROM readings WHERE id IN (
+			SELECT MAX(id) FROM readings WHERE serial_number IN (` + placeholders + `) GROUP BY serial_number
+		) ORDER BY timestamp, id`
+	} else {
+		query = `SELECT data FROM readings WHERE serial_number IN (` + placeholders + `)
+			AND timestamp >= ? ORDER BY timestamp, id`
+		args = append(args, since.UTC().Format(sqliteTimestampLayout))
+	}
+
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var values []float64
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+
+		var r Reading
+		if err := json.Unmarshal([]byte(data), &r.Data); err != nil {
+			return nil, err
+		}
+
+		if value, ok := r.NumericValue(field); ok {
+			values = append(values, value)
+		}
+	}
+
+	return values, rows.Err()
+}
+
+// loadVirtualDefinitions populates the virtual definitions of the given (indexed) peripherals,
+// restricted by the WHERE clause returned by serialFilter.
+func (d *Database) loadVirtualDefinitions(index map[string]*Peripheral, where string, args []any) error {
+	rows, err := d.db.Query(`SELECT serial_number, definition FROM virtual_peripherals`+where, args...)
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var serial, definition string
+		if err := rows.Scan(&serial, &definition); err != nil {
+			return err
+		}
+
+		p, ok := index[serial]
+		if !ok {
+			continue
+		}
+
+		p.Virtual = &VirtualDefinition{}
+		if err := json.Unmarshal([]byte(definition), p.Virtual); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
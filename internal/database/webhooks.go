@@ -0,0 +1,342 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// ErrWebhookNotFound is returned when an operation targets a webhook that does not exist.
+var ErrWebhookNotFound = errors.New("webhook not found")
+
+// Webhook is an external HTTP endpoint that server events are delivered to.
+type Webhook struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	// Secret is used to sign deliveries and is never serialized.
+	Secret string `json:"-"`
+	// EventTypes are the event types delivered to the webhook. An empty list means all events.
+	EventTypes []string  `json:"event_types"`
+	Enabled    bool      `json:"enabled"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// Accepts returns true if the webhook is enabled and subscribed to the given event type.
+func (w *Webhook) Accepts(eventType string) bool {
+	if !w.Enabled {
+		return false
+	} else if len(w.EventTypes) == 0 {
+		return true
+	}
+
+	for _, t := range w.EventTypes {
+		if t == eventType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// DeliveryStatus is the status of a webhook delivery.
+type DeliveryStatus string
+
+const (
+	DeliveryStatusPending   DeliveryStatus = "pending"
+	DeliveryStatusSucceeded DeliveryStatus = "succeeded"
+	DeliveryStatusFailed    DeliveryStatus = "failed"
+	// DeliveryStatusCancelled is the status of a delivery that was not attempted again because its
+	// webhook was disabled.
+	DeliveryStatusCancelled DeliveryStatus = "cancelled"
+)
+
+// WebhookDelivery is a single event delivered (or to be delivered) to a webhook. Pending deliveries
+// are stored so that retries survive a restart.
+type WebhookDelivery struct {
+	ID             int64          `json:"id"`
+	WebhookID      int64          `json:"webhook_id"`
+	EventType      string         `json:"event_type"`
+	Payload        string         `json:"payload"`
+	Status         DeliveryStatus `json:"status"`
+	Attempts       int            `json:"attempts"`
+	NextAttemptAt  *time.Time     `json:"next_attempt_at"`
+	LastStatusCode int            `json:"last_status_code"`
+	LastError      string         `json:"last_error"`
+	CreatedAt      time.Time      `json:"created_at"`
+	UpdatedAt      time.Time      `json:"updated_at"`
+}
+
+func (d *Database) initWebhooksSchema() error {
+	webhooksTable := `
+	CREATE TABLE IF NOT EXISTS webhooks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		url TEXT NOT NULL,
+		secret TEXT NOT NULL,
+		event_types JSON NOT NULL DEFAULT '[]',
+		enabled INTEGER NOT NULL DEFAULT 1,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);`
+
+	deliveriesTable := `
+	CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		webhook_id INTEGER NOT NULL,
+		event_type TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		status TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt_at TIMESTAMP,
+		last_status_code INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY(webhook_id) REFERENCES webhooks(id) ON DELETE CASCADE
+	);`
+
+	deliveriesIndex := `
+	CREATE INDEX IF NOT EXISTS webhook_deliveries_due
+	ON webhook_deliveries (status, next_attempt_at);`
+
+	for _, statement := range []string{webhooksTable, deliveriesTable, deliveriesIndex} {
+		if _, err := d.db.Exec(statement); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+const webhookColumns = `id, name, url, secret, event_types, enabled, created_at`
+
+func scanWebhook(row rowScanner) (*Webhook, error) {
+	var w Webhook
+	var eventTypes string
+	if err := row.Scan(&w.ID, &w.Name, &w.URL, &w.Secret, &eventTypes, &w.Enabled, &w.CreatedAt); err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal([]byte(eventTypes), &w.EventTypes); err != nil {
+		return nil, err
+	}
+
+	return &w, nil
+}
+
+func marshalEventTypes(eventTypes []string) (string, error) {
+	if eventTypes == nil {
+		eventTypes = []string{}
+	}
+
+	data, err := json.Marshal(eventTypes)
+	return string(data), err
+}
+
+// AddWebhook adds a new webhook, populating its ID on success.
+func (d *Database) AddWebhook(w *Webhook) error {
+	eventTypes, err := marshalEventTypes(w.EventTypes)
+	if err != nil {
+		return err
+	}
+
+	result, err := d.db.Exec(
+		`INSERT INTO webhooks (name, url, secret, event_types, enabled) VALUES (?, ?, ?, ?, ?)`,
+		w.Name, w.URL, w.Secret, eventTypes, w.Enabled,
+	)
+	if err != nil {
+		return err
+	}
+
+	w.ID, err = result.LastInsertId()
+	return err
+}
+
+// UpdateWebhook updates an existing webhook.
+func (d *Database) UpdateWebhook(w *Webhook) error {
+	eventTypes, err := marshalEventTypes(w.EventTypes)
+	if err != nil {
+		return err
+	}
+
+	result, err := d.db.Exec(
+		`UPDATE webhooks SET name = ?, url = ?, secret = ?, event_types = ?, enabled = ? WHERE id = ?`,
+		w.Name, w.URL, w.Secret, eventTypes, w.Enabled, w.ID,
+	)
+	if err != nil {
+		return err
+	}
+
+	return requireRowsAffected(result, ErrWebhookNotFound)
+}
+
+// DeleteWebhook deletes a webhook along with its delivery log.
+func (d *Database) DeleteWebhook(id int64) error {
+	result, err := d.db.Exec(`DELETE FROM webhooks WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+
+	return requireRowsAffected(result, ErrWebhookNotFound)
+}
+
+// GetWebhook retrieves a webhook by its ID, returning nil if it does not exist.
+func (d *Database) GetWebhook(id int64) (*Webhook, error) {
+	row := d.db.QueryRow(`SELECT `+webhookColumns+` FROM webhooks WHERE id = ?`, id)
+
+	w, err := scanWebhook(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return w, err
+}
+
+// GetAllWebhooks retrieves all webhooks.
+func (d *Database) GetAllWebhooks() ([]Webhook, error) {
+	rows, err := d.db.Query(`SELECT ` + webhookColumns + ` FROM webhooks ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	webhooks := []Webhook{}
+	for rows.Next() {
+		w, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		webhooks = append(webhooks, *w)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return webhooks, nil
+}
+
+const deliveryColumns = `id, webhook_id, event_type, payload, status, attempts, next_attempt_at,
+	last_status_code, last_error, created_at, updated_at`
+
+func scanDelivery(row rowScanner) (*WebhookDelivery, error) {
+	var w WebhookDelivery
+	var nextAttemptAt sql.NullTime
+	if err := row.Scan(&w.ID, &w.WebhookID, &w.EventType, &w.Payload, &w.Status, &w.Attempts,
+		&nextAttemptAt, &w.LastStatusCode, &w.LastError, &w.CreatedAt, &w.UpdatedAt); err != nil {
+		return nil, err
+	}
+
+	if nextAttemptAt.Valid {
+		w.NextAttemptAt = &nextAttemptAt.Time
+	}
+
+	return &w, nil
+}
+
+func scanDeliveries(rows *sql.Rows) ([]WebhookDelivery, error) {
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		w, err := scanDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		deliveries = append(deliveries, *w)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return deliveries, nil
+}
+
+// EnqueueWebhookDelivery stores a new pending delivery that is due immediately.
+func (d *Database) EnqueueWebhookDelivery(webhookID int64, eventType, payload string) (int64, error) {
+	result, err := d.db.Exec(
+		`INSERT INTO webhook_deliveries (webhook_id, event_type, payload, status, next_attempt_at)
+		 VALUES (?, ?, ?, ?, ?)`,
+		webhookID, eventType, payload, DeliveryStatusPending,
+		time.Now().UTC().Format(sqliteTimestampLayout),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.LastInsertId()
+}
+
+// GetDueWebhookDeliveries retrieves up to `limit` pending deliveries whose next attempt is due.
+func (d *Database) GetDueWebhookDeliveries(limit int) ([]WebhookDelivery, error) {
+	rows, err := d.db.Query(
+		`SELECT `+deliveryColumns+` FROM webhook_deliveries
+		 WHERE status = ? AND next_attempt_at <= ?
+		 ORDER BY next_attempt_at, id
+		 LIMIT ?`,
+		DeliveryStatusPending, time.Now().UTC().Format(sqliteTimestampLayout), limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanDeliveries(rows)
+}
+
+// GetWebhookDeliveries retrieves the most recent `limit` deliveries of a webhook.
+func (d *Database) GetWebhookDeliveries(webhookID int64, limit uint32) ([]WebhookDelivery, error) {
+	rows, err := d.db.Query(
+		`SELECT `+deliveryColumns+` FROM webhook_deliveries
+		 WHERE webhook_id = ?
+		 ORDER BY id DESC
+		 LIMIT ?`,
+		webhookID, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanDeliveries(rows)
+}
+
+// RecordWebhookAttempt records the outcome of a delivery attempt. If nextAttemptAt is nil, the
+// delivery will not be retried.
+func (d *Database) RecordWebhookAttempt(
+	id int64,
+	status DeliveryStatus,
+	statusCode int,
+	lastError string,
+	nextAttemptAt *time.Time,
+) error {
+	var next any
+	if nextAttemptAt != nil {
+		next = nextAttemptAt.UTC().Format(sqliteTimestampLayout)
+	}
+
+	_, err := d.db.Exec(
+		`UPDATE webhook_deliveries
+		 SET status = ?, attempts = attempts + 1, last_status_code = ?, last_error = ?,
+		     next_attempt_at = ?, updated_at = CURRENT_TIMESTAMP
+		 WHERE id = ?`,
+		status, statusCode, lastError, next, id,
+	)
+
+	return err
+}
+
+// CancelWebhookDelivery marks a pending delivery as cancelled, so that it is not attempted (again).
+func (d *Database) CancelWebhookDelivery(id int64, reason string) error {
+	_, err := d.db.Exec(
+		`UPDATE webhook_deliveries
+		 SET status = ?, last_error = ?, next_attempt_at = NULL, updated_at = CURRENT_TIMESTAMP
+		 WHERE id = ? AND status = ?`,
+		DeliveryStatusCancelled, reason, id, DeliveryStatusPending,
+	)
+
+	return err
+}
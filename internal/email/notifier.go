@@ -0,0 +1,289 @@
+// Package email sends email notifications for server events over SMTP.
+package email
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hafh-server/internal/events"
+	"hafh-server/internal/logger"
+	"net/mail"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// queueSize is the number of events that can be waiting to be processed before new events are
+	// dropped.
+	queueSize = 256
+	// maxDigestEvents is the maximum number of events described in a single digest. Any further
+	// events are only counted.
+	maxDigestEvents = 50
+)
+
+// NotifierConfig holds the configuration for the email [Notifier].
+type NotifierConfig struct {
+	Bus      *events.Bus
+	Host     string
+	Port     int
+	StartTLS bool
+	Username string
+	Password string
+	From     string
+	To       []string
+	// EventTypes are the event types that are emailed. An empty list means all events.
+	EventTypes []string
+	// DigestInterval is the minimum time between two emails. Events that occur within the interval
+	// are collected and sent as a single digest once it elapses.
+	DigestInterval time.Duration
+	Timeout        time.Duration
+	// Templates override the default templates, keyed by event type.
+	Templates map[string]Template
+}
+
+// Notifier emails server events to a fixed list of recipients. To avoid flooding inboxes (e.g. from
+// a flapping sensor), at most one email is sent per digest interval; events that occur in between
+// are collected into a single digest.
+type Notifier struct {
+	log            *zap.SugaredLogger
+	host           string
+	port           int
+	startTLS       bool
+	username       string
+	password       string
+	from           string
+	to             []string
+	eventTypes     map[events.Type]bool
+	digestInterval time.Duration
+	timeout        time.Duration
+	templates      map[events.Type]*compiledTemplate
+	fallback       *compiledTemplate
+	queue          chan events.Event
+}
+
+// NewNotifier creates a new email [Notifier] and subscribes it to the event bus.
+func NewNotifier(config *NotifierConfig) (*Notifier, error) {
+	if config == nil {
+		return nil, errors.New("config cannot be nil")
+	} else if config.Bus == nil {
+		return nil, errors.New("event bus is required")
+	} else if config.Host == "" {
+		return nil, errors.New("SMTP host is required")
+	} else if config.Port <= 0 {
+		return nil, errors.New("SMTP port is required")
+	} else if _, err := mail.ParseAddress(config.From); err != nil {
+		return nil, fmt.Errorf("invalid sender address: %w", err)
+	} else if len(config.To) == 0 {
+		return nil, errors.New("at least one recipient is required")
+	}
+
+	for _, to := range config.To {
+		if _, err := mail.ParseAddress(to); err != nil {
+			return nil, fmt.Errorf("invalid recipient address %q: %w", to, err)
+		}
+	}
+
+	n := &Notifier{
+		log:            logger.Named("email"),
+		host:           config.Host,
+		port:           config.Port,
+		startTLS:       config.StartTLS,
+		username:       config.Username,
+		password:       config.Password,
+		from:           config.From,
+		to:             config.To,
+		digestInterval: config.DigestInterval,
+		timeout:        config.Timeout,
+		templates:      map[events.Type]*compiledTemplate{},
+		queue:          make(chan events.Event, queueSize),
+	}
+
+	if n.timeout <= 0 {
+		n.timeout = 30 * time.Second
+	}
+
+	if len(config.EventTypes) > 0 {
+		n.eventTypes = map[events.Type]bool{}
+		for _, t := range config.EventTypes {
+			if !events.Type(t).IsValid() {
+				return nil, fmt.Errorf("unknown event type: %s", t)
+			}
+			n.eventTypes[events.Type(t)] = true
+		}
+	}
+
+	for t, template := range defaultTemplates {
+		compiled, err := compileTemplate(string(t), template)
+		if err != nil {
+			return nil, err
+		}
+		n.templates[t] = compiled
+	}
+
+	for t, template := range config.Templates {
+		if !events.Type(t).IsValid() {
+			return nil, fmt.Errorf("template for unknown event type: %s", t)
+		}
+
+		// Only override the parts of the default template that are configured.
+		defaults := defaultTemplates[events.Type(t)]
+		if template.Subject == "" {
+			template.Subject = defaults.Subject
+		}
+		if template.Body == "" {
+			template.Body = defaults.Body
+		}
+
+		compiled, err := compileTemplate(t, template)
+		if err != nil {
+			return nil, err
+		}
+		n.templates[events.Type(t)] = compiled
+	}
+
+	fallback, err := compileTemplate("fallback", fallbackTemplate)
+	if err != nil {
+		return nil, err
+	}
+	n.fallback = fallback
+
+	config.Bus.Subscribe(n.enqueue)
+	return n, nil
+}
+
+// Start sends notifications until the context is cancelled. **This should be called in a separate
+// goroutine.**
+func (n *Notifier) Start(ctx context.Context) {
+	var pending []events.Event
+	var lastSent time.Time
+
+	// The timer is only armed while events are waiting for the digest interval to elapse.
+	timer := time.NewTimer(0)
+	if !timer.Stop() {
+		<-timer.C
+	}
+	armed := false
+
+	for {
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			if len(pending) > 0 {
+				n.log.Warnf("Discarding %d pending notification(s) on shutdown", len(pending))
+			}
+			return
+		case event := <-n.queue:
+			pending = append(pending, event)
+			if wait := n.digestInterval - time.Since(lastSent); wait > 0 {
+				if !armed {
+					timer.Reset(wait)
+					armed = true
+				}
+				continue
+			}
+		case <-timer.C:
+			armed = false
+		}
+
+		if len(pending) > 0 {
+			n.flush(pending)
+			pending = nil
+			lastSent = time.Now()
+		}
+	}
+}
+
+// SendTest synchronously sends a test email, bypassing the digest interval. If no recipients are
+// given, the configured recipients are used.
+func (n *Notifier) SendTest(to ...string) error {
+	if len(to) == 0 {
+		to = n.to
+	}
+
+	for _, address := range to {
+		if _, err := mail.ParseAddress(address); err != nil {
+			return fmt.Errorf("invalid recipient address %q: %w", address, err)
+		}
+	}
+
+	return n.send(&message{
+		from:    n.from,
+		to:      to,
+		subject: "[HAFH] Test email",
+		body:    "This is a test email from HAFH-server. Email notifications are configured correctly.",
+	})
+}
+
+// enqueue queues an event for the notifier without blocking the publisher.
+func (n *Notifier) enqueue(event events.Event) {
+	if n.eventTypes != nil && !n.eventTypes[event.Type] {
+		return
+	}
+
+	select {
+	case n.queue <- event:
+	default:
+		n.log.Warnf("Notification queue is full, dropping %s event", event.Type)
+	}
+}
+
+// flush sends the pending events as a single email, or as a digest if there is more than one.
+func (n *Notifier) flush(pending []events.Event) {
+	m, err := n.compose(pending)
+	if err != nil {
+		n.log.Errorf("Failed to compose email: %v", err)
+		return
+	}
+
+	if err := n.send(m); err != nil {
+		n.log.Errorf("Failed to send email for %d event(s): %v", len(pending), err)
+		return
+	}
+
+	n.log.Debugf("Sent email for %d event(s)", len(pending))
+}
+
+func (n *Notifier) compose(pending []events.Event) (*message, error) {
+	if len(pending) == 1 {
+		subject, body, err := n.render(pending[0])
+		if err != nil {
+			return nil, err
+		}
+
+		return &message{from: n.from, to: n.to, subject: "[HAFH] " + subject, body: body}, nil
+	}
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "%d events occurred since the last notification:\n", len(pending))
+	for i, event := range pending {
+		if i == maxDigestEvents {
+			fmt.Fprintf(&body, "\n...and %d more.\n", len(pending)-maxDigestEvents)
+			break
+		}
+
+		subject, text, err := n.render(event)
+		if err != nil {
+			return nil, err
+		}
+
+		fmt.Fprintf(&body, "\n[%s] %s\n%s\n", event.Time.Local().Format("2006-01-02 15:04:05"), subject, text)
+	}
+
+	return &message{
+		from:    n.from,
+		to:      n.to,
+		subject: fmt.Sprintf("[HAFH] %d notifications", len(pending)),
+		body:    body.String(),
+	}, nil
+}
+
+func (n *Notifier) render(event events.Event) (string, string, error) {
+	template, ok := n.templates[event.Type]
+	if !ok {
+		template = n.fallback
+	}
+
+	return template.render(event)
+}
@@ -0,0 +1,258 @@
+package email
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"hafh-server/internal/events"
+	"hafh-server/internal/logger"
+	"io"
+	"mime/quotedprintable"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func init() {
+	logger.Init(false)
+}
+
+// received is an email received by a [testServer].
+type received struct {
+	from string
+	to   []string
+	auth string
+	data string
+}
+
+// testServer is a local stand-in for an SMTP server, which accepts every email unless rejectRcpt
+// is set, and records them.
+type testServer struct {
+	listener   net.Listener
+	rejectRcpt bool
+
+	mu     sync.Mutex
+	emails []received
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &testServer{listener: listener}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go s.serve(conn)
+		}
+	}()
+
+	return s
+}
+
+func (s *testServer) port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (s *testServer) received() []received {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]received(nil), s.emails...)
+}
+
+func (s *testServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 localhost ESMTP test")
+
+	var email received
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+
+		command, argument, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(command) {
+		case "EHLO", "HELO":
+			text.PrintfLine("250-localhost")
+			text.PrintfLine("250 AUTH PLAIN")
+		case "AUTH":
+			credentials, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(argument, "PLAIN "))
+			email.auth = string(credentials)
+			text.PrintfLine("235 Authenticated")
+		case "MAIL":
+			email.from = strings.TrimSuffix(strings.TrimPrefix(argument, "FROM:<"), ">")
+			text.PrintfLine("250 OK")
+		case "RCPT":
+			if s.rejectRcpt {
+				text.PrintfLine("550 No such user")
+				continue
+			}
+
+			email.to = append(email.to, strings.TrimSuffix(strings.TrimPrefix(argument, "TO:<"), ">"))
+			text.PrintfLine("250 OK")
+		case "DATA":
+			text.PrintfLine("354 Go ahead")
+			data, err := text.ReadDotBytes()
+			if err != nil {
+				return
+			}
+
+			email.data = string(data)
+			s.mu.Lock()
+			s.emails = append(s.emails, email)
+			s.mu.Unlock()
+			email = received{}
+			text.PrintfLine("250 OK")
+		case "QUIT":
+			text.PrintfLine("221 Bye")
+			return
+		default:
+			text.PrintfLine("502 Not implemented")
+		}
+	}
+}
+
+func newTestNotifier(t *testing.T, server *testServer, bus *events.Bus, digestInterval time.Duration) *Notifier {
+	t.Helper()
+
+	n, err := NewNotifier(&NotifierConfig{
+		Bus:            bus,
+		Host:           "127.0.0.1",
+		Port:           server.port(),
+		Username:       "user",
+		Password:       "secret",
+		From:           "HAFH <hafh@example.com>",
+		To:             []string{"alice@example.com", "Bob <bob@example.com>"},
+		EventTypes:     []string{string(events.AlertFired)},
+		DigestInterval: digestInterval,
+		Timeout:        5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("NewNotifier() error = %v", err)
+	}
+
+	return n
+}
+
+// body returns the decoded body of an email, whose line endings were normalized to LF when it was
+// received.
+func body(t *testing.T, data string) string {
+	t.Helper()
+
+	_, encoded, ok := strings.Cut(data, "\n\n")
+	if !ok {
+		t.Fatalf("email has no body: %q", data)
+	}
+
+	decoded, err := io.ReadAll(quotedprintable.NewReader(strings.NewReader(encoded)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(decoded)
+}
+
+func TestSendTest(t *testing.T) {
+	server := newTestServer(t)
+	n := newTestNotifier(t, server, events.NewBus(), 0)
+
+	if err := n.SendTest(); err != nil {
+		t.Fatalf("SendTest() error = %v", err)
+	}
+
+	emails := server.received()
+	if len(emails) != 1 {
+		t.Fatalf("received %d emails, want 1", len(emails))
+	}
+
+	email := emails[0]
+	if email.from != "hafh@example.com" {
+		t.Errorf("MAIL FROM = %q, want the bare sender address", email.from)
+	} else if strings.Join(email.to, ",") != "alice@example.com,bob@example.com" {
+		t.Errorf("RCPT TO = %v, want the bare recipient addresses", email.to)
+	} else if email.auth != "\x00user\x00secret" {
+		t.Errorf("AUTH PLAIN = %q", email.auth)
+	}
+
+	reader := textproto.NewReader(bufio.NewReader(strings.NewReader(email.data)))
+	header, err := reader.ReadMIMEHeader()
+	if err != nil {
+		t.Fatalf("invalid email: %v", err)
+	} else if header.Get("Subject") != "[HAFH] Test email" || header.Get("From") != "HAFH <hafh@example.com>" {
+		t.Errorf("header = %v", header)
+	}
+
+	if got := body(t, email.data); !strings.Contains(got, "configured correctly") {
+		t.Errorf("body = %q", got)
+	}
+}
+
+func TestSendTestRejected(t *testing.T) {
+	server := newTestServer(t)
+	server.rejectRcpt = true
+	n := newTestNotifier(t, server, events.NewBus(), 0)
+
+	if err := n.SendTest(); err == nil {
+		t.Error("SendTest() succeeded with a rejected recipient")
+	}
+
+	if err := n.SendTest("not an address"); err == nil {
+		t.Error("SendTest() succeeded with an invalid recipient")
+	}
+}
+
+func TestDigest(t *testing.T) {
+	server := newTestServer(t)
+	bus := events.NewBus()
+	n := newTestNotifier(t, server, bus, 200*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go n.Start(ctx)
+
+	waitFor := func(count int) []received {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if emails := server.received(); len(emails) >= count {
+				return emails
+			}
+		}
+
+		t.Fatalf("received %d emails, want %d", len(server.received()), count)
+		return nil
+	}
+
+	// The first event is emailed right away; the following ones are sent as one digest, and
+	// events of other types are not emailed at all.
+	bus.Publish(events.New(events.AlertFired, map[string]any{"rule_name": "first"}))
+	waitFor(1)
+
+	bus.Publish(events.New(events.AlertFired, map[string]any{"rule_name": "second"}))
+	bus.Publish(events.New(events.PeripheralOffline, map[string]any{}))
+	bus.Publish(events.New(events.AlertFired, map[string]any{"rule_name": "third"}))
+	emails := waitFor(2)
+
+	time.Sleep(300 * time.Millisecond)
+	if emails = server.received(); len(emails) != 2 {
+		t.Fatalf("received %d emails, want 2", len(emails))
+	} else if !strings.Contains(emails[1].data, "Subject: [HAFH] 2 notifications") {
+		t.Errorf("digest = %q", emails[1].data)
+	}
+}
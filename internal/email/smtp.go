@@ -0,0 +1,116 @@
+package email
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// message is a plain text email.
+type message struct {
+	from    string
+	to      []string
+	subject string
+	body    string
+}
+
+// bytes returns the message in RFC 5322 format, with the body quoted-printable encoded.
+func (m *message) bytes() []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", m.from)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(m.to, ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+
+	writer := quotedprintable.NewWriter(&buf)
+	writer.Write([]byte(strings.ReplaceAll(m.body, "\n", "\r\n")))
+	writer.Close()
+
+	return buf.Bytes()
+}
+
+// send delivers the message over SMTP, upgrading the connection with STARTTLS if configured.
+func (n *Notifier) send(m *message) error {
+	address := net.JoinHostPort(n.host, strconv.Itoa(n.port))
+	conn, err := net.DialTimeout("tcp", address, n.timeout)
+	if err != nil {
+		return err
+	}
+
+	// The deadline covers the whole conversation so a stalled server cannot block the notifier.
+	if err := conn.SetDeadline(time.Now().Add(n.timeout)); err != nil {
+		conn.Close()
+		return err
+	}
+
+	client, err := smtp.NewClient(conn, n.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	defer client.Close()
+
+	if n.startTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return errors.New("server does not support STARTTLS")
+		}
+
+		if err := client.StartTLS(&tls.Config{ServerName: n.host}); err != nil {
+			return err
+		}
+	}
+
+	if n.username != "" {
+		if err := client.Auth(smtp.PlainAuth("", n.username, n.password, n.host)); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Mail(envelopeAddress(m.from)); err != nil {
+		return err
+	}
+
+	for _, to := range m.to {
+		if err := client.Rcpt(envelopeAddress(to)); err != nil {
+			return err
+		}
+	}
+
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+
+	if _, err := writer.Write(m.bytes()); err != nil {
+		return err
+	}
+
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
+
+// envelopeAddress returns the bare address of an address that may have a display name, e.g.
+// "hafh@example.com" for "HAFH <hafh@example.com>", as the SMTP envelope only accepts the former.
+func envelopeAddress(address string) string {
+	if parsed, err := mail.ParseAddress(address); err == nil {
+		return parsed.Address
+	}
+
+	return address
+}
@@ -0,0 +1,102 @@
+package email
+
+import (
+	"bytes"
+	"fmt"
+	"hafh-server/internal/events"
+	"strings"
+	"text/template"
+)
+
+// Template is the subject and body of the email sent for an event. Both are [text/template]
+// templates executed with the [events.Event], so the event data is available as `.Data`.
+type Template struct {
+	Subject string
+	Body    string
+}
+
+// defaultTemplates are used for event types without a configured template.
+var defaultTemplates = map[events.Type]Template{
+	events.PeripheralRegistered: {
+		Subject: "New peripheral {{.Data.SerialNumber}}",
+		Body:    "A new peripheral ({{.Data.SerialNumber}}) reported its first reading and was registered automatically.",
+	},
+	events.PeripheralOffline: {
+		Subject: "{{or .Data.Name .Data.SerialNumber}} is offline",
+		Body: "Peripheral {{or .Data.Name .Data.SerialNumber}} ({{.Data.SerialNumber}}) has stopped reporting readings." +
+			"{{with .Data.LastSeenAt}} It was last seen at {{.Format \"2006-01-02 15:04:05 MST\"}}.{{end}}",
+	},
+	events.PeripheralOnline: {
+		Subject: "{{or .Data.Name .Data.SerialNumber}} is back online",
+		Body:    "Peripheral {{or .Data.Name .Data.SerialNumber}} ({{.Data.SerialNumber}}) is reporting readings again.",
+	},
+	events.AlertFired: {
+		Subject: "Alert: {{.Data.RuleName}} ({{.Data.SerialNumber}})",
+		Body:    "Alert rule \"{{.Data.RuleName}}\" fired for peripheral {{.Data.SerialNumber}} with a value of {{.Data.Value}}.",
+	},
+	events.AlertResolved: {
+		Subject: "Resolved: {{.Data.RuleName}} ({{.Data.SerialNumber}})",
+		Body: "Alert rule \"{{.Data.RuleName}}\" resolved for peripheral {{.Data.SerialNumber}}" +
+			"{{with .Data.ResolvedValue}} with a value of {{.}}{{end}}.",
+	},
+	events.PayloadRejected: {
+		Subject: "Rejected payload on {{.Data.Topic}}",
+		Body:    "A payload received on {{.Data.Topic}} could not be ingested: {{.Data.Error}}\n\n{{.Data.Payload}}",
+	},
+	events.AnomalyDetected: {
+		Subject: "Anomaly: {{.Data.Kind}} ({{.Data.SerialNumber}})",
+		Body:    "{{.Data.Message}}",
+	},
+	events.AnomalyResolved: {
+		Subject: "Resolved: {{.Data.Kind}} ({{.Data.SerialNumber}})",
+		Body:    "The {{.Data.Kind}} anomaly of peripheral {{.Data.SerialNumber}} has cleared: {{.Data.Message}}",
+	},
+	events.ReportGenerated: {
+		Subject: "Report: {{.Data.ScheduleName}}",
+		Body: "Readings from {{.Data.From.Local.Format \"2006-01-02 15:04\"}} to {{.Data.To.Local.Format \"2006-01-02 15:04\"}}:\n" +
+			"{{range .Data.Peripherals}}\n{{or .Name .SerialNumber}} ({{.Readings}} readings)\n" +
+			"{{range $field, $s := .Fields}}  {{$field}}: min {{printf \"%.2f\" $s.Min}}, max {{printf \"%.2f\" $s.Max}}, " +
+			"mean {{printf \"%.2f\" $s.Mean}}, last {{printf \"%.2f\" $s.Last}}\n{{end}}" +
+			"{{else}}\nNo readings were reported.\n{{end}}",
+	},
+}
+
+// fallbackTemplate is used for events without a default template.
+var fallbackTemplate = Template{
+	Subject: "{{.Type}}",
+	Body:    "{{.Type}} at {{.Time.Format \"2006-01-02 15:04:05 MST\"}}: {{.Data}}",
+}
+
+type compiledTemplate struct {
+	subject *template.Template
+	body    *template.Template
+}
+
+func compileTemplate(name string, t Template) (*compiledTemplate, error) {
+	subject, err := template.New(name + " subject").Option("missingkey=zero").Parse(t.Subject)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subject template for %s: %w", name, err)
+	}
+
+	body, err := template.New(name + " body").Option("missingkey=zero").Parse(t.Body)
+	if err != nil {
+		return nil, fmt.Errorf("invalid body template for %s: %w", name, err)
+	}
+
+	return &compiledTemplate{subject: subject, body: body}, nil
+}
+
+// render executes the template with the given event, returning the subject and body.
+func (t *compiledTemplate) render(event events.Event) (string, string, error) {
+	var subject, body bytes.Buffer
+	if err := t.subject.Execute(&subject, event); err != nil {
+		return "", "", err
+	}
+
+	if err := t.body.Execute(&body, event); err != nil {
+		return "", "", err
+	}
+
+	// Subjects are a single header line.
+	return strings.Join(strings.Fields(subject.String()), " "), body.String(), nil
+}
@@ -0,0 +1,119 @@
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// Type identifies the kind of an [Event].
+type Type string
+
+const (
+	// PeripheralRegistered is published when a reading arrives from an unknown peripheral and the
+	// peripheral is automatically registered.
+	PeripheralRegistered Type = "peripheral.registered"
+	// PeripheralOffline is published when a peripheral stops reporting readings.
+	PeripheralOffline Type = "peripheral.offline"
+	// PeripheralOnline is published when an offline peripheral starts reporting readings again.
+	PeripheralOnline Type = "peripheral.online"
+	// AlertFired is published when an alert rule fires for a peripheral.
+	AlertFired Type = "alert.fired"
+	// AlertResolved is published when a firing alert resolves.
+	AlertResolved Type = "alert.resolved"
+	// PayloadRejected is published when a reading payload cannot be ingested.
+	PayloadRejected Type = "payload.rejected"
+	// AnomalyDetected is published when the anomaly detector flags a peripheral's readings, e.g.
+	// a stuck sensor.
+	AnomalyDetected Type = "anomaly.detected"
+	// AnomalyResolved is published when a detected anomaly clears.
+	AnomalyResolved Type = "anomaly.resolved"
+	// ReportGenerated is published when a scheduled report has been generated.
+	ReportGenerated Type = "report.generated"
+)
+
+// Types are all event types that can be published.
+var Types = []Type{
+	PeripheralRegistered,
+	PeripheralOffline,
+	PeripheralOnline,
+	AlertFired,
+	AlertResolved,
+	PayloadRejected,
+	AnomalyDetected,
+	AnomalyResolved,
+	ReportGenerated,
+}
+
+// IsValid returns true if the event type is one of [Types].
+func (t Type) IsValid() bool {
+	for _, valid := range Types {
+		if t == valid {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Event is a notable occurrence within the server that other components can react to.
+type Event struct {
+	Type Type      `json:"type"`
+	Time time.Time `json:"time"`
+	Data any       `json:"data"`
+}
+
+// New creates a new event of the given type, timestamped now.
+func New(t Type, data any) Event {
+	return Event{Type: t, Time: time.Now().UTC(), Data: data}
+}
+
+// Handler is called for every event published on a [Bus]. Handlers are called synchronously from
+// the publisher's goroutine, so they must not block.
+type Handler func(event Event)
+
+// Bus is a simple in-process publish/subscribe event bus.
+type Bus struct {
+	mu       sync.RWMutex
+	handlers map[int]Handler
+	nextID   int
+}
+
+// NewBus creates a new, empty [Bus].
+func NewBus() *Bus {
+	return &Bus{handlers: map[int]Handler{}}
+}
+
+// Subscribe registers a handler for all events, returning a function that unsubscribes it.
+func (b *Bus) Subscribe(handler Handler) func() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	id := b.nextID
+	b.nextID++
+	b.handlers[id] = handler
+
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.handlers, id)
+	}
+}
+
+// Publish delivers an event to every subscribed handler. Publishing on a nil bus is a no-op.
+func (b *Bus) Publish(event Event) {
+	if b == nil {
+		return
+	}
+
+	// Handlers are called outside the lock so that they may (un)subscribe.
+	b.mu.RLock()
+	handlers := make([]Handler, 0, len(b.handlers))
+	for _, handler := range b.handlers {
+		handlers = append(handlers, handler)
+	}
+	b.mu.RUnlock()
+
+	for _, handler := range handlers {
+		handler(event)
+	}
+}
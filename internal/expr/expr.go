@@ -0,0 +1,316 @@
+// Package expr implements a small arithmetic expression language used to compute values from
+// reading data, e.g. "t * 1.8 + 32" or "dewpoint(t, h)".
+//
+// Expressions support numbers, variables, the operators + - * / % ^, comparisons (< <= > >= == !=),
+// logical operators (&& || !), parentheses, and the functions listed in [functions]. Comparisons and
+// logical operators evaluate to 1 (true) or 0 (false).
+package expr
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Expression is a parsed expression that can be evaluated repeatedly.
+type Expression struct {
+	source string
+	root   node
+}
+
+// ErrUnknownVariable is returned (wrapped) when an expression references a variable that was not
+// provided to [Expression.Eval].
+var ErrUnknownVariable = errors.New("unknown variable")
+
+// Parse parses the given source into an Expression.
+func Parse(source string) (*Expression, error) {
+	p := &parser{tokens: tokenize(source)}
+	root, err := p.parseBinary(0)
+	if err != nil {
+		return nil, err
+	}
+
+	if tok := p.peek(); tok.kind != tokenEOF {
+		return nil, fmt.Errorf("unexpected %q at position %d", tok.text, tok.pos)
+	}
+
+	return &Expression{source: source, root: root}, nil
+}
+
+// String returns the source of the expression.
+func (e *Expression) String() string {
+	return e.source
+}
+
+// Eval evaluates the expression with the given variables.
+func (e *Expression) Eval(vars map[string]float64) (float64, error) {
+	return e.root.eval(vars)
+}
+
+// Variables returns the sorted, de-duplicated names of the variables referenced by the expression.
+func (e *Expression) Variables() []string {
+	seen := map[string]bool{}
+	e.root.variables(seen)
+
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// Bool converts the result of an expression to a boolean, treating any non-zero value as true.
+func Bool(value float64) bool {
+	return value != 0 && !math.IsNaN(value)
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenNumber
+	tokenIdent
+	tokenOperator
+	tokenInvalid
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// twoCharOperators must be matched before single-character operators.
+var twoCharOperators = []string{"<=", ">=", "==", "!=", "&&", "||"}
+
+func tokenize(source string) []token {
+	var tokens []token
+	runes := []rune(source)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case unicode.IsDigit(r) || (r == '.' && i+1 < len(runes) && unicode.IsDigit(runes[i+1])):
+			start := i
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.') {
+				i++
+			}
+			// Allow exponents such as 1e-3.
+			if i < len(runes) && (runes[i] == 'e' || runes[i] == 'E') {
+				j := i + 1
+				if j < len(runes) && (runes[j] == '+' || runes[j] == '-') {
+					j++
+				}
+				if j < len(runes) && unicode.IsDigit(runes[j]) {
+					i = j
+					for i < len(runes) && unicode.IsDigit(runes[i]) {
+						i++
+					}
+				}
+			}
+			tokens = append(tokens, token{tokenNumber, string(runes[start:i]), start})
+		case unicode.IsLetter(r) || r == '_':
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) ||
+				runes[i] == '_' || runes[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, token{tokenIdent, string(runes[start:i]), start})
+		default:
+			matched := false
+			for _, op := range twoCharOperators {
+				if i+1 < len(runes) && string(runes[i:i+2]) == op {
+					tokens = append(tokens, token{tokenOperator, op, i})
+					i += len(op)
+					matched = true
+					break
+				}
+			}
+
+			if !matched {
+				kind := tokenOperator
+				if !strings.ContainsRune("+-*/%^()<>!,", r) {
+					kind = tokenInvalid
+				}
+				tokens = append(tokens, token{kind, string(r), i})
+				i++
+			}
+		}
+	}
+
+	return append(tokens, token{tokenEOF, "end of expression", len(runes)})
+}
+
+// maxDepth is how deeply parentheses, function calls, unary and right-associative operators can be
+// nested, which bounds the recursion of the parser.
+const maxDepth = 64
+
+type parser struct {
+	tokens []token
+	pos    int
+	// depth is the current nesting depth, see maxDepth.
+	depth int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokenEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// precedence returns the binding power of a binary operator, or -1 if the token is not one.
+func precedence(tok token) int {
+	if tok.kind != tokenOperator {
+		return -1
+	}
+
+	switch tok.text {
+	case "||":
+		return 1
+	case "&&":
+		return 2
+	case "==", "!=":
+		return 3
+	case "<", "<=", ">", ">=":
+		return 4
+	case "+", "-":
+		return 5
+	case "*", "/", "%":
+		return 6
+	case "^":
+		return 8
+	default:
+		return -1
+	}
+}
+
+func (p *parser) parseBinary(minPrecedence int) (node, error) {
+	if p.depth++; p.depth > maxDepth {
+		return nil, fmt.Errorf("expression is nested too deeply at position %d", p.peek().pos)
+	}
+
+	defer func() { p.depth-- }()
+
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		tok := p.peek()
+		prec := precedence(tok)
+		if prec < 0 || prec < minPrecedence {
+			return left, nil
+		}
+
+		p.next()
+
+		// Exponentiation is right-associative; everything else is left-associative.
+		nextMin := prec + 1
+		if tok.text == "^" {
+			nextMin = prec
+		}
+
+		right, err := p.parseBinary(nextMin)
+		if err != nil {
+			return nil, err
+		}
+
+		left = &binaryNode{op: tok.text, left: left, right: right}
+	}
+}
+
+func (p *parser) parseUnary() (node, error) {
+	tok := p.peek()
+	if tok.kind == tokenOperator && (tok.text == "-" || tok.text == "+" || tok.text == "!") {
+		p.next()
+		// Unary operators bind tighter than everything but exponentiation, so -2^2 == -4.
+		operand, err := p.parseBinary(7)
+		if err != nil {
+			return nil, err
+		}
+		return &unaryNode{op: tok.text, operand: operand}, nil
+	}
+
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokenNumber:
+		value, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at position %d", tok.text, tok.pos)
+		}
+		return numberNode(value), nil
+	case tokenIdent:
+		if next := p.peek(); next.kind == tokenOperator && next.text == "(" {
+			return p.parseCall(tok)
+		}
+		return variableNode(tok.text), nil
+	case tokenOperator:
+		if tok.text == "(" {
+			inner, err := p.parseBinary(0)
+			if err != nil {
+				return nil, err
+			}
+			if closing := p.next(); closing.text != ")" {
+				return nil, fmt.Errorf("expected ')' at position %d", closing.pos)
+			}
+			return inner, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unexpected %q at position %d", tok.text, tok.pos)
+}
+
+func (p *parser) parseCall(name token) (node, error) {
+	fn, ok := functions[name.text]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %q at position %d", name.text, name.pos)
+	}
+
+	p.next() // (
+	var args []node
+	if next := p.peek(); !(next.kind == tokenOperator && next.text == ")") {
+		for {
+			arg, err := p.parseBinary(0)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+
+			if next := p.peek(); next.kind == tokenOperator && next.text == "," {
+				p.next()
+				continue
+			}
+			break
+		}
+	}
+
+	if closing := p.next(); closing.text != ")" {
+		return nil, fmt.Errorf("expected ')' at position %d", closing.pos)
+	}
+
+	if fn.arity >= 0 && len(args) != fn.arity {
+		return nil, fmt.Errorf("function %s expects %d arguments, got %d", name.text, fn.arity, len(args))
+	} else if fn.arity < 0 && len(args) == 0 {
+		return nil, fmt.Errorf("function %s expects at least one argument", name.text)
+	}
+
+	return &callNode{name: name.text, fn: fn.fn, args: args}, nil
+}
@@ -0,0 +1,185 @@
+package expr
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestEval(t *testing.T) {
+	vars := map[string]float64{"t": 20, "h": 50, "living.t": 21.5}
+
+	tests := []struct {
+		source string
+		want   float64
+	}{
+		// Precedence and associativity.
+		{"1 + 2 * 3", 7},
+		{"(1 + 2) * 3", 9},
+		{"10 - 4 - 3", 3},
+		{"16 / 4 / 2", 2},
+		{"2 ^ 3 ^ 2", 512},
+		{"7 % 4 * 2", 6},
+		{"1 + 2 < 4", 1},
+		{"1 < 2 == 1", 1},
+		{"0 || 1 && 0", 0},
+		{"1 || 0 && 0", 1},
+		// Unary operators.
+		{"-2 ^ 2", -4},
+		{"(-2) ^ 2", 4},
+		{"-t + 5", -15},
+		{"- -3", 3},
+		{"2 * -3", -6},
+		{"+4", 4},
+		{"!0", 1},
+		{"!t", 0},
+		// Numbers, variables and functions.
+		{".5 + 1e1 + 2E-1", 10.7},
+		{"t * 1.8 + 32", 68},
+		{"living.t - t", 1.5},
+		{"max(t, h, 30)", 50},
+		{"min(3)", 3},
+		{"avg(1, 2, 3, 4)", 2.5},
+		{"abs(-t) + sqrt(16)", 24},
+		{"round(dewpoint(t, h))", 9},
+		// Logical operators short-circuit, so the right-hand side is not evaluated.
+		{"0 && missing", 0},
+		{"1 || missing", 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.source, func(t *testing.T) {
+			e, err := Parse(tt.source)
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+
+			got, err := e.Eval(vars)
+			if err != nil {
+				t.Fatalf("Eval() error = %v", err)
+			} else if math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("Eval() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+	tests := []struct {
+		source  string
+		wantErr error
+	}{
+		{source: "1 / 0"},
+		{source: "t / (h - 50)"},
+		{source: "5 % 0"},
+		{source: "dewpoint(t, 0)"},
+		{source: "missing + 1", wantErr: ErrUnknownVariable},
+		{source: "max(t, missing)", wantErr: ErrUnknownVariable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.source, func(t *testing.T) {
+			e, err := Parse(tt.source)
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+
+			_, err = e.Eval(map[string]float64{"t": 20, "h": 50})
+			if err == nil {
+				t.Fatal("Eval() succeeded")
+			} else if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("Eval() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []string{
+		"",
+		"1 +",
+		"* 2",
+		"(1 + 2",
+		"1 + 2)",
+		"1 2",
+		"t $ 2",
+		"1..2",
+		"max()",
+		"pow(2)",
+		"dewpoint(1, 2, 3)",
+		"unknown(1)",
+		"max(1,)",
+		"max(1 2)",
+		"()",
+		",",
+		"1 = 2",
+		"1 & 2",
+	}
+
+	for _, source := range tests {
+		t.Run(source, func(t *testing.T) {
+			if _, err := Parse(source); err == nil {
+				t.Errorf("Parse(%q) succeeded", source)
+			}
+		})
+	}
+}
+
+func TestParseDeepNesting(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+	}{
+		{"parentheses", strings.Repeat("(", 100000) + "1" + strings.Repeat(")", 100000)},
+		{"unclosed parentheses", strings.Repeat("(", 100000)},
+		{"unary minus", strings.Repeat("-", 100000) + "1"},
+		{"function calls", strings.Repeat("abs(", 100000) + "1" + strings.Repeat(")", 100000)},
+		{"exponentiation", "2" + strings.Repeat("^2", 100000)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Parse(tt.source); err == nil {
+				t.Error("Parse() succeeded")
+			}
+		})
+	}
+
+	// Nesting within the limit is allowed.
+	source := strings.Repeat("(", maxDepth-1) + "1" + strings.Repeat(")", maxDepth-1)
+	if _, err := Parse(source); err != nil {
+		t.Errorf("Parse() error = %v", err)
+	}
+}
+
+func TestLongChain(t *testing.T) {
+	// Left-associative operators are parsed iteratively, so long chains are not limited.
+	e, err := Parse("0" + strings.Repeat(" + 1", 10000))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+
+	if got, err := e.Eval(nil); err != nil || got != 10000 {
+		t.Errorf("Eval() = %v, %v, want 10000", got, err)
+	}
+}
+
+func TestVariables(t *testing.T) {
+	e, err := Parse("max(t, living.t) + t * h - 1")
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+
+	if got := strings.Join(e.Variables(), ","); got != "h,living.t,t" {
+		t.Errorf("Variables() = %s, want h,living.t,t", got)
+	}
+}
+
+func TestBool(t *testing.T) {
+	for value, want := range map[float64]bool{0: false, 1: true, -0.5: true, math.NaN(): false} {
+		if got := Bool(value); got != want {
+			t.Errorf("Bool(%v) = %v, want %v", value, got, want)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package expr
+
+import (
+	"errors"
+	"math"
+)
+
+type function struct {
+	// arity is the number of arguments the function expects, or -1 for variadic functions.
+	arity int
+	fn    func(args []float64) (float64, error)
+}
+
+func unary(fn func(float64) float64) function {
+	return function{arity: 1, fn: func(args []float64) (float64, error) {
+		return fn(args[0]), nil
+	}}
+}
+
+// functions are the functions that can be called from an expression.
+var functions = map[string]function{
+	"abs":   unary(math.Abs),
+	"sqrt":  unary(math.Sqrt),
+	"exp":   unary(math.Exp),
+	"ln":    unary(math.Log),
+	"log10": unary(math.Log10),
+	"floor": unary(math.Floor),
+	"ceil":  unary(math.Ceil),
+	"round": unary(math.Round),
+	"pow": {arity: 2, fn: func(args []float64) (float64, error) {
+		return math.Pow(args[0], args[1]), nil
+	}},
+	"min": {arity: -1, fn: func(args []float64) (float64, error) {
+		result := args[0]
+		for _, arg := range args[1:] {
+			result = math.Min(result, arg)
+		}
+		return result, nil
+	}},
+	"max": {arity: -1, fn: func(args []float64) (float64, error) {
+		result := args[0]
+		for _, arg := range args[1:] {
+			result = math.Max(result, arg)
+		}
+		return result, nil
+	}},
+	"avg": {arity: -1, fn: func(args []float64) (float64, error) {
+		sum := 0.0
+		for _, arg := range args {
+			sum += arg
+		}
+		return sum / float64(len(args)), nil
+	}},
+	"sum": {arity: -1, fn: func(args []float64) (float64, error) {
+		sum := 0.0
+		for _, arg := range args {
+			sum += arg
+		}
+		return sum, nil
+	}},
+	"dewpoint":  {arity: 2, fn: dewPoint},
+	"heatindex": {arity: 2, fn: heatIndex},
+}
+
+// dewPoint computes the dew point (°C) from a temperature (°C) and relative humidity (%) using the
+// Magnus formula.
+func dewPoint(args []float64) (float64, error) {
+	t, rh := args[0], args[1]
+	if rh <= 0 || rh > 100 {
+		return 0, errors.New("relative humidity must be in (0, 100]")
+	}
+
+	const a, b = 17.62, 243.12
+	gamma := math.Log(rh/100) + a*t/(b+t)
+	return b * gamma / (a - gamma), nil
+}
+
+// heatIndex computes the heat index (°C) from a temperature (°C) and relative humidity (%) using
+// the NWS Rothfusz regression, falling back to the simple formula for mild conditions.
+func heatIndex(args []float64) (float64, error) {
+	t, rh := args[0], args[1]
+	if rh < 0 || rh > 100 {
+		return 0, errors.New("relative humidity must be in [0, 100]")
+	}
+
+	f := t*9/5 + 32
+	hi := 0.5 * (f + 61 + (f-68)*1.2 + rh*0.094)
+	if (hi+f)/2 >= 80 {
+		hi = -42.379 + 2.04901523*f + 10.14333127*rh - 0.22475541*f*rh -
+			0.00683783*f*f - 0.05481717*rh*rh + 0.00122874*f*f*rh +
+			0.00085282*f*rh*rh - 0.00000199*f*f*rh*rh
+
+		if rh < 13 && f >= 80 && f <= 112 {
+			hi -= (13 - rh) / 4 * math.Sqrt((17-math.Abs(f-95))/17)
+		} else if rh > 85 && f >= 80 && f <= 87 {
+			hi += (rh - 85) / 10 * (87 - f) / 5
+		}
+	}
+
+	return (hi - 32) * 5 / 9, nil
+}
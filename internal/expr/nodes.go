@@ -0,0 +1,164 @@
+package expr
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+type node interface {
+	eval(vars map[string]float64) (float64, error)
+	variables(seen map[string]bool)
+}
+
+type numberNode float64
+
+func (n numberNode) eval(map[string]float64) (float64, error) {
+	return float64(n), nil
+}
+
+func (n numberNode) variables(map[string]bool) {}
+
+type variableNode string
+
+func (n variableNode) eval(vars map[string]float64) (float64, error) {
+	value, ok := vars[string(n)]
+	if !ok {
+		return 0, fmt.Errorf("%w: %s", ErrUnknownVariable, string(n))
+	}
+
+	return value, nil
+}
+
+func (n variableNode) variables(seen map[string]bool) {
+	seen[string(n)] = true
+}
+
+type unaryNode struct {
+	op      string
+	operand node
+}
+
+func (n *unaryNode) eval(vars map[string]float64) (float64, error) {
+	value, err := n.operand.eval(vars)
+	if err != nil {
+		return 0, err
+	}
+
+	switch n.op {
+	case "-":
+		return -value, nil
+	case "!":
+		return boolToFloat(!Bool(value)), nil
+	default:
+		return value, nil
+	}
+}
+
+func (n *unaryNode) variables(seen map[string]bool) {
+	n.operand.variables(seen)
+}
+
+type binaryNode struct {
+	op          string
+	left, right node
+}
+
+func (n *binaryNode) eval(vars map[string]float64) (float64, error) {
+	left, err := n.left.eval(vars)
+	if err != nil {
+		return 0, err
+	}
+
+	// Logical operators short-circuit.
+	if n.op == "&&" && !Bool(left) {
+		return 0, nil
+	} else if n.op == "||" && Bool(left) {
+		return 1, nil
+	}
+
+	right, err := n.right.eval(vars)
+	if err != nil {
+		return 0, err
+	}
+
+	switch n.op {
+	case "+":
+		return left + right, nil
+	case "-":
+		return left - right, nil
+	case "*":
+		return left * right, nil
+	case "/":
+		if right == 0 {
+			return 0, errors.New("division by zero")
+		}
+		return left / right, nil
+	case "%":
+		if right == 0 {
+			return 0, errors.New("division by zero")
+		}
+		return math.Mod(left, right), nil
+	case "^":
+		return math.Pow(left, right), nil
+	case "<":
+		return boolToFloat(left < right), nil
+	case "<=":
+		return boolToFloat(left <= right), nil
+	case ">":
+		return boolToFloat(left > right), nil
+	case ">=":
+		return boolToFloat(left >= right), nil
+	case "==":
+		return boolToFloat(left == right), nil
+	case "!=":
+		return boolToFloat(left != right), nil
+	case "&&", "||":
+		return boolToFloat(Bool(right)), nil
+	default:
+		return 0, fmt.Errorf("unknown operator %q", n.op)
+	}
+}
+
+func (n *binaryNode) variables(seen map[string]bool) {
+	n.left.variables(seen)
+	n.right.variables(seen)
+}
+
+type callNode struct {
+	name string
+	fn   func(args []float64) (float64, error)
+	args []node
+}
+
+func (n *callNode) eval(vars map[string]float64) (float64, error) {
+	args := make([]float64, len(n.args))
+	for i, arg := range n.args {
+		value, err := arg.eval(vars)
+		if err != nil {
+			return 0, err
+		}
+		args[i] = value
+	}
+
+	value, err := n.fn(args)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", n.name, err)
+	}
+
+	return value, nil
+}
+
+func (n *callNode) variables(seen map[string]bool) {
+	for _, arg := range n.args {
+		arg.variables(seen)
+	}
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+
+	return 0
+}
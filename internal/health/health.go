@@ -0,0 +1,79 @@
+// Package health checks whether the components of the server (e.g. the database or the MQTT
+// broker) are working, for the health endpoints and the systemd watchdog.
+package health
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// checkTimeout is how long a check may take before it is considered failing.
+const checkTimeout = 2 * time.Second
+
+// Check checks whether a component of the server is working.
+type Check struct {
+	Name  string
+	Check func(ctx context.Context) error
+	// Liveness marks checks whose failure means the server must be restarted. Other checks only
+	// mean that the server is not ready, e.g. because the ngrok tunnel is down.
+	Liveness bool
+}
+
+// Run runs the checks (only the liveness checks if liveness is set) concurrently, returning the
+// error of every check keyed by name, with nil for passing checks. A check that takes longer than
+// the timeout fails, even if it ignores its context, so that a stuck component cannot hang the
+// health endpoints or the watchdog.
+func Run(ctx context.Context, checks []Check, liveness bool) map[string]error {
+	type result struct {
+		name string
+		err  error
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+
+	// The channel is buffered so that checks that time out can still finish in the background.
+	results := make(chan result, len(checks))
+	count := 0
+	for _, check := range checks {
+		if liveness && !check.Liveness {
+			continue
+		}
+
+		count++
+		go func() {
+			results <- result{check.Name, check.Check(ctx)}
+		}()
+	}
+
+	errs := make(map[string]error, count)
+	for range count {
+		select {
+		case r := <-results:
+			errs[r.name] = r.err
+		case <-ctx.Done():
+			for _, check := range checks {
+				if _, ok := errs[check.Name]; !ok && (!liveness || check.Liveness) {
+					errs[check.Name] = fmt.Errorf("check did not finish: %w", ctx.Err())
+				}
+			}
+
+			return errs
+		}
+	}
+
+	return errs
+}
+
+// FirstFailure returns the error of the first failing check of the results, in the order of the
+// checks and prefixed with its name, or nil if every check passed.
+func FirstFailure(checks []Check, results map[string]error) error {
+	for _, check := range checks {
+		if err := results[check.Name]; err != nil {
+			return fmt.Errorf("%s: %w", check.Name, err)
+		}
+	}
+
+	return nil
+}
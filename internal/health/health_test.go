@@ -0,0 +1,54 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRun(t *testing.T) {
+	errDown := errors.New("down")
+	stuck := make(chan struct{})
+	t.Cleanup(func() { close(stuck) })
+
+	checks := []Check{
+		{Name: "database", Check: func(context.Context) error { return nil }, Liveness: true},
+		{Name: "mqtt", Check: func(context.Context) error { return errDown }, Liveness: true},
+		{Name: "ngrok", Check: func(context.Context) error { return errDown }},
+	}
+
+	results := Run(context.Background(), checks, true)
+	if len(results) != 2 || results["database"] != nil || results["mqtt"] != errDown {
+		t.Errorf("Run(liveness) = %v, want database and a failing mqtt", results)
+	}
+
+	results = Run(context.Background(), checks, false)
+	if len(results) != 3 || results["ngrok"] != errDown {
+		t.Errorf("Run() = %v, want every check", results)
+	}
+
+	if err := FirstFailure(checks, results); err == nil || err.Error() != "mqtt: down" {
+		t.Errorf("FirstFailure() = %v, want mqtt: down", err)
+	}
+
+	if err := FirstFailure(checks[:1], results); err != nil {
+		t.Errorf("FirstFailure() of passing checks = %v, want nil", err)
+	}
+
+	// A check that ignores its context fails once it times out, without holding up the others.
+	checks = append(checks, Check{Name: "stuck", Check: func(context.Context) error {
+		<-stuck
+		return nil
+	}})
+
+	start := time.Now()
+	results = Run(context.Background(), checks, false)
+	if elapsed := time.Since(start); elapsed > checkTimeout+time.Second {
+		t.Errorf("Run() with a stuck check took %s", elapsed)
+	}
+
+	if !errors.Is(results["stuck"], context.DeadlineExceeded) || results["database"] != nil || results["mqtt"] != errDown {
+		t.Errorf("Run() with a stuck check = %v", results)
+	}
+}
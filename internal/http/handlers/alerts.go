@@ -0,0 +1,266 @@
+package handlers
+
+import (
+	"errors"
+	"hafh-server/internal/database"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// alertRuleRequest is the request body for creating or updating an alert rule. All fields are
+// optional when updating.
+type alertRuleRequest struct {
+	Name            *string              `json:"name"`
+	SerialNumber    *string              `json:"serialNumber"`
+	Tag             *string              `json:"tag"`
+	Field           *string              `json:"field"`
+	Comparison      *database.Comparison `json:"comparison"`
+	Threshold       *float64             `json:"threshold"`
+	DurationSeconds *int64               `json:"durationSeconds"`
+	Hysteresis      *float64             `json:"hysteresis"`
+	Enabled         *bool                `json:"enabled"`
+}
+
+// apply copies the fields that are set in the request onto the rule.
+func (r *alertRuleRequest) apply(rule *database.AlertRule) {
+	if r.Name != nil {
+		rule.Name = *r.Name
+	}
+
+	if r.SerialNumber != nil {
+		rule.SerialNumber = *r.SerialNumber
+	}
+
+	if r.Tag != nil {
+		rule.Tag = *r.Tag
+	}
+
+	if r.Field != nil {
+		rule.Field = *r.Field
+	}
+
+	if r.Comparison != nil {
+		rule.Comparison = *r.Comparison
+	}
+
+	if r.Threshold != nil {
+		rule.Threshold = *r.Threshold
+	}
+
+	if r.DurationSeconds != nil {
+		rule.DurationSeconds = *r.DurationSeconds
+	}
+
+	if r.Hysteresis != nil {
+		rule.Hysteresis = *r.Hysteresis
+	}
+
+	if r.Enabled != nil {
+		rule.Enabled = *r.Enabled
+	}
+}
+
+// GetAlertRules returns all alert rules.
+func GetAlertRules(c *gin.Context) {
+	rules, err := config.db.GetAlertRules(false)
+	if err != nil {
+		config.log.Error("Failed to get alert rules: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get alert rules"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"rules": rules})
+}
+
+// GetAlertRule returns a single alert rule, identified by the `id` path parameter.
+func GetAlertRule(c *gin.Context) {
+	rule, ok := requireAlertRule(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"rule": rule})
+}
+
+// PostAlertRule creates a new alert rule.
+//
+// A request body is expected with the following schema:
+//
+//	{
+//	   "name": string,
+//	   "serialNumber": string (optional, the peripheral the rule applies to),
+//	   "tag": string (optional, a tag of the peripherals the rule applies to),
+//	   "field": string (a dot-separated path in the reading data, e.g. "t"),
+//	   "comparison": ">" | ">=" | "<" | "<=" | "==" | "!=",
+//	   "threshold": float64,
+//	   "durationSeconds": int (optional, how long the condition must hold before firing),
+//	   "hysteresis": float64 (optional, how far past the threshold the value must return to resolve),
+//	   "enabled": bool (optional, defaults to true)
+//	}
+func PostAlertRule(c *gin.Context) {
+	var request alertRuleRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		config.log.Error("Failed to bind JSON: ", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	rule := &database.AlertRule{Enabled: true}
+	request.apply(rule)
+
+	if err := rule.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := config.db.AddAlertRule(rule); err != nil {
+		config.log.Error("Failed to add alert rule: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add alert rule"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"rule": rule})
+}
+
+// PatchAlertRule partially updates the alert rule identified by the `id` path parameter, accepting
+// any of the fields of [PostAlertRule]. Any omitted field is left unchanged. Alerts of the rule that
+// are firing are resolved, and fire again if the updated rule still applies.
+func PatchAlertRule(c *gin.Context) {
+	var request alertRuleRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		config.log.Error("Failed to bind JSON: ", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	rule, ok := requireAlertRule(c)
+	if !ok {
+		return
+	}
+
+	request.apply(rule)
+	if err := rule.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := config.db.UpdateAlertRule(rule); err != nil {
+		config.log.Error("Failed to update alert rule: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update alert rule"})
+		return
+	}
+
+	resetAlertRule(rule.ID)
+
+	c.JSON(http.StatusOK, gin.H{"rule": rule})
+}
+
+// DeleteAlertRule deletes the alert rule identified by the `id` path parameter, along with its
+// alerts.
+func DeleteAlertRule(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid alert rule ID"})
+		return
+	}
+
+	// The rule's alerts are resolved first, as deleting the rule deletes them along with it.
+	resetAlertRule(id)
+
+	err = config.db.DeleteAlertRule(id)
+	if errors.Is(err, database.ErrAlertRuleNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Alert rule not found"})
+		return
+	} else if err != nil {
+		config.log.Error("Failed to delete alert rule: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete alert rule"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Alert rule deleted successfully"})
+}
+
+// GetAlerts returns alert events, most recent first.
+//
+// The list can be narrowed down with the following optional query parameters:
+//
+//   - `state`: `firing` or `resolved`.
+//   - `rule`: the ID of the alert rule.
+//   - `serial`: the serial number of the peripheral.
+//   - `limit`: the maximum number of alerts to return (defaults to 100).
+func GetAlerts(c *gin.Context) {
+	filter := database.AlertFilter{
+		State:        database.AlertState(c.Query("state")),
+		SerialNumber: c.Query("serial"),
+		Limit:        100,
+	}
+
+	if filter.State != "" && filter.State != database.AlertStateFiring &&
+		filter.State != database.AlertStateResolved {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid state"})
+		return
+	}
+
+	if rule := c.Query("rule"); rule != "" {
+		id, err := strconv.ParseInt(rule, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid rule"})
+			return
+		}
+		filter.RuleID = id
+	}
+
+	if limit := c.Query("limit"); limit != "" {
+		value, err := strconv.ParseUint(limit, 10, 32)
+		if err != nil || value == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+			return
+		}
+		filter.Limit = uint32(value)
+	}
+
+	alerts, err := config.db.FindAlerts(filter)
+	if err != nil {
+		config.log.Error("Failed to get alerts: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get alerts"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"alerts": alerts})
+}
+
+// resetAlertRule resolves the firing alerts of a rule that was edited, disabled or deleted, which
+// are then evaluated from scratch.
+func resetAlertRule(id int64) {
+	if config.alerts == nil {
+		return
+	}
+
+	if err := config.alerts.ResetRule(id); err != nil {
+		config.log.Error("Failed to reset alert rule: ", err)
+	}
+}
+
+// requireAlertRule looks up the alert rule identified by the `id` path parameter, responding with an
+// error if it is invalid or cannot be found.
+func requireAlertRule(c *gin.Context) (*database.AlertRule, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid alert rule ID"})
+		return nil, false
+	}
+
+	rule, err := config.db.GetAlertRule(id)
+	if err != nil {
+		config.log.Error("Failed to get alert rule: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get alert rule"})
+		return nil, false
+	} else if rule == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Alert rule not found"})
+		return nil, false
+	}
+
+	return rule, true
+}
@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"hafh-server/internal/database"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetAnomalies returns the anomalies found by the anomaly detector, most recent first.
+//
+// The list can be narrowed down with the following optional query parameters:
+//
+//   - `serial`: the serial number of the peripheral.
+//   - `kind`: `flatline`, `spike`, `out_of_range` or `rate_drop`.
+//   - `open`: `true` for unresolved anomalies, or `false` for resolved ones.
+//   - `limit`: the maximum number of anomalies to return (defaults to 100).
+func GetAnomalies(c *gin.Context) {
+	filter := database.AnomalyFilter{
+		SerialNumber: c.Query("serial"),
+		Kind:         database.AnomalyKind(c.Query("kind")),
+		Limit:        100,
+	}
+
+	if filter.Kind != "" && !filter.Kind.IsValid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid kind"})
+		return
+	}
+
+	if open := c.Query("open"); open != "" {
+		value, err := strconv.ParseBool(open)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid open"})
+			return
+		}
+		filter.Open = &value
+	}
+
+	if limit := c.Query("limit"); limit != "" {
+		value, err := strconv.ParseUint(limit, 10, 32)
+		if err != nil || value == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+			return
+		}
+		filter.Limit = uint32(value)
+	}
+
+	anomalies, err := config.db.FindAnomalies(filter)
+	if err != nil {
+		config.log.Error("Failed to get anomalies: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get anomalies"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"anomalies": anomalies})
+}
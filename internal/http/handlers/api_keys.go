@@ -0,0 +1,201 @@
+package handlers
+
+import (
+	"errors"
+	"hafh-server/internal/auth"
+	"hafh-server/internal/database"
+	"hafh-server/internal/http/middleware"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// apiKeyRequest is the request body for creating or updating an API key. All fields are optional
+// when updating.
+type apiKeyRequest struct {
+	Name      *string           `json:"name"`
+	Scopes    *[]database.Scope `json:"scopes"`
+	ExpiresAt *time.Time        `json:"expiresAt"`
+	// NeverExpires removes the expiry of the key when updating.
+	NeverExpires *bool `json:"neverExpires"`
+}
+
+// apply copies the fields that are set in the request onto the API key.
+func (r *apiKeyRequest) apply(key *database.APIKey) {
+	if r.Name != nil {
+		key.Name = *r.Name
+	}
+
+	if r.Scopes != nil {
+		key.Scopes = *r.Scopes
+	}
+
+	if r.ExpiresAt != nil {
+		expiresAt := r.ExpiresAt.UTC()
+		key.ExpiresAt = &expiresAt
+	} else if r.NeverExpires != nil && *r.NeverExpires {
+		key.ExpiresAt = nil
+	}
+}
+
+// validateAPIKey checks that the API key has a name and at least one scope, all of which are known.
+func validateAPIKey(key *database.APIKey) error {
+	if key.Name == "" {
+		return errors.New("name is required")
+	} else if len(key.Scopes) == 0 {
+		return errors.New("at least one scope is required")
+	}
+
+	for _, scope := range key.Scopes {
+		if !scope.IsValid() {
+			return errors.New("unknown scope: " + string(scope))
+		}
+	}
+
+	return nil
+}
+
+// GetAPIKeys returns all API keys. The keys themselves are never included.
+func GetAPIKeys(c *gin.Context) {
+	keys, err := config.db.GetAllAPIKeys()
+	if err != nil {
+		config.log.Error("Failed to get API keys: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get API keys"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"api_keys": keys})
+}
+
+// GetAPIKey returns a single API key, identified by the `id` path parameter.
+func GetAPIKey(c *gin.Context) {
+	key, ok := requireAPIKey(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"api_key": key})
+}
+
+// PostAPIKey generates a new API key. The key is only ever returned in the response to this
+// request; only its hash is stored.
+//
+// A request body is expected with the following schema:
+//
+//	{
+//	   "name": string,
+//	   "scopes": []string (any of "readings:read", "peripherals:write", "commands:send" and "admin"),
+//	   "expiresAt": string (optional, an RFC 3339 timestamp, defaults to never)
+//	}
+func PostAPIKey(c *gin.Context) {
+	middleware.MarkSensitive(c)
+
+	var request apiKeyRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		config.log.Error("Failed to bind JSON: ", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	key := &database.APIKey{}
+	request.apply(key)
+
+	if err := validateAPIKey(key); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if key.IsExpired(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expiresAt must be in the future"})
+		return
+	}
+
+	secret, prefix, hash, err := auth.GenerateAPIKey()
+	if err != nil {
+		config.log.Error("Failed to generate API key: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add API key"})
+		return
+	}
+
+	key.Prefix = prefix
+	key.Hash = hash
+	if err := config.db.AddAPIKey(key); err != nil {
+		config.log.Error("Failed to add API key: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add API key"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"api_key": key, "key": secret})
+}
+
+// PatchAPIKey partially updates the API key identified by the `id` path parameter, accepting any of
+// the fields of [PostAPIKey], as well as `"neverExpires": true` to remove its expiry. Any omitted
+// field is left unchanged. The key itself cannot be changed.
+func PatchAPIKey(c *gin.Context) {
+	var request apiKeyRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		config.log.Error("Failed to bind JSON: ", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	key, ok := requireAPIKey(c)
+	if !ok {
+		return
+	}
+
+	request.apply(key)
+	if err := validateAPIKey(key); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := config.db.UpdateAPIKey(key); err != nil {
+		config.log.Error("Failed to update API key: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update API key"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"api_key": key})
+}
+
+// DeleteAPIKey revokes the API key identified by the `id` path parameter.
+func DeleteAPIKey(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid API key ID"})
+		return
+	}
+
+	err = config.db.DeleteAPIKey(id)
+	if errors.Is(err, database.ErrAPIKeyNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+		return
+	} else if err != nil {
+		config.log.Error("Failed to delete API key: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete API key"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "API key deleted successfully"})
+}
+
+func requireAPIKey(c *gin.Context) (*database.APIKey, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid API key ID"})
+		return nil, false
+	}
+
+	key, err := config.db.GetAPIKey(id)
+	if err != nil {
+		config.log.Error("Failed to get API key: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get API key"})
+		return nil, false
+	} else if key == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+		return nil, false
+	}
+
+	return key, true
+}
@@ -0,0 +1,249 @@
+package handlers
+
+import (
+	"errors"
+	"hafh-server/internal/auth"
+	"hafh-server/internal/database"
+	"hafh-server/internal/http/middleware"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// loginRequest is the request body for logging in.
+type loginRequest struct {
+	Username string `json:"username" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+// PostLogin logs a user in, creating a new session. The session token is returned in the response
+// (to be sent in the `Authorization: Bearer` header) and set as a cookie (for browsers).
+//
+// A request body is expected with the following schema:
+//
+//	{
+//	   "username": string,
+//	   "password": string
+//	}
+func PostLogin(c *gin.Context) {
+	middleware.MarkSensitive(c)
+
+	var request loginRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		config.log.Error("Failed to bind JSON: ", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	if config.oidc != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Password login is disabled, log in with OIDC instead"})
+		return
+	}
+
+	user, err := config.db.GetUserByUsername(request.Username)
+	if err != nil {
+		config.log.Error("Failed to get user: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log in"})
+		return
+	}
+
+	if !auth.CheckPassword(user, request.Password) {
+		config.log.Warnf("Failed login for %q from %s", request.Username, c.ClientIP())
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid username or password"})
+		return
+	}
+
+	session, token, ok := startSession(c, user)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"token": token, "expires_at": session.ExpiresAt, "user": user})
+}
+
+// GetOIDCLogin redirects to the OpenID Connect provider to log in. Once logged in, the provider
+// redirects to [GetOIDCCallback]. The optional `redirect` query parameter is a path of this server
+// to redirect to after logging in.
+func GetOIDCLogin(c *gin.Context) {
+	if config.oidc == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "OIDC login is not configured"})
+		return
+	}
+
+	// Only local paths are allowed, so that the login cannot be used to redirect to another site.
+	redirect := c.Query("redirect")
+	if redirect != "" && (!strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") ||
+		strings.Contains(redirect, "\\")) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "redirect must be a local path"})
+		return
+	}
+
+	location, err := config.oidc.BeginLogin(c.Request.Context(), redirect)
+	if err != nil {
+		config.log.Error("Failed to begin OIDC login: ", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to reach the identity provider"})
+		return
+	}
+
+	c.Redirect(http.StatusFound, location)
+}
+
+// GetOIDCCallback completes a login with the OpenID Connect provider, creating (or updating the
+// role of) the user linked to the account at the provider and starting a session like [PostLogin].
+// The user is redirected to the `redirect` passed to [GetOIDCLogin], if any; otherwise the session
+// is returned like [PostLogin].
+func GetOIDCCallback(c *gin.Context) {
+	middleware.MarkSensitive(c)
+
+	if config.oidc == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "OIDC login is not configured"})
+		return
+	}
+
+	if providerError := c.Query("error"); providerError != "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "The identity provider refused the login: " +
+			providerError + " " + c.Query("error_description")})
+		return
+	}
+
+	state, code := c.Query("state"), c.Query("code")
+	if state == "" || code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "state and code are required"})
+		return
+	}
+
+	identity, redirect, err := config.oidc.CompleteLogin(c.Request.Context(), state, code)
+	if errors.Is(err, auth.ErrNoRole) {
+		config.log.Warnf("Rejected OIDC login without a role from %s", c.ClientIP())
+		c.JSON(http.StatusForbidden, gin.H{"error": "You have not been granted access"})
+		return
+	} else if err != nil {
+		config.log.Error("Failed to complete OIDC login: ", err)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Failed to log in"})
+		return
+	}
+
+	user, ok := oidcUser(c, identity)
+	if !ok {
+		return
+	}
+
+	session, token, ok := startSession(c, user)
+	if !ok {
+		return
+	}
+
+	if redirect != "" {
+		c.Redirect(http.StatusFound, redirect)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"token": token, "expires_at": session.ExpiresAt, "user": user})
+}
+
+// oidcUser returns the user linked to the account of the identity at the provider, creating it on
+// first login and keeping its role in sync with the claims. Users are never linked by username, as
+// the provider's usernames may be chosen by its users and would otherwise take over local accounts.
+// It responds with an error and returns false on failure.
+func oidcUser(c *gin.Context, identity *auth.Identity) (*database.User, bool) {
+	user, err := config.db.GetUserByOIDCSubject(identity.Issuer, identity.Subject)
+	if err != nil {
+		config.log.Error("Failed to get user: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log in"})
+		return nil, false
+	}
+
+	if user == nil {
+		existing, err := config.db.GetUserByUsername(identity.Username)
+		if err != nil {
+			config.log.Error("Failed to get user: ", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log in"})
+			return nil, false
+		} else if existing != nil {
+			config.log.Warnf("Rejected OIDC login of %s as existing user %q", identity.Subject, identity.Username)
+			c.JSON(http.StatusConflict, gin.H{"error": "The username is already taken by another user"})
+			return nil, false
+		}
+
+		// Users of the provider have no password.
+		user = &database.User{Username: identity.Username, Role: identity.Role,
+			OIDCIssuer: identity.Issuer, OIDCSubject: identity.Subject}
+		err = config.db.AddUser(user)
+	} else if user.Role != identity.Role {
+		user.Role = identity.Role
+		err = config.db.UpdateUser(user)
+	}
+
+	if err != nil {
+		config.log.Error("Failed to save OIDC user: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log in"})
+		return nil, false
+	}
+
+	return user, true
+}
+
+// startSession creates a new session for the user, setting the session cookie. It responds with an
+// error and returns false on failure.
+func startSession(c *gin.Context, user *database.User) (*database.Session, string, bool) {
+	token, hash, err := auth.GenerateSessionToken()
+	if err != nil {
+		config.log.Error("Failed to generate session token: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log in"})
+		return nil, "", false
+	}
+
+	now := time.Now()
+	session := &database.Session{
+		UserID:    user.ID,
+		Hash:      hash,
+		ExpiresAt: now.Add(config.sessionLifetime).UTC().Truncate(time.Second),
+	}
+
+	if err := config.db.AddSession(session); err != nil {
+		config.log.Error("Failed to add session: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log in"})
+		return nil, "", false
+	}
+
+	if err := config.db.RecordUserLogin(user.ID, now); err != nil {
+		config.log.Error("Failed to record login: ", err)
+	} else {
+		lastLoginAt := now.UTC().Truncate(time.Second)
+		user.LastLoginAt = &lastLoginAt
+	}
+
+	// Logging in is a good time to clean up, as sessions are otherwise never deleted on expiry.
+	if err := config.db.DeleteExpiredSessions(now); err != nil {
+		config.log.Error("Failed to delete expired sessions: ", err)
+	}
+
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(middleware.SessionCookie, token, int(config.sessionLifetime.Seconds()), "/", "",
+		c.Request.TLS != nil, true)
+
+	return session, token, true
+}
+
+// PostLogout logs the current user out, deleting their session.
+func PostLogout(c *gin.Context) {
+	if token := middleware.SessionToken(c); token != "" {
+		if err := config.db.DeleteSession(auth.HashToken(token)); err != nil {
+			config.log.Error("Failed to delete session: ", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out"})
+			return
+		}
+	}
+
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(middleware.SessionCookie, "", -1, "/", "", c.Request.TLS != nil, true)
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out successfully"})
+}
+
+// GetMe returns the authenticated principal of the request, i.e. the logged in user or API key and
+// the scopes it has been granted.
+func GetMe(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"principal": middleware.GetPrincipal(c)})
+}
@@ -0,0 +1,260 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"hafh-server/internal/commands"
+	"hafh-server/internal/database"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// automationRequest is the request body for creating or updating an automation. All fields are
+// optional when updating.
+type automationRequest struct {
+	Name            *string                         `json:"name"`
+	Conditions      *[]database.AutomationCondition `json:"conditions"`
+	Actions         *[]database.AutomationAction    `json:"actions"`
+	DurationSeconds *int64                          `json:"durationSeconds"`
+	CooldownSeconds *int64                          `json:"cooldownSeconds"`
+	Enabled         *bool                           `json:"enabled"`
+	DryRun          *bool                           `json:"dryRun"`
+}
+
+// apply copies the fields that are set in the request onto the automation.
+func (r *automationRequest) apply(automation *database.Automation) {
+	if r.Name != nil {
+		automation.Name = *r.Name
+	}
+
+	if r.Conditions != nil {
+		automation.Conditions = *r.Conditions
+	}
+
+	if r.Actions != nil {
+		automation.Actions = *r.Actions
+	}
+
+	if r.DurationSeconds != nil {
+		automation.DurationSeconds = *r.DurationSeconds
+	}
+
+	if r.CooldownSeconds != nil {
+		automation.CooldownSeconds = *r.CooldownSeconds
+	}
+
+	if r.Enabled != nil {
+		automation.Enabled = *r.Enabled
+	}
+
+	if r.DryRun != nil {
+		automation.DryRun = *r.DryRun
+	}
+}
+
+// validateAutomation validates the automation, including that every action targets a peripheral
+// that accepts its command. It responds with an error and returns false if it is invalid.
+func validateAutomation(c *gin.Context, automation *database.Automation) bool {
+	if err := automation.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+
+	if config.commands == nil {
+		return true
+	}
+
+	for i, action := range automation.Actions {
+		err := config.commands.Validate(action.SerialNumber, action.Command)
+		if errors.Is(err, commands.ErrUnknownPeripheral) || errors.Is(err, commands.ErrNotActuator) ||
+			errors.Is(err, commands.ErrUnsupportedCommand) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("action %d: %v", i, err)})
+			return false
+		} else if err != nil {
+			config.log.Error("Failed to validate automation action: ", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to validate automation"})
+			return false
+		}
+	}
+
+	return true
+}
+
+// GetAutomations returns all automations.
+func GetAutomations(c *gin.Context) {
+	automations, err := config.db.GetAutomations(false)
+	if err != nil {
+		config.log.Error("Failed to get automations: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get automations"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"automations": automations})
+}
+
+// GetAutomation returns a single automation, identified by the `id` path parameter.
+func GetAutomation(c *gin.Context) {
+	automation, ok := requireAutomation(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"automation": automation})
+}
+
+// PostAutomation creates a new automation.
+//
+// A request body is expected with the following schema:
+//
+//	{
+//	   "name": string,
+//	   "conditions": [
+//	      {
+//	         "kind": "reading" | "presence",
+//	         "serial_number": string,
+//	         "field": string (reading conditions only),
+//	         "comparison": ">" | ">=" | "<" | "<=" | "==" | "!=" (reading conditions only),
+//	         "threshold": float64 (reading conditions only),
+//	         "online": bool (presence conditions only)
+//	      }
+//	   ],
+//	   "actions": [
+//	      {
+//	         "serial_number": string (an actuator),
+//	         "command": string,
+//	         "args": object (optional)
+//	      }
+//	   ],
+//	   "durationSeconds": int (optional, how long the conditions must hold before triggering),
+//	   "cooldownSeconds": int (optional, the minimum time between two executions),
+//	   "enabled": bool (optional, defaults to true),
+//	   "dryRun": bool (optional, record executions without sending commands)
+//	}
+func PostAutomation(c *gin.Context) {
+	var request automationRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		config.log.Error("Failed to bind JSON: ", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	automation := &database.Automation{Enabled: true}
+	request.apply(automation)
+
+	if !validateAutomation(c, automation) {
+		return
+	}
+
+	if err := config.db.AddAutomation(automation); err != nil {
+		config.log.Error("Failed to add automation: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add automation"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"automation": automation})
+}
+
+// PatchAutomation partially updates the automation identified by the `id` path parameter,
+// accepting any of the fields of [PostAutomation]. Any omitted field is left unchanged, e.g.
+// `{"enabled": false}` disables an automation.
+func PatchAutomation(c *gin.Context) {
+	var request automationRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		config.log.Error("Failed to bind JSON: ", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	automation, ok := requireAutomation(c)
+	if !ok {
+		return
+	}
+
+	request.apply(automation)
+	if !validateAutomation(c, automation) {
+		return
+	}
+
+	if err := config.db.UpdateAutomation(automation); err != nil {
+		config.log.Error("Failed to update automation: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update automation"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"automation": automation})
+}
+
+// DeleteAutomation deletes the automation identified by the `id` path parameter, along with its
+// execution history.
+func DeleteAutomation(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid automation ID"})
+		return
+	}
+
+	err = config.db.DeleteAutomation(id)
+	if errors.Is(err, database.ErrAutomationNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Automation not found"})
+		return
+	} else if err != nil {
+		config.log.Error("Failed to delete automation: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete automation"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Automation deleted successfully"})
+}
+
+// GetAutomationExecutions returns the execution history of the automation identified by the `id`
+// path parameter, most recent first. The optional `limit` query parameter sets the maximum number
+// of executions to return (defaults to 100).
+func GetAutomationExecutions(c *gin.Context) {
+	automation, ok := requireAutomation(c)
+	if !ok {
+		return
+	}
+
+	limit := uint32(100)
+	if value := c.Query("limit"); value != "" {
+		parsed, err := strconv.ParseUint(value, 10, 32)
+		if err != nil || parsed == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+			return
+		}
+		limit = uint32(parsed)
+	}
+
+	executions, err := config.db.GetAutomationExecutions(automation.ID, limit)
+	if err != nil {
+		config.log.Error("Failed to get automation executions: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get automation executions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"executions": executions})
+}
+
+// requireAutomation looks up the automation identified by the `id` path parameter, responding with
+// an error if it is invalid or cannot be found.
+func requireAutomation(c *gin.Context) (*database.Automation, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid automation ID"})
+		return nil, false
+	}
+
+	automation, err := config.db.GetAutomation(id)
+	if err != nil {
+		config.log.Error("Failed to get automation: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get automation"})
+		return nil, false
+	} else if automation == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Automation not found"})
+		return nil, false
+	}
+
+	return automation, true
+}
@@ -0,0 +1,129 @@
+package handlers
+
+import (
+	"hafh-server/internal/database"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetCalibrations returns the calibrations of the peripheral identified by the `serial` path
+// parameter.
+func GetCalibrations(c *gin.Context) {
+	peripheral, ok := requirePeripheral(c)
+	if !ok {
+		return
+	}
+
+	calibrations, err := config.db.GetCalibrations(peripheral.SerialNumber)
+	if err != nil {
+		config.log.Error("Failed to get calibrations: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get calibrations"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"calibrations": calibrations})
+}
+
+// PutCalibrations replaces the calibrations of the peripheral identified by the `serial` path
+// parameter. Calibrations are applied to incoming readings before they are stored.
+//
+// A request body is expected with the following schema:
+//
+//	{
+//	   "calibrations": [{
+//	      "field": string,
+//	      "offset": float64 (optional),
+//	      "scale": float64 (optional, defaults to 1),
+//	      "polynomial": []float64 (optional, overrides offset and scale)
+//	   }]
+//	}
+func PutCalibrations(c *gin.Context) {
+	var request struct {
+		Calibrations []database.Calibration `json:"calibrations"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		config.log.Error("Failed to bind JSON: ", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	if err := database.ValidateCalibrations(request.Calibrations); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	peripheral, ok := requirePeripheral(c)
+	if !ok {
+		return
+	}
+
+	if err := config.db.SetCalibrations(peripheral.SerialNumber, request.Calibrations); err != nil {
+		config.log.Error("Failed to set calibrations: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set calibrations"})
+		return
+	}
+
+	GetCalibrations(c)
+}
+
+// GetDerivedFields returns the derived fields of the peripheral identified by the `serial` path
+// parameter.
+func GetDerivedFields(c *gin.Context) {
+	peripheral, ok := requirePeripheral(c)
+	if !ok {
+		return
+	}
+
+	fields, err := config.db.GetDerivedFields(peripheral.SerialNumber)
+	if err != nil {
+		config.log.Error("Failed to get derived fields: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get derived fields"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"derivedFields": fields})
+}
+
+// PutDerivedFields replaces the derived fields of the peripheral identified by the `serial` path
+// parameter. Derived fields are computed from incoming readings (after calibration) and evaluated in
+// order, so later fields may reference earlier ones.
+//
+// A request body is expected with the following schema:
+//
+//	{
+//	   "derivedFields": [{
+//	      "name": string,
+//	      "expression": string (e.g. "dewpoint(t, h)")
+//	   }]
+//	}
+func PutDerivedFields(c *gin.Context) {
+	var request struct {
+		DerivedFields []database.DerivedField `json:"derivedFields"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		config.log.Error("Failed to bind JSON: ", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	if err := database.ValidateDerivedFields(request.DerivedFields); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	peripheral, ok := requirePeripheral(c)
+	if !ok {
+		return
+	}
+
+	if err := config.db.SetDerivedFields(peripheral.SerialNumber, request.DerivedFields); err != nil {
+		config.log.Error("Failed to set derived fields: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set derived fields"})
+		return
+	}
+
+	GetDerivedFields(c)
+}
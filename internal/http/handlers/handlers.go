@@ -1,22 +1,95 @@
 package handlers
 
 import (
+	"hafh-server/internal/alerts"
+	"hafh-server/internal/auth"
+	"hafh-server/internal/commands"
 	"hafh-server/internal/database"
+	"hafh-server/internal/email"
+	"hafh-server/internal/health"
+	"hafh-server/internal/mqtt"
+	"hafh-server/internal/scheduler"
+	"hafh-server/internal/stream"
+	"hafh-server/internal/virtual"
+	"hafh-server/internal/webhooks"
+	"time"
 
 	"go.uber.org/zap"
 )
 
 type handlerConfig struct {
-	db  *database.Database
-	log *zap.SugaredLogger
+	db              *database.Database
+	log             *zap.SugaredLogger
+	offlineAfter    time.Duration
+	alerts          *alerts.Engine
+	webhooks        *webhooks.Dispatcher
+	email           *email.Notifier
+	commands        *commands.Sender
+	scheduler       *scheduler.Scheduler
+	virtual         *virtual.Engine
+	stream          *stream.Hub
+	sessionLifetime time.Duration
+	allowedOrigins  []string
+	oidc            *auth.Provider
+	broker          *mqtt.MqttServer
+	healthChecks    []health.Check
 }
 
 var config *handlerConfig
 
-// Init initializes the handler configuration with the provided database and logger.
-func Init(db *database.Database, log *zap.SugaredLogger) {
+// Options holds the dependencies of the handlers.
+type Options struct {
+	Db  *database.Database
+	Log *zap.SugaredLogger
+	// OfflineAfter is the duration after which a silent peripheral is considered offline.
+	OfflineAfter time.Duration
+	// Alerts is notified when alert rules change, so that their firing alerts are resolved.
+	Alerts *alerts.Engine
+	// Webhooks is used to send test deliveries. Test deliveries are unavailable if it is nil.
+	Webhooks *webhooks.Dispatcher
+	// Email is used to send test emails. Test emails are unavailable if it is nil, i.e. when email
+	// notifications are disabled.
+	Email *email.Notifier
+	// Commands is used to validate commands sent to actuators.
+	Commands *commands.Sender
+	// Scheduler is used to validate schedule expressions and run schedules on demand.
+	Scheduler *scheduler.Scheduler
+	// Virtual is notified when virtual peripherals change.
+	Virtual *virtual.Engine
+	// Stream delivers live readings and events to streaming clients. Streaming is unavailable if it
+	// is nil.
+	Stream *stream.Hub
+	// SessionLifetime is how long users stay logged in.
+	SessionLifetime time.Duration
+	// AllowedOrigins are the origins, other than the server's own, whose pages may open WebSockets
+	// authenticated by the session cookie.
+	AllowedOrigins []string
+	// OIDC logs users in with OpenID Connect instead of a password. Password logins are unavailable
+	// if it is set.
+	OIDC *auth.Provider
+	// Broker is the MQTT broker, whose connected clients are reported by the status endpoint.
+	Broker *mqtt.MqttServer
+	// HealthChecks are run by the health endpoints.
+	HealthChecks []health.Check
+}
+
+// Init initializes the handler configuration with the provided options.
+func Init(options *Options) {
 	config = &handlerConfig{
-		db:  db,
-		log: log,
+		db:              options.Db,
+		log:             options.Log,
+		offlineAfter:    options.OfflineAfter,
+		alerts:          options.Alerts,
+		webhooks:        options.Webhooks,
+		email:           options.Email,
+		commands:        options.Commands,
+		scheduler:       options.Scheduler,
+		virtual:         options.Virtual,
+		stream:          options.Stream,
+		sessionLifetime: options.SessionLifetime,
+		allowedOrigins:  options.AllowedOrigins,
+		oidc:            options.OIDC,
+		broker:          options.Broker,
+		healthChecks:    options.HealthChecks,
 	}
 }
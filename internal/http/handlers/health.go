@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"hafh-server/internal/health"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// startedAt is when the server started, for its uptime.
+var startedAt = time.Now()
+
+// GetHealth returns whether the server is alive, i.e. whether the liveness checks (e.g. of the
+// database and MQTT broker) pass. It responds with `503 Service Unavailable` if not, e.g. for a
+// watchdog to restart the server.
+func GetHealth(c *gin.Context) {
+	respondHealth(c, health.Run(c.Request.Context(), config.healthChecks, true))
+}
+
+// GetReadiness returns whether the server is ready to serve, i.e. whether every check (including
+// the ngrok tunnel, if enabled) passes. It responds with `503 Service Unavailable` if not.
+func GetReadiness(c *gin.Context) {
+	respondHealth(c, health.Run(c.Request.Context(), config.healthChecks, false))
+}
+
+// respondHealth responds with the status of every check. As the health endpoints are not
+// authenticated, the errors themselves are only logged.
+func respondHealth(c *gin.Context, results map[string]error) {
+	status, checks := "ok", gin.H{}
+	for name, err := range results {
+		if err != nil {
+			config.log.Warnf("Health check %s failed: %v", name, err)
+			status = "failing"
+			checks[name] = "failing"
+		} else {
+			checks[name] = "ok"
+		}
+	}
+
+	code := http.StatusOK
+	if status != "ok" {
+		code = http.StatusServiceUnavailable
+	}
+
+	c.JSON(code, gin.H{"status": status, "checks": checks})
+}
+
+// GetStatus returns diagnostics of the server: its uptime and versions, the health of its
+// components, the size and row counts of the database, the number of connected clients, and the
+// Go runtime's goroutines and memory.
+func GetStatus(c *gin.Context) {
+	checks := gin.H{}
+	for name, err := range health.Run(c.Request.Context(), config.healthChecks, false) {
+		if err != nil {
+			checks[name] = err.Error()
+		} else {
+			checks[name] = "ok"
+		}
+	}
+
+	size, err := config.db.Size()
+	if err != nil {
+		config.log.Error("Failed to get database size: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get status"})
+		return
+	}
+
+	rowCounts, err := config.db.RowCounts()
+	if err != nil {
+		config.log.Error("Failed to count database rows: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get status"})
+		return
+	}
+
+	clients := gin.H{}
+	if config.broker != nil {
+		clients["mqtt"] = config.broker.ClientsConnected()
+	}
+
+	if config.stream != nil {
+		clients["streams"] = config.stream.Subscribers()
+	}
+
+	var memory runtime.MemStats
+	runtime.ReadMemStats(&memory)
+
+	c.JSON(http.StatusOK, gin.H{
+		"started_at":     startedAt.UTC().Truncate(time.Second),
+		"uptime_seconds": int64(time.Since(startedAt).Seconds()),
+		"versions":       versions(),
+		"checks":         checks,
+		"database":       gin.H{"size_bytes": size, "row_counts": rowCounts},
+		"clients":        clients,
+		"runtime": gin.H{
+			"goroutines":       runtime.NumGoroutine(),
+			"heap_alloc_bytes": memory.HeapAlloc,
+			"sys_bytes":        memory.Sys,
+			"gc_cycles":        memory.NumGC,
+		},
+	})
+}
+
+// versions returns the versions of the API, the server build and Go.
+func versions() gin.H {
+	versions := gin.H{"api": ApiVersion, "go": runtime.Version()}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		versions["server"] = info.Main.Version
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				versions["revision"] = setting.Value
+			}
+		}
+	}
+
+	return versions
+}
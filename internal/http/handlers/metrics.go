@@ -0,0 +1,17 @@
+package handlers
+
+import (
+	"hafh-server/internal/metrics"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetMetrics returns the metrics of the server in the Prometheus text exposition format.
+func GetMetrics(c *gin.Context) {
+	c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	c.Status(http.StatusOK)
+	if _, err := metrics.Default.WriteTo(c.Writer); err != nil {
+		config.log.Error("Failed to write metrics: ", err)
+	}
+}
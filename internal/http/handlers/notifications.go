@@ -0,0 +1,41 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// PostEmailTest synchronously sends a test email, bypassing the digest interval.
+//
+// An optional request body can be provided with the following schema:
+//
+//	{
+//	   "to": []string (optional, defaults to the configured recipients)
+//	}
+func PostEmailTest(c *gin.Context) {
+	if config.email == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Email notifications are not enabled"})
+		return
+	}
+
+	var request struct {
+		To []string `json:"to"`
+	}
+
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&request); err != nil {
+			config.log.Error("Failed to bind JSON: ", err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+	}
+
+	if err := config.email.SendTest(request.To...); err != nil {
+		config.log.Error("Failed to send test email: ", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to send test email: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Test email sent successfully"})
+}
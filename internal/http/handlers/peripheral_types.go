@@ -0,0 +1,231 @@
+package handlers
+
+import (
+	"errors"
+	"hafh-server/internal/database"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetPeripheralTypes returns all peripheral types in the registry.
+func GetPeripheralTypes(c *gin.Context) {
+	types, err := config.db.GetAllPeripheralTypes()
+	if err != nil {
+		config.log.Error("Failed to get peripheral types: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get peripheral types"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"types": types})
+}
+
+// GetPeripheralType returns a single peripheral type, identified by the `id` path parameter.
+func GetPeripheralType(c *gin.Context) {
+	id, ok := peripheralTypeIDParam(c)
+	if !ok {
+		return
+	}
+
+	t, err := config.db.GetPeripheralType(id)
+	if err != nil {
+		config.log.Error("Failed to get peripheral type: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get peripheral type"})
+		return
+	} else if t == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Peripheral type not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"type": t})
+}
+
+// PostPeripheralType adds a new peripheral type to the registry.
+//
+// A request body is expected with the following schema:
+//
+//	{
+//	   "name": string,
+//	   "description": string (optional),
+//	   "fields": []FieldDefinition (optional),
+//	   "commands": []string (optional)
+//	}
+func PostPeripheralType(c *gin.Context) {
+	var request struct {
+		Name        string                     `json:"name" binding:"required"`
+		Description string                     `json:"description"`
+		Fields      []database.FieldDefinition `json:"fields"`
+		Commands    []string                   `json:"commands"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		config.log.Error("Failed to bind JSON: ", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	if err := database.ValidateFieldDefinitions(request.Fields); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	t := &database.PeripheralTypeDefinition{
+		Name:        request.Name,
+		Description: request.Description,
+		Fields:      request.Fields,
+		Commands:    request.Commands,
+	}
+
+	err := config.db.AddPeripheralType(t)
+	if errors.Is(err, database.ErrPeripheralTypeNameTaken) {
+		c.JSON(http.StatusConflict, gin.H{"error": "A peripheral type with this name already exists"})
+		return
+	} else if err != nil {
+		config.log.Error("Failed to add peripheral type: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add peripheral type"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"type": t})
+}
+
+// PatchPeripheralType partially updates the peripheral type identified by the `id` path parameter.
+// Any omitted field is left unchanged. Built-in types cannot be renamed.
+//
+// A request body is expected with the following schema:
+//
+//	{
+//	   "name": string (optional),
+//	   "description": string (optional),
+//	   "fields": []FieldDefinition (optional),
+//	   "commands": []string (optional)
+//	}
+func PatchPeripheralType(c *gin.Context) {
+	id, ok := peripheralTypeIDParam(c)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		Name        *string                     `json:"name"`
+		Description *string                     `json:"description"`
+		Fields      *[]database.FieldDefinition `json:"fields"`
+		Commands    *[]string                   `json:"commands"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		config.log.Error("Failed to bind JSON: ", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	t, err := config.db.GetPeripheralType(id)
+	if err != nil {
+		config.log.Error("Failed to get peripheral type: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get peripheral type"})
+		return
+	} else if t == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Peripheral type not found"})
+		return
+	}
+
+	if request.Name != nil {
+		t.Name = *request.Name
+	}
+
+	if request.Description != nil {
+		t.Description = *request.Description
+	}
+
+	if request.Fields != nil {
+		t.Fields = *request.Fields
+	}
+
+	if request.Commands != nil {
+		t.Commands = *request.Commands
+	}
+
+	if t.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Name is required"})
+		return
+	} else if err := database.ValidateFieldDefinitions(t.Fields); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = config.db.UpdatePeripheralType(t)
+	if errors.Is(err, database.ErrPeripheralTypeBuiltIn) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Built-in peripheral types cannot be renamed"})
+		return
+	} else if errors.Is(err, database.ErrPeripheralTypeNameTaken) {
+		c.JSON(http.StatusConflict, gin.H{"error": "A peripheral type with this name already exists"})
+		return
+	} else if err != nil {
+		config.log.Error("Failed to update peripheral type: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update peripheral type"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"type": t})
+}
+
+// DeletePeripheralType deletes the peripheral type identified by the `id` path parameter. Built-in
+// types and types assigned to a peripheral cannot be deleted.
+func DeletePeripheralType(c *gin.Context) {
+	id, ok := peripheralTypeIDParam(c)
+	if !ok {
+		return
+	}
+
+	err := config.db.DeletePeripheralType(id)
+	if errors.Is(err, database.ErrPeripheralTypeNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Peripheral type not found"})
+		return
+	} else if errors.Is(err, database.ErrPeripheralTypeBuiltIn) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Built-in peripheral types cannot be deleted"})
+		return
+	} else if errors.Is(err, database.ErrPeripheralTypeInUse) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Peripheral type is assigned to a peripheral"})
+		return
+	} else if err != nil {
+		config.log.Error("Failed to delete peripheral type: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete peripheral type"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Peripheral type deleted successfully"})
+}
+
+// peripheralTypeIDParam parses the `id` path parameter, responding with an error if it is invalid.
+func peripheralTypeIDParam(c *gin.Context) (database.PeripheralType, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid peripheral type ID"})
+		return 0, false
+	}
+
+	return database.PeripheralType(id), true
+}
+
+// validatePeripheralType checks that the given type exists in the registry and is not
+// PeripheralTypeUnknown, which is reserved for peripherals that have not been configured yet,
+// responding with an error if it is not.
+func validatePeripheralType(c *gin.Context, id database.PeripheralType) bool {
+	if id == database.PeripheralTypeUnknown {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid peripheral type"})
+		return false
+	}
+
+	t, err := config.db.GetPeripheralType(id)
+	if err != nil {
+		config.log.Error("Failed to get peripheral type: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get peripheral type"})
+		return false
+	} else if t == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid peripheral type"})
+		return false
+	}
+
+	return true
+}
@@ -1,22 +1,69 @@
 package handlers
 
 import (
+	"errors"
 	"hafh-server/internal/database"
+	"hafh-server/internal/ingest"
 	"net/http"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
 )
 
 // GetPeripherals returns the list of peripherals from the database.
+//
+// The list can be narrowed down with the following optional query parameters:
+//
+//   - `room`: the ID of the room the peripherals are in.
+//   - `tag`: a tag the peripherals must have.
+//   - `type`: the integer PeripheralType of the peripherals.
+//   - `online`: `true` or `false`, based on whether the peripherals have reported recently.
 func GetPeripherals(c *gin.Context) {
+	filter := database.PeripheralFilter{
+		Tag:          c.Query("tag"),
+		OfflineAfter: config.offlineAfter,
+	}
+
+	if room := c.Query("room"); room != "" {
+		roomID, err := strconv.ParseInt(room, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid room"})
+			return
+		}
+		filter.RoomID = &roomID
+	}
+
+	if peripheralType := c.Query("type"); peripheralType != "" {
+		value, err := strconv.ParseInt(peripheralType, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid type"})
+			return
+		}
+		t := database.PeripheralType(value)
+		filter.Type = &t
+	}
+
+	if online := c.Query("online"); online != "" {
+		value, err := strconv.ParseBool(online)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid online"})
+			return
+		}
+		filter.Online = &value
+	}
+
 	// Get the peripherals from the database.
-	peripherals, err := config.db.GetAllPeripherals()
+	peripherals, err := config.db.FindPeripherals(filter)
 	if err != nil {
 		config.log.Error("Failed to get peripherals: ", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get peripherals"})
 		return
 	}
 
+	for i := range peripherals {
+		peripherals[i].Online = peripherals[i].IsOnline(config.offlineAfter)
+	}
+
 	// Return the peripherals as JSON.
 	c.JSON(http.StatusOK, gin.H{"peripherals": peripherals})
 }
@@ -34,7 +81,7 @@ func PostConfigurePeripheral(c *gin.Context) {
 	var request struct {
 		SerialNumber string `json:"serialNumber" binding:"required"`
 		Name         string `json:"name" binding:"required"`
-		Type         uint8  `json:"type" binding:"required"`
+		Type         int64  `json:"type" binding:"required"`
 	}
 
 	if err := c.ShouldBindJSON(&request); err != nil {
@@ -69,6 +116,11 @@ func PostConfigurePeripheral(c *gin.Context) {
 		return
 	}
 
+	// The type must be registered in the peripheral type registry.
+	if !validatePeripheralType(c, database.PeripheralType(request.Type)) {
+		return
+	}
+
 	// Set the name of the peripheral in the database.
 	peripheral.Name = request.Name
 	peripheral.Type = database.PeripheralType(request.Type)
@@ -81,3 +133,215 @@ func PostConfigurePeripheral(c *gin.Context) {
 
 	c.JSON(http.StatusOK, gin.H{"message": "Peripheral name set successfully"})
 }
+
+// GetPeripheral returns a single peripheral, identified by the `serial` path parameter.
+func GetPeripheral(c *gin.Context) {
+	serial := c.Param("serial")
+
+	peripheral, err := config.db.GetPeripheralBySerial(serial)
+	if err != nil {
+		config.log.Error("Failed to get peripheral: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get peripheral"})
+		return
+	} else if peripheral == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Peripheral not found"})
+		return
+	}
+
+	peripheral.Online = peripheral.IsOnline(config.offlineAfter)
+	c.JSON(http.StatusOK, gin.H{"peripheral": peripheral})
+}
+
+// PatchPeripheral partially updates the peripheral identified by the `serial` path parameter. Any
+// omitted field is left unchanged.
+//
+// A request body is expected with the following schema:
+//
+//	{
+//	   "name": string (optional),
+//	   "type": PeripheralType (optional),
+//	   "roomId": int (optional, 0 removes the peripheral from its room),
+//	   "tags": []string (optional, replaces all tags),
+//	   "attributes": map[string]string (optional, replaces all attributes),
+//	   "fields": []FieldDefinition (optional, replaces all per-peripheral field definitions)
+//	}
+func PatchPeripheral(c *gin.Context) {
+	var request struct {
+		Name       *string                     `json:"name"`
+		Type       *int64                      `json:"type"`
+		RoomID     *int64                      `json:"roomId"`
+		Tags       *[]string                   `json:"tags"`
+		Attributes *map[string]string          `json:"attributes"`
+		Fields     *[]database.FieldDefinition `json:"fields"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		config.log.Error("Failed to bind JSON: ", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	if request.Attributes != nil {
+		if err := database.ValidatePeripheralAttributes(*request.Attributes); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	if request.Fields != nil {
+		if err := database.ValidateFieldDefinitions(*request.Fields); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	serial := c.Param("serial")
+	peripheral, err := config.db.GetPeripheralBySerial(serial)
+	if err != nil {
+		config.log.Error("Failed to get peripheral: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get peripheral"})
+		return
+	} else if peripheral == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Peripheral not found"})
+		return
+	}
+
+	if request.Name != nil {
+		peripheral.Name = *request.Name
+	}
+
+	if request.Type != nil {
+		if !validatePeripheralType(c, database.PeripheralType(*request.Type)) {
+			return
+		}
+		peripheral.Type = database.PeripheralType(*request.Type)
+	}
+
+	if request.RoomID != nil && *request.RoomID == 0 {
+		peripheral.RoomID = nil
+	} else if request.RoomID != nil {
+		room, err := config.db.GetRoom(*request.RoomID)
+		if err != nil {
+			config.log.Error("Failed to get room: ", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get room"})
+			return
+		} else if room == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Room not found"})
+			return
+		}
+		peripheral.RoomID = request.RoomID
+	}
+
+	update := database.PeripheralMetadataUpdate{
+		Tags:       request.Tags,
+		Attributes: request.Attributes,
+		Fields:     request.Fields,
+	}
+	if err := config.db.PatchPeripheral(peripheral, update); err != nil {
+		config.log.Error("Failed to update peripheral: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update peripheral"})
+		return
+	}
+
+	// Reload the peripheral so the response reflects the stored tags, attributes and fields.
+	peripheral, err = config.db.GetPeripheralBySerial(serial)
+	if err != nil {
+		config.log.Error("Failed to get peripheral: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get peripheral"})
+		return
+	}
+
+	peripheral.Online = peripheral.IsOnline(config.offlineAfter)
+	c.JSON(http.StatusOK, gin.H{"peripheral": peripheral})
+}
+
+// DeletePeripheral deletes the peripheral identified by the `serial` path parameter.
+//
+// The optional `readings` query parameter determines what happens to the peripheral's readings:
+//
+//   - `restrict` (default): the request fails if the peripheral has any readings.
+//   - `cascade`: the readings are deleted along with the peripheral.
+//   - `archive`: the readings are moved to the archive and the peripheral is deleted.
+func DeletePeripheral(c *gin.Context) {
+	mode, err := database.ReadingsDeleteModeFromString(c.Query("readings"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = config.db.DeletePeripheral(c.Param("serial"), mode)
+	if errors.Is(err, database.ErrPeripheralNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Peripheral not found"})
+		return
+	} else if errors.Is(err, database.ErrPeripheralHasReadings) {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "Peripheral has readings; use readings=cascade or readings=archive",
+		})
+		return
+	} else if err != nil {
+		config.log.Error("Failed to delete peripheral: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete peripheral"})
+		return
+	}
+
+	ingest.ForgetReadingGauges(c.Param("serial"))
+	reloadVirtualPeripherals()
+	c.JSON(http.StatusOK, gin.H{"message": "Peripheral deleted successfully"})
+}
+
+// PostMergePeripheral reassigns all readings of the peripheral identified by the `serial` path
+// parameter to a replacement peripheral, then deletes the original.
+//
+// A request body is expected with the following schema:
+//
+//	{
+//	   "targetSerialNumber": string
+//	}
+func PostMergePeripheral(c *gin.Context) {
+	var request struct {
+		TargetSerialNumber string `json:"targetSerialNumber" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		config.log.Error("Failed to bind JSON: ", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	serial := c.Param("serial")
+	if serial == request.TargetSerialNumber {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Cannot merge a peripheral into itself"})
+		return
+	}
+
+	moved, err := config.db.MergePeripherals(serial, request.TargetSerialNumber)
+	if errors.Is(err, database.ErrPeripheralNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Peripheral not found"})
+		return
+	} else if err != nil {
+		config.log.Error("Failed to merge peripherals: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to merge peripherals"})
+		return
+	}
+
+	ingest.ForgetReadingGauges(serial)
+	reloadVirtualPeripherals()
+	config.log.Infof("Merged peripheral %s into %s (%d readings moved)", serial, request.TargetSerialNumber, moved)
+	c.JSON(http.StatusOK, gin.H{"message": "Peripherals merged successfully", "readingsMoved": moved})
+}
+
+// requirePeripheral looks up the peripheral identified by the `serial` path parameter, responding
+// with an error if it cannot be found.
+func requirePeripheral(c *gin.Context) (*database.Peripheral, bool) {
+	peripheral, err := config.db.GetPeripheralBySerial(c.Param("serial"))
+	if err != nil {
+		config.log.Error("Failed to get peripheral: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get peripheral"})
+		return nil, false
+	} else if peripheral == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Peripheral not found"})
+		return nil, false
+	}
+
+	return peripheral, true
+}
@@ -1,12 +1,15 @@
 package handlers
 
 import (
+	"hafh-server/internal/database"
+	"hafh-server/internal/units"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
 )
 
-// PostReadings queries and returns the list of readings from the database.
+// PostReadings queries and returns the list of readings from the database, along with the field
+// definitions describing the reading data.
 //
 // A request body is expected with the following schema:
 //
@@ -14,6 +17,9 @@ import (
 //	   "serialNumber": string,
 //	   "numReadings": uint32
 //	}
+//
+// The optional `units` query parameter (`metric` or `imperial`) converts numeric fields with a known
+// unit to the requested system of measurement.
 func PostReadings(c *gin.Context) {
 	var request struct {
 		SerialNumber string `json:"serialNumber" binding:"required"`
@@ -26,6 +32,12 @@ func PostReadings(c *gin.Context) {
 		return
 	}
 
+	system, err := units.SystemFromString(c.Query("units"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	// Validate the serial number and number of readings.
 	if request.SerialNumber == "" {
 		config.log.Error("Serial number is required")
@@ -45,5 +57,65 @@ func PostReadings(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"readings": readings})
+	fields, err := config.db.GetFieldDefinitions(request.SerialNumber)
+	if err != nil {
+		config.log.Error("Failed to get field definitions: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get field definitions"})
+		return
+	}
+
+	if fields == nil {
+		fields = []database.FieldDefinition{}
+	} else if system != units.SystemNone {
+		fields = convertReadings(readings, fields, system)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"readings": readings, "fields": fields})
+}
+
+// convertReadings converts the numeric fields of the given readings (and their raw, uncalibrated
+// values, which are in the same unit) in place, returning the field definitions with their units
+// (and ranges) converted to match.
+func convertReadings(
+	readings []database.Reading,
+	fields []database.FieldDefinition,
+	system units.System,
+) []database.FieldDefinition {
+	converted := make([]database.FieldDefinition, 0, len(fields))
+	for _, field := range fields {
+		for i := range readings {
+			convertField(readings[i].Data, field, system)
+			convertField(readings[i].Raw, field, system)
+		}
+
+		if field.Min != nil {
+			lower, _, _ := units.Convert(*field.Min, field.Unit, system)
+			field.Min = &lower
+		}
+
+		if field.Max != nil {
+			upper, _, _ := units.Convert(*field.Max, field.Unit, system)
+			field.Max = &upper
+		}
+
+		field.Unit = units.ConvertUnit(field.Unit, system)
+		converted = append(converted, field)
+	}
+
+	return converted
+}
+
+// convertField converts the value of a numeric field of the given data in place, if it has one.
+func convertField(data map[string]any, field database.FieldDefinition, system units.System) {
+	value, ok := data[field.Name].(float64)
+	if !ok {
+		return
+	}
+
+	if value, _, ok = units.Convert(value, field.Unit, system); ok {
+		if field.Precision != nil {
+			value = units.Round(value, *field.Precision)
+		}
+		data[field.Name] = value
+	}
 }
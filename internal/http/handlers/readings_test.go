@@ -0,0 +1,31 @@
+package handlers
+
+import (
+	"hafh-server/internal/database"
+	"hafh-server/internal/units"
+	"testing"
+)
+
+func TestConvertReadings(t *testing.T) {
+	readings := []database.Reading{
+		{Data: map[string]any{"t": 100.0, "h": 40.0}, Raw: map[string]any{"t": 0.0}},
+		{Data: map[string]any{"t": "n/a"}},
+	}
+	fields := []database.FieldDefinition{{Name: "t", Unit: "°C"}, {Name: "h", Unit: "%"}}
+
+	converted := convertReadings(readings, fields, units.SystemImperial)
+	if converted[0].Unit != "°F" || converted[1].Unit != "%" {
+		t.Errorf("units = %s, %s, want °F, %%", converted[0].Unit, converted[1].Unit)
+	}
+
+	// Raw values are in the same unit as the calibrated ones, so they are converted alike.
+	if got := readings[0].Data["t"]; got != 212.0 {
+		t.Errorf("t = %v, want 212", got)
+	} else if got := readings[0].Raw["t"]; got != 32.0 {
+		t.Errorf("raw t = %v, want 32", got)
+	} else if got := readings[0].Data["h"]; got != 40.0 {
+		t.Errorf("h = %v, want 40", got)
+	} else if got := readings[1].Data["t"]; got != "n/a" {
+		t.Errorf("non-numeric t = %v, want n/a", got)
+	}
+}
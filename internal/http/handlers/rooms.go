@@ -0,0 +1,175 @@
+package handlers
+
+import (
+	"errors"
+	"hafh-server/internal/database"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetRooms returns the list of rooms from the database.
+func GetRooms(c *gin.Context) {
+	rooms, err := config.db.GetAllRooms()
+	if err != nil {
+		config.log.Error("Failed to get rooms: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get rooms"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"rooms": rooms})
+}
+
+// GetRoom returns a single room, identified by the `id` path parameter.
+func GetRoom(c *gin.Context) {
+	id, ok := roomIDParam(c)
+	if !ok {
+		return
+	}
+
+	room, err := config.db.GetRoom(id)
+	if err != nil {
+		config.log.Error("Failed to get room: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get room"})
+		return
+	} else if room == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Room not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"room": room})
+}
+
+// PostRoom creates a new room.
+//
+// A request body is expected with the following schema:
+//
+//	{
+//	   "name": string,
+//	   "floor": string (optional),
+//	   "description": string (optional)
+//	}
+func PostRoom(c *gin.Context) {
+	var request struct {
+		Name        string `json:"name" binding:"required"`
+		Floor       string `json:"floor"`
+		Description string `json:"description"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		config.log.Error("Failed to bind JSON: ", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	room := &database.Room{
+		Name:        request.Name,
+		Floor:       request.Floor,
+		Description: request.Description,
+	}
+
+	if err := config.db.AddRoom(room); err != nil {
+		config.log.Error("Failed to add room: ", err)
+		c.JSON(http.StatusConflict, gin.H{"error": "Failed to add room"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"room": room})
+}
+
+// PatchRoom partially updates the room identified by the `id` path parameter. Any omitted field is
+// left unchanged.
+//
+// A request body is expected with the following schema:
+//
+//	{
+//	   "name": string (optional),
+//	   "floor": string (optional),
+//	   "description": string (optional)
+//	}
+func PatchRoom(c *gin.Context) {
+	id, ok := roomIDParam(c)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		Name        *string `json:"name"`
+		Floor       *string `json:"floor"`
+		Description *string `json:"description"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		config.log.Error("Failed to bind JSON: ", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	room, err := config.db.GetRoom(id)
+	if err != nil {
+		config.log.Error("Failed to get room: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get room"})
+		return
+	} else if room == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Room not found"})
+		return
+	}
+
+	if request.Name != nil {
+		room.Name = *request.Name
+	}
+
+	if request.Floor != nil {
+		room.Floor = *request.Floor
+	}
+
+	if request.Description != nil {
+		room.Description = *request.Description
+	}
+
+	if room.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Name is required"})
+		return
+	}
+
+	if err := config.db.UpdateRoom(room); err != nil {
+		config.log.Error("Failed to update room: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update room"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"room": room})
+}
+
+// DeleteRoom deletes the room identified by the `id` path parameter. Peripherals in the room are
+// kept, but no longer belong to any room.
+func DeleteRoom(c *gin.Context) {
+	id, ok := roomIDParam(c)
+	if !ok {
+		return
+	}
+
+	err := config.db.DeleteRoom(id)
+	if errors.Is(err, database.ErrRoomNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Room not found"})
+		return
+	} else if err != nil {
+		config.log.Error("Failed to delete room: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete room"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Room deleted successfully"})
+}
+
+// roomIDParam parses the `id` path parameter, responding with an error if it is invalid.
+func roomIDParam(c *gin.Context) (int64, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid room ID"})
+		return 0, false
+	}
+
+	return id, true
+}
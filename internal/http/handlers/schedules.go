@@ -0,0 +1,294 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"hafh-server/internal/commands"
+	"hafh-server/internal/database"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// scheduleRequest is the request body for creating or updating a schedule. All fields are optional
+// when updating.
+type scheduleRequest struct {
+	Name            *string                      `json:"name"`
+	Expression      *string                      `json:"expression"`
+	Kind            *database.ScheduleKind       `json:"kind"`
+	Actions         *[]database.AutomationAction `json:"actions"`
+	Report          *database.ReportOptions      `json:"report"`
+	MissedRunPolicy *database.MissedRunPolicy    `json:"missedRunPolicy"`
+	Enabled         *bool                        `json:"enabled"`
+}
+
+// apply copies the fields that are set in the request onto the schedule.
+func (r *scheduleRequest) apply(schedule *database.Schedule) {
+	if r.Name != nil {
+		schedule.Name = *r.Name
+	}
+
+	if r.Expression != nil {
+		schedule.Expression = *r.Expression
+	}
+
+	if r.Kind != nil {
+		schedule.Kind = *r.Kind
+	}
+
+	if r.Actions != nil {
+		schedule.Actions = *r.Actions
+	}
+
+	if r.Report != nil {
+		schedule.Report = r.Report
+	}
+
+	if r.MissedRunPolicy != nil {
+		schedule.MissedRunPolicy = *r.MissedRunPolicy
+	}
+
+	if r.Enabled != nil {
+		schedule.Enabled = *r.Enabled
+	}
+}
+
+// prepareSchedule validates the schedule, including its expression and that every action targets a
+// peripheral that accepts its command, and computes its next run. It responds with an error and
+// returns false if it is invalid.
+func prepareSchedule(c *gin.Context, schedule *database.Schedule) bool {
+	if err := schedule.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+
+	next, err := config.scheduler.Next(schedule.Expression, time.Now())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid expression: " + err.Error()})
+		return false
+	}
+
+	schedule.NextRunAt = nil
+	if schedule.Enabled {
+		schedule.NextRunAt = &next
+	}
+
+	if schedule.Kind != database.ScheduleKindCommand {
+		schedule.Actions = nil
+		return true
+	}
+
+	schedule.Report = nil
+	if config.commands == nil {
+		return true
+	}
+
+	for i, action := range schedule.Actions {
+		err := config.commands.Validate(action.SerialNumber, action.Command)
+		if errors.Is(err, commands.ErrUnknownPeripheral) || errors.Is(err, commands.ErrNotActuator) ||
+			errors.Is(err, commands.ErrUnsupportedCommand) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("action %d: %v", i, err)})
+			return false
+		} else if err != nil {
+			config.log.Error("Failed to validate schedule action: ", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to validate schedule"})
+			return false
+		}
+	}
+
+	return true
+}
+
+// GetSchedules returns all schedules.
+func GetSchedules(c *gin.Context) {
+	schedules, err := config.db.GetSchedules(false)
+	if err != nil {
+		config.log.Error("Failed to get schedules: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get schedules"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"schedules": schedules})
+}
+
+// GetSchedule returns a single schedule, identified by the `id` path parameter.
+func GetSchedule(c *gin.Context) {
+	schedule, ok := requireSchedule(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"schedule": schedule})
+}
+
+// PostSchedule creates a new schedule.
+//
+// A request body is expected with the following schema:
+//
+//	{
+//	   "name": string,
+//	   "expression": string (a cron expression, e.g. "0 6 * * *", or "@sunset-30m"),
+//	   "kind": "command" | "report",
+//	   "actions": [
+//	      {
+//	         "serial_number": string (an actuator),
+//	         "command": string,
+//	         "args": object (optional)
+//	      }
+//	   ] (command schedules only),
+//	   "report": {
+//	      "serial_numbers": [string] (optional),
+//	      "tag": string (optional),
+//	      "period_seconds": int (optional, defaults to the time since the previous run)
+//	   } (report schedules only, optional),
+//	   "missedRunPolicy": "skip" | "catch_up" (optional, defaults to "skip"),
+//	   "enabled": bool (optional, defaults to true)
+//	}
+func PostSchedule(c *gin.Context) {
+	var request scheduleRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		config.log.Error("Failed to bind JSON: ", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	schedule := &database.Schedule{MissedRunPolicy: database.MissedRunSkip, Enabled: true}
+	request.apply(schedule)
+
+	if !prepareSchedule(c, schedule) {
+		return
+	}
+
+	if err := config.db.AddSchedule(schedule); err != nil {
+		config.log.Error("Failed to add schedule: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add schedule"})
+		return
+	}
+
+	config.scheduler.Reschedule()
+	c.JSON(http.StatusCreated, gin.H{"schedule": schedule})
+}
+
+// PatchSchedule partially updates the schedule identified by the `id` path parameter, accepting
+// any of the fields of [PostSchedule]. Any omitted field is left unchanged. The next run is
+// recomputed from now, so runs missed while a schedule was disabled are not caught up.
+func PatchSchedule(c *gin.Context) {
+	var request scheduleRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		config.log.Error("Failed to bind JSON: ", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	schedule, ok := requireSchedule(c)
+	if !ok {
+		return
+	}
+
+	request.apply(schedule)
+	if !prepareSchedule(c, schedule) {
+		return
+	}
+
+	if err := config.db.UpdateSchedule(schedule); err != nil {
+		config.log.Error("Failed to update schedule: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update schedule"})
+		return
+	}
+
+	config.scheduler.Reschedule()
+	c.JSON(http.StatusOK, gin.H{"schedule": schedule})
+}
+
+// DeleteSchedule deletes the schedule identified by the `id` path parameter, along with its run
+// history.
+func DeleteSchedule(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid schedule ID"})
+		return
+	}
+
+	err = config.db.DeleteSchedule(id)
+	if errors.Is(err, database.ErrScheduleNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Schedule not found"})
+		return
+	} else if err != nil {
+		config.log.Error("Failed to delete schedule: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete schedule"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Schedule deleted successfully"})
+}
+
+// GetScheduleRuns returns the run history of the schedule identified by the `id` path parameter,
+// most recent first. The optional `limit` query parameter sets the maximum number of runs to
+// return (defaults to 100).
+func GetScheduleRuns(c *gin.Context) {
+	schedule, ok := requireSchedule(c)
+	if !ok {
+		return
+	}
+
+	limit := uint32(100)
+	if value := c.Query("limit"); value != "" {
+		parsed, err := strconv.ParseUint(value, 10, 32)
+		if err != nil || parsed == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+			return
+		}
+		limit = uint32(parsed)
+	}
+
+	runs, err := config.db.GetScheduleRuns(schedule.ID, limit)
+	if err != nil {
+		config.log.Error("Failed to get schedule runs: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get schedule runs"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"runs": runs})
+}
+
+// PostScheduleRun runs the schedule identified by the `id` path parameter immediately, even if it
+// is disabled, and returns the run. This does not change when the schedule runs next.
+func PostScheduleRun(c *gin.Context) {
+	schedule, ok := requireSchedule(c)
+	if !ok {
+		return
+	}
+
+	run, err := config.scheduler.RunNow(schedule)
+	if err != nil {
+		config.log.Error("Failed to run schedule: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to run schedule"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"run": run})
+}
+
+// requireSchedule looks up the schedule identified by the `id` path parameter, responding with an
+// error if it is invalid or cannot be found.
+func requireSchedule(c *gin.Context) (*database.Schedule, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid schedule ID"})
+		return nil, false
+	}
+
+	schedule, err := config.db.GetSchedule(id)
+	if err != nil {
+		config.log.Error("Failed to get schedule: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get schedule"})
+		return nil, false
+	} else if schedule == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Schedule not found"})
+		return nil, false
+	}
+
+	return schedule, true
+}
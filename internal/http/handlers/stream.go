@@ -0,0 +1,193 @@
+package handlers
+
+import (
+	"fmt"
+	"hafh-server/internal/database"
+	"hafh-server/internal/events"
+	"hafh-server/internal/stream"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// streamHeartbeatInterval is how often a comment is sent to keep idle streams (and any proxies
+	// in between) from timing out.
+	streamHeartbeatInterval = 15 * time.Second
+	// streamReplayPage is how many missed readings are fetched at a time when a stream resumes.
+	streamReplayPage = 1000
+)
+
+// parseStreamFilter parses the `serial`, `tag` and `type` query parameters of a stream. It responds
+// with an error and returns false if they are invalid.
+func parseStreamFilter(c *gin.Context) (stream.Filter, bool) {
+	filter := stream.Filter{
+		SerialNumbers: splitQuery(c.QueryArray("serial")),
+		Tag:           c.Query("tag"),
+		Events:        splitQuery(c.QueryArray("type")),
+	}
+
+	for _, event := range filter.Events {
+		if event != stream.ReadingEvent && !events.Type(event).IsValid() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid type: " + event})
+			return filter, false
+		}
+	}
+
+	return filter, true
+}
+
+// splitQuery splits repeated and/or comma-separated query values, e.g. `?serial=a,b&serial=c`.
+func splitQuery(values []string) []string {
+	var result []string
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				result = append(result, part)
+			}
+		}
+	}
+
+	return result
+}
+
+// GetStream streams newly ingested readings and server events (e.g. presence changes and alerts)
+// using Server-Sent Events. Readings are sent as `reading` events whose ID is the reading ID; server
+// events are sent with their type as the event name.
+//
+// The stream can be narrowed down with the following optional query parameters, each of which may
+// be repeated or comma-separated:
+//
+//   - `serial`: the serial numbers of the peripherals.
+//   - `tag`: a tag the peripherals must have.
+//   - `type`: `reading` and/or server event types (e.g. `alert.fired`).
+//
+// When a client reconnects with the `Last-Event-ID` header (or `lastEventId` query parameter), the
+// readings it missed are replayed first.
+func GetStream(c *gin.Context) {
+	if config.stream == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Streaming is not available"})
+		return
+	}
+
+	filter, ok := parseStreamFilter(c)
+	if !ok {
+		return
+	}
+
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.Query("lastEventId")
+	}
+
+	lastID := 0
+	if lastEventID != "" {
+		parsed, err := strconv.Atoi(lastEventID)
+		if err != nil || parsed < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Last-Event-ID"})
+			return
+		}
+		lastID = parsed
+	}
+
+	// Subscribe before replaying, so that no reading is missed in between. Readings that are both
+	// replayed and delivered live are skipped by ID.
+	subscription := config.stream.Subscribe(filter)
+	defer subscription.Close()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	fmt.Fprintf(c.Writer, "retry: %d\n\n", (3 * time.Second).Milliseconds())
+
+	if lastID > 0 && (len(filter.Events) == 0 || slices.Contains(filter.Events, stream.ReadingEvent)) {
+		var err error
+		lastID, err = replayReadings(&filter, lastID, func(reading *database.Reading, data []byte) bool {
+			writeStreamEvent(c.Writer, strconv.Itoa(reading.ID), stream.ReadingEvent, data)
+			c.Writer.Flush()
+			return c.Request.Context().Err() == nil
+		})
+		if err != nil {
+			config.log.Error("Failed to replay missed readings: ", err)
+			return
+		}
+	}
+
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-heartbeat.C:
+			io.WriteString(c.Writer, ": ping\n\n")
+		case message, ok := <-subscription.C:
+			// The subscription is closed if the client fell behind; it will reconnect and resume.
+			if !ok {
+				return
+			}
+
+			id := ""
+			if message.ReadingID > 0 {
+				if message.ReadingID <= lastID {
+					continue
+				}
+				id = strconv.Itoa(message.ReadingID)
+				lastID = message.ReadingID
+			}
+
+			writeStreamEvent(c.Writer, id, message.Event, message.Data)
+		}
+
+		c.Writer.Flush()
+	}
+}
+
+// replayReadings passes the readings after lastID that match the filter to send, oldest first, a page
+// at a time until every missed reading has been sent. It stops early if send returns false, and
+// returns the ID of the last reading sent.
+func replayReadings(filter *stream.Filter, lastID int, send func(reading *database.Reading, data []byte) bool) (int, error) {
+	for {
+		readings, err := config.db.GetReadingsAfter(lastID, filter.SerialNumbers, filter.Tag, streamReplayPage)
+		if err != nil {
+			return lastID, err
+		}
+
+		for i := range readings {
+			data, err := readings[i].ToJson()
+			if err != nil {
+				return lastID, err
+			}
+
+			if !send(&readings[i], data) {
+				return lastID, nil
+			}
+			lastID = readings[i].ID
+		}
+
+		if len(readings) < streamReplayPage {
+			return lastID, nil
+		}
+	}
+}
+
+// writeStreamEvent writes a single Server-Sent Event. Events without an ID leave the client's last
+// event ID unchanged.
+func writeStreamEvent(w io.Writer, id, event string, data []byte) {
+	if id != "" {
+		fmt.Fprintf(w, "id: %s\n", id)
+	}
+
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+}
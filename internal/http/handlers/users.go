@@ -0,0 +1,217 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"hafh-server/internal/auth"
+	"hafh-server/internal/database"
+	"hafh-server/internal/http/middleware"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// userRequest is the request body for creating or updating a user. All fields are optional when
+// updating.
+type userRequest struct {
+	Username *string        `json:"username"`
+	Password *string        `json:"password"`
+	Role     *database.Role `json:"role"`
+}
+
+// apply validates the fields that are set in the request and copies them onto the user, hashing the
+// password.
+func (r *userRequest) apply(user *database.User) error {
+	if r.Username != nil {
+		user.Username = strings.TrimSpace(*r.Username)
+	}
+
+	if r.Role != nil {
+		user.Role = *r.Role
+	}
+
+	if user.Username == "" {
+		return errors.New("username is required")
+	} else if !user.Role.IsValid() {
+		return fmt.Errorf("role must be one of %q, %q or %q",
+			database.RoleViewer, database.RoleOperator, database.RoleAdmin)
+	}
+
+	if r.Password != nil {
+		if len(*r.Password) < auth.MinPasswordLength {
+			return fmt.Errorf("password must be at least %d characters", auth.MinPasswordLength)
+		}
+
+		hash, err := auth.HashPassword(*r.Password)
+		if err != nil {
+			return err
+		}
+
+		user.PasswordHash = hash
+	} else if user.PasswordHash == "" {
+		return errors.New("password is required")
+	}
+
+	return nil
+}
+
+// GetUsers returns all users. Password hashes are never included.
+func GetUsers(c *gin.Context) {
+	users, err := config.db.GetAllUsers()
+	if err != nil {
+		config.log.Error("Failed to get users: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get users"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"users": users})
+}
+
+// GetUser returns a single user, identified by the `id` path parameter.
+func GetUser(c *gin.Context) {
+	user, ok := requireUser(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"user": user})
+}
+
+// PostUser creates a new user.
+//
+// A request body is expected with the following schema:
+//
+//	{
+//	   "username": string (unique, case-insensitive),
+//	   "password": string (at least 8 characters),
+//	   "role": string (optional, one of "viewer", "operator" and "admin", defaults to "viewer")
+//	}
+func PostUser(c *gin.Context) {
+	middleware.MarkSensitive(c)
+
+	var request userRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		config.log.Error("Failed to bind JSON: ", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	user := &database.User{Role: database.RoleViewer}
+	if err := request.apply(user); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !requireUniqueUsername(c, user) {
+		return
+	}
+
+	if err := config.db.AddUser(user); err != nil {
+		config.log.Error("Failed to add user: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add user"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"user": user})
+}
+
+// PatchUser partially updates the user identified by the `id` path parameter, accepting any of the
+// fields of [PostUser]. Any omitted field is left unchanged. Changing the password logs the user out
+// of every session.
+func PatchUser(c *gin.Context) {
+	middleware.MarkSensitive(c)
+
+	var request userRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		config.log.Error("Failed to bind JSON: ", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	user, ok := requireUser(c)
+	if !ok {
+		return
+	}
+
+	if err := request.apply(user); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !requireUniqueUsername(c, user) {
+		return
+	}
+
+	if err := config.db.UpdateUser(user); err != nil {
+		config.log.Error("Failed to update user: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update user"})
+		return
+	}
+
+	if request.Password != nil {
+		if err := config.db.DeleteUserSessions(user.ID); err != nil {
+			config.log.Error("Failed to delete sessions: ", err)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"user": user})
+}
+
+// DeleteUser deletes the user identified by the `id` path parameter, logging them out of every
+// session.
+func DeleteUser(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	err = config.db.DeleteUser(id)
+	if errors.Is(err, database.ErrUserNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	} else if err != nil {
+		config.log.Error("Failed to delete user: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete user"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "User deleted successfully"})
+}
+
+func requireUser(c *gin.Context) (*database.User, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return nil, false
+	}
+
+	user, err := config.db.GetUser(id)
+	if err != nil {
+		config.log.Error("Failed to get user: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user"})
+		return nil, false
+	} else if user == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return nil, false
+	}
+
+	return user, true
+}
+
+// requireUniqueUsername responds with a conflict if another user already has the user's username.
+func requireUniqueUsername(c *gin.Context, user *database.User) bool {
+	existing, err := config.db.GetUserByUsername(user.Username)
+	if err != nil {
+		config.log.Error("Failed to get user: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user"})
+		return false
+	} else if existing != nil && existing.ID != user.ID {
+		c.JSON(http.StatusConflict, gin.H{"error": "Username is already taken"})
+		return false
+	}
+
+	return true
+}
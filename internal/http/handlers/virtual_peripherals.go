@@ -0,0 +1,193 @@
+package handlers
+
+import (
+	"errors"
+	"hafh-server/internal/database"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// virtualPeripheralRequest is the request body for creating or updating a virtual peripheral. All
+// fields are optional when updating.
+type virtualPeripheralRequest struct {
+	Inputs          *[]database.VirtualInput `json:"inputs"`
+	Fields          *[]database.DerivedField `json:"fields"`
+	IntervalSeconds *int64                   `json:"intervalSeconds"`
+}
+
+// apply copies the fields that are set in the request onto the definition.
+func (r *virtualPeripheralRequest) apply(definition *database.VirtualDefinition) {
+	if r.Inputs != nil {
+		definition.Inputs = *r.Inputs
+	}
+
+	if r.Fields != nil {
+		definition.Fields = *r.Fields
+	}
+
+	if r.IntervalSeconds != nil {
+		definition.IntervalSeconds = *r.IntervalSeconds
+	}
+}
+
+// reloadVirtualPeripherals makes the virtual peripheral engine pick up changed definitions.
+func reloadVirtualPeripherals() {
+	if config.virtual != nil {
+		config.virtual.Reload()
+	}
+}
+
+// GetVirtualPeripherals returns the definitions of all virtual peripherals. The peripherals
+// themselves are returned by [GetPeripherals] along with every other peripheral.
+func GetVirtualPeripherals(c *gin.Context) {
+	virtuals, err := config.db.GetVirtualPeripherals()
+	if err != nil {
+		config.log.Error("Failed to get virtual peripherals: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get virtual peripherals"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"virtualPeripherals": virtuals})
+}
+
+// PostVirtualPeripheral creates a new virtual peripheral, whose readings are computed from the
+// readings of other peripherals.
+//
+// A request body is expected with the following schema:
+//
+//	{
+//	   "serialNumber": string,
+//	   "name": string,
+//	   "type": PeripheralType (optional, defaults to Sensor),
+//	   "inputs": [
+//	      {
+//	         "name": string (the variable used in expressions),
+//	         "serial_number": string (either this or tag),
+//	         "tag": string (either this or serial_number),
+//	         "field": string,
+//	         "aggregate": "last" | "mean" | "min" | "max" | "sum" | "count" (optional, defaults to "last"),
+//	         "window_seconds": int (optional, defaults to the latest reading of each peripheral)
+//	      }
+//	   ],
+//	   "fields": [
+//	      {
+//	         "name": string,
+//	         "expression": string (e.g. "avg(living, kitchen)")
+//	      }
+//	   ],
+//	   "intervalSeconds": int (optional, also recompute on this interval)
+//	}
+func PostVirtualPeripheral(c *gin.Context) {
+	var request struct {
+		virtualPeripheralRequest
+		SerialNumber string `json:"serialNumber" binding:"required"`
+		Name         string `json:"name" binding:"required"`
+		Type         *int64 `json:"type"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		config.log.Error("Failed to bind JSON: ", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	peripheral := &database.Peripheral{
+		SerialNumber: request.SerialNumber,
+		Name:         request.Name,
+		Type:         database.PeripheralTypeSensor,
+	}
+
+	if request.Type != nil {
+		peripheral.Type = database.PeripheralType(*request.Type)
+		if !validatePeripheralType(c, peripheral.Type) {
+			return
+		}
+	}
+
+	definition := &database.VirtualDefinition{}
+	request.apply(definition)
+	if err := definition.Validate(peripheral.SerialNumber); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	existing, err := config.db.GetPeripheralBySerial(peripheral.SerialNumber)
+	if err != nil {
+		config.log.Error("Failed to get peripheral: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get peripheral"})
+		return
+	} else if existing != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Peripheral already exists"})
+		return
+	}
+
+	if err := config.db.AddVirtualPeripheral(peripheral, definition); err != nil {
+		config.log.Error("Failed to add virtual peripheral: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add virtual peripheral"})
+		return
+	}
+
+	reloadVirtualPeripherals()
+
+	peripheral, ok := requireVirtualPeripheral(c, peripheral.SerialNumber)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"peripheral": peripheral})
+}
+
+// PatchVirtualPeripheral partially updates the definition of the virtual peripheral identified by
+// the `serial` path parameter, accepting the `inputs`, `fields` and `intervalSeconds` of
+// [PostVirtualPeripheral]. The name, type, room and tags are updated like those of any other
+// peripheral (see [PatchPeripheral]).
+func PatchVirtualPeripheral(c *gin.Context) {
+	var request virtualPeripheralRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		config.log.Error("Failed to bind JSON: ", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	peripheral, ok := requireVirtualPeripheral(c, c.Param("serial"))
+	if !ok {
+		return
+	}
+
+	request.apply(peripheral.Virtual)
+	if err := peripheral.Virtual.Validate(peripheral.SerialNumber); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err := config.db.SetVirtualDefinition(peripheral.SerialNumber, peripheral.Virtual)
+	if errors.Is(err, database.ErrVirtualPeripheralNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Virtual peripheral not found"})
+		return
+	} else if err != nil {
+		config.log.Error("Failed to update virtual peripheral: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update virtual peripheral"})
+		return
+	}
+
+	reloadVirtualPeripherals()
+	c.JSON(http.StatusOK, gin.H{"peripheral": peripheral})
+}
+
+// requireVirtualPeripheral looks up a virtual peripheral, responding with an error if it cannot be
+// found or is not virtual.
+func requireVirtualPeripheral(c *gin.Context, serial string) (*database.Peripheral, bool) {
+	peripheral, err := config.db.GetPeripheralBySerial(serial)
+	if err != nil {
+		config.log.Error("Failed to get peripheral: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get peripheral"})
+		return nil, false
+	} else if peripheral == nil || peripheral.Virtual == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Virtual peripheral not found"})
+		return nil, false
+	}
+
+	peripheral.Online = peripheral.IsOnline(config.offlineAfter)
+	return peripheral, true
+}
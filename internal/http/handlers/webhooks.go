@@ -0,0 +1,280 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"hafh-server/internal/database"
+	"hafh-server/internal/events"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// webhookRequest is the request body for creating or updating a webhook. All fields are optional
+// when updating.
+type webhookRequest struct {
+	Name       *string   `json:"name"`
+	URL        *string   `json:"url"`
+	Secret     *string   `json:"secret"`
+	EventTypes *[]string `json:"eventTypes"`
+	Enabled    *bool     `json:"enabled"`
+}
+
+// apply copies the fields that are set in the request onto the webhook.
+func (r *webhookRequest) apply(webhook *database.Webhook) {
+	if r.Name != nil {
+		webhook.Name = *r.Name
+	}
+
+	if r.URL != nil {
+		webhook.URL = *r.URL
+	}
+
+	if r.Secret != nil {
+		webhook.Secret = *r.Secret
+	}
+
+	if r.EventTypes != nil {
+		webhook.EventTypes = *r.EventTypes
+	}
+
+	if r.Enabled != nil {
+		webhook.Enabled = *r.Enabled
+	}
+}
+
+// validateWebhook checks that the webhook has a name, an absolute HTTP(S) URL and only known event
+// types.
+func validateWebhook(webhook *database.Webhook) error {
+	if webhook.Name == "" {
+		return errors.New("name is required")
+	}
+
+	u, err := url.Parse(webhook.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("url must be an absolute http or https URL")
+	}
+
+	for _, t := range webhook.EventTypes {
+		if !events.Type(t).IsValid() {
+			return errors.New("unknown event type: " + t)
+		}
+	}
+
+	return nil
+}
+
+// GetWebhooks returns all webhooks. Secrets are never included.
+func GetWebhooks(c *gin.Context) {
+	webhooks, err := config.db.GetAllWebhooks()
+	if err != nil {
+		config.log.Error("Failed to get webhooks: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get webhooks"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"webhooks": webhooks})
+}
+
+// GetWebhook returns a single webhook, identified by the `id` path parameter.
+func GetWebhook(c *gin.Context) {
+	webhook, ok := requireWebhook(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"webhook": webhook})
+}
+
+// PostWebhook registers a new webhook. If no secret is provided, one is generated. The secret is
+// only ever returned in the response to this request.
+//
+// A request body is expected with the following schema:
+//
+//	{
+//	   "name": string,
+//	   "url": string (an absolute http or https URL),
+//	   "secret": string (optional, used to sign deliveries),
+//	   "eventTypes": []string (optional, the event types to deliver, defaults to all),
+//	   "enabled": bool (optional, defaults to true)
+//	}
+func PostWebhook(c *gin.Context) {
+	var request webhookRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		config.log.Error("Failed to bind JSON: ", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	webhook := &database.Webhook{Enabled: true}
+	request.apply(webhook)
+
+	if err := validateWebhook(webhook); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if webhook.Secret == "" {
+		secret, err := generateSecret()
+		if err != nil {
+			config.log.Error("Failed to generate webhook secret: ", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add webhook"})
+			return
+		}
+		webhook.Secret = secret
+	}
+
+	if err := config.db.AddWebhook(webhook); err != nil {
+		config.log.Error("Failed to add webhook: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add webhook"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"webhook": webhook, "secret": webhook.Secret})
+}
+
+// PatchWebhook partially updates the webhook identified by the `id` path parameter, accepting any of
+// the fields of [PostWebhook]. Any omitted field is left unchanged.
+func PatchWebhook(c *gin.Context) {
+	var request webhookRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		config.log.Error("Failed to bind JSON: ", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	webhook, ok := requireWebhook(c)
+	if !ok {
+		return
+	}
+
+	request.apply(webhook)
+	if err := validateWebhook(webhook); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if webhook.Secret == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "secret cannot be empty"})
+		return
+	}
+
+	if err := config.db.UpdateWebhook(webhook); err != nil {
+		config.log.Error("Failed to update webhook: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update webhook"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"webhook": webhook})
+}
+
+// DeleteWebhook deletes the webhook identified by the `id` path parameter, along with its delivery
+// log.
+func DeleteWebhook(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook ID"})
+		return
+	}
+
+	err = config.db.DeleteWebhook(id)
+	if errors.Is(err, database.ErrWebhookNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+		return
+	} else if err != nil {
+		config.log.Error("Failed to delete webhook: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete webhook"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Webhook deleted successfully"})
+}
+
+// GetWebhookDeliveries returns the delivery log of the webhook identified by the `id` path
+// parameter, most recent first. The optional `limit` query parameter sets the maximum number of
+// deliveries to return (defaults to 100).
+func GetWebhookDeliveries(c *gin.Context) {
+	webhook, ok := requireWebhook(c)
+	if !ok {
+		return
+	}
+
+	limit := uint32(100)
+	if value := c.Query("limit"); value != "" {
+		parsed, err := strconv.ParseUint(value, 10, 32)
+		if err != nil || parsed == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+			return
+		}
+		limit = uint32(parsed)
+	}
+
+	deliveries, err := config.db.GetWebhookDeliveries(webhook.ID, limit)
+	if err != nil {
+		config.log.Error("Failed to get webhook deliveries: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get webhook deliveries"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"deliveries": deliveries})
+}
+
+// PostWebhookTest queues a test delivery to the webhook identified by the `id` path parameter,
+// regardless of its event type filter. The webhook must be enabled. The outcome can be found in the
+// delivery log.
+func PostWebhookTest(c *gin.Context) {
+	if config.webhooks == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Webhooks are not available"})
+		return
+	}
+
+	webhook, ok := requireWebhook(c)
+	if !ok {
+		return
+	} else if !webhook.Enabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "Webhook is disabled"})
+		return
+	}
+
+	id, err := config.webhooks.SendTest(webhook)
+	if err != nil {
+		config.log.Error("Failed to send test delivery: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send test delivery"})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"deliveryId": id})
+}
+
+// requireWebhook looks up the webhook identified by the `id` path parameter, responding with an
+// error if it is invalid or cannot be found.
+func requireWebhook(c *gin.Context) (*database.Webhook, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook ID"})
+		return nil, false
+	}
+
+	webhook, err := config.db.GetWebhook(id)
+	if err != nil {
+		config.log.Error("Failed to get webhook: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get webhook"})
+		return nil, false
+	} else if webhook == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+		return nil, false
+	}
+
+	return webhook, true
+}
+
+// generateSecret returns a random, hex-encoded 32 byte secret.
+func generateSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(secret), nil
+}
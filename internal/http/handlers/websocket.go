@@ -0,0 +1,451 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hafh-server/internal/commands"
+	"hafh-server/internal/database"
+	"hafh-server/internal/events"
+	"hafh-server/internal/http/middleware"
+	"hafh-server/internal/stream"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// websocketWriteTimeout is how long a single write may take before the client is considered
+	// too slow and disconnected.
+	websocketWriteTimeout = 10 * time.Second
+	// websocketPongTimeout is how long the server waits for any message (including a pong) from
+	// the client before disconnecting it.
+	websocketPongTimeout = 60 * time.Second
+	// websocketPingInterval must be shorter than websocketPongTimeout.
+	websocketPingInterval = 25 * time.Second
+	// websocketSendQueue is how many outgoing messages are buffered per connection.
+	websocketSendQueue = 256
+	// websocketMaxMessageSize is the maximum size of a message from the client.
+	websocketMaxMessageSize = 64 * 1024
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+	CheckOrigin:     checkOrigin,
+}
+
+// checkOrigin protects WebSockets authenticated by the session cookie from cross-site WebSocket
+// hijacking: browsers send the cookie along with WebSocket requests from any site, so these must
+// come from the server's own origin or an allowed one. Browsers cannot add the API key or bearer
+// token headers to WebSocket requests, so requests authenticated by them are not checked.
+func checkOrigin(r *http.Request) bool {
+	if r.Header.Get("X-API-Key") != "" || strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		return true
+	}
+
+	// Clients other than browsers need not send an origin.
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	} else if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+
+	for _, allowed := range config.allowedOrigins {
+		if strings.EqualFold(strings.TrimSuffix(allowed, "/"), u.Scheme+"://"+u.Host) {
+			return true
+		}
+	}
+
+	config.log.Warnf("Rejected WebSocket from origin %s", origin)
+	return false
+}
+
+// websocketRequest is a message sent by a WebSocket client. ID is echoed back in the response, so
+// that clients can match responses to requests.
+type websocketRequest struct {
+	Type string `json:"type"`
+	ID   string `json:"id,omitempty"`
+
+	// Fields of "subscribe" requests.
+	SerialNumbers []string `json:"serial_numbers,omitempty"`
+	Tag           string   `json:"tag,omitempty"`
+	Events        []string `json:"events,omitempty"`
+	LastReadingID int      `json:"last_reading_id,omitempty"`
+
+	// Fields of "unsubscribe" requests.
+	Subscription string `json:"subscription,omitempty"`
+
+	// Fields of "command" requests.
+	SerialNumber string         `json:"serial_number,omitempty"`
+	Command      string         `json:"command,omitempty"`
+	Args         map[string]any `json:"args,omitempty"`
+}
+
+// websocketResponse is a message sent to a WebSocket client.
+type websocketResponse struct {
+	Type          string          `json:"type"`
+	ID            string          `json:"id,omitempty"`
+	Subscription  string          `json:"subscription,omitempty"`
+	Event         string          `json:"event,omitempty"`
+	Data          json.RawMessage `json:"data,omitempty"`
+	LastReadingID int             `json:"last_reading_id,omitempty"`
+	Error         string          `json:"error,omitempty"`
+}
+
+// websocketSession is the state of a single WebSocket connection.
+type websocketSession struct {
+	conn   *websocket.Conn
+	ctx    context.Context
+	cancel context.CancelFunc
+	// done is closed once the handler of the session has returned.
+	done   chan struct{}
+	send   chan *websocketResponse
+	source string
+	// canCommand is whether the client has been granted the scope to send commands.
+	canCommand bool
+
+	mu            sync.Mutex
+	nextID        int
+	subscriptions map[string]*stream.Subscription
+}
+
+// GetWebSocket upgrades the connection to a WebSocket, over which clients subscribe to live
+// readings and server events, and send commands to actuators. Every message is a JSON object with
+// a `type` and an optional `id`, which is echoed back in the response:
+//
+//   - `{"type": "subscribe", "serial_numbers": [...], "tag": "...", "events": [...], "last_reading_id": int}`
+//     subscribes to readings and events (see [GetStream] for the filters), replying with a
+//     `subscribed` message holding the `subscription` ID. Missed readings after `last_reading_id`
+//     are replayed first.
+//   - `{"type": "unsubscribe", "subscription": "..."}` cancels a subscription.
+//   - `{"type": "command", "serial_number": "...", "command": "...", "args": {...}}` sends a
+//     command to an actuator, replying with `command_sent`. This requires the `commands:send` scope.
+//   - `{"type": "ping"}` replies with `pong`.
+//
+// Readings and events are sent as `reading` and `event` messages with the `subscription` they
+// matched and their `data`. Failed requests are answered with an `error` message. A subscription
+// whose client falls too far behind is dropped with a `subscription_dropped` message holding the
+// `last_reading_id` delivered, from which the client can resubscribe.
+func GetWebSocket(c *gin.Context) {
+	if config.stream == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Streaming is not available"})
+		return
+	}
+
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// The upgrader has already responded with an error.
+		config.log.Debug("Failed to upgrade to WebSocket: ", err)
+		return
+	}
+
+	source := "websocket:" + c.ClientIP()
+	canCommand := false
+	if principal := middleware.GetPrincipal(c); principal != nil {
+		source = "websocket:" + principal.Name
+		canCommand = principal.Has(database.ScopeSendCommands)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	session := &websocketSession{
+		conn:          conn,
+		ctx:           ctx,
+		cancel:        cancel,
+		done:          make(chan struct{}),
+		send:          make(chan *websocketResponse, websocketSendQueue),
+		source:        source,
+		canCommand:    canCommand,
+		subscriptions: map[string]*stream.Subscription{},
+	}
+
+	websockets.add(session)
+	defer websockets.remove(session)
+
+	config.log.Debugf("WebSocket client connected from %s", c.ClientIP())
+
+	go session.writeLoop()
+	session.readLoop()
+
+	// The read loop only returns once the connection is broken.
+	cancel()
+	session.closeSubscriptions()
+	conn.Close()
+	config.log.Debugf("WebSocket client from %s disconnected", c.ClientIP())
+}
+
+// websocketSessions tracks the open WebSocket sessions, as the HTTP server neither waits for nor
+// closes the connections of WebSockets once they are upgraded.
+type websocketSessions struct {
+	mu       sync.Mutex
+	sessions map[*websocketSession]struct{}
+}
+
+var websockets = &websocketSessions{sessions: map[*websocketSession]struct{}{}}
+
+func (w *websocketSessions) add(session *websocketSession) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.sessions[session] = struct{}{}
+}
+
+func (w *websocketSessions) remove(session *websocketSession) {
+	w.mu.Lock()
+	delete(w.sessions, session)
+	w.mu.Unlock()
+
+	close(session.done)
+}
+
+// CloseWebSockets disconnects every WebSocket client, and waits for their handlers to return until
+// ctx is done. Clients are expected to reconnect, e.g. once the server is restarted.
+func CloseWebSockets(ctx context.Context) error {
+	websockets.mu.Lock()
+	sessions := make([]*websocketSession, 0, len(websockets.sessions))
+	for session := range websockets.sessions {
+		sessions = append(sessions, session)
+	}
+	websockets.mu.Unlock()
+
+	for _, session := range sessions {
+		session.cancel()
+	}
+
+	for _, session := range sessions {
+		select {
+		case <-session.done:
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for WebSocket clients to disconnect: %w", ctx.Err())
+		}
+	}
+
+	return nil
+}
+
+// readLoop handles requests until the connection is closed or broken.
+func (s *websocketSession) readLoop() {
+	s.conn.SetReadLimit(websocketMaxMessageSize)
+	s.conn.SetReadDeadline(time.Now().Add(websocketPongTimeout))
+	s.conn.SetPongHandler(func(string) error {
+		return s.conn.SetReadDeadline(time.Now().Add(websocketPongTimeout))
+	})
+
+	for {
+		var request websocketRequest
+		if err := s.conn.ReadJSON(&request); err != nil {
+			var syntaxErr *json.SyntaxError
+			var typeErr *json.UnmarshalTypeError
+			if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+				s.reply(&websocketResponse{Type: "error", Error: "invalid message: " + err.Error()})
+				continue
+			}
+			return
+		}
+
+		s.conn.SetReadDeadline(time.Now().Add(websocketPongTimeout))
+		s.handle(&request)
+	}
+}
+
+// writeLoop writes queued messages and pings until the session ends. Writes that take too long
+// (i.e. a client that stopped reading) break the connection.
+func (s *websocketSession) writeLoop() {
+	ping := time.NewTicker(websocketPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			// Closing the connection ends the read loop, if the session is closed by the server.
+			s.conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+				time.Now().Add(time.Second))
+			s.conn.Close()
+			return
+		case <-ping.C:
+			if err := s.conn.WriteControl(websocket.PingMessage, nil,
+				time.Now().Add(websocketWriteTimeout)); err != nil {
+				s.conn.Close()
+				return
+			}
+		case response := <-s.send:
+			s.conn.SetWriteDeadline(time.Now().Add(websocketWriteTimeout))
+			if err := s.conn.WriteJSON(response); err != nil {
+				s.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// reply queues a message, waiting for room in the queue unless the session has ended.
+func (s *websocketSession) reply(response *websocketResponse) bool {
+	select {
+	case s.send <- response:
+		return true
+	case <-s.ctx.Done():
+		return false
+	}
+}
+
+func (s *websocketSession) replyError(id string, format string, args ...any) {
+	s.reply(&websocketResponse{Type: "error", ID: id, Error: fmt.Sprintf(format, args...)})
+}
+
+func (s *websocketSession) handle(request *websocketRequest) {
+	switch request.Type {
+	case "subscribe":
+		s.subscribe(request)
+	case "unsubscribe":
+		s.mu.Lock()
+		subscription, ok := s.subscriptions[request.Subscription]
+		delete(s.subscriptions, request.Subscription)
+		s.mu.Unlock()
+
+		if !ok {
+			s.replyError(request.ID, "unknown subscription %q", request.Subscription)
+			return
+		}
+
+		subscription.Close()
+		s.reply(&websocketResponse{Type: "unsubscribed", ID: request.ID, Subscription: request.Subscription})
+	case "command":
+		s.command(request)
+	case "ping":
+		s.reply(&websocketResponse{Type: "pong", ID: request.ID})
+	default:
+		s.replyError(request.ID, "unknown message type %q", request.Type)
+	}
+}
+
+func (s *websocketSession) subscribe(request *websocketRequest) {
+	filter := stream.Filter{
+		SerialNumbers: request.SerialNumbers,
+		Tag:           request.Tag,
+		Events:        request.Events,
+	}
+
+	for _, event := range filter.Events {
+		if event != stream.ReadingEvent && !events.Type(event).IsValid() {
+			s.replyError(request.ID, "invalid event type %q", event)
+			return
+		}
+	}
+
+	subscription := config.stream.Subscribe(filter)
+
+	s.mu.Lock()
+	s.nextID++
+	id := strconv.Itoa(s.nextID)
+	s.subscriptions[id] = subscription
+	s.mu.Unlock()
+
+	s.reply(&websocketResponse{Type: "subscribed", ID: request.ID, Subscription: id})
+
+	go s.forward(id, subscription, &filter, request.LastReadingID)
+}
+
+// forward replays the readings missed since lastReadingID, then forwards the subscription's
+// messages until it is closed.
+func (s *websocketSession) forward(id string, subscription *stream.Subscription, filter *stream.Filter, lastReadingID int) {
+	if lastReadingID > 0 && (len(filter.Events) == 0 || slices.Contains(filter.Events, stream.ReadingEvent)) {
+		var err error
+		ended := false
+		lastReadingID, err = replayReadings(filter, lastReadingID, func(_ *database.Reading, data []byte) bool {
+			ended = !s.reply(&websocketResponse{Type: "reading", Subscription: id, Data: data})
+			return !ended
+		})
+		if err != nil {
+			config.log.Error("Failed to replay missed readings: ", err)
+		} else if ended {
+			return
+		}
+	}
+
+	for message := range subscription.C {
+		response := &websocketResponse{Type: "event", Subscription: id, Event: message.Event, Data: message.Data}
+		if message.ReadingID > 0 {
+			if message.ReadingID <= lastReadingID {
+				continue
+			}
+
+			response.Type = "reading"
+			response.Event = ""
+			lastReadingID = message.ReadingID
+		}
+
+		// Waiting for room in the queue applies backpressure to the subscription, which the hub
+		// drops once its own buffer is full.
+		if !s.reply(response) {
+			return
+		}
+	}
+
+	// The subscription was closed, either by the client or by the hub because the client fell
+	// behind. Only the latter is reported.
+	s.mu.Lock()
+	_, active := s.subscriptions[id]
+	delete(s.subscriptions, id)
+	s.mu.Unlock()
+
+	if active {
+		s.reply(&websocketResponse{Type: "subscription_dropped", Subscription: id, LastReadingID: lastReadingID})
+	}
+}
+
+func (s *websocketSession) command(request *websocketRequest) {
+	if config.commands == nil {
+		s.replyError(request.ID, "commands are not available")
+		return
+	} else if !s.canCommand {
+		s.replyError(request.ID, "missing scope: %s", database.ScopeSendCommands)
+		return
+	}
+
+	command := &commands.Command{
+		SerialNumber: request.SerialNumber,
+		Command:      request.Command,
+		Args:         request.Args,
+		Source:       s.source,
+	}
+
+	if err := config.commands.Send(command); err != nil {
+		s.replyError(request.ID, "failed to send command: %v", err)
+		return
+	}
+
+	data, err := json.Marshal(command)
+	if err != nil {
+		config.log.Error("Failed to encode command: ", err)
+		return
+	}
+
+	s.reply(&websocketResponse{Type: "command_sent", ID: request.ID, Data: data})
+}
+
+// closeSubscriptions closes every subscription of the session.
+func (s *websocketSession) closeSubscriptions() {
+	s.mu.Lock()
+	subscriptions := s.subscriptions
+	s.subscriptions = map[string]*stream.Subscription{}
+	s.mu.Unlock()
+
+	for _, subscription := range subscriptions {
+		subscription.Close()
+	}
+}
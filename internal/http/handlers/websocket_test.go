@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"hafh-server/internal/logger"
+	"net/http/httptest"
+	"testing"
+)
+
+func init() {
+	logger.Init(false)
+}
+
+func TestCheckOrigin(t *testing.T) {
+	Init(&Options{Log: logger.Named("test"), AllowedOrigins: []string{"https://dashboard.example.com/"}})
+
+	tests := []struct {
+		name    string
+		origin  string
+		headers map[string]string
+		want    bool
+	}{
+		{"no origin", "", nil, true},
+		{"same origin", "http://hafh.local:8080", nil, true},
+		{"same origin, other case", "http://HAFH.local:8080", nil, true},
+		{"allowed origin", "https://dashboard.example.com", nil, true},
+		{"allowed origin, other case", "https://Dashboard.Example.com", nil, true},
+		{"allowed host, other scheme", "http://dashboard.example.com", nil, false},
+		{"other port", "http://hafh.local:9090", nil, false},
+		{"other site", "https://evil.example.com", nil, false},
+		{"suffix of the host", "http://hafh.local:8080.evil.example.com", nil, false},
+		{"opaque origin", "null", nil, false},
+		{"malformed origin", "http://[::1", nil, false},
+		{"API key", "https://evil.example.com", map[string]string{"X-API-Key": "key"}, true},
+		{"bearer token", "https://evil.example.com", map[string]string{"Authorization": "Bearer token"}, true},
+		{"other authorization", "https://evil.example.com", map[string]string{"Authorization": "Basic dXNlcg=="}, false},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "http://hafh.local:8080/api/v1/ws", nil)
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		for name, value := range tt.headers {
+			r.Header.Set(name, value)
+		}
+
+		if got := checkOrigin(r); got != tt.want {
+			t.Errorf("%s: checkOrigin() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
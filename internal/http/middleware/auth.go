@@ -1,17 +1,145 @@
 package middleware
 
 import (
-	"github.com/gin-gonic/gin"
+	"crypto/subtle"
+	"hafh-server/internal/auth"
+	"hafh-server/internal/database"
 	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
 )
 
-// APIKeyAuth is a middleware function that checks for a valid API key in the request header.
-func APIKeyAuth(apiKey string) gin.HandlerFunc {
+// principalKey is the key of the authenticated [auth.Principal] in the request context.
+const principalKey = "principal"
+
+// SessionCookie is the name of the cookie holding the session token of a logged in user.
+const SessionCookie = "hafh_session"
+
+// lastUsedResolution is how stale the recorded last use of an API key may be, so that the database
+// is not written on every request.
+const lastUsedResolution = time.Minute
+
+// SessionAuth is a middleware function that authenticates logged in users by the session token in
+// the `Authorization: Bearer` header or the session cookie. If an OpenID Connect provider is given,
+// bearer tokens that are JWTs are validated against it instead. Requests with an API key, or without
+// a session token, are left to [APIKeyAuth], which must run after it.
+func SessionAuth(db *database.Database, oidc *auth.Provider) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		if c.GetHeader("X-API-Key") != apiKey {
+		token := SessionToken(c)
+		if token == "" || c.GetHeader("X-API-Key") != "" {
+			c.Next()
+			return
+		}
+
+		if oidc != nil && auth.IsJWT(token) {
+			identity, err := oidc.VerifyBearer(c.Request.Context(), token)
+			if err != nil {
+				log.Debug("Rejected bearer token: ", err)
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid bearer token"})
+				return
+			}
+
+			c.Set(principalKey, auth.IdentityPrincipal(identity))
+			c.Next()
+			return
+		}
+
+		user, err := db.GetSessionUser(auth.HashToken(token), time.Now())
+		if err != nil {
+			log.Error("Failed to get session: ", err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to authenticate"})
+			return
+		} else if user == nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired session"})
+			return
+		}
+
+		c.Set(principalKey, auth.UserPrincipal(user))
+		c.Next()
+	}
+}
+
+// SessionToken returns the session token of the request, from the `Authorization: Bearer` header or
+// the session cookie, or an empty string if there is none.
+func SessionToken(c *gin.Context) string {
+	if token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+
+	token, _ := c.Cookie(SessionCookie)
+	return token
+}
+
+// APIKeyAuth is a middleware function that checks for a valid API key in the request header, unless
+// a previous middleware (i.e. [SessionAuth]) has already authenticated the request. The bootstrap
+// key from the configuration (as currently returned by bootstrapKey) is an admin; any other key is
+// looked up (by its hash) in the database, and must not have expired. The authenticated principal
+// is stored in the context.
+func APIKeyAuth(bootstrapKey func() string, db *database.Database) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if GetPrincipal(c) != nil {
+			c.Next()
+			return
+		}
+
+		key := c.GetHeader("X-API-Key")
+		if key == "" {
 			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Invalid API key"})
 			return
 		}
+
+		if bootstrap := bootstrapKey(); bootstrap != "" && subtle.ConstantTimeCompare([]byte(key), []byte(bootstrap)) == 1 {
+			c.Set(principalKey, &auth.Bootstrap)
+			c.Next()
+			return
+		}
+
+		apiKey, err := db.GetAPIKeyByHash(auth.HashToken(key))
+		if err != nil {
+			log.Error("Failed to get API key: ", err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to authenticate"})
+			return
+		}
+
+		now := time.Now()
+		if apiKey == nil || apiKey.IsExpired(now) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Invalid API key"})
+			return
+		}
+
+		if apiKey.LastUsedAt == nil || now.Sub(*apiKey.LastUsedAt) >= lastUsedResolution {
+			if err := db.TouchAPIKey(apiKey.ID, now); err != nil {
+				log.Error("Failed to record API key use: ", err)
+			}
+		}
+
+		c.Set(principalKey, &auth.Principal{Name: apiKey.Name, APIKeyID: apiKey.ID, Scopes: apiKey.Scopes})
+		c.Next()
+	}
+}
+
+// RequireScope is a middleware function that rejects requests whose principal lacks the given
+// scope. It must run after [APIKeyAuth].
+func RequireScope(scope database.Scope) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		principal := GetPrincipal(c)
+		if principal == nil || !principal.Has(scope) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Missing scope: " + string(scope)})
+			return
+		}
 		c.Next()
 	}
 }
+
+// GetPrincipal returns the authenticated principal of the request, or nil if there is none.
+func GetPrincipal(c *gin.Context) *auth.Principal {
+	value, ok := c.Get(principalKey)
+	if !ok {
+		return nil
+	}
+
+	principal, _ := value.(*auth.Principal)
+	return principal
+}
@@ -3,6 +3,7 @@ package middleware
 import (
 	"bytes"
 	"io"
+	"strings"
 	"time"
 
 	"hafh-server/internal/logger"
@@ -13,13 +14,26 @@ import (
 
 var log *zap.SugaredLogger
 
+// sensitiveKey marks a request whose bodies must not be logged in the request context.
+const sensitiveKey = "sensitive"
+
+// MarkSensitive prevents the request and response bodies of the request from being logged, e.g.
+// because they contain passwords or keys.
+func MarkSensitive(c *gin.Context) {
+	c.Set(sensitiveKey, true)
+}
+
 type responseWriter struct {
 	gin.ResponseWriter
 	body *bytes.Buffer
 }
 
 func (w *responseWriter) Write(b []byte) (int, error) {
-	w.body.Write(b)
+	// Streamed responses are long-lived, so their bodies are not kept for logging.
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream") {
+		w.body.Write(b)
+	}
+
 	return w.ResponseWriter.Write(b)
 }
 
@@ -52,6 +66,9 @@ func HttpLogger(l *zap.SugaredLogger) gin.HandlerFunc {
 		latency := time.Since(start)
 		status := wrappedWriter.Status()
 		responseBody := wrappedWriter.body.String()
+		if c.GetBool(sensitiveKey) {
+			requestBody, responseBody = "[redacted]", "[redacted]"
+		}
 
 		log.Debug("HTTP Request",
 			zap.String("method", c.Request.Method),
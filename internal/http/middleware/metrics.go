@@ -0,0 +1,48 @@
+package middleware
+
+import (
+	"hafh-server/internal/metrics"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	httpRequests = metrics.NewCounter("hafh_http_requests_total",
+		"HTTP requests served, by method, route and status.", "method", "route", "status")
+	httpRequestDuration = metrics.NewHistogram("hafh_http_request_duration_seconds",
+		"Time taken to serve HTTP requests, by method and route.", nil, "method", "route")
+)
+
+// Metrics is a middleware that counts HTTP requests and measures their latency. Requests are
+// labelled with their route pattern rather than their path, so that e.g. every peripheral shares a
+// series; requests that match no route are labelled "unmatched". Likewise, clients cannot add a
+// series per method: methods other than the standard ones are labelled "other".
+func Metrics() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+
+		method := methodLabel(c.Request.Method)
+		httpRequests.Inc(method, route, strconv.Itoa(c.Writer.Status()))
+		httpRequestDuration.Observe(time.Since(start).Seconds(), method, route)
+	}
+}
+
+// methodLabel returns the method, if it is a standard one, or "other".
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	default:
+		return "other"
+	}
+}
@@ -1,37 +1,300 @@
 package middleware
 
 import (
-	"github.com/gin-gonic/gin"
+	"errors"
+	"fmt"
+	"hafh-server/internal/auth"
+	"hafh-server/internal/database"
+	"math"
 	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/gin-gonic/gin"
 )
 
-// RateLimit is a middleware function that limits the number of requests
-// a client can make to the server within a specified time frame.
-func RateLimit(maxRequestsPerSecond int) gin.HandlerFunc {
-	limiter := make(chan time.Time, maxRequestsPerSecond)
+// Rate is a token bucket rate limit: a sustained number of requests per second, and the number of
+// requests that may be made at once after being idle.
+type Rate struct {
+	PerSecond float64
+	Burst     int
+}
+
+// RateLimiterConfig holds the configuration for the [RateLimiter].
+type RateLimiterConfig struct {
+	// Default is the rate limit of every client, unless one of its scopes has a different one.
+	Default Rate
+	// Scopes are the rate limits of clients with the given scopes. A client with several scopes
+	// gets the most generous rate limit.
+	Scopes map[database.Scope]Rate
+	// Routes are additional rate limits of routes, keyed by method and route pattern (e.g.
+	// "POST /api/v1/auth/login"), which apply on top of the rate limit of the client.
+	Routes map[string]Rate
+	// IdleAfter is how long a client must be idle before its buckets are dropped, defaulting to 10
+	// minutes.
+	IdleAfter time.Duration
+}
+
+// bucket is a token bucket, refilled lazily whenever it is used.
+type bucket struct {
+	rate     Rate
+	tokens   float64
+	lastUsed time.Time
+}
+
+// refill adds the tokens earned since the bucket was last used.
+func (b *bucket) refill(now time.Time) {
+	b.tokens = math.Min(float64(b.rate.Burst), b.tokens+now.Sub(b.lastUsed).Seconds()*b.rate.PerSecond)
+	b.lastUsed = now
+}
+
+// untilFull returns how long it takes for the bucket to refill completely.
+func (b *bucket) untilFull() time.Duration {
+	return secondsToDuration((float64(b.rate.Burst) - b.tokens) / b.rate.PerSecond)
+}
 
-	// Fill the limiter.
-	for range maxRequestsPerSecond {
-		limiter <- time.Now()
+// bucketKey identifies the bucket of a client, or of a client and route.
+type bucketKey struct {
+	client string
+	route  string
+}
+
+// failedAuthRoute is the route of the buckets of [RateLimiter.LimitFailedAuth].
+const failedAuthRoute = "failed authentication"
+
+// RateLimiter limits the rate of requests of every client, identified by its API key or user, or by
+// its IP address if it is not authenticated.
+type RateLimiter struct {
+	// config is replaced by [RateLimiter.Update].
+	config    atomic.Pointer[RateLimiterConfig]
+	mu        sync.Mutex
+	buckets   map[bucketKey]*bucket
+	lastSweep time.Time
+}
+
+// NewRateLimiter creates a new [RateLimiter].
+func NewRateLimiter(config *RateLimiterConfig) (*RateLimiter, error) {
+	l := &RateLimiter{buckets: map[bucketKey]*bucket{}, lastSweep: time.Now()}
+	if err := l.Update(config); err != nil {
+		return nil, err
 	}
 
-	go func() {
-		ticker := time.NewTicker(1 * time.Second)
-		for t := range ticker.C {
-			select {
-			case limiter <- t:
-			default:
-			}
+	return l, nil
+}
+
+// Update replaces the rate limits, e.g. when the configuration is reloaded. Clients whose rate
+// limit changed start over with a full bucket. If the configuration is invalid, the rate limits are
+// left unchanged.
+func (l *RateLimiter) Update(config *RateLimiterConfig) error {
+	if config == nil {
+		return errors.New("config cannot be nil")
+	} else if err := validateRate("default", config.Default); err != nil {
+		return err
+	}
+
+	for scope, rate := range config.Scopes {
+		if !scope.IsValid() {
+			return fmt.Errorf("unknown scope: %s", scope)
+		} else if err := validateRate(string(scope), rate); err != nil {
+			return err
+		}
+	}
+
+	for route, rate := range config.Routes {
+		if err := validateRate(route, rate); err != nil {
+			return err
 		}
-	}()
+	}
+
+	updated := *config
+	if updated.IdleAfter <= 0 {
+		updated.IdleAfter = 10 * time.Minute
+	}
+
+	l.config.Store(&updated)
+	return nil
+}
+
+func validateRate(name string, rate Rate) error {
+	if rate.PerSecond <= 0 || rate.Burst < 1 {
+		return fmt.Errorf("rate limit of %s must allow at least one request", name)
+	}
 
+	return nil
+}
+
+// RateLimit is a middleware function that limits the number of requests each client can make. It
+// must run after authentication, so that authenticated clients are told apart by their principal
+// rather than by their (possibly shared) IP address. Every response carries `RateLimit-Limit`,
+// `RateLimit-Remaining` and `RateLimit-Reset` headers, and rejected requests a `Retry-After` header.
+func (l *RateLimiter) RateLimit() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		select {
-		case <-limiter:
-			c.Next()
-		default:
-			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "Rate limit exceeded"})
+		config := l.config.Load()
+		client, rate := clientRate(c, config)
+		keys := []bucketKey{{client: client}}
+		rates := []Rate{rate}
+
+		route := c.Request.Method + " " + c.FullPath()
+		if routeRate, ok := config.Routes[route]; ok {
+			keys = append(keys, bucketKey{client: client, route: route})
+			rates = append(rates, routeRate)
 		}
+
+		allowed, limiting := l.take(keys, rates, config.IdleAfter, time.Now())
+		if !respond(c, allowed, limiting) {
+			return
+		}
+
+		c.Next()
 	}
 }
+
+// LimitFailedAuth is a middleware function that limits the rate of failed authentications by IP
+// address, so that API keys (e.g. a weak bootstrap key) cannot be guessed: [RateLimiter.RateLimit]
+// runs after authentication and never sees rejected requests. It must run before authentication.
+// Only requests that end up without a principal count, but once an IP address has used up its rate
+// limit, all of its requests are rejected until it refills, as they cannot be told apart otherwise.
+func (l *RateLimiter) LimitFailedAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		config := l.config.Load()
+		key := bucketKey{client: "ip:" + c.ClientIP(), route: failedAuthRoute}
+
+		if b := l.peek(key, config.Default, config.IdleAfter, time.Now()); b.tokens < 1 {
+			respond(c, false, b)
+			return
+		}
+
+		c.Next()
+
+		if GetPrincipal(c) == nil {
+			l.take([]bucketKey{key}, []Rate{config.Default}, config.IdleAfter, time.Now())
+		}
+	}
+}
+
+// respond sets the rate limit headers of the limiting bucket, rejecting the request if it is not
+// allowed. It returns whether the request is allowed.
+func respond(c *gin.Context, allowed bool, limiting bucket) bool {
+	c.Header("RateLimit-Limit", strconv.Itoa(limiting.rate.Burst))
+	c.Header("RateLimit-Remaining", strconv.Itoa(int(limiting.tokens)))
+	c.Header("RateLimit-Reset", strconv.Itoa(ceilSeconds(limiting.untilFull())))
+
+	if !allowed {
+		retryAfter := secondsToDuration((1 - limiting.tokens) / limiting.rate.PerSecond)
+		c.Header("Retry-After", strconv.Itoa(ceilSeconds(retryAfter)))
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "Rate limit exceeded"})
+	}
+
+	return allowed
+}
+
+// clientRate returns the key and rate limit of the client of the request.
+func clientRate(c *gin.Context, config *RateLimiterConfig) (string, Rate) {
+	principal := GetPrincipal(c)
+	if principal == nil {
+		return "ip:" + c.ClientIP(), config.Default
+	}
+
+	rate, found := config.Default, false
+	for _, scope := range principal.Scopes {
+		if scopeRate, ok := config.Scopes[scope]; ok && (!found || scopeRate.PerSecond > rate.PerSecond) {
+			rate, found = scopeRate, true
+		}
+	}
+
+	return clientKey(principal), rate
+}
+
+// clientKey identifies the principal, so that every API key and user has its own buckets.
+func clientKey(p *auth.Principal) string {
+	if p.APIKeyID != 0 {
+		return "key:" + strconv.FormatInt(p.APIKeyID, 10)
+	} else if p.UserID != 0 {
+		return "user:" + strconv.FormatInt(p.UserID, 10)
+	}
+
+	return "principal:" + p.Name
+}
+
+// take takes a token from every bucket if they all have one. It returns whether the request is
+// allowed, and a copy of the bucket the response headers are about: the one that takes longest to
+// allow another request if the request is rejected, or the one with the fewest tokens left
+// otherwise.
+func (l *RateLimiter) take(keys []bucketKey, rates []Rate, idleAfter time.Duration, now time.Time) (bool, bucket) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(idleAfter, now)
+
+	buckets := make([]*bucket, len(keys))
+	allowed := true
+	for i, key := range keys {
+		b := l.bucket(key, rates[i], now)
+		buckets[i] = b
+		allowed = allowed && b.tokens >= 1
+	}
+
+	var limiting *bucket
+	for _, b := range buckets {
+		if allowed {
+			b.tokens--
+			if limiting == nil || b.tokens/float64(b.rate.Burst) < limiting.tokens/float64(limiting.rate.Burst) {
+				limiting = b
+			}
+		} else if b.tokens < 1 {
+			if limiting == nil || (1-b.tokens)/b.rate.PerSecond > (1-limiting.tokens)/limiting.rate.PerSecond {
+				limiting = b
+			}
+		}
+	}
+
+	return allowed, *limiting
+}
+
+// peek returns a copy of a bucket without taking a token from it.
+func (l *RateLimiter) peek(key bucketKey, rate Rate, idleAfter time.Duration, now time.Time) bucket {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(idleAfter, now)
+	return *l.bucket(key, rate, now)
+}
+
+// bucket returns the refilled bucket with the given key, creating a full one if there is none or its
+// rate changed. The lock must be held.
+func (l *RateLimiter) bucket(key bucketKey, rate Rate, now time.Time) *bucket {
+	b, ok := l.buckets[key]
+	if !ok || b.rate != rate {
+		b = &bucket{rate: rate, tokens: float64(rate.Burst), lastUsed: now}
+		l.buckets[key] = b
+	}
+
+	b.refill(now)
+	return b
+}
+
+// sweep drops the buckets that have been idle long enough to have refilled completely, as they
+// would be recreated identically. The lock must be held.
+func (l *RateLimiter) sweep(idleAfter time.Duration, now time.Time) {
+	if now.Sub(l.lastSweep) < idleAfter/2 {
+		return
+	}
+
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		idle := now.Sub(b.lastUsed)
+		if idle >= idleAfter && idle >= b.untilFull() {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
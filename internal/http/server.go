@@ -4,11 +4,27 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"hafh-server/internal/alerts"
+	"hafh-server/internal/auth"
+	"hafh-server/internal/commands"
 	"hafh-server/internal/database"
+	"hafh-server/internal/email"
+	"hafh-server/internal/health"
 	"hafh-server/internal/http/handlers"
 	"hafh-server/internal/http/middleware"
 	"hafh-server/internal/logger"
+	"hafh-server/internal/mqtt"
+	"hafh-server/internal/scheduler"
+	"hafh-server/internal/stream"
+	"hafh-server/internal/virtual"
+	"hafh-server/internal/webhooks"
+	"maps"
+	"math"
+	"net"
 	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
@@ -17,34 +33,122 @@ import (
 // HttpServer represents an HTTP server.
 type HttpServer struct {
 	internalServer *http.Server
-	log            *zap.SugaredLogger
-	Db             *database.Database
+	// tlsServer serves HTTPS, if configured.
+	tlsServer *http.Server
+	// listener and tlsListener are the sockets to serve on, if passed by systemd.
+	listener    net.Listener
+	tlsListener net.Listener
+	listening   atomic.Bool
+	// limiter, bootstrapKey and certs can be changed while the server runs.
+	limiter      *middleware.RateLimiter
+	bootstrapKey *atomic.Pointer[string]
+	certs        *certReloader
+	log          *zap.SugaredLogger
+	Db           *database.Database
 }
 
 // HttpServerConfig holds the configuration for the HTTP server.
 type HttpServerConfig struct {
-	Port                 int
-	ApiKey               string
-	MaxRequestsPerSecond int
-	Db                   *database.Database
+	Port   int
+	ApiKey string
+	// RateLimit limits the rate of requests of every client, defaulting to 5 requests per second
+	// with a burst of 10.
+	RateLimit    middleware.RateLimiterConfig
+	OfflineAfter time.Duration
+	Db           *database.Database
+	Alerts       *alerts.Engine
+	Webhooks     *webhooks.Dispatcher
+	Email        *email.Notifier
+	Commands     *commands.Sender
+	Scheduler    *scheduler.Scheduler
+	Virtual      *virtual.Engine
+	Stream       *stream.Hub
+	// SessionLifetime is how long users stay logged in, defaulting to a week.
+	SessionLifetime time.Duration
+	// AllowedOrigins are the origins, other than the server's own, whose pages may open WebSockets
+	// authenticated by the session cookie.
+	AllowedOrigins []string
+	// OIDC, if set, logs users in with OpenID Connect instead of a password and validates bearer
+	// tokens it issued.
+	OIDC *auth.Provider
+	// TLS, if set, serves HTTPS in addition to plain HTTP on the loopback interface.
+	TLS *TLSConfig
+	// Listener and TLSListener, if set, are served on instead of listening on the port and TLS port,
+	// e.g. when passed by systemd socket activation.
+	Listener    net.Listener
+	TLSListener net.Listener
+	// Broker is the MQTT broker, whose connected clients are reported by the status endpoint.
+	Broker *mqtt.MqttServer
+	// HealthChecks are run by /healthz (only the liveness checks) and /readyz.
+	HealthChecks []health.Check
+	// Metrics serves Prometheus metrics at /metrics, to clients with the readings:read scope unless
+	// PublicMetrics is set.
+	Metrics       bool
+	PublicMetrics bool
 }
 
 const (
-	apiPrefix           = "/api/" + handlers.ApiVersionMajor
-	versionEndpoint     = apiPrefix + "/version"
-	readingsEndpoint    = apiPrefix + "/readings"
-	peripheralsEndpoint = apiPrefix + "/peripherals"
+	apiPrefix             = "/api/" + handlers.ApiVersionMajor
+	versionEndpoint       = apiPrefix + "/version"
+	readingsEndpoint      = apiPrefix + "/readings"
+	streamEndpoint        = apiPrefix + "/stream"
+	websocketEndpoint     = apiPrefix + "/ws"
+	peripheralsEndpoint   = apiPrefix + "/peripherals"
+	peripheralEndpoint    = peripheralsEndpoint + "/:serial"
+	mergeEndpoint         = peripheralEndpoint + "/merge"
+	calibrationsEndpoint  = peripheralEndpoint + "/calibrations"
+	derivedFieldsEndpoint = peripheralEndpoint + "/derived-fields"
+	roomsEndpoint         = apiPrefix + "/rooms"
+	roomEndpoint          = roomsEndpoint + "/:id"
+	typesEndpoint         = apiPrefix + "/peripheral-types"
+	typeEndpoint          = typesEndpoint + "/:id"
+	alertRulesEndpoint    = apiPrefix + "/alert-rules"
+	alertRuleEndpoint     = alertRulesEndpoint + "/:id"
+	alertsEndpoint        = apiPrefix + "/alerts"
+	anomaliesEndpoint     = apiPrefix + "/anomalies"
+	webhooksEndpoint      = apiPrefix + "/webhooks"
+	webhookEndpoint       = webhooksEndpoint + "/:id"
+	deliveriesEndpoint    = webhookEndpoint + "/deliveries"
+	webhookTestEndpoint   = webhookEndpoint + "/test"
+	emailTestEndpoint     = apiPrefix + "/notifications/email/test"
+	automationsEndpoint   = apiPrefix + "/automations"
+	automationEndpoint    = automationsEndpoint + "/:id"
+	executionsEndpoint    = automationEndpoint + "/executions"
+	schedulesEndpoint     = apiPrefix + "/schedules"
+	scheduleEndpoint      = schedulesEndpoint + "/:id"
+	scheduleRunsEndpoint  = scheduleEndpoint + "/runs"
+	scheduleRunEndpoint   = scheduleEndpoint + "/run"
+	virtualsEndpoint      = apiPrefix + "/virtual-peripherals"
+	virtualEndpoint       = virtualsEndpoint + "/:serial"
+	adminKeysEndpoint     = apiPrefix + "/admin/keys"
+	adminKeyEndpoint      = adminKeysEndpoint + "/:id"
+	adminUsersEndpoint    = apiPrefix + "/admin/users"
+	adminUserEndpoint     = adminUsersEndpoint + "/:id"
+	loginEndpoint         = apiPrefix + "/auth/login"
+	logoutEndpoint        = apiPrefix + "/auth/logout"
+	meEndpoint            = apiPrefix + "/auth/me"
+	oidcLoginEndpoint     = apiPrefix + "/auth/oidc/login"
+	oidcCallbackEndpoint  = apiPrefix + "/auth/oidc/callback"
+	metricsEndpoint       = "/metrics"
+	healthEndpoint        = "/healthz"
+	readinessEndpoint     = "/readyz"
+	adminStatusEndpoint   = apiPrefix + "/admin/status"
 )
 
-// NewServer creates a new [HttpServer] instance with the specified port, API key, and max requests per second (rate limit).
+// NewServer creates a new [HttpServer] instance with the specified port, API key, and rate limits.
 //
 // Notes:
 //
 // - The server will listen on the specified port, defaulting to 8080 if not provided.
 //
-// - The API key is required for authentication.
+// - If TLS is configured, HTTPS is served on its own port (defaulting to 8443), and plain HTTP requests from other
+// hosts than this one are either redirected to HTTPS or not served at all.
 //
-// - The max requests per second is used to limit the rate of incoming requests, defaulting to 5 if not provided.
+// - The API key is required for authentication, and is an admin key that can create scoped API keys.
+//
+// - The rate limits apply to every client (API key, user or IP address) separately, defaulting to 5 requests per
+// second with a burst of 10 if not provided. Logging in is limited to 5 attempts, then one every 5 seconds, unless
+// overridden.
 func NewServer(config *HttpServerConfig) (*HttpServer, error) {
 	// Validate the configuration.
 	if config == nil {
@@ -53,62 +157,358 @@ func NewServer(config *HttpServerConfig) (*HttpServer, error) {
 
 	port := config.Port
 	apiKey := config.ApiKey
-	maxRequestsPerSecond := config.MaxRequestsPerSecond
 	db := config.Db
 	if port == 0 {
 		port = 8080
-	} else if maxRequestsPerSecond <= 0 {
-		maxRequestsPerSecond = 5
-	} else if apiKey == "" {
+	}
+
+	limiter, err := middleware.NewRateLimiter(rateLimiterConfig(config.RateLimit))
+	if err != nil {
+		return nil, err
+	}
+
+	sessionLifetime := config.SessionLifetime
+	if sessionLifetime <= 0 {
+		sessionLifetime = 7 * 24 * time.Hour
+	}
+
+	if apiKey == "" {
 		return nil, errors.New("API key is required")
 	} else if db == nil {
 		return nil, errors.New("database is required")
 	}
 
+	// The bootstrap key can be changed by [HttpServer.SetAPIKey].
+	bootstrapKey := &atomic.Pointer[string]{}
+	bootstrapKey.Store(&apiKey)
+
 	gin.SetMode(gin.ReleaseMode)
 
 	server := gin.New()
 
+	// Only the ngrok forwarder, which connects from this host, may set the client IP address (with
+	// X-Forwarded-For), so that other clients cannot evade the rate limits by rotating it.
+	if err := server.SetTrustedProxies([]string{"127.0.0.1", "::1"}); err != nil {
+		return nil, err
+	}
+
 	log := logger.Named("http")
 	server.Use(
 		middleware.HttpLogger(log),
-		middleware.APIKeyAuth(apiKey),
-		middleware.RateLimit(maxRequestsPerSecond),
+		middleware.Metrics(),
 		gin.Recovery(),
 	)
 
-	handlers.Init(db, log)
+	handlers.Init(&handlers.Options{
+		Db:              db,
+		Log:             log,
+		OfflineAfter:    config.OfflineAfter,
+		Alerts:          config.Alerts,
+		Webhooks:        config.Webhooks,
+		Email:           config.Email,
+		Commands:        config.Commands,
+		Scheduler:       config.Scheduler,
+		Virtual:         config.Virtual,
+		Stream:          config.Stream,
+		SessionLifetime: sessionLifetime,
+		AllowedOrigins:  config.AllowedOrigins,
+		OIDC:            config.OIDC,
+		Broker:          config.Broker,
+		HealthChecks:    config.HealthChecks,
+	})
+
+	// Logging in, the health checks and (if public) the metrics do not require authentication.
+	// These are rate limited by IP address.
+	public := server.Group("", limiter.RateLimit())
+	public.POST(loginEndpoint, handlers.PostLogin)
+	public.GET(oidcLoginEndpoint, handlers.GetOIDCLogin)
+	public.GET(oidcCallbackEndpoint, handlers.GetOIDCCallback)
+	public.GET(healthEndpoint, handlers.GetHealth)
+	public.GET(readinessEndpoint, handlers.GetReadiness)
+	if config.Metrics && config.PublicMetrics {
+		public.GET(metricsEndpoint, handlers.GetMetrics)
+	}
+
+	// Every other route accepts either a user session or an API key, and is rate limited by it.
+	// Failed authentications are rate limited by IP address.
+	authenticated := server.Group("",
+		limiter.LimitFailedAuth(),
+		middleware.SessionAuth(db, config.OIDC),
+		middleware.APIKeyAuth(func() string { return *bootstrapKey.Load() }, db),
+		limiter.RateLimit(),
+	)
+	authenticated.POST(logoutEndpoint, handlers.PostLogout)
+	authenticated.GET(meEndpoint, handlers.GetMe)
+
+	// Route definitions, grouped by the scope they require:
+	read := authenticated.Group("", middleware.RequireScope(database.ScopeReadReadings))
+	read.GET(versionEndpoint, handlers.GetApiVersion)
+	if config.Metrics && !config.PublicMetrics {
+		read.GET(metricsEndpoint, handlers.GetMetrics)
+	}
+	read.POST(readingsEndpoint, handlers.PostReadings)
+	read.GET(peripheralsEndpoint, handlers.GetPeripherals)
+	read.GET(peripheralEndpoint, handlers.GetPeripheral)
+	read.GET(calibrationsEndpoint, handlers.GetCalibrations)
+	read.GET(derivedFieldsEndpoint, handlers.GetDerivedFields)
+	read.GET(streamEndpoint, handlers.GetStream)
+	read.GET(websocketEndpoint, handlers.GetWebSocket)
+	read.GET(roomsEndpoint, handlers.GetRooms)
+	read.GET(roomEndpoint, handlers.GetRoom)
+	read.GET(typesEndpoint, handlers.GetPeripheralTypes)
+	read.GET(typeEndpoint, handlers.GetPeripheralType)
+	read.GET(alertRulesEndpoint, handlers.GetAlertRules)
+	read.GET(alertRuleEndpoint, handlers.GetAlertRule)
+	read.GET(alertsEndpoint, handlers.GetAlerts)
+	read.GET(anomaliesEndpoint, handlers.GetAnomalies)
+	read.GET(webhooksEndpoint, handlers.GetWebhooks)
+	read.GET(webhookEndpoint, handlers.GetWebhook)
+	read.GET(deliveriesEndpoint, handlers.GetWebhookDeliveries)
+	read.GET(automationsEndpoint, handlers.GetAutomations)
+	read.GET(automationEndpoint, handlers.GetAutomation)
+	read.GET(executionsEndpoint, handlers.GetAutomationExecutions)
+	read.GET(schedulesEndpoint, handlers.GetSchedules)
+	read.GET(scheduleEndpoint, handlers.GetSchedule)
+	read.GET(scheduleRunsEndpoint, handlers.GetScheduleRuns)
+	read.GET(virtualsEndpoint, handlers.GetVirtualPeripherals)
+
+	write := authenticated.Group("", middleware.RequireScope(database.ScopeWritePeripherals))
+	write.POST(peripheralsEndpoint, handlers.PostConfigurePeripheral)
+	write.PATCH(peripheralEndpoint, handlers.PatchPeripheral)
+	write.DELETE(peripheralEndpoint, handlers.DeletePeripheral)
+	write.POST(mergeEndpoint, handlers.PostMergePeripheral)
+	write.PUT(calibrationsEndpoint, handlers.PutCalibrations)
+	write.PUT(derivedFieldsEndpoint, handlers.PutDerivedFields)
+	write.POST(roomsEndpoint, handlers.PostRoom)
+	write.PATCH(roomEndpoint, handlers.PatchRoom)
+	write.DELETE(roomEndpoint, handlers.DeleteRoom)
+	write.POST(typesEndpoint, handlers.PostPeripheralType)
+	write.PATCH(typeEndpoint, handlers.PatchPeripheralType)
+	write.DELETE(typeEndpoint, handlers.DeletePeripheralType)
+	write.POST(virtualsEndpoint, handlers.PostVirtualPeripheral)
+	write.PATCH(virtualEndpoint, handlers.PatchVirtualPeripheral)
 
-	// Route definitions:
-	server.GET(versionEndpoint, handlers.GetApiVersion)
-	server.GET(peripheralsEndpoint, handlers.GetPeripherals)
-	server.POST(peripheralsEndpoint, handlers.PostConfigurePeripheral)
-	server.POST(readingsEndpoint, handlers.PostReadings)
+	command := authenticated.Group("", middleware.RequireScope(database.ScopeSendCommands))
+	command.POST(scheduleRunEndpoint, handlers.PostScheduleRun)
+
+	// Everything else changes the behavior of the server, or manages access to it.
+	admin := authenticated.Group("", middleware.RequireScope(database.ScopeAdmin))
+	admin.POST(alertRulesEndpoint, handlers.PostAlertRule)
+	admin.PATCH(alertRuleEndpoint, handlers.PatchAlertRule)
+	admin.DELETE(alertRuleEndpoint, handlers.DeleteAlertRule)
+	admin.POST(webhooksEndpoint, handlers.PostWebhook)
+	admin.PATCH(webhookEndpoint, handlers.PatchWebhook)
+	admin.DELETE(webhookEndpoint, handlers.DeleteWebhook)
+	admin.POST(webhookTestEndpoint, handlers.PostWebhookTest)
+	admin.POST(emailTestEndpoint, handlers.PostEmailTest)
+	admin.POST(automationsEndpoint, handlers.PostAutomation)
+	admin.PATCH(automationEndpoint, handlers.PatchAutomation)
+	admin.DELETE(automationEndpoint, handlers.DeleteAutomation)
+	admin.POST(schedulesEndpoint, handlers.PostSchedule)
+	admin.PATCH(scheduleEndpoint, handlers.PatchSchedule)
+	admin.DELETE(scheduleEndpoint, handlers.DeleteSchedule)
+	admin.GET(adminKeysEndpoint, handlers.GetAPIKeys)
+	admin.POST(adminKeysEndpoint, handlers.PostAPIKey)
+	admin.GET(adminKeyEndpoint, handlers.GetAPIKey)
+	admin.PATCH(adminKeyEndpoint, handlers.PatchAPIKey)
+	admin.DELETE(adminKeyEndpoint, handlers.DeleteAPIKey)
+	admin.GET(adminUsersEndpoint, handlers.GetUsers)
+	admin.POST(adminUsersEndpoint, handlers.PostUser)
+	admin.GET(adminUserEndpoint, handlers.GetUser)
+	admin.PATCH(adminUserEndpoint, handlers.PatchUser)
+	admin.DELETE(adminUserEndpoint, handlers.DeleteUser)
+	admin.GET(adminStatusEndpoint, handlers.GetStatus)
+
+	// Requests are cancelled once the server shuts down, so that live streams, which never complete
+	// on their own, do not hold up the shutdown.
+	ctx, cancel := context.WithCancel(context.Background())
+	baseContext := func(net.Listener) context.Context { return ctx }
 
 	s := &http.Server{
-		Addr:    fmt.Sprintf(":%d", port),
-		Handler: server,
+		Addr:        fmt.Sprintf(":%d", port),
+		Handler:     server,
+		BaseContext: baseContext,
+	}
+	s.RegisterOnShutdown(cancel)
+
+	var tlsServer *http.Server
+	var certs *certReloader
+	if config.TLS != nil {
+		tlsPort := config.TLS.Port
+		if tlsPort == 0 {
+			tlsPort = 8443
+		}
+
+		certs, err = newCertReloader(config.TLS, log)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsServer = &http.Server{
+			Addr:        fmt.Sprintf(":%d", tlsPort),
+			Handler:     server,
+			TLSConfig:   certs.TLSConfig(),
+			BaseContext: baseContext,
+		}
+		tlsServer.RegisterOnShutdown(cancel)
+
+		if config.TLS.RedirectHTTP {
+			s.Handler = redirectToHTTPS(server, tlsPort)
+		} else {
+			s.Addr = fmt.Sprintf("localhost:%d", port)
+			s.Handler = requireLoopback(server)
+		}
 	}
 
 	return &HttpServer{
 		internalServer: s,
+		tlsServer:      tlsServer,
+		listener:       config.Listener,
+		tlsListener:    config.TLSListener,
+		limiter:        limiter,
+		bootstrapKey:   bootstrapKey,
+		certs:          certs,
 		log:            log,
 		Db:             db,
 	}, nil
 }
 
-// Start starts the HTTP server and listens for incoming requests. **This should be called in a separate goroutine.**
+// rateLimiterConfig fills in the defaults of the rate limits: 5 requests per second, with a burst of
+// twice that, and a limit on logging in to slow down password guessing, unless configured otherwise.
+func rateLimiterConfig(config middleware.RateLimiterConfig) *middleware.RateLimiterConfig {
+	if config.Default.PerSecond <= 0 {
+		config.Default.PerSecond = 5
+	}
+
+	if config.Default.Burst <= 0 {
+		config.Default.Burst = 2 * int(math.Ceil(config.Default.PerSecond))
+	}
+
+	loginRoute := http.MethodPost + " " + loginEndpoint
+	if _, ok := config.Routes[loginRoute]; !ok {
+		config.Routes = maps.Clone(config.Routes)
+		if config.Routes == nil {
+			config.Routes = map[string]middleware.Rate{}
+		}
+		config.Routes[loginRoute] = middleware.Rate{PerSecond: 0.2, Burst: 5}
+	}
+
+	return &config
+}
+
+// SetRateLimit replaces the rate limits, with the same defaults as [NewServer]. If they are invalid,
+// the rate limits are left unchanged.
+func (s *HttpServer) SetRateLimit(config middleware.RateLimiterConfig) error {
+	return s.limiter.Update(rateLimiterConfig(config))
+}
+
+// SetAPIKey replaces the bootstrap API key.
+func (s *HttpServer) SetAPIKey(key string) error {
+	if key == "" {
+		return errors.New("API key is required")
+	}
+
+	s.bootstrapKey.Store(&key)
+	return nil
+}
+
+// ReloadCertificates reloads the HTTPS certificate (and client CA) from disk now, rather than when
+// the files are next checked for changes. If reloading fails, the previous certificate is kept.
+func (s *HttpServer) ReloadCertificates() error {
+	if s.certs == nil {
+		return nil
+	}
+
+	return s.certs.reload()
+}
+
+// Start starts the HTTP server and listens for incoming requests, blocking until it is shut down
+// or fails. If HTTPS is configured, it is served as well, and the first of the two servers to fail
+// is returned once both have stopped, so that the server can be started again.
 func (s *HttpServer) Start() error {
-	s.log.Debugf("HTTP server listening on %s", s.internalServer.Addr)
-	if err := s.internalServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+	listener, err := s.listen(s.listener, s.internalServer)
+	if err != nil {
 		return errors.New("failed to start server: " + err.Error())
 	}
 
+	var tlsListener net.Listener
+	if s.tlsServer != nil {
+		if tlsListener, err = s.listen(s.tlsListener, s.tlsServer); err != nil {
+			listener.Close()
+			return errors.New("failed to start HTTPS server: " + err.Error())
+		}
+	}
+
+	s.listening.Store(true)
+	defer s.listening.Store(false)
+
+	// WebSocket clients reconnect once the server is restarted, rather than staying connected to a
+	// server that no longer listens.
+	defer handlers.CloseWebSockets(context.Background())
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+
+	// If either server fails, the listener of the other is closed so that it stops as well.
+	serve := func(name string, serve func() error, other net.Listener) {
+		defer wg.Done()
+
+		if err := serve(); err != nil && err != http.ErrServerClosed {
+			errs <- fmt.Errorf("failed to serve %s: %w", name, err)
+			if other != nil {
+				other.Close()
+			}
+		}
+	}
+
+	if tlsListener != nil {
+		wg.Add(1)
+		go serve("HTTPS", func() error {
+			s.log.Debugf("HTTPS server listening on %s", tlsListener.Addr())
+			return s.tlsServer.ServeTLS(tlsListener, "", "")
+		}, listener)
+	}
+
+	wg.Add(1)
+	go serve("HTTP", func() error {
+		s.log.Debugf("HTTP server listening on %s", listener.Addr())
+		return s.internalServer.Serve(listener)
+	}, tlsListener)
+
+	wg.Wait()
+	close(errs)
+
+	return <-errs
+}
+
+// listen returns the given listener (e.g. passed by systemd), or listens on the address of the server.
+func (s *HttpServer) listen(listener net.Listener, server *http.Server) (net.Listener, error) {
+	if listener != nil {
+		return listener, nil
+	}
+
+	return net.Listen("tcp", server.Addr)
+}
+
+// Health returns an error if the HTTP server is not listening for requests.
+func (s *HttpServer) Health() error {
+	if !s.listening.Load() {
+		return errors.New("HTTP server is not listening")
+	}
+
 	return nil
 }
 
 // Shutdown gracefully shuts down the HTTP server, allowing for any ongoing requests to complete.
+// Live streams and WebSockets are ended rather than waited for.
 func (s *HttpServer) Shutdown(ctx context.Context) error {
 	s.log.Debug("Shutting down HTTP server...")
-	return s.internalServer.Shutdown(ctx)
+
+	var tlsErr error
+	if s.tlsServer != nil {
+		tlsErr = s.tlsServer.Shutdown(ctx)
+	}
+
+	err := errors.Join(s.internalServer.Shutdown(ctx), tlsErr)
+	return errors.Join(err, handlers.CloseWebSockets(ctx))
 }
@@ -0,0 +1,704 @@
+package http
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"hafh-server/internal/alerts"
+	"hafh-server/internal/auth"
+	"hafh-server/internal/commands"
+	"hafh-server/internal/database"
+	"hafh-server/internal/health"
+	"hafh-server/internal/http/handlers"
+	"hafh-server/internal/http/middleware"
+	"hafh-server/internal/logger"
+	"hafh-server/internal/metrics"
+	"hafh-server/internal/stream"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func init() {
+	logger.Init(false)
+}
+
+const testBootstrapKey = "bootstrap"
+
+// publisher discards the commands sent to actuators.
+type publisher struct{}
+
+func (publisher) Publish(topic string, payload []byte) error { return nil }
+
+// newTestDatabase returns an in-memory database with an actuator "fan", closed when the test ends.
+func newTestDatabase(t *testing.T) *database.Database {
+	t.Helper()
+
+	db, err := database.New(":memory:")
+	if err != nil {
+		t.Fatalf("database.New() error = %v", err)
+	}
+
+	t.Cleanup(func() { db.Close() })
+
+	if err := db.AddPeripheral(&database.Peripheral{SerialNumber: "fan", Type: database.PeripheralTypeActuator}); err != nil {
+		t.Fatalf("AddPeripheral() error = %v", err)
+	}
+
+	return db
+}
+
+// newTestServer serves the API with generous rate limits, on config.Db if set (e.g. for components
+// that need it) or on a new [newTestDatabase] otherwise.
+func newTestServer(t *testing.T, config HttpServerConfig) (*httptest.Server, *database.Database) {
+	t.Helper()
+
+	s, db := newTestHttpServer(t, config)
+	server := httptest.NewServer(s.internalServer.Handler)
+	t.Cleanup(server.Close)
+	return server, db
+}
+
+// newTestHttpServer creates the server behind [newTestServer], for tests that start it themselves.
+func newTestHttpServer(t *testing.T, config HttpServerConfig) (*HttpServer, *database.Database) {
+	t.Helper()
+
+	db := config.Db
+	if db == nil {
+		db = newTestDatabase(t)
+	}
+
+	sender, err := commands.NewSender(db, publisher{}, "commands/")
+	if err != nil {
+		t.Fatalf("NewSender() error = %v", err)
+	}
+
+	hub, err := stream.NewHub(db)
+	if err != nil {
+		t.Fatalf("NewHub() error = %v", err)
+	}
+
+	config.ApiKey, config.Db, config.Commands, config.Stream = testBootstrapKey, db, sender, hub
+	if config.RateLimit.Default.PerSecond == 0 {
+		config.RateLimit.Default = middleware.Rate{PerSecond: 1000, Burst: 1000}
+	}
+
+	s, err := NewServer(&config)
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+
+	// Servers do not wait for WebSockets, whose handlers (and the middleware around them) must
+	// return before the next test initializes the handlers again.
+	var requests sync.WaitGroup
+	handler := s.internalServer.Handler
+	s.internalServer.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		defer requests.Done()
+
+		handler.ServeHTTP(w, r)
+	})
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := handlers.CloseWebSockets(ctx); err != nil {
+			t.Errorf("CloseWebSockets() error = %v", err)
+		}
+
+		requests.Wait()
+	})
+
+	return s, db
+}
+
+// addAPIKey creates an API key with the given scopes, returning the key.
+func addAPIKey(t *testing.T, db *database.Database, scopes ...database.Scope) string {
+	t.Helper()
+
+	key, prefix, hash, err := auth.GenerateAPIKey()
+	if err != nil {
+		t.Fatalf("GenerateAPIKey() error = %v", err)
+	}
+
+	if err := db.AddAPIKey(&database.APIKey{Name: "test", Prefix: prefix, Hash: hash, Scopes: scopes}); err != nil {
+		t.Fatalf("AddAPIKey() error = %v", err)
+	}
+
+	return key
+}
+
+// request makes a request with the given API key (if any), returning the status and body.
+func request(t *testing.T, server *httptest.Server, method, path, key, body string) (int, string) {
+	t.Helper()
+
+	header := http.Header{}
+	if key != "" {
+		header.Set("X-API-Key", key)
+	}
+
+	response, data := requestWithHeader(t, server, method, path, header, body)
+	return response.StatusCode, data
+}
+
+// requestWithHeader makes a request with the given header, returning the response and its body.
+func requestWithHeader(t *testing.T, server *httptest.Server, method, path string, header http.Header, body string) (*http.Response, string) {
+	t.Helper()
+
+	r, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("NewRequest() error = %v", err)
+	}
+
+	r.Header = header.Clone()
+	r.Header.Set("Content-Type", "application/json")
+
+	response, err := server.Client().Do(r)
+	if err != nil {
+		t.Fatalf("%s %s error = %v", method, path, err)
+	}
+
+	defer response.Body.Close()
+	data, _ := io.ReadAll(response.Body)
+	return response, string(data)
+}
+
+func TestScopes(t *testing.T) {
+	server, db := newTestServer(t, HttpServerConfig{})
+
+	keys := map[database.Scope]string{}
+	for _, scope := range []database.Scope{
+		database.ScopeReadReadings, database.ScopeWritePeripherals, database.ScopeSendCommands, database.ScopeAdmin,
+	} {
+		keys[scope] = addAPIKey(t, db, scope)
+	}
+
+	tests := []struct {
+		method, path, body string
+		// scope is the scope required by the route, or empty if any principal may use it.
+		scope database.Scope
+	}{
+		{"GET", "/api/v1/auth/me", "", ""},
+		{"GET", "/api/v1/peripherals", "", database.ScopeReadReadings},
+		// Querying readings only reads.
+		{"POST", "/api/v1/readings", `{"serialNumber": "fan", "numReadings": 1}`, database.ScopeReadReadings},
+		{"GET", "/api/v1/alerts", "", database.ScopeReadReadings},
+		{"GET", "/api/v1/ws", "", database.ScopeReadReadings},
+		{"POST", "/api/v1/peripherals", `{}`, database.ScopeWritePeripherals},
+		{"PATCH", "/api/v1/peripherals/fan", `{"name": "Fan"}`, database.ScopeWritePeripherals},
+		{"POST", "/api/v1/rooms", `{}`, database.ScopeWritePeripherals},
+		{"POST", "/api/v1/schedules/1/run", "", database.ScopeSendCommands},
+		{"POST", "/api/v1/alert-rules", `{}`, database.ScopeAdmin},
+		{"POST", "/api/v1/schedules", `{}`, database.ScopeAdmin},
+		{"GET", "/api/v1/admin/keys", "", database.ScopeAdmin},
+		{"GET", "/api/v1/admin/users", "", database.ScopeAdmin},
+	}
+
+	for _, tt := range tests {
+		for scope, key := range keys {
+			status, body := request(t, server, tt.method, tt.path, key, tt.body)
+			forbidden := status == http.StatusForbidden && strings.Contains(body, "Missing scope")
+			want := tt.scope != "" && scope != tt.scope && scope != database.ScopeAdmin
+			if forbidden != want {
+				t.Errorf("%s %s with %s: status %d (%s), want forbidden = %v", tt.method, tt.path, scope, status, body, want)
+			}
+		}
+
+		// The bootstrap key may do anything, and requests without a key nothing.
+		if status, body := request(t, server, tt.method, tt.path, testBootstrapKey, tt.body); status == http.StatusForbidden {
+			t.Errorf("%s %s with the bootstrap key: status %d (%s)", tt.method, tt.path, status, body)
+		}
+
+		if status, _ := request(t, server, tt.method, tt.path, "", tt.body); status != http.StatusForbidden {
+			t.Errorf("%s %s without a key: status %d, want %d", tt.method, tt.path, status, http.StatusForbidden)
+		}
+	}
+}
+
+func TestWebSocketCommandScope(t *testing.T) {
+	server, db := newTestServer(t, HttpServerConfig{})
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/v1/ws"
+
+	tests := []struct {
+		scopes []database.Scope
+		want   string
+	}{
+		{[]database.Scope{database.ScopeReadReadings}, "error"},
+		{[]database.Scope{database.ScopeReadReadings, database.ScopeSendCommands}, "command_sent"},
+		{[]database.Scope{database.ScopeAdmin}, "command_sent"},
+	}
+
+	for _, tt := range tests {
+		header := http.Header{"X-API-Key": {addAPIKey(t, db, tt.scopes...)}}
+		conn, _, err := websocket.DefaultDialer.Dial(url, header)
+		if err != nil {
+			t.Fatalf("Dial() error = %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if err := conn.WriteJSON(map[string]any{"type": "command", "serial_number": "fan", "command": "on"}); err != nil {
+			t.Fatalf("WriteJSON() error = %v", err)
+		}
+
+		var response struct {
+			Type  string `json:"type"`
+			Error string `json:"error"`
+		}
+		if err := conn.ReadJSON(&response); err != nil {
+			t.Fatalf("ReadJSON() error = %v", err)
+		}
+
+		if response.Type != tt.want {
+			t.Errorf("command with scopes %v: response %+v, want %s", tt.scopes, response, tt.want)
+		} else if tt.want == "error" && !strings.Contains(response.Error, string(database.ScopeSendCommands)) {
+			t.Errorf("command with scopes %v: error %q, want a missing scope", tt.scopes, response.Error)
+		}
+	}
+}
+
+// login logs in, returning the response and the session token (if any).
+func login(t *testing.T, server *httptest.Server, username, password string) (*http.Response, string) {
+	t.Helper()
+
+	body, _ := json.Marshal(map[string]string{"username": username, "password": password})
+	response, data := requestWithHeader(t, server, "POST", "/api/v1/auth/login", http.Header{}, string(body))
+
+	var session struct {
+		Token string `json:"token"`
+	}
+	json.Unmarshal([]byte(data), &session)
+	return response, session.Token
+}
+
+func addUser(t *testing.T, db *database.Database, username, password string, role database.Role) *database.User {
+	t.Helper()
+
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		t.Fatalf("HashPassword() error = %v", err)
+	}
+
+	user := &database.User{Username: username, PasswordHash: hash, Role: role}
+	if err := db.AddUser(user); err != nil {
+		t.Fatalf("AddUser() error = %v", err)
+	}
+
+	return user
+}
+
+func bearer(token string) http.Header {
+	return http.Header{"Authorization": {"Bearer " + token}}
+}
+
+func TestLogin(t *testing.T) {
+	server, db := newTestServer(t, HttpServerConfig{})
+	addUser(t, db, "alice", "correct horse", database.RoleViewer)
+
+	for _, credentials := range [][2]string{{"alice", "wrong password"}, {"mallory", "correct horse"}} {
+		if response, token := login(t, server, credentials[0], credentials[1]); response.StatusCode != http.StatusUnauthorized || token != "" {
+			t.Errorf("login as %s with %q: status %d, want %d", credentials[0], credentials[1], response.StatusCode, http.StatusUnauthorized)
+		}
+	}
+
+	response, token := login(t, server, "alice", "correct horse")
+	if response.StatusCode != http.StatusOK || token == "" {
+		t.Fatalf("login: status %d, token %q", response.StatusCode, token)
+	}
+
+	var cookie *http.Cookie
+	for _, c := range response.Cookies() {
+		if c.Name == middleware.SessionCookie {
+			cookie = c
+		}
+	}
+
+	if cookie == nil || cookie.Value != token || !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode {
+		t.Fatalf("session cookie = %+v", cookie)
+	}
+
+	// The session authenticates with either the header or the cookie.
+	for name, header := range map[string]http.Header{
+		"bearer": bearer(token),
+		"cookie": {"Cookie": {cookie.String()}},
+	} {
+		response, body := requestWithHeader(t, server, "GET", "/api/v1/auth/me", header, "")
+		if response.StatusCode != http.StatusOK || !strings.Contains(body, `"name":"alice"`) {
+			t.Errorf("GET /api/v1/auth/me with the %s: status %d (%s)", name, response.StatusCode, body)
+		}
+	}
+
+	if response, body := requestWithHeader(t, server, "GET", "/api/v1/auth/me", bearer("not a session"), ""); response.StatusCode != http.StatusUnauthorized {
+		t.Errorf("GET /api/v1/auth/me with an unknown token: status %d (%s)", response.StatusCode, body)
+	}
+
+	if response, _ := requestWithHeader(t, server, "POST", "/api/v1/auth/logout", bearer(token), ""); response.StatusCode != http.StatusOK {
+		t.Fatalf("logout: status %d", response.StatusCode)
+	}
+
+	if response, _ := requestWithHeader(t, server, "GET", "/api/v1/auth/me", bearer(token), ""); response.StatusCode != http.StatusUnauthorized {
+		t.Errorf("GET /api/v1/auth/me after logging out: status %d, want %d", response.StatusCode, http.StatusUnauthorized)
+	}
+}
+
+func TestRoles(t *testing.T) {
+	server, db := newTestServer(t, HttpServerConfig{})
+
+	tests := []struct {
+		role database.Role
+		// read, write, command and admin are whether the role may read peripherals, delete a
+		// peripheral, run a schedule and list users.
+		read, write, command, admin bool
+	}{
+		{database.RoleViewer, true, false, false, false},
+		{database.RoleOperator, true, false, true, false},
+		{database.RoleAdmin, true, true, true, true},
+	}
+
+	for _, tt := range tests {
+		addUser(t, db, string(tt.role), "correct horse", tt.role)
+		_, token := login(t, server, string(tt.role), "correct horse")
+
+		for _, route := range []struct {
+			method, path string
+			allowed      bool
+		}{
+			{"GET", "/api/v1/peripherals", tt.read},
+			{"DELETE", "/api/v1/peripherals/missing", tt.write},
+			{"POST", "/api/v1/schedules/1000/run", tt.command},
+			{"GET", "/api/v1/admin/users", tt.admin},
+		} {
+			response, body := requestWithHeader(t, server, route.method, route.path, bearer(token), "")
+			forbidden := response.StatusCode == http.StatusForbidden
+			if forbidden == route.allowed {
+				t.Errorf("%s %s as %s: status %d (%s), want allowed = %v", route.method, route.path, tt.role, response.StatusCode, body, route.allowed)
+			}
+		}
+	}
+}
+
+func TestPasswordChangeEndsSessions(t *testing.T) {
+	server, db := newTestServer(t, HttpServerConfig{})
+	alice := addUser(t, db, "alice", "correct horse", database.RoleViewer)
+	_, token := login(t, server, "alice", "correct horse")
+
+	status, body := request(t, server, "PATCH", "/api/v1/admin/users/"+strconv.FormatInt(alice.ID, 10), testBootstrapKey,
+		`{"password": "battery staple"}`)
+	if status != http.StatusOK {
+		t.Fatalf("PATCH user: status %d (%s)", status, body)
+	}
+
+	if response, _ := requestWithHeader(t, server, "GET", "/api/v1/auth/me", bearer(token), ""); response.StatusCode != http.StatusUnauthorized {
+		t.Errorf("GET /api/v1/auth/me after changing the password: status %d, want %d", response.StatusCode, http.StatusUnauthorized)
+	}
+
+	if response, _ := login(t, server, "alice", "battery staple"); response.StatusCode != http.StatusOK {
+		t.Errorf("login with the new password: status %d", response.StatusCode)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	server, db := newTestServer(t, HttpServerConfig{RateLimit: middleware.RateLimiterConfig{
+		Default: middleware.Rate{PerSecond: 0.001, Burst: 2},
+		Routes:  map[string]middleware.Rate{"GET " + versionEndpoint: {PerSecond: 0.001, Burst: 1}},
+	}})
+
+	get := func(path, key string) *http.Response {
+		t.Helper()
+
+		response, _ := requestWithHeader(t, server, "GET", path, http.Header{"X-Api-Key": {key}}, "")
+		return response
+	}
+
+	// Every API key has its own bucket.
+	alice, bob := addAPIKey(t, db, database.ScopeReadReadings), addAPIKey(t, db, database.ScopeReadReadings)
+	for i, want := range []string{"1", "0"} {
+		response := get(meEndpoint, alice)
+		if response.StatusCode != http.StatusOK || response.Header.Get("RateLimit-Limit") != "2" ||
+			response.Header.Get("RateLimit-Remaining") != want {
+			t.Errorf("request %d: status %d, headers %v", i+1, response.StatusCode, response.Header)
+		}
+	}
+
+	if response := get(meEndpoint, alice); response.StatusCode != http.StatusTooManyRequests ||
+		response.Header.Get("Retry-After") == "" {
+		t.Errorf("request over the limit: status %d, headers %v", response.StatusCode, response.Header)
+	}
+
+	// Routes are limited on top of the client's limit.
+	if response := get(versionEndpoint, bob); response.StatusCode != http.StatusOK {
+		t.Errorf("GET %s with another key: status %d, want %d", versionEndpoint, response.StatusCode, http.StatusOK)
+	}
+
+	if response := get(versionEndpoint, bob); response.StatusCode != http.StatusTooManyRequests ||
+		response.Header.Get("RateLimit-Limit") != "1" {
+		t.Errorf("GET %s over its limit: status %d, headers %v", versionEndpoint, response.StatusCode, response.Header)
+	}
+
+	if response := get(meEndpoint, bob); response.StatusCode != http.StatusOK {
+		t.Errorf("GET %s after the route's limit: status %d, want %d", meEndpoint, response.StatusCode, http.StatusOK)
+	}
+
+	// Failed authentications are limited by IP address, and the requests above did not count.
+	carol := addAPIKey(t, db, database.ScopeReadReadings)
+	for _, want := range []int{http.StatusForbidden, http.StatusForbidden, http.StatusTooManyRequests} {
+		if response := get(meEndpoint, "hafh_guessed"); response.StatusCode != want {
+			t.Errorf("GET %s with an invalid key: status %d, want %d", meEndpoint, response.StatusCode, want)
+		}
+	}
+
+	// A correct guess is rejected as well.
+	if response := get(meEndpoint, carol); response.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("GET %s after failed authentications: status %d, want %d", meEndpoint, response.StatusCode,
+			http.StatusTooManyRequests)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	server, db := newTestServer(t, HttpServerConfig{HealthChecks: []health.Check{
+		{Name: "database", Check: func(context.Context) error { return nil }, Liveness: true},
+		{Name: "ngrok", Check: func(context.Context) error { return errors.New("secret detail") }},
+	}})
+
+	tests := []struct {
+		path       string
+		wantStatus int
+		wantBody   string
+	}{
+		{healthEndpoint, http.StatusOK, `{"checks":{"database":"ok"},"status":"ok"}`},
+		{readinessEndpoint, http.StatusServiceUnavailable, `{"checks":{"database":"ok","ngrok":"failing"},"status":"failing"}`},
+	}
+
+	// The health endpoints are not authenticated, so they do not reveal why a check fails.
+	for _, tt := range tests {
+		if status, body := request(t, server, "GET", tt.path, "", ""); status != tt.wantStatus || body != tt.wantBody {
+			t.Errorf("GET %s: status %d (%s), want %d (%s)", tt.path, status, body, tt.wantStatus, tt.wantBody)
+		}
+	}
+
+	if status, _ := request(t, server, "GET", adminStatusEndpoint, addAPIKey(t, db, database.ScopeReadReadings), ""); status != http.StatusForbidden {
+		t.Errorf("GET %s without the admin scope: status %d, want %d", adminStatusEndpoint, status, http.StatusForbidden)
+	}
+
+	status, body := request(t, server, "GET", adminStatusEndpoint, testBootstrapKey, "")
+	if status != http.StatusOK {
+		t.Fatalf("GET %s: status %d (%s)", adminStatusEndpoint, status, body)
+	}
+
+	var response struct {
+		Checks   map[string]string `json:"checks"`
+		Database struct {
+			RowCounts map[string]int64 `json:"row_counts"`
+		} `json:"database"`
+		Versions map[string]string `json:"versions"`
+	}
+
+	if err := json.Unmarshal([]byte(body), &response); err != nil {
+		t.Fatalf("json.Unmarshal() error = %v", err)
+	}
+
+	if response.Checks["ngrok"] != "secret detail" || response.Database.RowCounts["peripherals"] != 1 ||
+		response.Versions["api"] == "" {
+		t.Errorf("GET %s = %s", adminStatusEndpoint, body)
+	}
+}
+
+func TestDeleteAlertRuleResolvesAlerts(t *testing.T) {
+	db := newTestDatabase(t)
+	engine, err := alerts.NewEngine(db)
+	if err != nil {
+		t.Fatalf("NewEngine() error = %v", err)
+	}
+
+	var mu sync.Mutex
+	var notified []database.AlertState
+	engine.OnAlert(func(alert *database.Alert) {
+		mu.Lock()
+		defer mu.Unlock()
+		notified = append(notified, alert.State)
+	})
+
+	server, _ := newTestServer(t, HttpServerConfig{Db: db, Alerts: engine})
+
+	rule := &database.AlertRule{Name: "too hot", Field: "t", Comparison: database.ComparisonGreater, Threshold: 30, Enabled: true}
+	if err := db.AddAlertRule(rule); err != nil {
+		t.Fatalf("AddAlertRule() error = %v", err)
+	}
+
+	engine.Evaluate(&database.Reading{SerialNumber: "fan", Data: map[string]any{"t": 35.0}}, &database.Peripheral{SerialNumber: "fan"})
+
+	path := "/api/v1/alert-rules/" + strconv.FormatInt(rule.ID, 10)
+	if status, body := request(t, server, "DELETE", path, testBootstrapKey, ""); status != http.StatusOK {
+		t.Fatalf("DELETE %s: status %d (%s)", path, status, body)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	// The alert is resolved before it is deleted along with its rule, so that its listeners (e.g.
+	// webhooks) are told that it no longer fires.
+	if len(notified) != 2 || notified[1] != database.AlertStateResolved {
+		t.Errorf("notified %v, want firing then resolved", notified)
+	}
+}
+
+func TestShutdownEndsStreams(t *testing.T) {
+	s, _ := newTestHttpServer(t, HttpServerConfig{})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+
+	s.listener = listener
+	stopped := make(chan error, 1)
+	go func() { stopped <- s.Start() }()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+listener.Addr().String()+"/api/v1/ws",
+		http.Header{"X-API-Key": {testBootstrapKey}})
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	r, err := http.NewRequest("GET", "http://"+listener.Addr().String()+"/api/v1/stream", nil)
+	if err != nil {
+		t.Fatalf("NewRequest() error = %v", err)
+	}
+
+	r.Header.Set("X-API-Key", testBootstrapKey)
+	response, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatalf("GET /api/v1/stream error = %v", err)
+	}
+
+	defer response.Body.Close()
+	if line, err := bufio.NewReader(response.Body).ReadString('\n'); err != nil || !strings.HasPrefix(line, "retry:") {
+		t.Fatalf("stream started with %q, %v, want a retry interval", line, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown() with an open stream and WebSocket error = %v", err)
+	}
+
+	if err := <-stopped; err != nil {
+		t.Errorf("Start() error = %v", err)
+	}
+
+	if _, err := io.ReadAll(response.Body); err != nil {
+		t.Errorf("reading the rest of the stream error = %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Errorf("ReadMessage() after Shutdown() error = %v, want a normal closure", err)
+	}
+}
+
+func TestMetricsMethodLabel(t *testing.T) {
+	server, _ := newTestServer(t, HttpServerConfig{})
+
+	request(t, server, "BREW", "/api/v1/peripherals", testBootstrapKey, "")
+
+	var b strings.Builder
+	if _, err := metrics.Default.WriteTo(&b); err != nil {
+		t.Fatalf("WriteTo() error = %v", err)
+	}
+
+	if exposition := b.String(); strings.Contains(exposition, `method="BREW"`) ||
+		!strings.Contains(exposition, `hafh_http_requests_total{method="other"`) {
+		t.Errorf("a request with a non-standard method was not labelled \"other\":\n%s", exposition)
+	}
+}
+
+func TestStreamReplaysEveryMissedReading(t *testing.T) {
+	server, db := newTestServer(t, HttpServerConfig{})
+
+	// More readings are missed than are replayed at a time.
+	var ids []int
+	for i := range 2*1000 + 5 {
+		reading := &database.Reading{SerialNumber: "fan", Data: map[string]any{"on": float64(i)}}
+		if err := db.InsertReading(reading); err != nil {
+			t.Fatalf("InsertReading() error = %v", err)
+		}
+		ids = append(ids, reading.ID)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	r, err := http.NewRequestWithContext(ctx, "GET", server.URL+"/api/v1/stream?lastEventId="+strconv.Itoa(ids[0]), nil)
+	if err != nil {
+		t.Fatalf("NewRequest() error = %v", err)
+	}
+
+	r.Header.Set("X-API-Key", testBootstrapKey)
+	response, err := server.Client().Do(r)
+	if err != nil {
+		t.Fatalf("GET /api/v1/stream error = %v", err)
+	}
+
+	defer response.Body.Close()
+
+	want := ids[1:]
+	var got []int
+	scanner := bufio.NewScanner(response.Body)
+	for len(got) < len(want) && scanner.Scan() {
+		if id, ok := strings.CutPrefix(scanner.Text(), "id: "); ok {
+			n, _ := strconv.Atoi(id)
+			got = append(got, n)
+		}
+	}
+
+	if !slices.Equal(got, want) {
+		t.Errorf("replayed %d readings (error %v), want %d from %d to %d", len(got), scanner.Err(), len(want),
+			want[0], want[len(want)-1])
+	}
+}
+
+func TestRateLimitIgnoresSpoofedForwarding(t *testing.T) {
+	s, _ := newTestHttpServer(t, HttpServerConfig{RateLimit: middleware.RateLimiterConfig{
+		Default: middleware.Rate{PerSecond: 0.001, Burst: 2},
+	}})
+
+	get := func(remoteAddr, forwardedFor string) int {
+		t.Helper()
+
+		r := httptest.NewRequest("GET", meEndpoint, nil)
+		r.RemoteAddr = remoteAddr
+		r.Header.Set("X-Api-Key", "hafh_guessed")
+		r.Header.Set("X-Forwarded-For", forwardedFor)
+
+		w := httptest.NewRecorder()
+		s.internalServer.Handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// A client on the network shares one bucket, whatever address it claims to forward for.
+	for i, want := range []int{http.StatusForbidden, http.StatusForbidden, http.StatusTooManyRequests} {
+		if status := get("192.168.1.20:1234", "10.0.0."+strconv.Itoa(i)); status != want {
+			t.Errorf("request %d from the network: status %d, want %d", i+1, status, want)
+		}
+	}
+
+	// The forwarder on this host forwards for clients with buckets of their own.
+	for i := range 3 {
+		if status := get("127.0.0.1:1234", "203.0.113."+strconv.Itoa(i)); status != http.StatusForbidden {
+			t.Errorf("request %d forwarded from this host: status %d, want %d", i+1, status, http.StatusForbidden)
+		}
+	}
+}
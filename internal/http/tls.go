@@ -0,0 +1,253 @@
+package http
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// certCheckInterval is how often the certificate files are checked for changes.
+const certCheckInterval = 10 * time.Second
+
+// TLSConfig holds the configuration for serving HTTPS.
+type TLSConfig struct {
+	// Port is the port to serve HTTPS on, defaulting to 8443.
+	Port     int
+	CertPath string
+	KeyPath  string
+	// ClientCAPath, if set, requires clients to present a certificate signed by this CA.
+	ClientCAPath string
+	// MinVersion is the minimum TLS version ("1.0", "1.1", "1.2" or "1.3"), defaulting to "1.2".
+	MinVersion string
+	// RedirectHTTP redirects plain HTTP requests to HTTPS, except those from the loopback interface
+	// (e.g. the ngrok forwarder). Otherwise, plain HTTP is only served on the loopback interface.
+	RedirectHTTP bool
+}
+
+// tlsVersions are the TLS versions that can be configured as the minimum.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// certReloader serves the certificate (and client CA) on disk, reloading them when the files
+// change so that renewed certificates are picked up without a restart.
+type certReloader struct {
+	certPath   string
+	keyPath    string
+	caPath     string
+	minVersion uint16
+	log        *zap.SugaredLogger
+
+	mu        sync.Mutex
+	config    *tls.Config
+	modTimes  []time.Time
+	lastCheck time.Time
+}
+
+// newCertReloader loads the certificate (and client CA), failing if they cannot be loaded.
+func newCertReloader(config *TLSConfig, log *zap.SugaredLogger) (*certReloader, error) {
+	minVersion := uint16(tls.VersionTLS12)
+	if config.MinVersion != "" {
+		version, ok := tlsVersions[config.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown minimum TLS version: %s", config.MinVersion)
+		}
+
+		minVersion = version
+	}
+
+	r := &certReloader{
+		certPath:   config.CertPath,
+		keyPath:    config.KeyPath,
+		caPath:     config.ClientCAPath,
+		minVersion: minVersion,
+		log:        log,
+	}
+
+	modTimes, err := r.statFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	if r.config, err = r.load(); err != nil {
+		return nil, err
+	}
+
+	r.modTimes = modTimes
+	r.lastCheck = time.Now()
+
+	return r, nil
+}
+
+// TLSConfig returns the configuration of the HTTPS server, which asks the reloader for the current
+// certificate on every connection.
+func (r *certReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: r.minVersion,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.current(time.Now()), nil
+		},
+	}
+}
+
+// current returns the configuration with the current certificate, reloading it if the files have
+// changed since they were last checked. If reloading fails, the previous certificate is kept.
+func (r *certReloader) current(now time.Time) *tls.Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if now.Sub(r.lastCheck) < certCheckInterval {
+		return r.config
+	}
+
+	r.lastCheck = now
+	if err := r.reloadIfChanged(); err != nil {
+		// The files may be halfway through being replaced, so they are checked again next time.
+		r.log.Error("Failed to reload TLS certificate: ", err)
+	}
+
+	return r.config
+}
+
+// reload reloads the certificate now if the files have changed, e.g. when the configuration is
+// reloaded. If reloading fails, the previous certificate is kept.
+func (r *certReloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.lastCheck = time.Now()
+	return r.reloadIfChanged()
+}
+
+// reloadIfChanged reloads the certificate if the files have changed. The lock must be held.
+func (r *certReloader) reloadIfChanged() error {
+	modTimes, err := r.statFiles()
+	if err != nil {
+		return err
+	} else if slices.EqualFunc(modTimes, r.modTimes, time.Time.Equal) {
+		return nil
+	}
+
+	config, err := r.load()
+	if err != nil {
+		return err
+	}
+
+	r.log.Info("Reloaded TLS certificate")
+	r.config = config
+	r.modTimes = modTimes
+
+	return nil
+}
+
+// load loads the certificate (and client CA) from disk.
+func (r *certReloader) load() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(r.certPath, r.keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("loading cert/key: %w", err)
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   r.minVersion,
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+
+	if r.caPath != "" {
+		caCert, err := os.ReadFile(r.caPath)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA cert: %w", err)
+		}
+
+		caPool := x509.NewCertPool()
+		if !caPool.AppendCertsFromPEM(caCert) {
+			return nil, errors.New("appending CA cert")
+		}
+
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		config.ClientCAs = caPool
+	}
+
+	return config, nil
+}
+
+// statFiles returns the modification times of the certificate files.
+func (r *certReloader) statFiles() ([]time.Time, error) {
+	paths := []string{r.certPath, r.keyPath}
+	if r.caPath != "" {
+		paths = append(paths, r.caPath)
+	}
+
+	modTimes := make([]time.Time, len(paths))
+	for i, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+
+		modTimes[i] = info.ModTime()
+	}
+
+	return modTimes, nil
+}
+
+// redirectToHTTPS serves requests from the loopback interface (e.g. the ngrok forwarder, which
+// terminates TLS itself) with the handler, and redirects every other request to HTTPS.
+func redirectToHTTPS(handler http.Handler, httpsPort int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fromLoopback(r) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+
+		if httpsPort != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(httpsPort))
+		}
+
+		// 308 keeps the method and body of the request.
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
+
+// requireLoopback serves requests from the loopback interface with the handler, and rejects every
+// other request. Plain HTTP only listens on localhost then, but a socket passed by systemd may be
+// listening on any interface.
+func requireLoopback(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !fromLoopback(r) {
+			http.Error(w, "Plain HTTP is only served to this host, use HTTPS instead", http.StatusForbidden)
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// fromLoopback returns true if the request was made from the loopback interface.
+func fromLoopback(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
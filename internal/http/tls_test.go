@@ -0,0 +1,164 @@
+package http
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"hafh-server/internal/logger"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert writes a new self-signed certificate for the common name and its key to the paths,
+// with the given modification time.
+func writeCert(t *testing.T, certPath, keyPath, commonName string, modTime time.Time) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate() error = %v", err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey() error = %v", err)
+	}
+
+	for path, block := range map[string]*pem.Block{
+		certPath: {Type: "CERTIFICATE", Bytes: der},
+		keyPath:  {Type: "EC PRIVATE KEY", Bytes: keyDER},
+	} {
+		if err := os.WriteFile(path, pem.EncodeToMemory(block), 0o600); err != nil {
+			t.Fatalf("WriteFile() error = %v", err)
+		} else if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatalf("Chtimes() error = %v", err)
+		}
+	}
+}
+
+// commonName returns the common name of the certificate of a TLS configuration.
+func commonName(t *testing.T, config *tls.Config) string {
+	t.Helper()
+
+	cert, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatalf("ParseCertificate() error = %v", err)
+	}
+
+	return cert.Subject.CommonName
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	modTime := time.Now().Add(-time.Hour)
+	writeCert(t, certPath, keyPath, "first", modTime)
+
+	r, err := newCertReloader(&TLSConfig{CertPath: certPath, KeyPath: keyPath}, logger.Named("test"))
+	if err != nil {
+		t.Fatalf("newCertReloader() error = %v", err)
+	}
+
+	now := time.Now()
+	if config := r.current(now); commonName(t, config) != "first" || config.MinVersion != tls.VersionTLS12 {
+		t.Errorf("current() = %s, version %x, want first with TLS 1.2", commonName(t, config), config.MinVersion)
+	}
+
+	// Renewed certificates are picked up once the files are next checked.
+	writeCert(t, certPath, keyPath, "second", modTime.Add(time.Minute))
+	if got := commonName(t, r.current(now.Add(time.Second))); got != "first" {
+		t.Errorf("current() before the next check = %s, want first", got)
+	}
+
+	if got := commonName(t, r.current(now.Add(certCheckInterval+time.Second))); got != "second" {
+		t.Errorf("current() after the next check = %s, want second", got)
+	}
+
+	// The previous certificate is kept if the files cannot be loaded.
+	if err := os.WriteFile(keyPath, []byte("not a key"), 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	if err := r.reload(); err == nil {
+		t.Error("reload() of an invalid key error = nil, want an error")
+	}
+
+	if got := commonName(t, r.current(time.Now())); got != "second" {
+		t.Errorf("current() after failing to reload = %s, want second", got)
+	}
+}
+
+func TestNewCertReloaderValidatesConfig(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	writeCert(t, certPath, keyPath, "server", time.Now())
+
+	tests := []*TLSConfig{
+		{CertPath: certPath, KeyPath: keyPath, MinVersion: "1.4"},
+		{CertPath: certPath, KeyPath: filepath.Join(dir, "missing.key")},
+		{CertPath: certPath, KeyPath: keyPath, ClientCAPath: keyPath},
+	}
+
+	for _, config := range tests {
+		if _, err := newCertReloader(config, logger.Named("test")); err == nil {
+			t.Errorf("newCertReloader(%+v) error = nil, want an error", config)
+		}
+	}
+}
+
+func TestPlainHTTP(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	tests := []struct {
+		name       string
+		handler    http.Handler
+		remoteAddr string
+		wantStatus int
+		wantURL    string
+	}{
+		{"redirect from loopback", redirectToHTTPS(handler, 8443), "127.0.0.1:1234", http.StatusNoContent, ""},
+		{"redirect from IPv6 loopback", redirectToHTTPS(handler, 8443), "[::1]:1234", http.StatusNoContent, ""},
+		{"redirect from the network", redirectToHTTPS(handler, 8443), "192.168.1.20:1234",
+			http.StatusPermanentRedirect, "https://hafh.local:8443/api/v1/peripherals?limit=1"},
+		{"redirect to the default port", redirectToHTTPS(handler, 443), "192.168.1.20:1234",
+			http.StatusPermanentRedirect, "https://hafh.local/api/v1/peripherals?limit=1"},
+		{"loopback only from loopback", requireLoopback(handler), "127.0.0.1:1234", http.StatusNoContent, ""},
+		{"loopback only from the network", requireLoopback(handler), "192.168.1.20:1234", http.StatusForbidden, ""},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "http://hafh.local:8080/api/v1/peripherals?limit=1", nil)
+		r.RemoteAddr = tt.remoteAddr
+
+		w := httptest.NewRecorder()
+		tt.handler.ServeHTTP(w, r)
+
+		if w.Code != tt.wantStatus || w.Header().Get("Location") != tt.wantURL {
+			t.Errorf("%s: status %d, location %q, want %d, %q", tt.name, w.Code, w.Header().Get("Location"),
+				tt.wantStatus, tt.wantURL)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package ingest
+
+import (
+	"errors"
+	"hafh-server/internal/database"
+	"hafh-server/internal/events"
+	"hafh-server/internal/expr"
+	"hafh-server/internal/logger"
+	"math"
+
+	"go.uber.org/zap"
+)
+
+// ReadingListener is notified of every reading after it has been stored, along with the peripheral
+// that reported it.
+type ReadingListener func(reading *database.Reading, peripheral *database.Peripheral)
+
+// Processor is the ingest path for readings reported by peripherals. It registers unknown
+// peripherals, applies calibrations and derived fields, stores the reading, and notifies any
+// listeners.
+type Processor struct {
+	db        *database.Database
+	bus       *events.Bus
+	log       *zap.SugaredLogger
+	listeners []ReadingListener
+}
+
+// NewProcessor creates a new [Processor] that stores readings in the given database and publishes
+// events on the given bus (which may be nil).
+func NewProcessor(db *database.Database, bus *events.Bus) (*Processor, error) {
+	if db == nil {
+		return nil, errors.New("database is required")
+	}
+
+	return &Processor{
+		db:  db,
+		bus: bus,
+		log: logger.Named("ingest"),
+	}, nil
+}
+
+// OnReading registers a listener that is called (synchronously) for every stored reading. This is
+// not safe to call concurrently with [Processor.Process], so listeners should be registered before
+// the processor is in use.
+func (p *Processor) OnReading(listener ReadingListener) {
+	p.listeners = append(p.listeners, listener)
+}
+
+// RejectedPayload is the data of a [events.PayloadRejected] event.
+type RejectedPayload struct {
+	Topic   string `json:"topic"`
+	Payload string `json:"payload"`
+	Error   string `json:"error"`
+}
+
+// ProcessPayload parses a JSON reading payload received on the given topic and runs it through the
+// ingest path. Payloads that cannot be ingested are reported on the event bus.
+func (p *Processor) ProcessPayload(topic string, payload []byte) error {
+	reading, err := database.ReadingFromJson(payload)
+	if err != nil {
+		ingestErrors.Inc("parse")
+	} else {
+		err = p.Process(reading)
+	}
+
+	if err != nil {
+		p.bus.Publish(events.New(events.PayloadRejected, RejectedPayload{
+			Topic:   topic,
+			Payload: string(payload),
+			Error:   err.Error(),
+		}))
+	}
+
+	return err
+}
+
+// Process runs a reading through the ingest path and stores it.
+func (p *Processor) Process(reading *database.Reading) error {
+	if err := p.process(reading); err != nil {
+		ingestErrors.Inc("process")
+		return err
+	}
+
+	readingsIngested.Inc()
+	return nil
+}
+
+func (p *Processor) process(reading *database.Reading) error {
+	if reading == nil || reading.SerialNumber == "" {
+		return errors.New("reading must have a serial number")
+	}
+
+	// If the peripheral does not exist, create it.
+	peripheral, err := p.db.GetPeripheralBySerial(reading.SerialNumber)
+	if err != nil {
+		return err
+	} else if peripheral == nil {
+		if err := p.db.AddPeripheral(&database.Peripheral{
+			SerialNumber: reading.SerialNumber,
+			Type:         database.PeripheralTypeUnknown,
+		}); err != nil {
+			return err
+		}
+
+		p.log.Infof("Added new peripheral: %s", reading.SerialNumber)
+
+		if peripheral, err = p.db.GetPeripheralBySerial(reading.SerialNumber); err != nil {
+			return err
+		}
+
+		p.bus.Publish(events.New(events.PeripheralRegistered, peripheral))
+	}
+
+	if err := p.calibrate(reading); err != nil {
+		return err
+	}
+
+	if err := p.derive(reading); err != nil {
+		return err
+	}
+
+	// Insert the reading into the database.
+	if err := p.db.InsertReading(reading); err != nil {
+		return err
+	}
+
+	p.log.Infof("Inserted reading: %s", reading.String())
+
+	for _, listener := range p.listeners {
+		listener(reading, peripheral)
+	}
+
+	return nil
+}
+
+// calibrate applies the peripheral's calibrations to the reading in place, preserving the original
+// values in reading.Raw.
+func (p *Processor) calibrate(reading *database.Reading) error {
+	// Raw values are only ever set by the server, never by the peripheral.
+	reading.Raw = nil
+
+	calibrations, err := p.db.GetCalibrations(reading.SerialNumber)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range calibrations {
+		value, ok := reading.Data[c.Field].(float64)
+		if !ok {
+			continue
+		}
+
+		if reading.Raw == nil {
+			reading.Raw = map[string]any{}
+		}
+
+		reading.Raw[c.Field] = value
+		reading.Data[c.Field] = c.Apply(value)
+	}
+
+	return nil
+}
+
+// derive computes the peripheral's derived fields and adds them to the reading. A derived field
+// whose inputs are missing from the reading is skipped.
+func (p *Processor) derive(reading *database.Reading) error {
+	fields, err := p.db.GetDerivedFields(reading.SerialNumber)
+	if err != nil || len(fields) == 0 {
+		return err
+	}
+
+	vars := NumericFields(reading.Data)
+	for _, f := range fields {
+		expression, err := expr.Parse(f.Expression)
+		if err != nil {
+			p.log.Warnf("Skipping invalid derived field %s for %s: %v", f.Name, reading.SerialNumber, err)
+			continue
+		}
+
+		value, err := expression.Eval(vars)
+		if err != nil {
+			p.log.Debugf("Skipping derived field %s for %s: %v", f.Name, reading.SerialNumber, err)
+			continue
+		} else if math.IsNaN(value) || math.IsInf(value, 0) {
+			p.log.Debugf("Skipping derived field %s for %s: not a finite number", f.Name, reading.SerialNumber)
+			continue
+		}
+
+		reading.Data[f.Name] = value
+		vars[f.Name] = value
+	}
+
+	return nil
+}
+
+// NumericFields returns the numeric (and boolean, as 0 or 1) top-level fields of reading data, for
+// use as expression variables.
+func NumericFields(data map[string]any) map[string]float64 {
+	vars := make(map[string]float64, len(data))
+	for key, value := range data {
+		switch v := value.(type) {
+		case float64:
+			vars[key] = v
+		case bool:
+			if v {
+				vars[key] = 1
+			} else {
+				vars[key] = 0
+			}
+		}
+	}
+
+	return vars
+}
@@ -0,0 +1,123 @@
+package ingest
+
+import (
+	"hafh-server/internal/database"
+	"hafh-server/internal/logger"
+	"reflect"
+	"testing"
+)
+
+func init() {
+	logger.Init(false)
+}
+
+func newTestProcessor(t *testing.T) (*Processor, *database.Database) {
+	t.Helper()
+
+	db, err := database.New(":memory:")
+	if err != nil {
+		t.Fatalf("database.New() error = %v", err)
+	}
+
+	t.Cleanup(func() { db.Close() })
+
+	processor, err := NewProcessor(db, nil)
+	if err != nil {
+		t.Fatalf("NewProcessor() error = %v", err)
+	}
+
+	return processor, db
+}
+
+// lastReading returns the latest stored reading of a peripheral.
+func lastReading(t *testing.T, db *database.Database, serial string) database.Reading {
+	t.Helper()
+
+	readings, err := db.GetLastReadings(serial, 1)
+	if err != nil {
+		t.Fatalf("GetLastReadings() error = %v", err)
+	} else if len(readings) != 1 {
+		t.Fatalf("%d readings of %s, want 1", len(readings), serial)
+	}
+
+	return readings[0]
+}
+
+func TestProcess(t *testing.T) {
+	processor, db := newTestProcessor(t)
+
+	if err := db.AddPeripheral(&database.Peripheral{SerialNumber: "sn-1", Type: database.PeripheralTypeSensor}); err != nil {
+		t.Fatalf("AddPeripheral() error = %v", err)
+	}
+
+	scale := 2.0
+	if err := db.SetCalibrations("sn-1", []database.Calibration{
+		{Field: "t", Offset: -1, Scale: &scale},
+		{Field: "p", Polynomial: []float64{1, 0, 1}},
+	}); err != nil {
+		t.Fatalf("SetCalibrations() error = %v", err)
+	}
+
+	// Derived fields see the calibrated values and the derived fields before them, and are skipped
+	// if an input is missing.
+	if err := db.SetDerivedFields("sn-1", []database.DerivedField{
+		{Name: "double", Expression: "t * 2"},
+		{Name: "skipped", Expression: "missing + 1"},
+		{Name: "chained", Expression: "double + h"},
+	}); err != nil {
+		t.Fatalf("SetDerivedFields() error = %v", err)
+	}
+
+	var notified []string
+	processor.OnReading(func(reading *database.Reading, peripheral *database.Peripheral) {
+		notified = append(notified, peripheral.SerialNumber)
+	})
+
+	// Peripherals cannot supply their own raw values.
+	reading := &database.Reading{
+		SerialNumber: "sn-1",
+		Data:         map[string]any{"t": 20.0, "p": 3.0, "h": 50.0, "label": "kitchen"},
+		Raw:          map[string]any{"t": 1000.0},
+	}
+	if err := processor.Process(reading); err != nil {
+		t.Fatalf("Process() error = %v", err)
+	}
+
+	stored := lastReading(t, db, "sn-1")
+	wantData := map[string]any{"t": 39.0, "p": 10.0, "h": 50.0, "label": "kitchen", "double": 78.0, "chained": 128.0}
+	if !reflect.DeepEqual(stored.Data, wantData) {
+		t.Errorf("Data = %v, want %v", stored.Data, wantData)
+	}
+
+	if wantRaw := map[string]any{"t": 20.0, "p": 3.0}; !reflect.DeepEqual(stored.Raw, wantRaw) {
+		t.Errorf("Raw = %v, want %v", stored.Raw, wantRaw)
+	}
+
+	if !reflect.DeepEqual(notified, []string{"sn-1"}) {
+		t.Errorf("listener notified of %v, want [sn-1]", notified)
+	}
+}
+
+func TestProcessRegistersPeripheral(t *testing.T) {
+	processor, db := newTestProcessor(t)
+
+	if err := processor.Process(&database.Reading{SerialNumber: "new", Data: map[string]any{"t": 20.0}}); err != nil {
+		t.Fatalf("Process() error = %v", err)
+	}
+
+	p, err := db.GetPeripheralBySerial("new")
+	if err != nil || p == nil {
+		t.Fatalf("GetPeripheralBySerial() = %v, %v, want the new peripheral", p, err)
+	} else if p.Type != database.PeripheralTypeUnknown {
+		t.Errorf("Type = %v, want %v", p.Type, database.PeripheralTypeUnknown)
+	}
+
+	// Without calibrations, nothing is raw.
+	if stored := lastReading(t, db, "new"); stored.Data["t"] != 20.0 || stored.Raw != nil {
+		t.Errorf("reading = %+v, want t = 20 without raw values", stored)
+	}
+
+	if err := processor.Process(&database.Reading{Data: map[string]any{"t": 20.0}}); err == nil {
+		t.Error("Process() of a reading without a serial number succeeded")
+	}
+}
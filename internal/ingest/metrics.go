@@ -0,0 +1,39 @@
+package ingest
+
+import (
+	"hafh-server/internal/database"
+	"hafh-server/internal/metrics"
+	"sync/atomic"
+)
+
+var (
+	readingsIngested = metrics.NewCounter("hafh_ingest_readings_total",
+		"Readings stored, from MQTT, HTTP or virtual peripherals.")
+	ingestErrors = metrics.NewCounter("hafh_ingest_errors_total",
+		`Readings that could not be ingested, by stage ("parse" or "process").`, "stage")
+
+	// readingGauge is the gauge of [ReadingGauges], if enabled.
+	readingGauge atomic.Pointer[metrics.Gauge]
+)
+
+// ReadingGauges returns a listener that exports the latest value of every numeric field of every
+// peripheral as the hafh_reading_value gauge, so that sensors can be charted from the metrics.
+func ReadingGauges() ReadingListener {
+	gauge := metrics.NewGauge("hafh_reading_value",
+		"Latest value of every numeric reading field, by peripheral serial number and field.", "serial_number", "field")
+	readingGauge.Store(gauge)
+
+	return func(reading *database.Reading, _ *database.Peripheral) {
+		for field, value := range NumericFields(reading.Data) {
+			gauge.Set(value, reading.SerialNumber, field)
+		}
+	}
+}
+
+// ForgetReadingGauges removes the gauges of a peripheral that has been deleted (or merged into
+// another), so that its last values are not exported forever.
+func ForgetReadingGauges(serialNumber string) {
+	if gauge := readingGauge.Load(); gauge != nil {
+		gauge.DeletePrefix(serialNumber)
+	}
+}
@@ -0,0 +1,237 @@
+// Package lifecycle supervises the long-running components of the server (e.g. the HTTP server
+// and MQTT broker): it starts them all at once, restarts those that can be restarted when they
+// fail, reports those that cannot to the caller, and stops them in reverse dependency order within
+// a global deadline.
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hafh-server/internal/health"
+	"hafh-server/internal/logger"
+	"hafh-server/internal/metrics"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var componentRestarts = metrics.NewCounter(
+	"hafh_component_restarts_total",
+	"Number of times a component was restarted after failing.",
+	"component",
+)
+
+// Component is a long-running part of the server.
+type Component struct {
+	Name string
+	// Start starts the component. It may return once the component runs in the background, or
+	// block while it runs, in which case it returns nil once the component is stopped, or an error
+	// if it fails. The context is cancelled when the component is stopped, before Stop is called.
+	Start func(ctx context.Context) error
+	// Stop, if set, stops the component, giving up once ctx is done.
+	Stop func(ctx context.Context) error
+	// Health, if set, returns an error if the component is not healthy, and is run by the health
+	// endpoints and the systemd watchdog.
+	Health func(ctx context.Context) error
+	// Liveness is whether a failing health check means the server is stuck, see [health.Check].
+	Liveness bool
+	// Restart restarts the component with backoff when it fails. Otherwise, its failure is reported
+	// by [Manager.Failed], and the server is expected to shut down.
+	Restart bool
+}
+
+// ManagerConfig is the configuration of a [Manager].
+type ManagerConfig struct {
+	// ShutdownTimeout is how long every component has, together, to stop.
+	ShutdownTimeout time.Duration
+	// InitialBackoff is the delay before a failed component is restarted, which doubles with every
+	// failure in a row, up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// Manager starts, supervises and stops components.
+type Manager struct {
+	shutdownTimeout time.Duration
+	initialBackoff  time.Duration
+	maxBackoff      time.Duration
+	log             *zap.SugaredLogger
+
+	components []*Component
+	failed     chan error
+
+	mu       sync.Mutex
+	started  []*supervised
+	stopping bool
+}
+
+// supervised is a started component.
+type supervised struct {
+	*Component
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewManager creates a new [Manager] without components.
+func NewManager(config *ManagerConfig) (*Manager, error) {
+	if config == nil {
+		return nil, errors.New("config cannot be nil")
+	} else if config.ShutdownTimeout <= 0 {
+		return nil, errors.New("shutdown timeout must be positive")
+	} else if config.InitialBackoff <= 0 {
+		return nil, errors.New("initial backoff must be positive")
+	} else if config.MaxBackoff < config.InitialBackoff {
+		return nil, errors.New("max backoff cannot be less than the initial backoff")
+	}
+
+	return &Manager{
+		shutdownTimeout: config.ShutdownTimeout,
+		initialBackoff:  config.InitialBackoff,
+		maxBackoff:      config.MaxBackoff,
+		log:             logger.Named("lifecycle"),
+		failed:          make(chan error, 1),
+	}, nil
+}
+
+// Add adds a component. Components are stopped in the reverse of the order they are added, so a
+// component must be added after the components it depends on. They are not started in order,
+// though: a component must not rely on another having started, only on it having been created.
+func (m *Manager) Add(component Component) {
+	m.components = append(m.components, &component)
+}
+
+// Checks returns the health checks of the components.
+func (m *Manager) Checks() []health.Check {
+	var checks []health.Check
+	for _, component := range m.components {
+		if component.Health != nil {
+			checks = append(checks, health.Check{Name: component.Name, Check: component.Health, Liveness: component.Liveness})
+		}
+	}
+
+	return checks
+}
+
+// Start starts every component, without waiting for any to be running, and supervises them until
+// they are stopped by [Manager.Shutdown].
+func (m *Manager) Start() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, component := range m.components {
+		if m.stopping {
+			return
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		s := &supervised{Component: component, cancel: cancel, done: make(chan struct{})}
+		m.started = append(m.started, s)
+
+		go m.supervise(ctx, s)
+	}
+}
+
+// Failed returns a channel that receives the error of the first component that failed and is not
+// restarted. The server should then shut down.
+func (m *Manager) Failed() <-chan error {
+	return m.failed
+}
+
+// supervise runs the component, restarting it with backoff if it fails and can be restarted.
+func (m *Manager) supervise(ctx context.Context, s *supervised) {
+	defer close(s.done)
+
+	if s.Start == nil {
+		return
+	}
+
+	backoff := m.initialBackoff
+	for ctx.Err() == nil {
+		startedAt := time.Now()
+		err := s.Start(ctx)
+		if err == nil || ctx.Err() != nil {
+			return
+		}
+
+		if !s.Restart {
+			m.log.Errorf("Component %s failed: %v", s.Name, err)
+			select {
+			case m.failed <- fmt.Errorf("%s failed: %w", s.Name, err):
+			default:
+			}
+
+			return
+		}
+
+		// A component that ran for a while before failing is not failing in a row.
+		if time.Since(startedAt) > m.maxBackoff {
+			backoff = m.initialBackoff
+		}
+
+		m.log.Errorf("Component %s failed, restarting in %s: %v", s.Name, backoff, err)
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		componentRestarts.Inc(s.Name)
+		backoff = min(2*backoff, m.maxBackoff)
+	}
+}
+
+// Shutdown stops every started component in reverse order, and waits for them to return. Once the
+// shutdown timeout has passed, the remaining components are still stopped, but are not waited for.
+func (m *Manager) Shutdown() error {
+	m.mu.Lock()
+	m.stopping = true
+	started := m.started
+	m.started = nil
+	m.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.shutdownTimeout)
+	defer cancel()
+
+	var errs []error
+	for i := len(started) - 1; i >= 0; i-- {
+		s := started[i]
+
+		m.log.Debugf("Stopping %s...", s.Name)
+		s.cancel()
+		if s.Stop != nil {
+			if err := s.Stop(ctx); err != nil {
+				errs = append(errs, fmt.Errorf("stopping %s: %w", s.Name, err))
+			}
+		}
+
+		if err := wait(ctx, s.done); err != nil {
+			errs = append(errs, fmt.Errorf("stopping %s: %w", s.Name, err))
+		} else {
+			m.log.Infof("Stopped %s", s.Name)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// wait waits for done to be closed, returning an error if ctx is done first. Once ctx is done,
+// done is still checked so that components which did stop are not reported.
+func wait(ctx context.Context, done <-chan struct{}) error {
+	select {
+	case <-done:
+		return nil
+	default:
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
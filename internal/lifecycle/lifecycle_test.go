@@ -0,0 +1,232 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"hafh-server/internal/logger"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func init() {
+	logger.Init(false)
+}
+
+func newTestManager(t *testing.T, shutdownTimeout time.Duration) *Manager {
+	t.Helper()
+
+	m, err := NewManager(&ManagerConfig{
+		ShutdownTimeout: shutdownTimeout,
+		InitialBackoff:  time.Millisecond,
+		MaxBackoff:      4 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewManager() error = %v", err)
+	}
+
+	return m
+}
+
+// recorder records the order in which components are started and stopped.
+type recorder struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (r *recorder) record(event string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.events = append(r.events, event)
+}
+
+func (r *recorder) get() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return slices.Clone(r.events)
+}
+
+func TestStartAndShutdown(t *testing.T) {
+	m := newTestManager(t, time.Second)
+	r := &recorder{}
+	mqttStarted, httpStarted := make(chan struct{}), make(chan struct{})
+
+	// The database has nothing to start, the broker runs in the background and the server blocks.
+	m.Add(Component{Name: "database", Stop: func(context.Context) error {
+		r.record("stop database")
+		return nil
+	}})
+	m.Add(Component{
+		Name: "mqtt",
+		Start: func(context.Context) error {
+			r.record("start mqtt")
+			close(mqttStarted)
+			return nil
+		},
+		Stop: func(context.Context) error {
+			r.record("stop mqtt")
+			return nil
+		},
+	})
+	m.Add(Component{
+		Name: "http",
+		Start: func(ctx context.Context) error {
+			r.record("start http")
+			close(httpStarted)
+			<-ctx.Done()
+			return nil
+		},
+		Stop: func(context.Context) error {
+			r.record("stop http")
+			return nil
+		},
+		Health: func(context.Context) error { return nil },
+	})
+
+	if checks := m.Checks(); len(checks) != 1 || checks[0].Name != "http" || checks[0].Liveness {
+		t.Errorf("Checks() = %+v, want the check of http", checks)
+	}
+
+	m.Start()
+	<-mqttStarted
+	<-httpStarted
+
+	if err := m.Shutdown(); err != nil {
+		t.Fatalf("Shutdown() error = %v", err)
+	}
+
+	// The background broker may be started concurrently with the server, but every component is
+	// stopped in reverse order.
+	events := r.get()
+	if len(events) != 5 || !slices.Equal(events[2:], []string{"stop http", "stop mqtt", "stop database"}) {
+		t.Errorf("events = %v", events)
+	}
+
+	select {
+	case err := <-m.Failed():
+		t.Errorf("Failed() = %v after a clean shutdown", err)
+	default:
+	}
+
+	// Components are not started once the manager is shutting down.
+	m.Start()
+	if events := r.get(); len(events) != 5 {
+		t.Errorf("Start() after Shutdown() started components: %v", events)
+	}
+}
+
+func TestRestart(t *testing.T) {
+	m := newTestManager(t, time.Second)
+
+	var mu sync.Mutex
+	attempts := 0
+	running := make(chan struct{})
+	m.Add(Component{
+		Name: "ngrok",
+		Start: func(ctx context.Context) error {
+			mu.Lock()
+			attempts++
+			attempt := attempts
+			mu.Unlock()
+
+			if attempt < 4 {
+				return errors.New("tunnel closed")
+			}
+
+			close(running)
+			<-ctx.Done()
+			return ctx.Err()
+		},
+		Restart: true,
+	})
+
+	m.Start()
+
+	select {
+	case <-running:
+	case <-time.After(time.Second):
+		t.Fatal("the component was not restarted")
+	}
+
+	if err := m.Shutdown(); err != nil {
+		t.Errorf("Shutdown() error = %v", err)
+	}
+
+	select {
+	case err := <-m.Failed():
+		t.Errorf("Failed() = %v for a restarted component", err)
+	default:
+	}
+}
+
+func TestFailure(t *testing.T) {
+	m := newTestManager(t, time.Second)
+	m.Add(Component{Name: "mqtt", Start: func(context.Context) error { return errors.New("address in use") }})
+	m.Start()
+
+	select {
+	case err := <-m.Failed():
+		if err == nil || err.Error() != "mqtt failed: address in use" {
+			t.Errorf("Failed() = %v, want mqtt failed: address in use", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the failure was not reported")
+	}
+
+	if err := m.Shutdown(); err != nil {
+		t.Errorf("Shutdown() error = %v", err)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	m := newTestManager(t, 50*time.Millisecond)
+	started, stuck := make(chan struct{}), make(chan struct{})
+	t.Cleanup(func() { close(stuck) })
+
+	databaseStopped := false
+	m.Add(Component{Name: "database", Stop: func(ctx context.Context) error {
+		databaseStopped = true
+		return nil
+	}})
+	m.Add(Component{Name: "http", Start: func(context.Context) error {
+		close(started)
+		<-stuck
+		return nil
+	}})
+	m.Start()
+	<-started
+
+	start := time.Now()
+	err := m.Shutdown()
+	if err == nil || !strings.Contains(err.Error(), "stopping http") || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Shutdown() error = %v, want a timeout stopping http", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Shutdown() took %s", elapsed)
+	}
+
+	// Components after the stuck one are still stopped.
+	if !databaseStopped {
+		t.Error("the database was not stopped after the timeout")
+	}
+}
+
+func TestNewManagerValidatesConfig(t *testing.T) {
+	tests := []*ManagerConfig{
+		nil,
+		{InitialBackoff: time.Second, MaxBackoff: time.Second},
+		{ShutdownTimeout: time.Second, MaxBackoff: time.Second},
+		{ShutdownTimeout: time.Second, InitialBackoff: time.Minute, MaxBackoff: time.Second},
+	}
+
+	for _, config := range tests {
+		if _, err := NewManager(config); err == nil {
+			t.Errorf("NewManager(%+v) error = nil, want an error", config)
+		}
+	}
+}
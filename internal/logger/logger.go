@@ -8,6 +8,9 @@ import (
 
 var baseLogger *zap.Logger
 
+// level is the minimum level of the global logger, which can be changed at runtime.
+var level = zap.NewAtomicLevel()
+
 // Init sets up the global logger. If debug is true, logs everything.
 // Otherwise, logs only Info and above.
 func Init(debug bool) {
@@ -22,10 +25,7 @@ func Init(debug bool) {
 		ConsoleSeparator: " ",
 	}
 
-	level := zapcore.InfoLevel
-	if debug {
-		level = zapcore.DebugLevel
-	}
+	SetDebug(debug)
 
 	core := zapcore.NewCore(
 		zapcore.NewConsoleEncoder(encoderCfg),
@@ -36,6 +36,16 @@ func Init(debug bool) {
 	baseLogger = zap.New(core, zap.AddCaller(), zap.AddCallerSkip(1))
 }
 
+// SetDebug changes whether the global logger (and every logger created from it) logs everything, or
+// only Info and above.
+func SetDebug(debug bool) {
+	if debug {
+		level.SetLevel(zapcore.DebugLevel)
+	} else {
+		level.SetLevel(zapcore.InfoLevel)
+	}
+}
+
 // Named creates a new logger with the specified module name.
 func Named(module string) *zap.SugaredLogger {
 	return baseLogger.Named(module).Sugar()
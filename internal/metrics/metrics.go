@@ -0,0 +1,399 @@
+// Package metrics is a minimal implementation of Prometheus metrics (counters, gauges and
+// histograms, optionally with labels) and of the Prometheus text exposition format.
+//
+// Metrics are registered in the [Default] registry when they are created, typically as package
+// variables of the package they instrument, and are served by [Registry.WriteTo].
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the default upper bounds of histogram buckets, suitable for latencies in
+// seconds.
+var DefaultBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Default is the registry that metrics are registered in.
+var Default = NewRegistry()
+
+// sample is a single value of a metric, with the values of its labels.
+type sample struct {
+	suffix      string
+	labelNames  []string
+	labelValues []string
+	value       float64
+}
+
+// metric is a named metric, which produces its samples when collected.
+type metric interface {
+	name() string
+	help() string
+	kind() string
+	collect() []sample
+}
+
+// Registry holds metrics and writes them in the Prometheus text exposition format.
+type Registry struct {
+	mu      sync.Mutex
+	metrics map[string]metric
+}
+
+// NewRegistry creates a new, empty [Registry].
+func NewRegistry() *Registry {
+	return &Registry{metrics: map[string]metric{}}
+}
+
+// register adds the metric, replacing any metric with the same name.
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.metrics[m.name()] = m
+}
+
+// Unregister removes the metric with the given name, if any.
+func (r *Registry) Unregister(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.metrics, name)
+}
+
+// WriteTo writes every metric in the Prometheus text exposition format, sorted by name.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	metrics := make([]metric, 0, len(r.metrics))
+	for _, m := range r.metrics {
+		metrics = append(metrics, m)
+	}
+	r.mu.Unlock()
+
+	slices.SortFunc(metrics, func(a, b metric) int { return strings.Compare(a.name(), b.name()) })
+
+	var b strings.Builder
+	for _, m := range metrics {
+		fmt.Fprintf(&b, "# HELP %s %s\n", m.name(), helpEscaper.Replace(m.help()))
+		fmt.Fprintf(&b, "# TYPE %s %s\n", m.name(), m.kind())
+
+		for _, s := range m.collect() {
+			b.WriteString(m.name())
+			b.WriteString(s.suffix)
+			writeLabels(&b, s.labelNames, s.labelValues)
+			b.WriteByte(' ')
+			b.WriteString(formatValue(s.value))
+			b.WriteByte('\n')
+		}
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func writeLabels(b *strings.Builder, names, values []string) {
+	if len(names) == 0 {
+		return
+	}
+
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(values[i]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+// desc is the name, help and label names shared by every kind of metric.
+type desc struct {
+	metricName string
+	metricHelp string
+	labelNames []string
+}
+
+func (d *desc) name() string { return d.metricName }
+func (d *desc) help() string { return d.metricHelp }
+
+// key joins label values into a map key, panicking if the number of values is wrong.
+func (d *desc) key(labelValues []string) string {
+	if len(labelValues) != len(d.labelNames) {
+		panic(fmt.Sprintf("metric %s has %d labels, got %d values", d.metricName, len(d.labelNames), len(labelValues)))
+	}
+
+	return strings.Join(labelValues, "\xff")
+}
+
+// vector holds a value of type T for every combination of label values.
+type vector[T any] struct {
+	desc
+	mu     sync.Mutex
+	series map[string]*T
+	labels map[string][]string
+}
+
+func newVector[T any](name, help string, labelNames []string) vector[T] {
+	return vector[T]{
+		desc:   desc{metricName: name, metricHelp: help, labelNames: labelNames},
+		series: map[string]*T{},
+		labels: map[string][]string{},
+	}
+}
+
+// with calls fn with the value of the given label values, creating it with init if needed. The lock
+// is held while fn runs.
+func (v *vector[T]) with(labelValues []string, init func() *T, fn func(*T)) {
+	key := v.key(labelValues)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	value, ok := v.series[key]
+	if !ok {
+		value = init()
+		v.series[key] = value
+		v.labels[key] = slices.Clone(labelValues)
+	}
+
+	fn(value)
+}
+
+// Delete removes the series with the given label values, e.g. of a deleted peripheral.
+func (v *vector[T]) Delete(labelValues ...string) {
+	key := v.key(labelValues)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	delete(v.series, key)
+	delete(v.labels, key)
+}
+
+// DeletePrefix removes every series whose first label values are the given ones, e.g. every field
+// of a deleted peripheral.
+func (v *vector[T]) DeletePrefix(labelValues ...string) {
+	if len(labelValues) > len(v.labelNames) {
+		panic(fmt.Sprintf("metric %s has %d labels, got %d values", v.metricName, len(v.labelNames), len(labelValues)))
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	for key, values := range v.labels {
+		if slices.Equal(values[:len(labelValues)], labelValues) {
+			delete(v.series, key)
+			delete(v.labels, key)
+		}
+	}
+}
+
+// each calls fn for every series, sorted by label values. The lock is held while fn runs.
+func (v *vector[T]) each(fn func(labelValues []string, value *T)) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		fn(v.labels[key], v.series[key])
+	}
+}
+
+// Counter is a value that only goes up, e.g. the number of requests served.
+type Counter struct {
+	vector[float64]
+}
+
+// NewCounter creates a counter with the given label names, and registers it in [Default].
+func NewCounter(name, help string, labelNames ...string) *Counter {
+	c := &Counter{newVector[float64](name, help, labelNames)}
+	Default.register(c)
+	return c
+}
+
+func (c *Counter) kind() string { return "counter" }
+
+// Inc adds one to the counter with the given label values.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds a non-negative value to the counter with the given label values.
+func (c *Counter) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		panic("counter cannot decrease")
+	}
+
+	c.with(labelValues, newFloat, func(v *float64) { *v += delta })
+}
+
+func (c *Counter) collect() []sample {
+	return collectValues(&c.vector)
+}
+
+// Gauge is a value that can go up and down, e.g. the latest reading of a sensor.
+type Gauge struct {
+	vector[float64]
+}
+
+// NewGauge creates a gauge with the given label names, and registers it in [Default].
+func NewGauge(name, help string, labelNames ...string) *Gauge {
+	g := &Gauge{newVector[float64](name, help, labelNames)}
+	Default.register(g)
+	return g
+}
+
+func (g *Gauge) kind() string { return "gauge" }
+
+// Set sets the gauge with the given label values.
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	g.with(labelValues, newFloat, func(v *float64) { *v = value })
+}
+
+func (g *Gauge) collect() []sample {
+	return collectValues(&g.vector)
+}
+
+func newFloat() *float64 {
+	return new(float64)
+}
+
+func collectValues(v *vector[float64]) []sample {
+	var samples []sample
+	v.each(func(labelValues []string, value *float64) {
+		samples = append(samples, sample{labelNames: v.labelNames, labelValues: labelValues, value: *value})
+	})
+
+	return samples
+}
+
+// histogramValue is the state of a single histogram series.
+type histogramValue struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// Histogram counts observations (e.g. latencies) in buckets.
+type Histogram struct {
+	vector[histogramValue]
+	buckets []float64
+}
+
+// NewHistogram creates a histogram with the given bucket upper bounds ([DefaultBuckets] if nil) and
+// label names, and registers it in [Default].
+func NewHistogram(name, help string, buckets []float64, labelNames ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+
+	buckets = slices.Clone(buckets)
+	slices.Sort(buckets)
+
+	h := &Histogram{vector: newVector[histogramValue](name, help, labelNames), buckets: buckets}
+	Default.register(h)
+	return h
+}
+
+func (h *Histogram) kind() string { return "histogram" }
+
+// Observe records a value in the histogram with the given label values.
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	init := func() *histogramValue { return &histogramValue{counts: make([]uint64, len(h.buckets))} }
+	h.with(labelValues, init, func(v *histogramValue) {
+		if i, _ := slices.BinarySearch(h.buckets, value); i < len(h.buckets) {
+			v.counts[i]++
+		}
+
+		v.count++
+		v.sum += value
+	})
+}
+
+func (h *Histogram) collect() []sample {
+	var samples []sample
+	h.each(func(labelValues []string, value *histogramValue) {
+		bucketLabels := append(slices.Clone(h.labelNames), "le")
+
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += value.counts[i]
+			samples = append(samples, sample{
+				suffix:      "_bucket",
+				labelNames:  bucketLabels,
+				labelValues: append(slices.Clone(labelValues), formatValue(bound)),
+				value:       float64(cumulative),
+			})
+		}
+
+		samples = append(samples,
+			sample{suffix: "_bucket", labelNames: bucketLabels, labelValues: append(slices.Clone(labelValues), "+Inf"), value: float64(value.count)},
+			sample{suffix: "_sum", labelNames: h.labelNames, labelValues: labelValues, value: value.sum},
+			sample{suffix: "_count", labelNames: h.labelNames, labelValues: labelValues, value: float64(value.count)},
+		)
+	})
+
+	return samples
+}
+
+// funcMetric is a metric whose samples are computed when it is collected.
+type funcMetric struct {
+	desc
+	metricKind string
+	fn         func(emit func(value float64, labelValues ...string))
+}
+
+func (f *funcMetric) kind() string { return f.metricKind }
+
+func (f *funcMetric) collect() []sample {
+	var samples []sample
+	f.fn(func(value float64, labelValues ...string) {
+		f.key(labelValues)
+		samples = append(samples, sample{labelNames: f.labelNames, labelValues: labelValues, value: value})
+	})
+
+	return samples
+}
+
+// NewCounterFunc registers a counter in [Default] whose values are computed by fn every time the
+// metrics are collected, e.g. from the statistics of a library. fn calls emit for every series.
+func NewCounterFunc(name, help string, labelNames []string, fn func(emit func(value float64, labelValues ...string))) {
+	Default.register(&funcMetric{desc: desc{metricName: name, metricHelp: help, labelNames: labelNames}, metricKind: "counter", fn: fn})
+}
+
+// NewGaugeFunc registers a gauge in [Default] whose values are computed by fn every time the
+// metrics are collected, like [NewCounterFunc].
+func NewGaugeFunc(name, help string, labelNames []string, fn func(emit func(value float64, labelValues ...string))) {
+	Default.register(&funcMetric{desc: desc{metricName: name, metricHelp: help, labelNames: labelNames}, metricKind: "gauge", fn: fn})
+}
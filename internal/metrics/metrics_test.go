@@ -0,0 +1,127 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+// render returns the lines of the exposition of the metric with the given name.
+func render(t *testing.T, name string) string {
+	t.Helper()
+
+	var b strings.Builder
+	if _, err := Default.WriteTo(&b); err != nil {
+		t.Fatalf("WriteTo() error = %v", err)
+	}
+
+	var lines []string
+	for _, line := range strings.Split(b.String(), "\n") {
+		if strings.HasPrefix(line, name) || strings.HasPrefix(line, "# HELP "+name+" ") ||
+			strings.HasPrefix(line, "# TYPE "+name+" ") {
+			lines = append(lines, line)
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func TestCounter(t *testing.T) {
+	c := NewCounter("test_requests_total", "Requests\nserved.", "method", "path")
+	t.Cleanup(func() { Default.Unregister("test_requests_total") })
+
+	c.Inc("GET", "/")
+	c.Add(2.5, "GET", "/")
+	c.Inc("POST", `/a "quoted"\path`)
+
+	want := `# HELP test_requests_total Requests\nserved.
+# TYPE test_requests_total counter
+test_requests_total{method="GET",path="/"} 3.5
+test_requests_total{method="POST",path="/a \"quoted\"\\path"} 1`
+	if got := render(t, "test_requests_total"); got != want {
+		t.Errorf("exposition =\n%s\nwant\n%s", got, want)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Add() of a negative value did not panic")
+		}
+	}()
+	c.Add(-1, "GET", "/")
+}
+
+func TestGaugeDelete(t *testing.T) {
+	g := NewGauge("test_reading_value", "Latest readings.", "serial_number", "field")
+	t.Cleanup(func() { Default.Unregister("test_reading_value") })
+
+	g.Set(21.5, "sensor-1", "t")
+	g.Set(40, "sensor-1", "h")
+	g.Set(-3, "sensor-2", "t")
+	g.Set(19, "sensor-1", "t")
+
+	want := `# HELP test_reading_value Latest readings.
+# TYPE test_reading_value gauge
+test_reading_value{serial_number="sensor-1",field="h"} 40
+test_reading_value{serial_number="sensor-1",field="t"} 19
+test_reading_value{serial_number="sensor-2",field="t"} -3`
+	if got := render(t, "test_reading_value"); got != want {
+		t.Errorf("exposition =\n%s\nwant\n%s", got, want)
+	}
+
+	g.Delete("sensor-2", "t")
+	g.DeletePrefix("sensor-1")
+	g.Set(1, "sensor-10", "t")
+
+	want = `# HELP test_reading_value Latest readings.
+# TYPE test_reading_value gauge
+test_reading_value{serial_number="sensor-10",field="t"} 1`
+	if got := render(t, "test_reading_value"); got != want {
+		t.Errorf("exposition after deleting =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram("test_duration_seconds", "Durations.", []float64{1, 0.1}, "route")
+	t.Cleanup(func() { Default.Unregister("test_duration_seconds") })
+
+	for _, value := range []float64{0.05, 0.1, 0.5, 2} {
+		h.Observe(value, "/")
+	}
+
+	want := `# HELP test_duration_seconds Durations.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{route="/",le="0.1"} 2
+test_duration_seconds_bucket{route="/",le="1"} 3
+test_duration_seconds_bucket{route="/",le="+Inf"} 4
+test_duration_seconds_sum{route="/"} 2.65
+test_duration_seconds_count{route="/"} 4`
+	if got := render(t, "test_duration_seconds"); got != want {
+		t.Errorf("exposition =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestFuncMetrics(t *testing.T) {
+	NewGaugeFunc("test_clients", "Clients.", nil, func(emit func(float64, ...string)) { emit(3) })
+	NewCounterFunc("test_messages_total", "Messages.", []string{"direction"}, func(emit func(float64, ...string)) {
+		emit(5, "in")
+		emit(7, "out")
+	})
+	t.Cleanup(func() {
+		Default.Unregister("test_clients")
+		Default.Unregister("test_messages_total")
+	})
+
+	want := `# HELP test_clients Clients.
+# TYPE test_clients gauge
+test_clients 3`
+	if got := render(t, "test_clients"); got != want {
+		t.Errorf("exposition =\n%s\nwant\n%s", got, want)
+	}
+
+	want = `# HELP test_messages_total Messages.
+# TYPE test_messages_total counter
+test_messages_total{direction="in"} 5
+test_messages_total{direction="out"} 7`
+	if got := render(t, "test_messages_total"); got != want {
+		t.Errorf("exposition =\n%s\nwant\n%s", got, want)
+	}
+}
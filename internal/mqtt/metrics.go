@@ -0,0 +1,26 @@
+package mqtt
+
+import (
+	"hafh-server/internal/metrics"
+	"sync/atomic"
+
+	server "github.com/mochi-mqtt/server/v2"
+)
+
+// registerMetrics exports the statistics of the broker as metrics.
+func registerMetrics(s *server.Server) {
+	stat := func(value *int64) func(emit func(float64, ...string)) {
+		return func(emit func(float64, ...string)) {
+			emit(float64(atomic.LoadInt64(value)))
+		}
+	}
+
+	metrics.NewGaugeFunc("hafh_mqtt_clients_connected",
+		"MQTT clients currently connected.", nil, stat(&s.Info.ClientsConnected))
+	metrics.NewCounterFunc("hafh_mqtt_messages_received_total",
+		"MQTT messages published by clients.", nil, stat(&s.Info.MessagesReceived))
+	metrics.NewCounterFunc("hafh_mqtt_messages_published_total",
+		"MQTT messages delivered to subscribers, including commands sent by the server.", nil, stat(&s.Info.MessagesSent))
+	metrics.NewCounterFunc("hafh_mqtt_messages_dropped_total",
+		"MQTT messages dropped because a subscriber was too slow.", nil, stat(&s.Info.MessagesDropped))
+}
@@ -5,10 +5,12 @@ import (
 	"crypto/x509"
 	"errors"
 	"fmt"
-	"hafh-server/internal/database"
+	"hafh-server/internal/ingest"
 	"hafh-server/internal/logger"
 	"log/slog"
+	"net"
 	"os"
+	"sync/atomic"
 
 	server "github.com/mochi-mqtt/server/v2"
 	"github.com/mochi-mqtt/server/v2/hooks/auth"
@@ -18,9 +20,12 @@ import (
 
 // MqttServer represents an MQTT server.
 type MqttServer struct {
-	server *server.Server
-	log    *zap.SugaredLogger
-	config MqttServerConfig
+	server  *server.Server
+	log     *zap.SugaredLogger
+	config  MqttServerConfig
+	serving atomic.Bool
+	// tlsConfig holds the certificates, which are replaced by [MqttServer.ReloadCertificates].
+	tlsConfig atomic.Pointer[tls.Config]
 }
 
 // MqttServerConfig holds the configuration for the MQTT server.
@@ -30,13 +35,16 @@ type MqttServerConfig struct {
 	CertPath        string
 	KeyPath         string
 	CaPath          string
-	Db              *database.Database
+	Processor       *ingest.Processor
 	DataTopicPrefix string
+	// Listener, if set, is served on (with TLS) instead of listening on the address and port, e.g.
+	// when passed by systemd socket activation.
+	Listener net.Listener
 }
 
 type publishReceiverArg struct {
 	log             *zap.SugaredLogger
-	db              *database.Database
+	processor       *ingest.Processor
 	dataTopicPrefix string
 }
 
@@ -51,7 +59,8 @@ func NewBroker(config *MqttServerConfig) (*MqttServer, error) {
 	}
 
 	log := logger.Named("mqtt")
-	s := server.New(nil)
+	// The inline client allows the server itself to publish, e.g. commands to actuators.
+	s := server.New(&server.Options{InlineClient: true})
 	if s == nil {
 		return nil, errors.New("failed to create MQTT server")
 	}
@@ -76,51 +85,110 @@ func NewBroker(config *MqttServerConfig) (*MqttServer, error) {
 	}
 
 	// Hook for processing incoming MQTT messages, if applicable.
-	if config.DataTopicPrefix != "" && config.Db != nil {
+	if config.DataTopicPrefix != "" && config.Processor != nil {
 		err = s.AddHook(new(PublishReceiverHook), PublishReceiverConfig{
 			log:   log,
 			fn:    onMqttDataReceived,
-			fnArg: &publishReceiverArg{log: log, db: config.Db, dataTopicPrefix: config.DataTopicPrefix},
+			fnArg: &publishReceiverArg{log: log, processor: config.Processor, dataTopicPrefix: config.DataTopicPrefix},
 		})
 
 		if err != nil {
 			return nil, errors.New("failed to add publish receiver hook: " + err.Error())
 		}
 	} else {
-		log.Debug("Skipping publish receiver hook as no data topic prefix or database is provided")
+		log.Debug("Skipping publish receiver hook as no data topic prefix or ingest processor is provided")
 	}
 
-	tlsConfig, err := loadTLSConfig(config.CertPath, config.KeyPath, config.CaPath)
+	internal := &MqttServer{server: s, log: log, config: *config}
+	if internal.config.Port == 0 {
+		internal.config.Port = 8883
+	}
+
+	certificates, err := loadTLSConfig(config.CertPath, config.KeyPath, config.CaPath)
 	if err != nil {
 		return nil, errors.New("failed to load TLS config: " + err.Error())
 	}
 
-	tcp := listeners.NewTCP(listeners.Config{
-		ID:        "hafh-mqtt-tls",
-		Address:   fmt.Sprintf("%s:%d", config.Address, config.Port),
-		TLSConfig: tlsConfig,
-	})
-	if err := s.AddListener(tcp); err != nil {
-		return nil, errors.New("failed to add TCP listener: " + err.Error())
+	internal.tlsConfig.Store(certificates)
+
+	// Every connection uses the current certificates.
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return internal.tlsConfig.Load(), nil
+		},
 	}
 
-	internal := MqttServer{server: s, log: log, config: *config}
-	if internal.config.Port == 0 {
-		internal.config.Port = 8883
+	var listener listeners.Listener
+	if config.Listener != nil {
+		listener = listeners.NewNet("hafh-mqtt-tls", tls.NewListener(config.Listener, tlsConfig))
+	} else {
+		listener = listeners.NewTCP(listeners.Config{
+			ID:        "hafh-mqtt-tls",
+			Address:   fmt.Sprintf("%s:%d", config.Address, config.Port),
+			TLSConfig: tlsConfig,
+		})
+	}
+
+	if err := s.AddListener(listener); err != nil {
+		return nil, errors.New("failed to add TCP listener: " + err.Error())
 	}
 
-	return &internal, nil
+	registerMetrics(s)
+
+	return internal, nil
 }
 
 // Start starts the MQTT server (TLS) and listens for incoming connections on the specified port.
 func (s *MqttServer) Start() error {
-	s.log.Debugf("MQTT server listening on %s:%d (TLS)", s.config.Address, s.config.Port)
-	return s.server.Serve()
+	if s.config.Listener != nil {
+		s.log.Debugf("MQTT server listening on %s (TLS, socket activated)", s.config.Listener.Addr())
+	} else {
+		s.log.Debugf("MQTT server listening on %s:%d (TLS)", s.config.Address, s.config.Port)
+	}
+	if err := s.server.Serve(); err != nil {
+		return err
+	}
+
+	s.serving.Store(true)
+	return nil
+}
+
+// Health returns an error if the MQTT server is not listening for connections.
+func (s *MqttServer) Health() error {
+	if !s.serving.Load() {
+		return errors.New("MQTT server is not listening")
+	}
+
+	return nil
+}
+
+// ClientsConnected returns the number of connected MQTT clients.
+func (s *MqttServer) ClientsConnected() int64 {
+	return atomic.LoadInt64(&s.server.Info.ClientsConnected)
+}
+
+// Publish publishes a message to the given topic (QoS 1, not retained) from the server itself.
+func (s *MqttServer) Publish(topic string, payload []byte) error {
+	return s.server.Publish(topic, payload, false, 1)
+}
+
+// ReloadCertificates reloads the certificates (and CA) from disk, e.g. once they have been renewed.
+// Connected clients are not affected. If reloading fails, the previous certificates are kept.
+func (s *MqttServer) ReloadCertificates() error {
+	tlsConfig, err := loadTLSConfig(s.config.CertPath, s.config.KeyPath, s.config.CaPath)
+	if err != nil {
+		return err
+	}
+
+	s.tlsConfig.Store(tlsConfig)
+	return nil
 }
 
 // Shutdown gracefully shuts down the MQTT server.
 func (s *MqttServer) Shutdown() error {
 	s.log.Debug("Shutting down MQTT server...")
+	s.serving.Store(false)
 	return s.server.Close()
 }
 
@@ -160,32 +228,6 @@ func onMqttDataReceived(topic, payload string, arg any) error {
 		return nil
 	}
 
-	// Validate the reading payload.
-	reading, err := database.ReadingFromJson([]byte(payload))
-	if err != nil {
-		return err
-	} else if reading == nil || reading.SerialNumber == "" {
-		return nil
-	}
-
-	// The reading is valid. If the peripheral does not exist, create it.
-	peripheral, err := args.db.GetPeripheralBySerial(reading.SerialNumber)
-	if err != nil {
-		return err
-	} else if peripheral == nil {
-		args.db.AddPeripheral(&database.Peripheral{
-			SerialNumber: reading.SerialNumber,
-			Type:         database.PeripheralTypeUnknown,
-		})
-
-		args.log.Infof("Added new peripheral: %s", reading.SerialNumber)
-	}
-
-	// Insert the reading into the database.
-	if err := args.db.InsertReading(reading); err != nil {
-		return err
-	}
-
-	args.log.Infof("Inserted reading: %s", reading.String())
-	return nil
+	// Validate the reading payload and run it through the ingest path.
+	return args.processor.ProcessPayload(topic, []byte(payload))
 }
@@ -7,6 +7,7 @@ import (
 	"hafh-server/internal/logger"
 	"net/url"
 	"strings"
+	"sync/atomic"
 
 	"go.uber.org/zap"
 	"golang.ngrok.com/ngrok"
@@ -28,6 +29,10 @@ type Forwarder struct {
 	authToken  string
 	region     string
 	log        *zap.SugaredLogger
+	// connected is whether the session with ngrok is connected, and forwarding whether the tunnel
+	// is established.
+	connected  atomic.Bool
+	forwarding atomic.Bool
 }
 
 // NewForwarder creates a new Forwarder instance.
@@ -62,22 +67,39 @@ func NewForwarder(config *ForwarderConfig) (*Forwarder, error) {
 	}, nil
 }
 
-// Start starts the ngrok forwarding.
+// Start starts the ngrok forwarding, blocking until ctx is done or the forwarding fails.
 func (f *Forwarder) Start(ctx context.Context) error {
 	session, err := ngrok.Connect(ctx,
 		ngrok.WithAuthtoken(f.authToken),
 		ngrok.WithRegion(f.region),
+		ngrok.WithConnectHandler(func(context.Context, ngrok.Session) {
+			f.connected.Store(true)
+		}),
+		ngrok.WithDisconnectHandler(func(context.Context, ngrok.Session, error) {
+			f.connected.Store(false)
+		}),
 	)
 	if err != nil {
 		return err
 	}
 
+	defer func() {
+		session.Close()
+		f.connected.Store(false)
+	}()
+
+	// Closing the session stops the forwarding.
+	stop := context.AfterFunc(ctx, func() { session.Close() })
+	defer stop()
+
 	for {
 		fwd, err := session.ListenAndForward(ctx,
 			f.backendUrl,
 			ngrokConfig.HTTPEndpoint(ngrokConfig.WithDomain(f.domain)),
 		)
-		if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		} else if err != nil {
 			return err
 		}
 
@@ -85,8 +107,10 @@ func (f *Forwarder) Start(ctx context.Context) error {
 			"url": fwd.URL(),
 		})
 
+		f.forwarding.Store(true)
 		err = fwd.Wait()
-		if err == nil {
+		f.forwarding.Store(false)
+		if err == nil || ctx.Err() != nil {
 			return nil
 		}
 
@@ -94,3 +118,15 @@ func (f *Forwarder) Start(ctx context.Context) error {
 			map[string]any{"err": err})
 	}
 }
+
+// Health returns an error if the session with ngrok is not connected or the tunnel is not
+// established.
+func (f *Forwarder) Health() error {
+	if !f.connected.Load() {
+		return errors.New("ngrok session is not connected")
+	} else if !f.forwarding.Load() {
+		return errors.New("ngrok tunnel is not established")
+	}
+
+	return nil
+}
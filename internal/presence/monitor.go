@@ -0,0 +1,113 @@
+package presence
+
+import (
+	"context"
+	"errors"
+	"hafh-server/internal/database"
+	"hafh-server/internal/events"
+	"hafh-server/internal/logger"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// minInterval is the minimum interval between presence checks.
+const minInterval = 5 * time.Second
+
+// Change is the data of a [events.PeripheralOffline] or [events.PeripheralOnline] event.
+type Change struct {
+	SerialNumber string     `json:"serial_number"`
+	Name         string     `json:"name"`
+	LastSeenAt   *time.Time `json:"last_seen_at"`
+}
+
+// Monitor periodically checks when each peripheral last reported a reading, publishing an event
+// whenever a peripheral goes offline or comes back online.
+type Monitor struct {
+	db           *database.Database
+	bus          *events.Bus
+	log          *zap.SugaredLogger
+	offlineAfter time.Duration
+	interval     time.Duration
+	online       map[string]bool
+}
+
+// NewMonitor creates a new presence [Monitor]. A peripheral is considered offline once it has not
+// reported a reading for offlineAfter.
+func NewMonitor(db *database.Database, bus *events.Bus, offlineAfter time.Duration) (*Monitor, error) {
+	if db == nil {
+		return nil, errors.New("database is required")
+	} else if bus == nil {
+		return nil, errors.New("event bus is required")
+	} else if offlineAfter <= 0 {
+		return nil, errors.New("offline duration must be positive")
+	}
+
+	// Check often enough that a change is noticed well within the offline duration.
+	interval := offlineAfter / 10
+	if interval < minInterval {
+		interval = minInterval
+	}
+
+	return &Monitor{
+		db:           db,
+		bus:          bus,
+		log:          logger.Named("presence"),
+		offlineAfter: offlineAfter,
+		interval:     interval,
+	}, nil
+}
+
+// Start runs the monitor until the context is cancelled. **This should be called in a separate
+// goroutine.**
+func (m *Monitor) Start(ctx context.Context) {
+	m.log.Debugf("Checking peripheral presence every %s", m.interval)
+
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		m.check()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *Monitor) check() {
+	peripherals, err := m.db.GetAllPeripherals()
+	if err != nil {
+		m.log.Errorf("Failed to get peripherals: %v", err)
+		return
+	}
+
+	// The first check only establishes a baseline, so that peripherals that were already offline
+	// when the server started do not produce events.
+	baseline := m.online == nil
+	current := make(map[string]bool, len(peripherals))
+	for i := range peripherals {
+		p := &peripherals[i]
+		online := p.IsOnline(m.offlineAfter)
+		current[p.SerialNumber] = online
+
+		// Newly registered peripherals are announced separately.
+		previous, known := m.online[p.SerialNumber]
+		if baseline || !known || previous == online {
+			continue
+		}
+
+		change := Change{SerialNumber: p.SerialNumber, Name: p.Name, LastSeenAt: p.LastSeenAt}
+		if online {
+			m.log.Infof("Peripheral %s is back online", p.SerialNumber)
+			m.bus.Publish(events.New(events.PeripheralOnline, change))
+		} else {
+			m.log.Warnf("Peripheral %s is offline", p.SerialNumber)
+			m.bus.Publish(events.New(events.PeripheralOffline, change))
+		}
+	}
+
+	m.online = current
+}
@@ -0,0 +1,79 @@
+package scheduler
+
+import (
+	"hafh-server/internal/database"
+	"hafh-server/internal/events"
+	"time"
+)
+
+// Report is the output of a report schedule, and the data of a [events.ReportGenerated] event.
+type Report struct {
+	ScheduleID   int64              `json:"schedule_id"`
+	ScheduleName string             `json:"schedule_name"`
+	From         time.Time          `json:"from"`
+	To           time.Time          `json:"to"`
+	Peripherals  []PeripheralReport `json:"peripherals"`
+}
+
+// PeripheralReport is the summary of the readings of a single peripheral in a [Report].
+type PeripheralReport struct {
+	database.ReadingSummary
+	Name string `json:"name"`
+}
+
+// report summarizes the readings reported in the schedule's period and publishes the report.
+func (s *Scheduler) report(schedule *database.Schedule, now time.Time) (*Report, error) {
+	options := schedule.Report
+	if options == nil {
+		options = &database.ReportOptions{}
+	}
+
+	from := now.Add(-defaultReportPeriod)
+	if options.PeriodSeconds > 0 {
+		from = now.Add(-time.Duration(options.PeriodSeconds) * time.Second)
+	} else if schedule.LastRunAt != nil {
+		from = *schedule.LastRunAt
+	}
+
+	serials := options.SerialNumbers
+	if options.Tag != "" {
+		peripherals, err := s.db.FindPeripherals(database.PeripheralFilter{Tag: options.Tag})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, p := range peripherals {
+			serials = append(serials, p.SerialNumber)
+		}
+
+		// A tag without peripherals matches nothing, rather than everything.
+		if len(serials) == 0 {
+			serials = []string{""}
+		}
+	}
+
+	summaries, err := s.db.SummarizeReadings(from, now, serials)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &Report{
+		ScheduleID:   schedule.ID,
+		ScheduleName: schedule.Name,
+		From:         from.UTC(),
+		To:           now.UTC(),
+		Peripherals:  make([]PeripheralReport, 0, len(summaries)),
+	}
+
+	for _, summary := range summaries {
+		entry := PeripheralReport{ReadingSummary: summary}
+		if p, err := s.db.GetPeripheralBySerial(summary.SerialNumber); err == nil && p != nil {
+			entry.Name = p.Name
+		}
+
+		report.Peripherals = append(report.Peripherals, entry)
+	}
+
+	s.bus.Publish(events.New(events.ReportGenerated, report))
+	return report, nil
+}
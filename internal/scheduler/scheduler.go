@@ -0,0 +1,265 @@
+// Package scheduler runs the schedules stored in the database at the times described by their cron
+// expressions.
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hafh-server/internal/commands"
+	"hafh-server/internal/cron"
+	"hafh-server/internal/database"
+	"hafh-server/internal/events"
+	"hafh-server/internal/logger"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// maxSleep bounds how long the scheduler sleeps, so that changes to the clock (e.g. after NTP
+// synchronization on boot) are noticed.
+const maxSleep = time.Minute
+
+// defaultReportPeriod is the period covered by the first run of a report without a fixed period.
+const defaultReportPeriod = 24 * time.Hour
+
+// Config holds the configuration for the [Scheduler].
+type Config struct {
+	Db     *database.Database
+	Sender *commands.Sender
+	Bus    *events.Bus
+	Parser *cron.Parser
+	// Grace is how late a run may start before it is considered missed, and handled according to
+	// the schedule's missed run policy.
+	Grace time.Duration
+}
+
+// Scheduler runs schedules when they are due. The next run time of every schedule is stored in the
+// database, so runs that were missed while the server was not running are detected on startup.
+type Scheduler struct {
+	db     *database.Database
+	sender *commands.Sender
+	bus    *events.Bus
+	parser *cron.Parser
+	grace  time.Duration
+	log    *zap.SugaredLogger
+	wake   chan struct{}
+}
+
+// New creates a new [Scheduler].
+func New(config *Config) (*Scheduler, error) {
+	if config == nil {
+		return nil, errors.New("config cannot be nil")
+	} else if config.Db == nil {
+		return nil, errors.New("database is required")
+	} else if config.Sender == nil {
+		return nil, errors.New("command sender is required")
+	}
+
+	parser := config.Parser
+	if parser == nil {
+		parser = &cron.Parser{}
+	}
+
+	grace := config.Grace
+	if grace <= 0 {
+		grace = 2 * time.Minute
+	}
+
+	return &Scheduler{
+		db:     config.Db,
+		sender: config.Sender,
+		bus:    config.Bus,
+		parser: parser,
+		grace:  grace,
+		log:    logger.Named("scheduler"),
+		wake:   make(chan struct{}, 1),
+	}, nil
+}
+
+// Next parses a schedule expression and returns its next occurrence after the given time.
+func (s *Scheduler) Next(expression string, after time.Time) (time.Time, error) {
+	spec, err := s.parser.Parse(expression)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	next := spec.Next(after)
+	if next.IsZero() {
+		return time.Time{}, errors.New("expression never occurs")
+	}
+
+	return next, nil
+}
+
+// Reschedule wakes up the scheduler after schedules have changed.
+func (s *Scheduler) Reschedule() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Start runs due schedules until the context is cancelled. **This should be called in a separate
+// goroutine.**
+func (s *Scheduler) Start(ctx context.Context) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		case <-s.wake:
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+		}
+
+		sleep := maxSleep
+		if next := s.runDue(time.Now()); !next.IsZero() {
+			sleep = min(max(time.Until(next), 0), maxSleep)
+		}
+
+		timer.Reset(sleep)
+	}
+}
+
+// runDue runs every enabled schedule that is due, returning the earliest next run time.
+func (s *Scheduler) runDue(now time.Time) time.Time {
+	schedules, err := s.db.GetSchedules(true)
+	if err != nil {
+		s.log.Errorf("Failed to get schedules: %v", err)
+		return time.Time{}
+	}
+
+	var earliest time.Time
+	for i := range schedules {
+		schedule := &schedules[i]
+		if next := s.runIfDue(schedule, now); !next.IsZero() && (earliest.IsZero() || next.Before(earliest)) {
+			earliest = next
+		}
+	}
+
+	return earliest
+}
+
+// runIfDue runs the schedule if it is due, returning its next run time.
+func (s *Scheduler) runIfDue(schedule *database.Schedule, now time.Time) time.Time {
+	next, err := s.Next(schedule.Expression, now)
+	if err != nil {
+		s.log.Errorf("Invalid expression for schedule %d: %v", schedule.ID, err)
+		return time.Time{}
+	}
+
+	// Schedules without a next run time (e.g. never scheduled) start from now.
+	if schedule.NextRunAt == nil {
+		if err := s.db.SetScheduleNextRun(schedule.ID, &next); err != nil {
+			s.log.Errorf("Failed to set next run of schedule %d: %v", schedule.ID, err)
+		}
+		return next
+	}
+
+	due := *schedule.NextRunAt
+	if due.After(now) {
+		return due
+	}
+
+	var run *database.ScheduleRun
+	if now.Sub(due) > s.grace && schedule.MissedRunPolicy == database.MissedRunSkip {
+		s.log.Warnf("Skipping missed run of schedule %q (due %s)", schedule.Name, due.Local().Format(time.RFC3339))
+		run = &database.ScheduleRun{
+			ScheduleID:   schedule.ID,
+			ScheduledFor: due,
+			StartedAt:    now,
+			Status:       database.ScheduleRunSkipped,
+			Error:        "missed",
+		}
+	} else {
+		run = s.run(schedule, due)
+	}
+
+	if err := s.db.RecordScheduleRun(run, &next); err != nil {
+		s.log.Errorf("Failed to record run of schedule %d: %v", schedule.ID, err)
+	}
+
+	return next
+}
+
+// RunNow runs a schedule immediately, regardless of whether it is enabled or due, and records the
+// run without changing when it runs next.
+func (s *Scheduler) RunNow(schedule *database.Schedule) (*database.ScheduleRun, error) {
+	run := s.run(schedule, time.Now())
+	if err := s.db.RecordScheduleRun(run, schedule.NextRunAt); err != nil {
+		return nil, err
+	}
+
+	return run, nil
+}
+
+// run executes a schedule and returns the (unrecorded) run.
+func (s *Scheduler) run(schedule *database.Schedule, scheduledFor time.Time) *database.ScheduleRun {
+	run := &database.ScheduleRun{
+		ScheduleID:   schedule.ID,
+		ScheduledFor: scheduledFor,
+		StartedAt:    time.Now(),
+		Status:       database.ScheduleRunSucceeded,
+	}
+
+	var output any
+	var err error
+	switch schedule.Kind {
+	case database.ScheduleKindCommand:
+		output, err = s.sendCommands(schedule)
+	case database.ScheduleKindReport:
+		output, err = s.report(schedule, run.StartedAt)
+	default:
+		err = fmt.Errorf("unknown schedule kind %q", schedule.Kind)
+	}
+
+	if err != nil {
+		run.Status = database.ScheduleRunFailed
+		run.Error = err.Error()
+		s.log.Errorf("Schedule %q failed: %v", schedule.Name, err)
+	} else {
+		s.log.Infof("Ran schedule %q", schedule.Name)
+	}
+
+	if output != nil {
+		if data, err := json.Marshal(output); err == nil {
+			run.Output = data
+		}
+	}
+
+	return run
+}
+
+func (s *Scheduler) sendCommands(schedule *database.Schedule) ([]database.ActionResult, error) {
+	var results []database.ActionResult
+	failed := 0
+	for _, action := range schedule.Actions {
+		result := database.ActionResult{SerialNumber: action.SerialNumber, Command: action.Command}
+		if err := s.sender.Send(&commands.Command{
+			SerialNumber: action.SerialNumber,
+			Command:      action.Command,
+			Args:         action.Args,
+			Source:       fmt.Sprintf("schedule:%d", schedule.ID),
+		}); err != nil {
+			result.Error = err.Error()
+			failed++
+		}
+
+		results = append(results, result)
+	}
+
+	if failed > 0 {
+		return results, fmt.Errorf("%d of %d commands failed", failed, len(results))
+	}
+
+	return results, nil
+}
@@ -0,0 +1,214 @@
+package scheduler
+
+import (
+	"hafh-server/internal/commands"
+	"hafh-server/internal/cron"
+	"hafh-server/internal/database"
+	"hafh-server/internal/logger"
+	"sync"
+	"testing"
+	"time"
+)
+
+func init() {
+	logger.Init(false)
+}
+
+// publisher records the topics commands are published to.
+type publisher struct {
+	mu     sync.Mutex
+	topics []string
+}
+
+func (p *publisher) Publish(topic string, payload []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.topics = append(p.topics, topic)
+	return nil
+}
+
+func (p *publisher) count() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.topics)
+}
+
+// newTestScheduler returns a scheduler with an actuator "fan" and a daily schedule that turns it on
+// at 08:00 UTC.
+func newTestScheduler(t *testing.T, policy database.MissedRunPolicy) (*Scheduler, *database.Database, *publisher, *database.Schedule) {
+	t.Helper()
+
+	db, err := database.New(":memory:")
+	if err != nil {
+		t.Fatalf("database.New() error = %v", err)
+	}
+
+	t.Cleanup(func() { db.Close() })
+
+	if err := db.AddPeripheral(&database.Peripheral{SerialNumber: "fan", Type: database.PeripheralTypeActuator}); err != nil {
+		t.Fatalf("AddPeripheral() error = %v", err)
+	}
+
+	schedule := &database.Schedule{
+		Name:            "morning",
+		Expression:      "0 8 * * *",
+		Kind:            database.ScheduleKindCommand,
+		Actions:         []database.AutomationAction{{SerialNumber: "fan", Command: "on"}},
+		MissedRunPolicy: policy,
+		Enabled:         true,
+	}
+	if err := db.AddSchedule(schedule); err != nil {
+		t.Fatalf("AddSchedule() error = %v", err)
+	}
+
+	p := &publisher{}
+	sender, err := commands.NewSender(db, p, "commands/")
+	if err != nil {
+		t.Fatalf("NewSender() error = %v", err)
+	}
+
+	s, err := New(&Config{Db: db, Sender: sender, Parser: &cron.Parser{TimeZone: time.UTC}, Grace: time.Minute})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	return s, db, p, schedule
+}
+
+func getRuns(t *testing.T, db *database.Database, id int64) []database.ScheduleRun {
+	t.Helper()
+
+	runs, err := db.GetScheduleRuns(id, 10)
+	if err != nil {
+		t.Fatalf("GetScheduleRuns() error = %v", err)
+	}
+
+	return runs
+}
+
+func TestRunDue(t *testing.T) {
+	s, db, p, schedule := newTestScheduler(t, database.MissedRunSkip)
+	day := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// The first pass only schedules the next run.
+	if next, want := s.runDue(day.Add(7*time.Hour)), day.Add(8*time.Hour); !next.Equal(want) {
+		t.Fatalf("runDue() = %v, want %v", next, want)
+	}
+
+	if p.count() != 0 || len(getRuns(t, db, schedule.ID)) != 0 {
+		t.Fatal("schedule ran before it was due")
+	}
+
+	// Nothing runs before the next run time.
+	s.runDue(day.Add(7*time.Hour + 59*time.Minute))
+	if p.count() != 0 {
+		t.Fatal("schedule ran before it was due")
+	}
+
+	next := s.runDue(day.Add(8*time.Hour + 10*time.Second))
+	if want := day.Add(32 * time.Hour); !next.Equal(want) {
+		t.Errorf("runDue() = %v, want %v", next, want)
+	}
+
+	if p.count() != 1 || p.topics[0] != "commands/fan" {
+		t.Errorf("published to %v, want [commands/fan]", p.topics)
+	}
+
+	runs := getRuns(t, db, schedule.ID)
+	if len(runs) != 1 || runs[0].Status != database.ScheduleRunSucceeded || !runs[0].ScheduledFor.Equal(day.Add(8*time.Hour)) {
+		t.Fatalf("runs = %+v, want one successful run", runs)
+	}
+
+	stored, err := db.GetSchedule(schedule.ID)
+	if err != nil {
+		t.Fatalf("GetSchedule() error = %v", err)
+	}
+
+	if stored.LastRunAt == nil || stored.NextRunAt == nil || !stored.NextRunAt.Equal(day.Add(32*time.Hour)) {
+		t.Errorf("last run = %v, next run = %v", stored.LastRunAt, stored.NextRunAt)
+	}
+
+	// Running again at the same time does not run the schedule twice.
+	s.runDue(day.Add(8*time.Hour + 20*time.Second))
+	if p.count() != 1 {
+		t.Errorf("schedule ran %d times, want 1", p.count())
+	}
+}
+
+func TestMissedRuns(t *testing.T) {
+	day := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		policy database.MissedRunPolicy
+		// late is how long after the due time the scheduler runs.
+		late     time.Duration
+		status   database.ScheduleRunStatus
+		commands int
+	}{
+		{database.MissedRunSkip, 30 * time.Second, database.ScheduleRunSucceeded, 1},
+		{database.MissedRunSkip, 3 * 24 * time.Hour, database.ScheduleRunSkipped, 0},
+		// Catching up runs once, however many runs were missed.
+		{database.MissedRunCatchUp, 3 * 24 * time.Hour, database.ScheduleRunSucceeded, 1},
+	}
+
+	for _, tt := range tests {
+		s, db, p, schedule := newTestScheduler(t, tt.policy)
+		due := day.Add(8 * time.Hour)
+		if err := db.SetScheduleNextRun(schedule.ID, &due); err != nil {
+			t.Fatalf("SetScheduleNextRun() error = %v", err)
+		}
+
+		now := due.Add(tt.late)
+		next := s.runDue(now)
+		if want, _ := s.Next(schedule.Expression, now); !next.Equal(want) {
+			t.Errorf("%s, %v late: runDue() = %v, want %v", tt.policy, tt.late, next, want)
+		}
+
+		runs := getRuns(t, db, schedule.ID)
+		if len(runs) != 1 || runs[0].Status != tt.status {
+			t.Errorf("%s, %v late: runs = %+v, want one %s run", tt.policy, tt.late, runs, tt.status)
+		}
+
+		if p.count() != tt.commands {
+			t.Errorf("%s, %v late: %d commands sent, want %d", tt.policy, tt.late, p.count(), tt.commands)
+		}
+
+		stored, err := db.GetSchedule(schedule.ID)
+		if err != nil {
+			t.Fatalf("GetSchedule() error = %v", err)
+		}
+
+		// Skipped runs do not count as the last run.
+		if ran := stored.LastRunAt != nil; ran != (tt.status != database.ScheduleRunSkipped) {
+			t.Errorf("%s, %v late: last run = %v", tt.policy, tt.late, stored.LastRunAt)
+		}
+	}
+}
+
+func TestFailedRun(t *testing.T) {
+	s, db, _, schedule := newTestScheduler(t, database.MissedRunSkip)
+	schedule.Actions = append(schedule.Actions, database.AutomationAction{SerialNumber: "missing", Command: "on"})
+	if err := db.UpdateSchedule(schedule); err != nil {
+		t.Fatalf("UpdateSchedule() error = %v", err)
+	}
+
+	run, err := s.RunNow(schedule)
+	if err != nil {
+		t.Fatalf("RunNow() error = %v", err)
+	}
+
+	if run.Status != database.ScheduleRunFailed || run.Error == "" || len(run.Output) == 0 {
+		t.Errorf("run = %+v, want a failed run with the action results", run)
+	}
+}
+
+func TestNextNeverOccurs(t *testing.T) {
+	s, _, _, _ := newTestScheduler(t, database.MissedRunSkip)
+	if _, err := s.Next("0 0 30 2 *", time.Now()); err == nil {
+		t.Error("Next() error = nil, want an error")
+	}
+
+	if _, err := s.Next("not cron", time.Now()); err == nil {
+		t.Error("Next() error = nil, want an error")
+	}
+}
@@ -0,0 +1,212 @@
+// Package stream fans out newly ingested readings and server events to live subscribers, such as
+// Server-Sent Events clients.
+package stream
+
+import (
+	"encoding/json"
+	"errors"
+	"hafh-server/internal/database"
+	"hafh-server/internal/events"
+	"hafh-server/internal/logger"
+	"slices"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// ReadingEvent is the event name of readings, alongside the [events.Type] of server events.
+const ReadingEvent = "reading"
+
+// bufferSize is how many messages a subscriber can fall behind before it is dropped.
+const bufferSize = 256
+
+// Message is a reading or server event delivered to subscribers.
+type Message struct {
+	// ReadingID is the ID of the reading, or zero for server events.
+	ReadingID int
+	// Event is [ReadingEvent] or the type of the server event.
+	Event string
+	// Data is the JSON encoded reading or server event.
+	Data []byte
+	// SerialNumber and Tags identify the peripheral the message is about, if any.
+	SerialNumber string
+	Tags         []string
+}
+
+// Filter narrows down the messages delivered to a subscriber. Zero-valued fields are ignored.
+type Filter struct {
+	SerialNumbers []string
+	Tag           string
+	// Events are [ReadingEvent] and/or server event types.
+	Events []string
+}
+
+// Matches returns true if the message passes the filter. Messages that are not about a peripheral
+// never match a serial number or tag filter.
+func (f *Filter) Matches(m *Message) bool {
+	if len(f.Events) > 0 && !slices.Contains(f.Events, m.Event) {
+		return false
+	} else if len(f.SerialNumbers) > 0 && !slices.Contains(f.SerialNumbers, m.SerialNumber) {
+		return false
+	} else if f.Tag != "" && !slices.Contains(m.Tags, f.Tag) {
+		return false
+	}
+
+	return true
+}
+
+// Subscription receives the messages matching its filter on C until it is closed. C is closed when
+// the subscription is closed, including when the hub drops a subscriber that fell too far behind.
+type Subscription struct {
+	C      <-chan *Message
+	c      chan *Message
+	filter Filter
+	hub    *Hub
+	closed bool
+}
+
+// Close unsubscribes from the hub. It is safe to call more than once.
+func (s *Subscription) Close() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+
+	s.hub.remove(s)
+}
+
+// Hub delivers readings (from the ingest path) and server events (from the event bus) to every
+// matching subscriber. Delivery never blocks: a subscriber whose buffer is full is dropped, and is
+// expected to resubscribe and catch up on the readings it missed.
+type Hub struct {
+	db          *database.Database
+	log         *zap.SugaredLogger
+	mu          sync.Mutex
+	subscribers map[*Subscription]struct{}
+}
+
+// NewHub creates a new [Hub] that looks up the tags of the peripherals in server events in the
+// given database.
+func NewHub(db *database.Database) (*Hub, error) {
+	if db == nil {
+		return nil, errors.New("database is required")
+	}
+
+	return &Hub{
+		db:          db,
+		log:         logger.Named("stream"),
+		subscribers: map[*Subscription]struct{}{},
+	}, nil
+}
+
+// Subscribe creates a new subscription for the messages matching the filter.
+func (h *Hub) Subscribe(filter Filter) *Subscription {
+	c := make(chan *Message, bufferSize)
+	s := &Subscription{C: c, c: c, filter: filter, hub: h}
+
+	h.mu.Lock()
+	h.subscribers[s] = struct{}{}
+	h.mu.Unlock()
+
+	return s
+}
+
+// OnReading delivers a newly ingested reading. It has the signature of an ingest.ReadingListener.
+func (h *Hub) OnReading(reading *database.Reading, peripheral *database.Peripheral) {
+	if !h.hasSubscribers() {
+		return
+	}
+
+	data, err := json.Marshal(reading)
+	if err != nil {
+		h.log.Errorf("Failed to encode reading: %v", err)
+		return
+	}
+
+	message := &Message{
+		ReadingID:    reading.ID,
+		Event:        ReadingEvent,
+		Data:         data,
+		SerialNumber: reading.SerialNumber,
+	}
+
+	if peripheral != nil {
+		message.Tags = peripheral.Tags
+	}
+
+	h.publish(message)
+}
+
+// OnEvent delivers a server event. It has the signature of an [events.Handler].
+func (h *Hub) OnEvent(event events.Event) {
+	if !h.hasSubscribers() {
+		return
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		h.log.Errorf("Failed to encode event: %v", err)
+		return
+	}
+
+	message := &Message{Event: string(event.Type), Data: data}
+
+	// Most events are about a peripheral, whose tags are needed for filtering.
+	var subject struct {
+		Data struct {
+			SerialNumber string `json:"serial_number"`
+		} `json:"data"`
+	}
+
+	if err := json.Unmarshal(data, &subject); err == nil && subject.Data.SerialNumber != "" {
+		message.SerialNumber = subject.Data.SerialNumber
+		if p, err := h.db.GetPeripheralBySerial(message.SerialNumber); err == nil && p != nil {
+			message.Tags = p.Tags
+		}
+	}
+
+	h.publish(message)
+}
+
+// Subscribers returns the number of subscriptions, i.e. of connected streaming clients (a
+// WebSocket client may have several).
+func (h *Hub) Subscribers() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return len(h.subscribers)
+}
+
+func (h *Hub) hasSubscribers() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return len(h.subscribers) > 0
+}
+
+func (h *Hub) publish(message *Message) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for s := range h.subscribers {
+		if !s.filter.Matches(message) {
+			continue
+		}
+
+		select {
+		case s.c <- message:
+		default:
+			h.log.Warnf("Dropping a subscriber that fell %d messages behind", bufferSize)
+			h.remove(s)
+		}
+	}
+}
+
+// remove unsubscribes and closes a subscription. The lock must be held.
+func (h *Hub) remove(s *Subscription) {
+	if s.closed {
+		return
+	}
+
+	s.closed = true
+	delete(h.subscribers, s)
+	close(s.c)
+}
@@ -0,0 +1,176 @@
+package stream
+
+import (
+	"encoding/json"
+	"hafh-server/internal/database"
+	"hafh-server/internal/events"
+	"hafh-server/internal/logger"
+	"testing"
+)
+
+func init() {
+	logger.Init(false)
+}
+
+func newTestHub(t *testing.T) (*Hub, *database.Database) {
+	t.Helper()
+
+	db, err := database.New(":memory:")
+	if err != nil {
+		t.Fatalf("database.New() error = %v", err)
+	}
+
+	t.Cleanup(func() { db.Close() })
+
+	hub, err := NewHub(db)
+	if err != nil {
+		t.Fatalf("NewHub() error = %v", err)
+	}
+
+	return hub, db
+}
+
+// receive returns the messages buffered for a subscription.
+func receive(s *Subscription) []*Message {
+	var messages []*Message
+	for {
+		select {
+		case m, ok := <-s.C:
+			if !ok {
+				return messages
+			}
+			messages = append(messages, m)
+		default:
+			return messages
+		}
+	}
+}
+
+func TestFilter(t *testing.T) {
+	reading := &Message{ReadingID: 1, Event: ReadingEvent, SerialNumber: "a", Tags: []string{"kitchen"}}
+	event := &Message{Event: string(events.PeripheralRegistered), SerialNumber: "b"}
+	serverEvent := &Message{Event: string(events.ReportGenerated)}
+
+	tests := []struct {
+		filter Filter
+		want   []bool
+	}{
+		{Filter{}, []bool{true, true, true}},
+		{Filter{Events: []string{ReadingEvent}}, []bool{true, false, false}},
+		{Filter{Events: []string{ReadingEvent, string(events.ReportGenerated)}}, []bool{true, false, true}},
+		{Filter{SerialNumbers: []string{"a"}}, []bool{true, false, false}},
+		{Filter{SerialNumbers: []string{"a", "b"}}, []bool{true, true, false}},
+		{Filter{Tag: "kitchen"}, []bool{true, false, false}},
+		{Filter{Tag: "garage"}, []bool{false, false, false}},
+		{Filter{SerialNumbers: []string{"b"}, Tag: "kitchen"}, []bool{false, false, false}},
+	}
+
+	for _, tt := range tests {
+		for i, m := range []*Message{reading, event, serverEvent} {
+			if got := tt.filter.Matches(m); got != tt.want[i] {
+				t.Errorf("%+v.Matches(%s of %q) = %v, want %v", tt.filter, m.Event, m.SerialNumber, got, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestReadings(t *testing.T) {
+	hub, _ := newTestHub(t)
+	all := hub.Subscribe(Filter{})
+	kitchen := hub.Subscribe(Filter{Tag: "kitchen"})
+	registered := hub.Subscribe(Filter{Events: []string{string(events.PeripheralRegistered)}})
+
+	reading := &database.Reading{ID: 7, SerialNumber: "a", Data: map[string]any{"t": 21.5}}
+	hub.OnReading(reading, &database.Peripheral{SerialNumber: "a", Tags: []string{"kitchen"}})
+	hub.OnReading(&database.Reading{ID: 8, SerialNumber: "b"}, &database.Peripheral{SerialNumber: "b"})
+
+	messages := receive(all)
+	if len(messages) != 2 {
+		t.Fatalf("received %d messages, want 2", len(messages))
+	}
+
+	m := messages[0]
+	if m.ReadingID != 7 || m.Event != ReadingEvent || m.SerialNumber != "a" {
+		t.Errorf("message = %+v", m)
+	}
+
+	var decoded database.Reading
+	if err := json.Unmarshal(m.Data, &decoded); err != nil || decoded.ID != 7 || decoded.Data["t"] != 21.5 {
+		t.Errorf("data = %s, %v", m.Data, err)
+	}
+
+	if messages := receive(kitchen); len(messages) != 1 || messages[0].ReadingID != 7 {
+		t.Errorf("kitchen received %+v, want reading 7", messages)
+	}
+
+	if messages := receive(registered); len(messages) != 0 {
+		t.Errorf("registered subscriber received %d readings", len(messages))
+	}
+}
+
+func TestEvents(t *testing.T) {
+	hub, db := newTestHub(t)
+	if err := db.AddPeripheral(&database.Peripheral{SerialNumber: "a", Type: database.PeripheralTypeSensor}); err != nil {
+		t.Fatalf("AddPeripheral() error = %v", err)
+	}
+
+	tags := []string{"kitchen"}
+	if err := db.PatchPeripheral(&database.Peripheral{SerialNumber: "a", Type: database.PeripheralTypeSensor},
+		database.PeripheralMetadataUpdate{Tags: &tags}); err != nil {
+		t.Fatalf("PatchPeripheral() error = %v", err)
+	}
+
+	kitchen := hub.Subscribe(Filter{Tag: "kitchen"})
+	all := hub.Subscribe(Filter{})
+
+	// The tags of the peripheral an event is about are looked up, so the event can be filtered.
+	hub.OnEvent(events.New(events.PeripheralRegistered, &database.Peripheral{SerialNumber: "a"}))
+	hub.OnEvent(events.New(events.ReportGenerated, map[string]any{"schedule_id": 1}))
+
+	messages := receive(kitchen)
+	if len(messages) != 1 {
+		t.Fatalf("kitchen received %d messages, want 1", len(messages))
+	}
+
+	if m := messages[0]; m.Event != string(events.PeripheralRegistered) || m.SerialNumber != "a" || m.ReadingID != 0 {
+		t.Errorf("message = %+v", m)
+	}
+
+	if messages := receive(all); len(messages) != 2 {
+		t.Errorf("received %d messages, want 2", len(messages))
+	}
+}
+
+func TestSlowSubscriber(t *testing.T) {
+	hub, _ := newTestHub(t)
+	slow := hub.Subscribe(Filter{})
+	fast := hub.Subscribe(Filter{})
+
+	for i := range bufferSize + 1 {
+		hub.OnReading(&database.Reading{ID: i + 1, SerialNumber: "a"}, nil)
+		receive(fast)
+	}
+
+	// The slow subscriber is dropped, and its channel closed after the buffered messages.
+	if got := len(receive(slow)); got != bufferSize {
+		t.Errorf("slow subscriber received %d messages, want %d", got, bufferSize)
+	}
+
+	if _, ok := <-slow.C; ok {
+		t.Error("slow subscription is still open")
+	}
+
+	if got := hub.Subscribers(); got != 1 {
+		t.Errorf("Subscribers() = %d, want 1", got)
+	}
+
+	// Closing a dropped subscription is harmless.
+	slow.Close()
+	fast.Close()
+	fast.Close()
+	if got := hub.Subscribers(); got != 0 {
+		t.Errorf("Subscribers() = %d after closing, want 0", got)
+	}
+
+	hub.OnReading(&database.Reading{ID: bufferSize + 2, SerialNumber: "a"}, nil)
+}
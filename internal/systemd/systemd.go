@@ -0,0 +1,124 @@
+// Package systemd implements the parts of the systemd service protocol used by the server: readiness,
+// status and watchdog notifications (sd_notify) and socket activation (sd_listen_fds). Every
+// function is a no-op when the server is not run by systemd.
+package systemd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Notification states, see sd_notify(3).
+const (
+	Ready    = "READY=1"
+	Stopping = "STOPPING=1"
+	Watchdog = "WATCHDOG=1"
+)
+
+// listenFDsStart is the first file descriptor passed by socket activation.
+const listenFDsStart = 3
+
+// Notify sends the given states (e.g. [Ready], or [Status]) to systemd. It returns false if the
+// server is not run by a systemd service of Type=notify.
+func Notify(states ...string) (bool, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false, nil
+	}
+
+	// Names starting with "@" are abstract sockets, which the net package handles.
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(strings.Join(states, "\n"))); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Status returns the state that describes the status of the server, e.g. "Waiting for ngrok",
+// as shown by `systemctl status`.
+func Status(format string, args ...any) string {
+	// A status is a single line.
+	return "STATUS=" + strings.ReplaceAll(fmt.Sprintf(format, args...), "\n", " ")
+}
+
+// WatchdogInterval returns how often systemd expects a [Watchdog] notification, and false if the
+// watchdog is not enabled for the server.
+func WatchdogInterval() (time.Duration, bool) {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0, false
+	}
+
+	// The watchdog may be meant for another process, e.g. a parent shell.
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, false
+	}
+
+	return time.Duration(usec) * time.Microsecond, true
+}
+
+// Listeners returns the listening sockets passed by socket activation, keyed by their
+// FileDescriptorName in the socket unit (e.g. "http"). Sockets without a name are keyed by their
+// socket unit's name. It returns nil if no sockets were passed, and must only be called once.
+func Listeners() (map[string]net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, nil
+	}
+
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	// The sockets are not passed on to child processes.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := make(map[string]net.Listener, count)
+	for i := range count {
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		file := os.NewFile(uintptr(listenFDsStart+i), name)
+		listener, err := net.FileListener(file)
+		// The listener has its own copy of the file descriptor.
+		file.Close()
+		if err == nil {
+			if _, ok := listeners[name]; ok {
+				listener.Close()
+				err = errors.New("more than one socket is named " + name)
+			}
+		} else {
+			err = fmt.Errorf("socket %s is not a listening socket: %w", name, err)
+		}
+
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+
+			return nil, err
+		}
+
+		listeners[name] = listener
+	}
+
+	return listeners, nil
+}
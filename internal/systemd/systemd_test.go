@@ -0,0 +1,78 @@
+package systemd
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if ok, err := Notify(Ready); ok || err != nil {
+		t.Errorf("Notify() without systemd = %v, %v, want false, nil", ok, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("ListenUnixgram() error = %v", err)
+	}
+
+	defer conn.Close()
+
+	t.Setenv("NOTIFY_SOCKET", path)
+	if ok, err := Notify(Ready, Status("Waiting for %s", "ngrok:\nnot connected")); !ok || err != nil {
+		t.Fatalf("Notify() = %v, %v, want true, nil", ok, err)
+	}
+
+	buffer := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buffer)
+	if err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+
+	if got, want := string(buffer[:n]), "READY=1\nSTATUS=Waiting for ngrok: not connected"; got != want {
+		t.Errorf("notification = %q, want %q", got, want)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+	tests := []struct {
+		usec, pid string
+		want      time.Duration
+		wantOK    bool
+	}{
+		{"", "", 0, false},
+		{"0", "", 0, false},
+		{"invalid", "", 0, false},
+		{"30000000", "", 30 * time.Second, true},
+		{"30000000", pid, 30 * time.Second, true},
+		{"30000000", "1", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Setenv("WATCHDOG_USEC", tt.usec)
+		t.Setenv("WATCHDOG_PID", tt.pid)
+
+		if got, ok := WatchdogInterval(); got != tt.want || ok != tt.wantOK {
+			t.Errorf("WatchdogInterval() with %q for %q = %v, %v, want %v, %v", tt.usec, tt.pid, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestListenersWithoutSystemd(t *testing.T) {
+	// Sockets passed to another process (e.g. a parent) are not ours to use.
+	for _, pid := range []string{"", "1"} {
+		t.Setenv("LISTEN_PID", pid)
+		t.Setenv("LISTEN_FDS", "1")
+
+		if listeners, err := Listeners(); listeners != nil || err != nil {
+			t.Errorf("Listeners() for PID %q = %v, %v, want nil, nil", pid, listeners, err)
+		}
+	}
+}
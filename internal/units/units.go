@@ -0,0 +1,101 @@
+package units
+
+import (
+	"errors"
+	"math"
+)
+
+// System is a system of measurement that reading values can be converted to.
+type System string
+
+const (
+	// SystemNone leaves values in the unit they were reported in.
+	SystemNone     System = ""
+	SystemMetric   System = "metric"
+	SystemImperial System = "imperial"
+)
+
+// SystemFromString converts a string to a System.
+func SystemFromString(s string) (System, error) {
+	switch System(s) {
+	case SystemNone, SystemMetric, SystemImperial:
+		return System(s), nil
+	default:
+		return SystemNone, errors.New("invalid unit system: " + s)
+	}
+}
+
+type conversion struct {
+	to      string
+	convert func(float64) float64
+}
+
+func linear(scale float64) func(float64) float64 {
+	return func(v float64) float64 { return v * scale }
+}
+
+// toImperial maps metric units to their imperial equivalents.
+var toImperial = map[string]conversion{
+	"C":    {"F", func(v float64) float64 { return v*9/5 + 32 }},
+	"°C":   {"°F", func(v float64) float64 { return v*9/5 + 32 }},
+	"mm":   {"in", linear(1 / 25.4)},
+	"cm":   {"in", linear(1 / 2.54)},
+	"m":    {"ft", linear(1 / 0.3048)},
+	"km":   {"mi", linear(1 / 1.609344)},
+	"m/s":  {"mph", linear(2.2369362920544)},
+	"km/h": {"mph", linear(1 / 1.609344)},
+	"g":    {"oz", linear(1 / 28.349523125)},
+	"kg":   {"lb", linear(1 / 0.45359237)},
+	"L":    {"gal", linear(1 / 3.785411784)},
+	"hPa":  {"inHg", linear(1 / 33.8638866667)},
+	"kPa":  {"psi", linear(1 / 6.894757293168)},
+}
+
+// toMetric maps imperial units to their metric equivalents.
+var toMetric = map[string]conversion{
+	"F":    {"C", func(v float64) float64 { return (v - 32) * 5 / 9 }},
+	"°F":   {"°C", func(v float64) float64 { return (v - 32) * 5 / 9 }},
+	"in":   {"mm", linear(25.4)},
+	"ft":   {"m", linear(0.3048)},
+	"mi":   {"km", linear(1.609344)},
+	"mph":  {"km/h", linear(1.609344)},
+	"oz":   {"g", linear(28.349523125)},
+	"lb":   {"kg", linear(0.45359237)},
+	"gal":  {"L", linear(3.785411784)},
+	"inHg": {"hPa", linear(33.8638866667)},
+	"psi":  {"kPa", linear(6.894757293168)},
+}
+
+// Convert converts a value in the given unit to the given system. The converted value and its unit
+// are returned, along with whether a conversion was applied. Values whose unit is unknown or already
+// in the target system are returned unchanged.
+func Convert(value float64, unit string, system System) (float64, string, bool) {
+	var table map[string]conversion
+	switch system {
+	case SystemMetric:
+		table = toMetric
+	case SystemImperial:
+		table = toImperial
+	default:
+		return value, unit, false
+	}
+
+	c, ok := table[unit]
+	if !ok {
+		return value, unit, false
+	}
+
+	return c.convert(value), c.to, true
+}
+
+// ConvertUnit returns the unit a value in the given unit would be converted to in the given system.
+func ConvertUnit(unit string, system System) string {
+	_, converted, _ := Convert(0, unit, system)
+	return converted
+}
+
+// Round rounds a value to the given number of decimal places.
+func Round(value float64, precision int) float64 {
+	scale := math.Pow(10, float64(precision))
+	return math.Round(value*scale) / scale
+}
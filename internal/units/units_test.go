@@ -0,0 +1,81 @@
+package units
+
+import (
+	"math"
+	"testing"
+)
+
+func TestConvert(t *testing.T) {
+	tests := []struct {
+		value     float64
+		unit      string
+		system    System
+		want      float64
+		wantUnit  string
+		converted bool
+	}{
+		{20, "°C", SystemImperial, 68, "°F", true},
+		{68, "°F", SystemMetric, 20, "°C", true},
+		{-40, "C", SystemImperial, -40, "F", true},
+		{1, "in", SystemMetric, 25.4, "mm", true},
+		{1, "kg", SystemImperial, 2.20462, "lb", true},
+		{20, "°C", SystemMetric, 20, "°C", false},
+		{20, "°C", SystemNone, 20, "°C", false},
+		{50, "%", SystemImperial, 50, "%", false},
+	}
+
+	for _, tt := range tests {
+		got, unit, converted := Convert(tt.value, tt.unit, tt.system)
+		if math.Abs(got-tt.want) > 1e-4 || unit != tt.wantUnit || converted != tt.converted {
+			t.Errorf("Convert(%v, %q, %q) = %v, %q, %v, want %v, %q, %v",
+				tt.value, tt.unit, tt.system, got, unit, converted, tt.want, tt.wantUnit, tt.converted)
+		}
+	}
+}
+
+func TestConvertRoundTrip(t *testing.T) {
+	for unit, c := range toImperial {
+		back, ok := toMetric[c.to]
+		if !ok {
+			t.Errorf("%s converts to %s, which has no metric conversion", unit, c.to)
+			continue
+		}
+
+		// Only the °C/°F and C/F pairs convert back to the same unit; the others, e.g. cm, convert
+		// back to the base unit of the dimension, e.g. mm.
+		if got := back.convert(c.convert(10)); back.to == unit && math.Abs(got-10) > 1e-9 {
+			t.Errorf("%s -> %s -> %s: 10 became %v", unit, c.to, back.to, got)
+		}
+	}
+}
+
+func TestSystemFromString(t *testing.T) {
+	for _, s := range []string{"", "metric", "imperial"} {
+		if _, err := SystemFromString(s); err != nil {
+			t.Errorf("SystemFromString(%q) error = %v", s, err)
+		}
+	}
+
+	if _, err := SystemFromString("Metric"); err == nil {
+		t.Error("SystemFromString(\"Metric\") succeeded")
+	}
+}
+
+func TestRound(t *testing.T) {
+	tests := []struct {
+		value     float64
+		precision int
+		want      float64
+	}{
+		{21.456, 1, 21.5},
+		{21.456, 0, 21},
+		{-1.25, 1, -1.3},
+		{1234.5, -2, 1200},
+	}
+
+	for _, tt := range tests {
+		if got := Round(tt.value, tt.precision); got != tt.want {
+			t.Errorf("Round(%v, %d) = %v, want %v", tt.value, tt.precision, got, tt.want)
+		}
+	}
+}
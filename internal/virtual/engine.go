@@ -0,0 +1,308 @@
+// Package virtual computes the readings of virtual peripherals from the readings of other
+// peripherals.
+package virtual
+
+import (
+	"context"
+	"errors"
+	"hafh-server/internal/database"
+	"hafh-server/internal/expr"
+	"hafh-server/internal/ingest"
+	"hafh-server/internal/logger"
+	"math"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// minRecomputeInterval throttles recomputing a virtual peripheral when its inputs report often,
+// which also bounds virtual peripherals that (indirectly) depend on each other.
+const minRecomputeInterval = time.Second
+
+// tickInterval is how often the engine checks for virtual peripherals to recompute.
+const tickInterval = time.Second
+
+// virtualState is a virtual peripheral known to the engine.
+type virtualState struct {
+	definition   database.VirtualPeripheral
+	expressions  []*expr.Expression
+	lastComputed time.Time
+	dirty        bool
+}
+
+// Engine recomputes virtual peripherals whenever one of their inputs reports a reading, and on
+// their interval. Computed readings are run through the ingest path, so they are stored and
+// evaluated like any other reading.
+type Engine struct {
+	db        *database.Database
+	processor *ingest.Processor
+	log       *zap.SugaredLogger
+
+	mu       sync.Mutex
+	virtuals map[string]*virtualState
+	// changedSerials holds the serial numbers of peripherals that reported readings since the last
+	// tick, and changedTags the serial numbers of those peripherals per tag.
+	changedSerials map[string]bool
+	changedTags    map[string]map[string]bool
+	reload         bool
+	wake           chan struct{}
+}
+
+// NewEngine creates a new [Engine] that stores computed readings through the given processor.
+func NewEngine(db *database.Database, processor *ingest.Processor) (*Engine, error) {
+	if db == nil {
+		return nil, errors.New("database is required")
+	} else if processor == nil {
+		return nil, errors.New("processor is required")
+	}
+
+	return &Engine{
+		db:             db,
+		processor:      processor,
+		log:            logger.Named("virtual"),
+		virtuals:       map[string]*virtualState{},
+		changedSerials: map[string]bool{},
+		changedTags:    map[string]map[string]bool{},
+		reload:         true,
+		wake:           make(chan struct{}, 1),
+	}, nil
+}
+
+// Reload reloads the virtual peripheral definitions after they have changed.
+func (e *Engine) Reload() {
+	e.mu.Lock()
+	e.reload = true
+	e.mu.Unlock()
+
+	e.signal()
+}
+
+// OnReading marks the virtual peripherals that depend on the reporting peripheral for recomputing.
+// It is an [ingest.ReadingListener] and never blocks.
+func (e *Engine) OnReading(reading *database.Reading, peripheral *database.Peripheral) {
+	e.mu.Lock()
+	e.changedSerials[reading.SerialNumber] = true
+	if peripheral != nil {
+		for _, tag := range peripheral.Tags {
+			if e.changedTags[tag] == nil {
+				e.changedTags[tag] = map[string]bool{}
+			}
+			e.changedTags[tag][reading.SerialNumber] = true
+		}
+	}
+	e.mu.Unlock()
+
+	e.signal()
+}
+
+func (e *Engine) signal() {
+	select {
+	case e.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Start recomputes virtual peripherals until the context is cancelled. **This should be called in
+// a separate goroutine.**
+func (e *Engine) Start(ctx context.Context) {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+
+	for {
+		e.tick(time.Now())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-e.wake:
+		}
+	}
+}
+
+// tick recomputes every virtual peripheral whose inputs changed or whose interval elapsed.
+func (e *Engine) tick(now time.Time) {
+	e.mu.Lock()
+	reload := e.reload
+	changedSerials, changedTags := e.changedSerials, e.changedTags
+	e.reload = false
+	e.changedSerials, e.changedTags = map[string]bool{}, map[string]map[string]bool{}
+	e.mu.Unlock()
+
+	// The state is only ever accessed from this goroutine, so it is safe to use without the lock.
+	if reload {
+		e.load()
+	}
+
+	for serial, state := range e.virtuals {
+		for _, input := range state.definition.Inputs {
+			if changedSerials[input.SerialNumber] || changedOther(changedTags[input.Tag], serial) {
+				state.dirty = true
+			}
+		}
+
+		interval := state.definition.Interval()
+		due := state.dirty || (interval > 0 && now.Sub(state.lastComputed) >= interval)
+		if !due || now.Sub(state.lastComputed) < minRecomputeInterval {
+			continue
+		}
+
+		state.dirty = false
+		state.lastComputed = now
+		if err := e.compute(state, now); err != nil {
+			e.log.Errorf("Failed to compute virtual peripheral %s: %v", serial, err)
+		}
+	}
+}
+
+// changedOther returns true if any peripheral other than self changed, so that virtual peripherals
+// with the tag of their own inputs are not recomputed by their own readings.
+func changedOther(serials map[string]bool, self string) bool {
+	for serial := range serials {
+		if serial != self {
+			return true
+		}
+	}
+
+	return false
+}
+
+// load reloads the definitions from the database, keeping the state of unchanged peripherals.
+func (e *Engine) load() {
+	virtuals, err := e.db.GetVirtualPeripherals()
+	if err != nil {
+		e.log.Errorf("Failed to get virtual peripherals: %v", err)
+		return
+	}
+
+	states := make(map[string]*virtualState, len(virtuals))
+	for _, v := range virtuals {
+		state := &virtualState{definition: v, dirty: true}
+		if previous, ok := e.virtuals[v.SerialNumber]; ok {
+			state.lastComputed = previous.lastComputed
+		}
+
+		for _, f := range v.Fields {
+			expression, err := expr.Parse(f.Expression)
+			if err != nil {
+				e.log.Warnf("Skipping invalid field %s of virtual peripheral %s: %v", f.Name, v.SerialNumber, err)
+			}
+			state.expressions = append(state.expressions, expression)
+		}
+
+		states[v.SerialNumber] = state
+	}
+
+	e.virtuals = states
+}
+
+// compute computes a reading of the virtual peripheral and ingests it. No reading is stored if
+// none of the fields can be computed, e.g. because the inputs have not reported yet.
+func (e *Engine) compute(state *virtualState, now time.Time) error {
+	vars := map[string]float64{}
+	for _, input := range state.definition.Inputs {
+		value, ok, err := e.inputValue(state.definition.SerialNumber, &input, now)
+		if err != nil {
+			return err
+		} else if ok {
+			vars[input.Name] = value
+		}
+	}
+
+	data := map[string]any{}
+	for i, f := range state.definition.Fields {
+		if state.expressions[i] == nil {
+			continue
+		}
+
+		value, err := state.expressions[i].Eval(vars)
+		if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+			e.log.Debugf("Skipping field %s of virtual peripheral %s: %v", f.Name, state.definition.SerialNumber, err)
+			continue
+		}
+
+		data[f.Name] = value
+		vars[f.Name] = value
+	}
+
+	if len(data) == 0 {
+		return nil
+	}
+
+	return e.processor.Process(&database.Reading{
+		SerialNumber: state.definition.SerialNumber,
+		Data:         data,
+	})
+}
+
+// inputValue computes the value of an input, returning false if there are no values to aggregate.
+func (e *Engine) inputValue(self string, input *database.VirtualInput, now time.Time) (float64, bool, error) {
+	serials := []string{input.SerialNumber}
+	if input.Tag != "" {
+		peripherals, err := e.db.FindPeripherals(database.PeripheralFilter{Tag: input.Tag})
+		if err != nil {
+			return 0, false, err
+		}
+
+		serials = serials[:0]
+		for _, p := range peripherals {
+			if p.SerialNumber != self {
+				serials = append(serials, p.SerialNumber)
+			}
+		}
+	}
+
+	var since *time.Time
+	if window := input.Window(); window > 0 {
+		start := now.Add(-window)
+		since = &start
+	}
+
+	values, err := e.db.GetVirtualInputValues(serials, input.Field, since)
+	if err != nil {
+		return 0, false, err
+	}
+
+	if input.Aggregate == database.AggregateCount {
+		return float64(len(values)), true, nil
+	} else if len(values) == 0 {
+		return 0, false, nil
+	}
+
+	return Aggregate(input.Aggregate, values), true, nil
+}
+
+// Aggregate combines values with the given aggregate. The values must not be empty.
+func Aggregate(aggregate database.VirtualAggregate, values []float64) float64 {
+	switch aggregate {
+	case database.AggregateMean:
+		sum := 0.0
+		for _, v := range values {
+			sum += v
+		}
+		return sum / float64(len(values))
+	case database.AggregateMin:
+		result := values[0]
+		for _, v := range values[1:] {
+			result = math.Min(result, v)
+		}
+		return result
+	case database.AggregateMax:
+		result := values[0]
+		for _, v := range values[1:] {
+			result = math.Max(result, v)
+		}
+		return result
+	case database.AggregateSum:
+		sum := 0.0
+		for _, v := range values {
+			sum += v
+		}
+		return sum
+	case database.AggregateCount:
+		return float64(len(values))
+	default:
+		return values[len(values)-1]
+	}
+}
@@ -0,0 +1,234 @@
+package virtual
+
+import (
+	"hafh-server/internal/database"
+	"hafh-server/internal/ingest"
+	"hafh-server/internal/logger"
+	"testing"
+	"time"
+)
+
+func init() {
+	logger.Init(false)
+}
+
+func TestAggregate(t *testing.T) {
+	values := []float64{3, -1, 4, 2}
+
+	tests := []struct {
+		aggregate database.VirtualAggregate
+		want      float64
+	}{
+		{database.AggregateLast, 2},
+		{database.AggregateMean, 2},
+		{database.AggregateMin, -1},
+		{database.AggregateMax, 4},
+		{database.AggregateSum, 8},
+		{database.AggregateCount, 4},
+	}
+
+	for _, tt := range tests {
+		if got := Aggregate(tt.aggregate, values); got != tt.want {
+			t.Errorf("Aggregate(%s) = %v, want %v", tt.aggregate, got, tt.want)
+		}
+	}
+}
+
+type testEngine struct {
+	*Engine
+	t         *testing.T
+	db        *database.Database
+	processor *ingest.Processor
+}
+
+// newTestEngine returns an engine with sensors "t1" and "t2" tagged "room", a power meter "meter",
+// and a virtual peripheral "house", also tagged "room", with the mean temperature of the room and
+// the energy reported by the meter in the last hour.
+func newTestEngine(t *testing.T) *testEngine {
+	t.Helper()
+
+	db, err := database.New(":memory:")
+	if err != nil {
+		t.Fatalf("database.New() error = %v", err)
+	}
+
+	t.Cleanup(func() { db.Close() })
+
+	processor, err := ingest.NewProcessor(db, nil)
+	if err != nil {
+		t.Fatalf("NewProcessor() error = %v", err)
+	}
+
+	engine, err := NewEngine(db, processor)
+	if err != nil {
+		t.Fatalf("NewEngine() error = %v", err)
+	}
+
+	processor.OnReading(engine.OnReading)
+
+	for _, serial := range []string{"t1", "t2", "meter"} {
+		if err := db.AddPeripheral(&database.Peripheral{SerialNumber: serial, Type: database.PeripheralTypeSensor}); err != nil {
+			t.Fatalf("AddPeripheral() error = %v", err)
+		}
+	}
+
+	definition := &database.VirtualDefinition{
+		Inputs: []database.VirtualInput{
+			{Name: "t", Tag: "room", Field: "temp", Aggregate: database.AggregateMean},
+			{Name: "p", SerialNumber: "meter", Field: "w", Aggregate: database.AggregateSum, WindowSeconds: 3600},
+		},
+		Fields: []database.DerivedField{
+			{Name: "temp", Expression: "t"},
+			{Name: "energy", Expression: "p"},
+			{Name: "kwh", Expression: "energy / 1000"},
+		},
+	}
+	if err := definition.Validate("house"); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+
+	if err := db.AddVirtualPeripheral(&database.Peripheral{SerialNumber: "house", Type: database.PeripheralTypeSensor}, definition); err != nil {
+		t.Fatalf("AddVirtualPeripheral() error = %v", err)
+	}
+
+	tags := []string{"room"}
+	for _, serial := range []string{"t1", "t2", "house"} {
+		if err := db.PatchPeripheral(&database.Peripheral{SerialNumber: serial, Type: database.PeripheralTypeSensor},
+			database.PeripheralMetadataUpdate{Tags: &tags}); err != nil {
+			t.Fatalf("PatchPeripheral() error = %v", err)
+		}
+	}
+
+	return &testEngine{Engine: engine, t: t, db: db, processor: processor}
+}
+
+func (e *testEngine) report(serial string, data map[string]any) {
+	e.t.Helper()
+
+	if err := e.processor.Process(&database.Reading{SerialNumber: serial, Data: data}); err != nil {
+		e.t.Fatalf("Process() error = %v", err)
+	}
+}
+
+// readings returns the computed readings of the virtual peripheral, oldest first.
+func (e *testEngine) readings() []database.Reading {
+	e.t.Helper()
+
+	readings, err := e.db.GetReadingsAfter(0, []string{"house"}, "", 100)
+	if err != nil {
+		e.t.Fatalf("GetReadingsAfter() error = %v", err)
+	}
+
+	return readings
+}
+
+func TestCompute(t *testing.T) {
+	e := newTestEngine(t)
+	now := time.Now()
+
+	// Nothing is stored before the inputs report.
+	e.tick(now)
+	if readings := e.readings(); len(readings) != 0 {
+		t.Fatalf("readings = %+v, want none", readings)
+	}
+
+	e.report("t1", map[string]any{"temp": 20})
+	e.report("t2", map[string]any{"temp": 24})
+	e.tick(now.Add(2 * time.Second))
+
+	readings := e.readings()
+	if len(readings) != 1 {
+		t.Fatalf("%d readings, want 1", len(readings))
+	}
+
+	// Fields without values for their inputs are left out.
+	if data := readings[0].Data; data["temp"] != 22.0 || len(data) != 1 {
+		t.Errorf("data = %v, want temp = 22", data)
+	}
+
+	e.report("meter", map[string]any{"w": 1500})
+	e.report("meter", map[string]any{"w": 500})
+	e.report("t1", map[string]any{"temp": 30})
+	e.tick(now.Add(4 * time.Second))
+
+	readings = e.readings()
+	if len(readings) != 2 {
+		t.Fatalf("%d readings, want 2", len(readings))
+	}
+
+	// The virtual peripheral's own readings are not inputs, even though it has the tag.
+	want := map[string]float64{"temp": 27, "energy": 2000, "kwh": 2}
+	for field, value := range want {
+		if got := readings[1].Data[field]; got != value {
+			t.Errorf("%s = %v, want %v", field, got, value)
+		}
+	}
+
+	// ...nor do they trigger recomputing it.
+	e.tick(now.Add(10 * time.Second))
+	if got := len(e.readings()); got != 2 {
+		t.Errorf("%d readings after a tick without changes, want 2", got)
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	e := newTestEngine(t)
+	now := time.Now()
+
+	e.report("t1", map[string]any{"temp": 20})
+	e.tick(now)
+
+	// Changes within the minimum recompute interval are computed once it elapses.
+	e.report("t1", map[string]any{"temp": 21})
+	e.tick(now.Add(minRecomputeInterval / 2))
+	if got := len(e.readings()); got != 1 {
+		t.Fatalf("%d readings within the minimum interval, want 1", got)
+	}
+
+	e.tick(now.Add(minRecomputeInterval))
+	readings := e.readings()
+	if len(readings) != 2 || readings[1].Data["temp"] != 21.0 {
+		t.Errorf("readings = %+v, want a second reading with temp = 21", readings)
+	}
+}
+
+func TestInterval(t *testing.T) {
+	e := newTestEngine(t)
+	now := time.Now()
+
+	e.report("t1", map[string]any{"temp": 20})
+	e.tick(now)
+
+	virtuals, err := e.db.GetVirtualPeripherals()
+	if err != nil || len(virtuals) != 1 {
+		t.Fatalf("GetVirtualPeripherals() = %v, %v", virtuals, err)
+	}
+
+	definition := virtuals[0].VirtualDefinition
+	definition.IntervalSeconds = 60
+	if err := e.db.SetVirtualDefinition("house", &definition); err != nil {
+		t.Fatalf("SetVirtualDefinition() error = %v", err)
+	}
+
+	// Reloading recomputes the changed definitions.
+	e.Reload()
+	e.tick(now.Add(30 * time.Second))
+
+	tests := []struct {
+		after time.Duration
+		want  int
+	}{
+		{60 * time.Second, 2},
+		{89 * time.Second, 2},
+		{90 * time.Second, 3},
+		{149 * time.Second, 3},
+		{150 * time.Second, 4},
+	}
+
+	for _, tt := range tests {
+		e.tick(now.Add(tt.after))
+		if got := len(e.readings()); got != tt.want {
+			t.Errorf("after %v, %d readings, want %d", tt.after, got, tt.want)
+		}
+	}
+}
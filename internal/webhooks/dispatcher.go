@@ -0,0 +1,336 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hafh-server/internal/database"
+	"hafh-server/internal/events"
+	"hafh-server/internal/logger"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// SignatureHeader carries the hex-encoded HMAC-SHA256 of the request body, keyed with the
+	// webhook's secret, in the form "sha256=<hex>".
+	SignatureHeader = "X-HAFH-Signature"
+	// EventHeader carries the event type of the delivery.
+	EventHeader = "X-HAFH-Event"
+	// DeliveryHeader carries the ID of the delivery, which is stable across retries.
+	DeliveryHeader = "X-HAFH-Delivery"
+
+	// TestEvent is the event type of deliveries sent with [Dispatcher.SendTest].
+	TestEvent = "webhook.test"
+
+	// pollInterval is how often the dispatcher checks for due deliveries when it is not woken up by
+	// a new event.
+	pollInterval = 5 * time.Second
+	batchSize    = 20
+	// queueSize is how many published events can wait to be stored as deliveries.
+	queueSize = 1024
+)
+
+// DispatcherConfig holds the configuration for the webhook [Dispatcher].
+type DispatcherConfig struct {
+	Db             *database.Database
+	Bus            *events.Bus
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Timeout        time.Duration
+}
+
+// Dispatcher delivers server events to registered webhooks. Every delivery is stored before it is
+// attempted, and failed deliveries are retried with exponential backoff, so that pending deliveries
+// survive a restart.
+type Dispatcher struct {
+	db             *database.Database
+	log            *zap.SugaredLogger
+	client         *http.Client
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	wake           chan struct{}
+	// queue holds the published events until they are stored, as the event bus must not block.
+	queue chan events.Event
+}
+
+// NewDispatcher creates a new webhook [Dispatcher] and subscribes it to the event bus.
+func NewDispatcher(config *DispatcherConfig) (*Dispatcher, error) {
+	if config == nil {
+		return nil, errors.New("config cannot be nil")
+	} else if config.Db == nil {
+		return nil, errors.New("database is required")
+	} else if config.Bus == nil {
+		return nil, errors.New("event bus is required")
+	}
+
+	d := &Dispatcher{
+		db:             config.Db,
+		log:            logger.Named("webhooks"),
+		client:         &http.Client{Timeout: config.Timeout},
+		maxAttempts:    config.MaxAttempts,
+		initialBackoff: config.InitialBackoff,
+		maxBackoff:     config.MaxBackoff,
+		wake:           make(chan struct{}, 1),
+		queue:          make(chan events.Event, queueSize),
+	}
+
+	if d.maxAttempts <= 0 {
+		d.maxAttempts = 8
+	}
+
+	if d.initialBackoff <= 0 {
+		d.initialBackoff = 10 * time.Second
+	}
+
+	if d.maxBackoff < d.initialBackoff {
+		d.maxBackoff = d.initialBackoff
+	}
+
+	if d.client.Timeout <= 0 {
+		d.client.Timeout = 10 * time.Second
+	}
+
+	config.Bus.Subscribe(d.enqueue)
+	return d, nil
+}
+
+// Start stores published events as deliveries and delivers pending deliveries until the context is
+// cancelled. It returns only once the events that were still queued are stored, so the database
+// must not be closed before it has returned. **This should be called in a separate goroutine.**
+func (d *Dispatcher) Start(ctx context.Context) {
+	stored := make(chan struct{})
+	go func() {
+		defer close(stored)
+		d.storeEvents(ctx)
+	}()
+
+	defer func() { <-stored }()
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		d.deliverDue(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-d.wake:
+		}
+	}
+}
+
+// SendTest enqueues a test delivery to the given webhook, regardless of its event type filter.
+func (d *Dispatcher) SendTest(webhook *database.Webhook) (int64, error) {
+	payload, err := json.Marshal(events.New(TestEvent, map[string]any{
+		"webhook_id": webhook.ID,
+		"message":    "This is a test delivery from HAFH-server",
+	}))
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := d.db.EnqueueWebhookDelivery(webhook.ID, TestEvent, string(payload))
+	if err != nil {
+		return 0, err
+	}
+
+	d.notify()
+	return id, nil
+}
+
+// enqueue queues an event to be stored as deliveries by [Dispatcher.storeEvents]. It is an event
+// bus handler, so it never blocks: if the queue is full, the event is dropped.
+func (d *Dispatcher) enqueue(event events.Event) {
+	select {
+	case d.queue <- event:
+	default:
+		d.log.Warnf("Dropping %s event, as too many events are waiting to be delivered", event.Type)
+	}
+}
+
+// storeEvents stores the queued events as deliveries until ctx is done. The events that are still
+// queued then are stored as well, so that they are delivered after a restart.
+func (d *Dispatcher) storeEvents(ctx context.Context) {
+	for {
+		select {
+		case event := <-d.queue:
+			d.store(event)
+		case <-ctx.Done():
+			for {
+				select {
+				case event := <-d.queue:
+					d.store(event)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// store stores a pending delivery of the event for every webhook subscribed to it.
+func (d *Dispatcher) store(event events.Event) {
+	webhooks, err := d.db.GetAllWebhooks()
+	if err != nil {
+		d.log.Errorf("Failed to get webhooks: %v", err)
+		return
+	}
+
+	var payload []byte
+	for i := range webhooks {
+		if !webhooks[i].Accepts(string(event.Type)) {
+			continue
+		}
+
+		if payload == nil {
+			if payload, err = json.Marshal(event); err != nil {
+				d.log.Errorf("Failed to serialize %s event: %v", event.Type, err)
+				return
+			}
+		}
+
+		if _, err := d.db.EnqueueWebhookDelivery(webhooks[i].ID, string(event.Type), string(payload)); err != nil {
+			d.log.Errorf("Failed to enqueue delivery to webhook %d: %v", webhooks[i].ID, err)
+		}
+	}
+
+	if payload != nil {
+		d.notify()
+	}
+}
+
+// notify wakes up the delivery loop without blocking.
+func (d *Dispatcher) notify() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (d *Dispatcher) deliverDue(ctx context.Context) {
+	for ctx.Err() == nil {
+		deliveries, err := d.db.GetDueWebhookDeliveries(batchSize)
+		if err != nil {
+			d.log.Errorf("Failed to get due deliveries: %v", err)
+			return
+		} else if len(deliveries) == 0 {
+			return
+		}
+
+		// A delivery whose outcome cannot be recorded would be attempted again right away, so the
+		// remaining deliveries wait for the next tick.
+		for i := range deliveries {
+			if !d.attempt(ctx, &deliveries[i]) {
+				return
+			}
+		}
+	}
+}
+
+// attempt attempts a delivery, returning false if its outcome could not be recorded.
+func (d *Dispatcher) attempt(ctx context.Context, delivery *database.WebhookDelivery) bool {
+	webhook, err := d.db.GetWebhook(delivery.WebhookID)
+	if err != nil {
+		d.log.Errorf("Failed to get webhook %d: %v", delivery.WebhookID, err)
+		return false
+	} else if webhook == nil || !webhook.Enabled {
+		// The webhook was deleted or disabled after the delivery was queued.
+		if err := d.db.CancelWebhookDelivery(delivery.ID, "webhook is disabled"); err != nil {
+			d.log.Errorf("Failed to cancel delivery %d: %v", delivery.ID, err)
+			return false
+		}
+
+		d.log.Debugf("Cancelled delivery %d, as webhook %d is disabled", delivery.ID, delivery.WebhookID)
+		return true
+	}
+
+	statusCode, err := d.send(ctx, webhook, delivery)
+	if err == nil {
+		d.log.Debugf("Delivered %s event to webhook %d", delivery.EventType, webhook.ID)
+		if err := d.db.RecordWebhookAttempt(delivery.ID, database.DeliveryStatusSucceeded, statusCode, "", nil); err != nil {
+			d.log.Errorf("Failed to record delivery %d: %v", delivery.ID, err)
+			return false
+		}
+		return true
+	} else if ctx.Err() != nil {
+		// The attempt was interrupted by a shutdown, and is made again after the restart.
+		return false
+	}
+
+	status := database.DeliveryStatusPending
+	var next *time.Time
+	if attempts := delivery.Attempts + 1; attempts >= d.maxAttempts {
+		status = database.DeliveryStatusFailed
+		d.log.Warnf("Giving up on delivery %d to webhook %d after %d attempts: %v", delivery.ID, webhook.ID, attempts, err)
+	} else {
+		at := time.Now().Add(d.backoff(attempts))
+		next = &at
+		d.log.Debugf("Delivery %d to webhook %d failed, retrying at %s: %v", delivery.ID, webhook.ID, at.Format(time.RFC3339), err)
+	}
+
+	if err := d.db.RecordWebhookAttempt(delivery.ID, status, statusCode, err.Error(), next); err != nil {
+		d.log.Errorf("Failed to record delivery %d: %v", delivery.ID, err)
+		return false
+	}
+
+	return true
+}
+
+// backoff returns the delay before the next attempt, doubling with every failed attempt.
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	delay := d.initialBackoff
+	for i := 1; i < attempts && delay < d.maxBackoff; i++ {
+		delay *= 2
+	}
+
+	return min(delay, d.maxBackoff)
+}
+
+func (d *Dispatcher) send(ctx context.Context, webhook *database.Webhook, delivery *database.WebhookDelivery) (int, error) {
+	body := []byte(delivery.Payload)
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "hafh-server")
+	request.Header.Set(EventHeader, delivery.EventType)
+	request.Header.Set(DeliveryHeader, strconv.FormatInt(delivery.ID, 10))
+	request.Header.Set(SignatureHeader, Sign(webhook.Secret, body))
+
+	response, err := d.client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64*1024))
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return response.StatusCode, fmt.Errorf("unexpected status code %d", response.StatusCode)
+	}
+
+	return response.StatusCode, nil
+}
+
+// Sign returns the signature of a webhook body, as sent in the [SignatureHeader].
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
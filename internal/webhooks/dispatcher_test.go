@@ -0,0 +1,271 @@
+package webhooks
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"hafh-server/internal/database"
+	"hafh-server/internal/events"
+	"hafh-server/internal/logger"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func init() {
+	logger.Init(false)
+}
+
+// newTestDispatcher returns a dispatcher, which is not started, with a webhook to a server that
+// responds with the given status codes in turn, repeating the last one.
+func newTestDispatcher(t *testing.T, statusCodes ...int) (*Dispatcher, *database.Database, *database.Webhook, *atomic.Int32) {
+	t.Helper()
+
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(requests.Add(1))
+		w.WriteHeader(statusCodes[min(n, len(statusCodes))-1])
+	}))
+	t.Cleanup(server.Close)
+
+	db, err := database.New(":memory:")
+	if err != nil {
+		t.Fatalf("database.New() error = %v", err)
+	}
+
+	t.Cleanup(func() { db.Close() })
+
+	d, err := NewDispatcher(&DispatcherConfig{
+		Db:             db,
+		Bus:            events.NewBus(),
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewDispatcher() error = %v", err)
+	}
+
+	webhook := &database.Webhook{Name: "test", URL: server.URL, Secret: "s3cret", Enabled: true}
+	if err := db.AddWebhook(webhook); err != nil {
+		t.Fatalf("AddWebhook() error = %v", err)
+	}
+
+	return d, db, webhook, &requests
+}
+
+func getDelivery(t *testing.T, db *database.Database, webhookID int64) database.WebhookDelivery {
+	t.Helper()
+
+	deliveries, err := db.GetWebhookDeliveries(webhookID, 1)
+	if err != nil {
+		t.Fatalf("GetWebhookDeliveries() error = %v", err)
+	} else if len(deliveries) != 1 {
+		t.Fatalf("%d deliveries, want 1", len(deliveries))
+	}
+
+	return deliveries[0]
+}
+
+func TestRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		statusCodes  []int
+		wantStatus   database.DeliveryStatus
+		wantAttempts int
+	}{
+		{"succeeds", []int{http.StatusNoContent}, database.DeliveryStatusSucceeded, 1},
+		{"succeeds after retries", []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusOK}, database.DeliveryStatusSucceeded, 3},
+		{"gives up", []int{http.StatusInternalServerError}, database.DeliveryStatusFailed, 3},
+		{"redirects are failures", []int{http.StatusNotModified}, database.DeliveryStatusFailed, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, db, webhook, requests := newTestDispatcher(t, tt.statusCodes...)
+			if _, err := d.SendTest(webhook); err != nil {
+				t.Fatalf("SendTest() error = %v", err)
+			}
+
+			// Every pass delivers what is due, and the backoff is short enough to be due again.
+			for range 5 {
+				d.deliverDue(context.Background())
+			}
+
+			delivery := getDelivery(t, db, webhook.ID)
+			if delivery.Status != tt.wantStatus || delivery.Attempts != tt.wantAttempts {
+				t.Errorf("delivery %s after %d attempts, want %s after %d", delivery.Status, delivery.Attempts, tt.wantStatus, tt.wantAttempts)
+			} else if int(requests.Load()) != tt.wantAttempts {
+				t.Errorf("%d requests, want %d", requests.Load(), tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	d := &Dispatcher{initialBackoff: 10 * time.Second, maxBackoff: time.Minute}
+
+	for attempts, want := range map[int]time.Duration{
+		1: 10 * time.Second,
+		2: 20 * time.Second,
+		3: 40 * time.Second,
+		4: time.Minute,
+		9: time.Minute,
+	} {
+		if got := d.backoff(attempts); got != want {
+			t.Errorf("backoff(%d) = %s, want %s", attempts, got, want)
+		}
+	}
+}
+
+func TestSignature(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- r
+		bodies <- body
+	}))
+	defer server.Close()
+
+	d, db, webhook, _ := newTestDispatcher(t, http.StatusOK)
+	webhook.URL = server.URL
+	if err := db.UpdateWebhook(webhook); err != nil {
+		t.Fatalf("UpdateWebhook() error = %v", err)
+	}
+
+	id, err := d.SendTest(webhook)
+	if err != nil {
+		t.Fatalf("SendTest() error = %v", err)
+	}
+
+	d.deliverDue(context.Background())
+	r, body := <-received, <-bodies
+
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(body)
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); r.Header.Get(SignatureHeader) != want {
+		t.Errorf("%s = %s, want %s", SignatureHeader, r.Header.Get(SignatureHeader), want)
+	} else if Sign("wrong", body) == want {
+		t.Error("signature does not depend on the secret")
+	}
+
+	if got := r.Header.Get(EventHeader); got != TestEvent {
+		t.Errorf("%s = %s, want %s", EventHeader, got, TestEvent)
+	}
+
+	if got := r.Header.Get(DeliveryHeader); got != "1" || id != 1 {
+		t.Errorf("%s = %s, want the delivery ID %d", DeliveryHeader, got, id)
+	}
+}
+
+func TestDisabledWebhook(t *testing.T) {
+	d, db, webhook, requests := newTestDispatcher(t, http.StatusOK)
+	if _, err := d.SendTest(webhook); err != nil {
+		t.Fatalf("SendTest() error = %v", err)
+	}
+
+	// The webhook is disabled after the delivery was queued.
+	webhook.Enabled = false
+	if err := db.UpdateWebhook(webhook); err != nil {
+		t.Fatalf("UpdateWebhook() error = %v", err)
+	}
+
+	d.deliverDue(context.Background())
+
+	if delivery := getDelivery(t, db, webhook.ID); delivery.Status != database.DeliveryStatusCancelled {
+		t.Errorf("delivery %s, want %s", delivery.Status, database.DeliveryStatusCancelled)
+	} else if requests.Load() != 0 {
+		t.Errorf("%d requests to a disabled webhook", requests.Load())
+	}
+
+	// Events are not queued for disabled webhooks at all.
+	d.store(events.New(events.AlertFired, nil))
+	if deliveries, _ := db.GetWebhookDeliveries(webhook.ID, 10); len(deliveries) != 1 {
+		t.Errorf("%d deliveries, want only the cancelled one", len(deliveries))
+	}
+}
+
+func TestPublishedEvents(t *testing.T) {
+	d, db, webhook, requests := newTestDispatcher(t, http.StatusOK)
+
+	bus := events.NewBus()
+	bus.Subscribe(d.enqueue)
+
+	// Publishing never blocks, even when no events are being stored.
+	for range queueSize + 10 {
+		bus.Publish(events.New(events.AlertFired, nil))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		d.Start(ctx)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for requests.Load() < queueSize && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	<-done
+
+	if got := requests.Load(); got != queueSize {
+		t.Errorf("%d events delivered, want %d (the rest being dropped)", got, queueSize)
+	}
+
+	if deliveries, _ := db.GetWebhookDeliveries(webhook.ID, queueSize+10); len(deliveries) != queueSize {
+		t.Errorf("%d deliveries, want %d", len(deliveries), queueSize)
+	}
+}
+
+func TestQueuedEventsStoredOnShutdown(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hafh.db")
+	db, err := database.New(path)
+	if err != nil {
+		t.Fatalf("database.New() error = %v", err)
+	}
+
+	bus := events.NewBus()
+	d, err := NewDispatcher(&DispatcherConfig{Db: db, Bus: bus})
+	if err != nil {
+		t.Fatalf("NewDispatcher() error = %v", err)
+	}
+
+	// The webhook is never reached, so that its deliveries stay pending.
+	webhook := &database.Webhook{Name: "test", URL: "http://127.0.0.1:0", Enabled: true}
+	if err := db.AddWebhook(webhook); err != nil {
+		t.Fatalf("AddWebhook() error = %v", err)
+	}
+
+	for range 10 {
+		bus.Publish(events.New(events.AlertFired, nil))
+	}
+
+	// Start returns only once the queued events are stored, so the database can then be closed.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	d.Start(ctx)
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	db, err = database.New(path)
+	if err != nil {
+		t.Fatalf("database.New() error = %v", err)
+	}
+
+	defer db.Close()
+
+	if deliveries, err := db.GetWebhookDeliveries(webhook.ID, 20); err != nil || len(deliveries) != 10 {
+		t.Errorf("GetWebhookDeliveries() = %d deliveries, %v, want 10 after a restart", len(deliveries), err)
+	}
+}